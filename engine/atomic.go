@@ -0,0 +1,93 @@
+package engine
+
+import (
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// Default affixes of the temporary files written in atomic mode.
+const (
+	defaultTempPrefix = "."
+	defaultTempSuffix = ".syncpkg-tmp"
+)
+
+// syncer is implemented by the files of the backends that can flush their content to stable storage.
+type syncer interface {
+	Sync() error
+}
+
+// isTemp reports whether rel is a temporary file written in atomic mode.
+func (e *Engine) isTemp(rel string) bool {
+	if !e.config.Atomic {
+		return false
+	}
+	name := path.Base(rel)
+	return len(name) > len(e.config.TempPrefix)+len(e.config.TempSuffix) &&
+		strings.HasPrefix(name, e.config.TempPrefix) && strings.HasSuffix(name, e.config.TempSuffix)
+}
+
+// target returns the relative path the content of rel is written to: rel itself, or its temporary file in atomic
+// mode.
+func (e *Engine) target(rel string) string {
+	if !e.config.Atomic {
+		return rel
+	}
+	return path.Join(parent(rel), e.config.TempPrefix+path.Base(rel)+e.config.TempSuffix)
+}
+
+// commit completes the copy of the file rel, described by info, written to its target on dst through w. It closes
+// w and carries the modification time over. In atomic mode, it syncs w first, if its backend supports it, and
+// renames the temporary file over rel last.
+func (e *Engine) commit(dst endpoint, rel string, info os.FileInfo, w io.WriteCloser) error {
+	if s, ok := w.(syncer); ok && e.config.Atomic {
+		err := s.Sync()
+		if err != nil {
+			_ = w.Close()
+			return err
+		}
+	}
+	err := w.Close()
+	if err != nil {
+		return err
+	}
+
+	target := dst.abs(e.target(rel))
+	err = dst.Chtimes(target, info.ModTime(), info.ModTime())
+	if err != nil {
+		e.log.Warn("cannot set modification time", "op", "chtimes", "path", rel, "error", err)
+	}
+	if !e.config.Atomic {
+		return nil
+	}
+	return dst.Rename(target, dst.abs(rel))
+}
+
+// removeTemps removes the temporary files left behind on p below rel by a previous run that did not finish its
+// transfers.
+func (e *Engine) removeTemps(p endpoint, rel string) error {
+	entries, err := p.List(p.abs(rel))
+	if err != nil {
+		if isNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		child := path.Join(rel, entry.Name())
+		if entry.IsDir() {
+			err = e.removeTemps(p, child)
+		} else if e.isTemp(child) {
+			e.log.Info("removing leftover temporary file", "op", "cleanup", "path", child)
+			err = p.Remove(p.abs(child))
+			if isNotExist(err) {
+				err = nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
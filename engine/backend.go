@@ -0,0 +1,102 @@
+package engine
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// SyncDirection is the direction of the sync (LocalToRemote, RemoteToLocal or Bidirectional)
+type SyncDirection int
+
+const (
+	//LocalToRemote is the direction of the sync from local to remote pc/server
+	LocalToRemote SyncDirection = iota
+	//RemoteToLocal is the direction of the sync from remote to local pc/server
+	RemoteToLocal
+	//Bidirectional syncs changes made on either side to the other one
+	Bidirectional
+)
+
+// Backend is the set of file operations the engine needs from one side of a sync pair.
+// The ftp and sftp packages implement it for their servers and Local implements it for the local file system.
+//
+// Every path passed to a Backend is absolute on that backend. Missing files must be reported with an error
+// that matches fs.ErrNotExist so the engine can tell them apart from transfer failures.
+type Backend interface {
+	// List returns the entries of the directory dir.
+	List(dir string) ([]os.FileInfo, error)
+	// Stat returns the file information of path.
+	Stat(path string) (os.FileInfo, error)
+	// Open opens path for reading.
+	Open(path string) (io.ReadCloser, error)
+	// Create creates or truncates path for writing. The file is complete once Close returns nil.
+	Create(path string) (io.WriteCloser, error)
+	// Mkdir creates the directory path along with any missing parents. It is not an error if it already exists.
+	Mkdir(path string) error
+	// Remove removes the file or empty directory path.
+	Remove(path string) error
+	// Rename moves oldPath to newPath, replacing newPath if it is an existing file.
+	Rename(oldPath, newPath string) error
+	// Chtimes sets the access and modification times of path.
+	Chtimes(path string, atime, mtime time.Time) error
+}
+
+// Local is the Backend that operates on the local file system.
+type Local struct{}
+
+// List returns the entries of the local directory dir.
+func (Local) List(dir string) ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			// The entry vanished between the listing and the stat.
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// Stat returns the file information of the local path.
+func (Local) Stat(path string) (os.FileInfo, error) {
+	return os.Stat(path)
+}
+
+// Open opens the local path for reading.
+func (Local) Open(path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
+
+// Create creates or truncates the local path for writing.
+func (Local) Create(path string) (io.WriteCloser, error) {
+	return os.Create(path)
+}
+
+// Mkdir creates the local directory path and any missing parents.
+func (Local) Mkdir(path string) error {
+	return os.MkdirAll(path, 0755)
+}
+
+// Remove removes the local file or empty directory path.
+func (Local) Remove(path string) error {
+	return os.Remove(path)
+}
+
+// Rename moves the local oldPath to newPath.
+func (Local) Rename(oldPath, newPath string) error {
+	return os.Rename(oldPath, newPath)
+}
+
+// Chtimes sets the access and modification times of the local path.
+func (Local) Chtimes(path string, atime, mtime time.Time) error {
+	return os.Chtimes(path, atime, mtime)
+}
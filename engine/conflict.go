@@ -0,0 +1,180 @@
+package engine
+
+import (
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cploutarchou/syncpkg/state"
+)
+
+// ConflictPolicy decides which version of a file survives when it changed on both sides since the last sync.
+type ConflictPolicy int
+
+const (
+	//NewestWins keeps the version with the most recent modification time
+	NewestWins ConflictPolicy = iota
+	//LocalWins keeps the local version
+	LocalWins
+	//RemoteWins keeps the remote version
+	RemoteWins
+	//KeepBoth keeps the incoming version under the original name and the other one as a conflict-suffixed copy
+	KeepBoth
+)
+
+// String returns the name of the policy.
+func (p ConflictPolicy) String() string {
+	switch p {
+	case NewestWins:
+		return "NewestWins"
+	case LocalWins:
+		return "LocalWins"
+	case RemoteWins:
+		return "RemoteWins"
+	case KeepBoth:
+		return "KeepBoth"
+	}
+	return "ConflictPolicy(" + strconv.Itoa(int(p)) + ")"
+}
+
+// sideOf returns the state recorded in entry for the given side of the sync pair.
+func sideOf(entry state.Entry, p endpoint) state.FileState {
+	if p.remote {
+		return entry.Remote
+	}
+	return entry.Local
+}
+
+// records holds the last synced state of every file, and the files the engine is currently writing.
+type records struct {
+	//pair holds the last synced state of the paths of the sync pair
+	pair *state.Pair
+	//mu guards busy
+	mu sync.Mutex
+	//busy counts the writes in progress per side and relative path
+	busy map[string]int
+}
+
+// get returns the record of rel, if any.
+func (r *records) get(rel string) (state.Entry, bool) {
+	return r.pair.Get(rel)
+}
+
+// delete forgets rel and everything below it.
+func (r *records) delete(rel string) {
+	r.pair.Delete(rel)
+}
+
+// busyKey returns the key of rel on the given side in the busy map.
+func busyKey(p endpoint, rel string) string {
+	if p.remote {
+		return "remote:" + rel
+	}
+	return "local:" + rel
+}
+
+// acquire marks rel on the given side as being written by the engine.
+func (r *records) acquire(p endpoint, rel string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.busy == nil {
+		r.busy = make(map[string]int)
+	}
+	r.busy[busyKey(p, rel)]++
+}
+
+// release undoes a previous acquire.
+func (r *records) release(p endpoint, rel string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := busyKey(p, rel)
+	r.busy[key]--
+	if r.busy[key] <= 0 {
+		delete(r.busy, key)
+	}
+}
+
+// isBusy reports whether the engine is writing rel on the given side.
+func (r *records) isBusy(p endpoint, rel string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.busy[busyKey(p, rel)] > 0
+}
+
+// conflictName returns the name of the conflict copy of rel that was found on the given side at time t,
+// for example "dir/report.conflict-remote-20230102-150405.txt".
+func conflictName(rel string, p endpoint, t time.Time) string {
+	side := "local"
+	if p.remote {
+		side = "remote"
+	}
+	ext := path.Ext(rel)
+	return strings.TrimSuffix(rel, ext) + ".conflict-" + side + "-" + t.Format("20060102-150405") + ext
+}
+
+// remember records the current state of both copies of rel. The hash of the content is only computed again
+// when the local copy changed since it was last recorded.
+func (e *Engine) remember(rel string) {
+	localInfo, err := e.local.Stat(e.local.abs(rel))
+	if err != nil {
+		return
+	}
+	remoteInfo, err := e.remote.Stat(e.remote.abs(rel))
+	if err != nil {
+		return
+	}
+	entry := state.Entry{Dir: localInfo.IsDir(), Local: state.StateOf(localInfo), Remote: state.StateOf(remoteInfo)}
+	if entry.Dir {
+		entry.Local, entry.Remote = state.FileState{}, state.FileState{}
+	} else if old, ok := e.records.get(rel); ok && e.local.matches(old.Local, localInfo) && hashAlgorithmOf(old.Hash) == e.recordAlgorithm() {
+		entry.Hash = old.Hash
+	} else {
+		entry.Hash, err = e.recordHash(rel, localInfo)
+		if err != nil {
+			e.log.Warn("cannot hash file", "op", "hash", "path", rel, "error", err)
+		}
+	}
+	e.records.pair.Set(rel, entry)
+}
+
+// resolveConflict settles a file that changed on both src and dst since the last sync according to the
+// configured ConflictPolicy.
+func (e *Engine) resolveConflict(src, dst endpoint, rel string, srcInfo, dstInfo os.FileInfo) error {
+	e.log.Warn("conflict: changed on both sides since the last sync", "op", "conflict", "path", rel,
+		"policy", e.config.ConflictPolicy.String())
+	e.emit(SyncEvent{Type: ConflictDetected, Path: rel, Direction: directionTo(dst), Size: srcInfo.Size()})
+
+	local, remote := src, dst
+	localInfo, remoteInfo := srcInfo, dstInfo
+	if src.remote {
+		local, remote = dst, src
+		localInfo, remoteInfo = dstInfo, srcInfo
+	}
+
+	switch e.config.ConflictPolicy {
+	case LocalWins:
+		return e.transfer(local, remote, rel, localInfo)
+	case RemoteWins:
+		return e.transfer(remote, local, rel, remoteInfo)
+	case KeepBoth:
+		// Move the version on dst out of the way and copy it back to src under its new name.
+		name := conflictName(rel, dst, time.Now())
+		err := dst.Rename(dst.abs(rel), dst.abs(name))
+		if err != nil {
+			return err
+		}
+		err = e.transfer(src, dst, rel, srcInfo)
+		if err != nil {
+			return err
+		}
+		return e.push(dst, src, name)
+	default:
+		if newer(remote, local, remoteInfo, localInfo) {
+			return e.transfer(remote, local, rel, remoteInfo)
+		}
+		return e.transfer(local, remote, rel, localInfo)
+	}
+}
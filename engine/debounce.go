@@ -0,0 +1,132 @@
+package engine
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/cploutarchou/syncpkg/worker"
+	"github.com/fsnotify/fsnotify"
+)
+
+// defaultDebounce is the default quiet window of the local events.
+const defaultDebounce = 100 * time.Millisecond
+
+// coalescer merges the fsnotify events of every path until the path was quiet for the debounce window, so that the
+// burst of events of a single save becomes a single task. It is only used by the watcher goroutine.
+type coalescer struct {
+	//pending holds the merged event of every path that is not due yet
+	pending map[string]*pendingEvent
+	//existed reports whether a path existed before its first event, it may be nil
+	existed func(name string) bool
+}
+
+// pendingEvent is the merged event of a path.
+type pendingEvent struct {
+	//op is the change to apply, one of fsnotify.Create, Write, Remove and Chmod
+	op fsnotify.Op
+	//created reports whether the path did not exist before its first event, so that a removal cancels it out
+	created bool
+	//deadline is the time the path is due at
+	deadline time.Time
+}
+
+// newCoalescer returns an empty coalescer. existed reports whether a path existed before its first event, such as a
+// path the last sync recorded, it may be nil if none did.
+func newCoalescer(existed func(name string) bool) *coalescer {
+	return &coalescer{pending: make(map[string]*pendingEvent), existed: existed}
+}
+
+// add merges op into the pending event of name, which becomes due at deadline. Only the newest state of the path is
+// kept: Create or Write followed by Write stays a single upload, Create followed by Remove cancels out if the path
+// did not exist before, and is a Remove if the Create was a rename over an existing file, and Remove followed by
+// Create, as editors do when they save by renaming a new file over the old one, is an upload.
+func (c *coalescer) add(name string, op fsnotify.Op, deadline time.Time) {
+	op = normalize(op)
+	p, ok := c.pending[name]
+	if !ok {
+		created := op == fsnotify.Create && (c.existed == nil || !c.existed(name))
+		c.pending[name] = &pendingEvent{op: op, created: created, deadline: deadline}
+		return
+	}
+	p.deadline = deadline
+	switch op {
+	case fsnotify.Remove:
+		if p.created {
+			delete(c.pending, name)
+			return
+		}
+		p.op = fsnotify.Remove
+	case fsnotify.Create:
+		if p.op == fsnotify.Remove || p.op == fsnotify.Write {
+			p.op = fsnotify.Write
+		} else {
+			p.op = fsnotify.Create
+		}
+	case fsnotify.Write:
+		if p.op != fsnotify.Create {
+			p.op = fsnotify.Write
+		}
+	}
+}
+
+// normalize reduces op to the single change it stands for. A rename removes the old name, the new name gets a
+// Create event of its own.
+func normalize(op fsnotify.Op) fsnotify.Op {
+	switch {
+	case op.Has(fsnotify.Remove), op.Has(fsnotify.Rename):
+		return fsnotify.Remove
+	case op.Has(fsnotify.Create):
+		return fsnotify.Create
+	case op.Has(fsnotify.Write):
+		return fsnotify.Write
+	}
+	return fsnotify.Chmod
+}
+
+// due removes the events due at now from the coalescer and returns them as tasks, sorted by path so that
+// directories come before their content. It also returns the time until the next event is due, or 0 if there is
+// none. A zero now returns every event.
+func (c *coalescer) due(now time.Time) ([]worker.Task, time.Duration) {
+	var tasks []worker.Task
+	var next time.Duration
+	for name, p := range c.pending {
+		if now.IsZero() || !p.deadline.After(now) {
+			tasks = append(tasks, worker.Task{EventType: p.op, Name: name})
+			delete(c.pending, name)
+			continue
+		}
+		if wait := p.deadline.Sub(now); next == 0 || wait < next {
+			next = wait
+		}
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].Name < tasks[j].Name })
+	return tasks, next
+}
+
+// queue queues tasks on the worker pool, waiting for room in its queue. The tasks are dropped if the pool was shut
+// down. Their Path is set to the path relative to the synced directory, so that the pool orders the tasks on the
+// local copy of a file with those on its remote copy.
+func (e *Engine) queue(tasks ...worker.Task) {
+	for _, task := range tasks {
+		if task.Path == "" {
+			src, _ := e.endpoints(task)
+			rel, err := src.rel(task.Name)
+			switch {
+			case err != nil:
+				// The task is then ordered by its name, with the tasks of its own side only.
+				e.log.Warn("cannot find the path of the task in the synced directory", "op", task.EventType.String(),
+					"path", task.Name, "error", err)
+			case rel == "":
+				task.Path = "."
+			default:
+				task.Path = rel
+			}
+		}
+		err := e.Pool.Submit(context.Background(), task)
+		if err != nil {
+			e.log.Error("cannot queue task", "op", task.EventType.String(), "path", task.Name, "error", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,491 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sort"
+)
+
+// defaultDeltaBlockSize is the block size of delta transfers if Config.DeltaBlockSize is not set.
+const defaultDeltaBlockSize = 128 * 1024
+
+// File is a file that can be read and written at arbitrary offsets.
+type File interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	// Truncate changes the size of the file.
+	Truncate(size int64) error
+}
+
+// RandomAccess is implemented by backends that can update a file in place, which delta transfers require on the
+// destination side.
+type RandomAccess interface {
+	// OpenFile opens the existing file path for reading and writing.
+	OpenFile(path string) (File, error)
+}
+
+// BlockHasher is implemented by backends that can hash a file block by block on the server, which delta transfers
+// require on the remote side.
+type BlockHasher interface {
+	// BlockHashes returns the hashes of the consecutive blocks of blockSize bytes of path, whose size is size,
+	// computed with the first of algorithms the server supports, along with the algorithm that was used. The last
+	// block may be shorter. It returns ErrHashUnsupported if none of algorithms is supported.
+	BlockHashes(path string, size, blockSize int64, algorithms ...HashAlgorithm) (HashAlgorithm, [][]byte, error)
+}
+
+// BlockSignature is the signature of a block of a file, as in rsync: its weak rolling checksum, which is cheap to
+// compute at every offset of another file, and its strong hash, which confirms the matches of the weak checksum.
+type BlockSignature struct {
+	//Weak is the rolling checksum of the block, see weakSum
+	Weak uint32
+	//Strong is the hash of the block
+	Strong []byte
+}
+
+// BlockSigner is implemented by backends that can compute the signatures of the blocks of a file on the server, which
+// delta transfers use to find the blocks of a remote file anywhere in the local copy, even when they moved.
+type BlockSigner interface {
+	// BlockSignatures returns the signatures of the consecutive blocks of blockSize bytes of path, whose size is size,
+	// with the strong hashes computed with the first of algorithms the server supports, along with the algorithm
+	// that was used. The last block may be shorter. It returns ErrHashUnsupported if the server cannot compute them.
+	BlockSignatures(path string, size, blockSize int64, algorithms ...HashAlgorithm) (HashAlgorithm, []BlockSignature, error)
+}
+
+// errNoDelta is returned by deltaCopy when a file cannot be transferred as a delta.
+var errNoDelta = errors.New("delta transfer not possible")
+
+// OpenFile opens the existing local file path for reading and writing.
+func (Local) OpenFile(path string) (File, error) {
+	return os.OpenFile(path, os.O_RDWR, 0)
+}
+
+// BlockSignatures returns the signatures of the consecutive blocks of blockSize bytes of the local path.
+func (Local) BlockSignatures(path string, size, blockSize int64, algorithms ...HashAlgorithm) (HashAlgorithm, []BlockSignature, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return HashNone, nil, err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+	algorithm := algorithms[0]
+	r := bufio.NewReader(f)
+	buf := make([]byte, blockSize)
+	var sigs []BlockSignature
+	for int64(len(sigs))*blockSize < size {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return HashNone, nil, err
+		}
+		h := algorithm.New()
+		h.Write(buf[:n])
+		sigs = append(sigs, BlockSignature{Weak: weakSum(buf[:n]).value(), Strong: h.Sum(nil)})
+	}
+	return algorithm, sigs, nil
+}
+
+// blockHashes returns the hashes of the blocks of the file rel on p, computed with the first of algorithms p
+// supports. Local files are hashed locally, remote files through the BlockHasher of the backend.
+func (e *Engine) blockHashes(p endpoint, rel string, size, blockSize int64, algorithms ...HashAlgorithm) (HashAlgorithm, [][]byte, error) {
+	if _, ok := p.Backend.(Local); !ok {
+		hasher, ok := p.Backend.(BlockHasher)
+		if !ok {
+			return HashNone, nil, ErrHashUnsupported
+		}
+		return hasher.BlockHashes(p.abs(rel), size, blockSize, algorithms...)
+	}
+
+	f, err := os.Open(p.abs(rel))
+	if err != nil {
+		return HashNone, nil, err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+	var sums [][]byte
+	for {
+		sum, err := hashReader(io.LimitReader(f, blockSize), algorithms[0])
+		if err != nil {
+			return HashNone, nil, err
+		}
+		sums = append(sums, sum)
+		if int64(len(sums))*blockSize >= size {
+			return algorithms[0], sums, nil
+		}
+	}
+}
+
+// blockSignatures returns the signatures of the blocks of the file rel on p, computed with the first of algorithms p
+// supports. Local files are signed locally, remote files through the BlockSigner of the backend.
+func (e *Engine) blockSignatures(p endpoint, rel string, size, blockSize int64, algorithms ...HashAlgorithm) (HashAlgorithm, []BlockSignature, error) {
+	signer, ok := p.Backend.(BlockSigner)
+	if !ok {
+		return HashNone, nil, ErrHashUnsupported
+	}
+	return signer.BlockSignatures(p.abs(rel), size, blockSize, algorithms...)
+}
+
+// deltaCopy updates the existing copy of rel on dst in place, writing only the blocks that differ from the copy on
+// src, which is described by info. It returns errNoDelta if the file cannot be transferred this way, in which case
+// nothing was written.
+//
+// When dst is the local side, the blocks of src are looked up anywhere in the local copy with their rolling
+// checksums, as rsync does, so that the data moved by an insertion or a deletion is copied locally rather than
+// transferred. When dst is the remote side, or the server cannot compute rolling checksums, blocks are only compared
+// at the same offsets: SFTP cannot move data inside a remote file without reading it back, so a block that moved
+// costs as much as a block that changed.
+func (e *Engine) deltaCopy(src, dst endpoint, rel string, info os.FileInfo) error {
+	dstInfo, err := dst.Stat(dst.abs(rel))
+	if err != nil || dstInfo.IsDir() || dstInfo.Size() == 0 || info.Size() == 0 {
+		return errNoDelta
+	}
+	access, ok := dst.Backend.(RandomAccess)
+	if !ok {
+		return errNoDelta
+	}
+	blockSize := e.config.DeltaBlockSize
+	if blockSize <= 0 {
+		blockSize = defaultDeltaBlockSize
+	}
+
+	var ops []deltaOp
+	algorithm := HashNone
+	var sigs []BlockSignature
+	if _, local := dst.Backend.(Local); local {
+		algorithm, sigs, err = e.blockSignatures(src, rel, info.Size(), blockSize, HashSHA256, HashMD5)
+		if err != nil && !errors.Is(err, ErrHashUnsupported) {
+			return err
+		}
+	}
+	if sigs == nil {
+		ops, err = e.fixedOps(src, dst, rel, info.Size(), dstInfo.Size(), blockSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	r, err := src.Open(src.abs(rel))
+	if err != nil {
+		return err
+	}
+	defer func(r io.ReadCloser) {
+		_ = r.Close()
+	}(r)
+	ra, ok := r.(io.ReaderAt)
+	if !ok {
+		return errNoDelta
+	}
+
+	w, err := access.OpenFile(dst.abs(rel))
+	if err != nil {
+		return err
+	}
+	if sigs != nil {
+		ops, err = rollingOps(w, dstInfo.Size(), info.Size(), blockSize, algorithm, sigs)
+	}
+	var written int64
+	if err == nil {
+		written, err = applyDelta(ra, w, ops)
+	}
+	if err == nil {
+		err = w.Truncate(info.Size())
+	}
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	e.metrics.wrote(dst, written)
+	e.log.Info("delta transfer", "op", "delta", "path", rel, "remote_path", e.remote.abs(rel), "bytes", written,
+		"size", info.Size())
+
+	err = dst.Chtimes(dst.abs(rel), info.ModTime(), info.ModTime())
+	if err != nil {
+		e.log.Warn("cannot set modification time", "op", "chtimes", "path", rel, "error", err)
+	}
+	return nil
+}
+
+// fixedOps returns the operations that update the copy of rel on dst, whose size is dstSize, to the copy on src, whose
+// size is srcSize, by comparing the hashes of their blocks at the same offsets. Both sides hash their blocks without
+// transferring the file. It returns errNoDelta if one side cannot hash blocks.
+func (e *Engine) fixedOps(src, dst endpoint, rel string, srcSize, dstSize, blockSize int64) ([]deltaOp, error) {
+	// Hash the remote copy first, since the local one can be hashed with whatever algorithm the server used.
+	first, second := src, dst
+	firstSize, secondSize := srcSize, dstSize
+	swapped := !second.remote
+	if swapped {
+		first, second = second, first
+		firstSize, secondSize = secondSize, firstSize
+	}
+	algorithm, firstSums, err := e.blockHashes(first, rel, firstSize, blockSize, HashSHA256, HashMD5)
+	if err != nil {
+		if errors.Is(err, ErrHashUnsupported) {
+			return nil, errNoDelta
+		}
+		return nil, err
+	}
+	_, secondSums, err := e.blockHashes(second, rel, secondSize, blockSize, algorithm)
+	if err != nil {
+		if errors.Is(err, ErrHashUnsupported) {
+			return nil, errNoDelta
+		}
+		return nil, err
+	}
+	srcSums, dstSums := firstSums, secondSums
+	if swapped {
+		srcSums, dstSums = secondSums, firstSums
+	}
+	return diffBlocks(srcSize, blockSize, srcSums, dstSums)
+}
+
+// deltaOp is a step of a delta transfer: n bytes written at the offset off of the destination file, copied from the
+// offset from of the destination file itself if copy is set, and transferred from the same offset of the source file
+// otherwise.
+type deltaOp struct {
+	off, n int64
+	copy   bool
+	from   int64
+}
+
+// diffBlocks returns the operations that transfer the blocks of the source file, whose size is size, that differ from
+// the blocks of the destination file at the same offset.
+func diffBlocks(size, blockSize int64, srcSums, dstSums [][]byte) ([]deltaOp, error) {
+	if int64(len(srcSums)) != (size+blockSize-1)/blockSize {
+		return nil, fmt.Errorf("got %d block hashes for %d bytes", len(srcSums), size)
+	}
+	var ops []deltaOp
+	for i, sum := range srcSums {
+		// Blocks of different lengths have different hashes, so a short last block of dst never matches a full one.
+		if i < len(dstSums) && bytes.Equal(sum, dstSums[i]) {
+			continue
+		}
+		off := int64(i) * blockSize
+		ops = append(ops, deltaOp{off: off, n: min(blockSize, size-off)})
+	}
+	return ops, nil
+}
+
+// rollingOps returns the operations that turn the destination file basis, whose size is basisSize, into the source
+// file, whose size is size and whose blocks have the signatures sigs. Every offset of basis is checked with the
+// rolling checksum against the full blocks of sigs, and with the strong hash only when the checksum matches. The
+// short last block, if any, is looked for at its own offset and at the end of basis, where an insertion or a
+// deletion earlier in the file moves it.
+func rollingOps(basis io.ReaderAt, basisSize, size, blockSize int64, algorithm HashAlgorithm, sigs []BlockSignature) ([]deltaOp, error) {
+	if int64(len(sigs)) != (size+blockSize-1)/blockSize {
+		return nil, fmt.Errorf("got %d block signatures for %d bytes", len(sigs), size)
+	}
+	found := make([]int64, len(sigs))
+	index := map[uint32][]int{}
+	for i := range sigs {
+		found[i] = -1
+		if int64(i+1)*blockSize <= size {
+			index[sigs[i].Weak] = append(index[sigs[i].Weak], i)
+		}
+	}
+
+	h := algorithm.New()
+	err := scanBlocks(basis, basisSize, blockSize, func(off int64, sum uint32, window [2][]byte) bool {
+		candidates := index[sum]
+		if len(candidates) == 0 {
+			return false
+		}
+		strong := hashWindow(h, window)
+		matched := false
+		for _, i := range candidates {
+			if found[i] < 0 && bytes.Equal(strong, sigs[i].Strong) {
+				found[i], matched = off, true
+			}
+		}
+		return matched
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if last := len(sigs) - 1; size%blockSize != 0 {
+		n := size % blockSize
+		for _, off := range []int64{int64(last) * blockSize, basisSize - n} {
+			if off < 0 || off+n > basisSize {
+				continue
+			}
+			buf := make([]byte, n)
+			_, err = basis.ReadAt(buf, off)
+			if err != nil && !errors.Is(err, io.EOF) {
+				return nil, err
+			}
+			if bytes.Equal(hashWindow(h, [2][]byte{buf}), sigs[last].Strong) {
+				found[last] = off
+				break
+			}
+		}
+	}
+
+	var ops []deltaOp
+	for i, from := range found {
+		off := int64(i) * blockSize
+		n := min(blockSize, size-off)
+		switch {
+		case from == off:
+		case from >= 0:
+			ops = append(ops, deltaOp{off: off, n: n, copy: true, from: from})
+		default:
+			ops = append(ops, deltaOp{off: off, n: n})
+		}
+	}
+	return ops, nil
+}
+
+// scanBlocks calls match with the rolling checksum of every window of blockSize bytes of r, whose size is size, in
+// order, along with the window, split in two where it wraps around. The window after a match is the one that follows
+// it rather than the one that overlaps it.
+func scanBlocks(r io.ReaderAt, size, blockSize int64, match func(off int64, sum uint32, window [2][]byte) bool) error {
+	if size < blockSize {
+		return nil
+	}
+	br := bufio.NewReader(io.NewSectionReader(r, 0, size))
+	ring := make([]byte, blockSize)
+	off := int64(0)
+	for off+blockSize <= size {
+		_, err := io.ReadFull(br, ring)
+		if err != nil {
+			return err
+		}
+		sum := weakSum(ring)
+		head := int64(0)
+		for {
+			if match(off, sum.value(), [2][]byte{ring[head:], ring[:head]}) {
+				off += blockSize
+				break
+			}
+			if off+blockSize >= size {
+				return nil
+			}
+			c, err := br.ReadByte()
+			if err != nil {
+				return err
+			}
+			sum.roll(ring[head], c)
+			ring[head] = c
+			head = (head + 1) % blockSize
+			off++
+		}
+	}
+	return nil
+}
+
+// hashWindow returns the hash of the window, reusing h.
+func hashWindow(h hash.Hash, window [2][]byte) []byte {
+	h.Reset()
+	h.Write(window[0])
+	h.Write(window[1])
+	return h.Sum(nil)
+}
+
+// rollingSum is the weak checksum of rsync over a window of n bytes: a is the sum of the bytes and b the sum of the
+// running values of a, both modulo 2^16. It can be moved by one byte in constant time.
+type rollingSum struct {
+	a, b, n uint32
+}
+
+// weakSum returns the rolling checksum of p.
+func weakSum(p []byte) rollingSum {
+	s := rollingSum{n: uint32(len(p))}
+	for _, c := range p {
+		s.a += uint32(c)
+		s.b += s.a
+	}
+	s.a &= 0xffff
+	s.b &= 0xffff
+	return s
+}
+
+// roll moves the window by one byte: out leaves it and in enters it.
+func (s *rollingSum) roll(out, in byte) {
+	s.a = (s.a - uint32(out) + uint32(in)) & 0xffff
+	s.b = (s.b - s.n*uint32(out) + s.a) & 0xffff
+}
+
+// value returns the checksum as a single number, b in the high 16 bits and a in the low ones.
+func (s rollingSum) value() uint32 {
+	return s.b<<16 | s.a
+}
+
+// applyDelta runs ops on the destination file dst, reading the transferred bytes from src, and returns the number of
+// bytes transferred.
+//
+// The copies run before the transfers, since those overwrite the data the copies read. The copies that move data
+// towards the start of the file run from the start and those that move it towards the end from the end, so that
+// neither overwrites the data the next one of its kind reads. A copy whose data was overwritten all the same, as
+// happens when two blocks swap places, is transferred instead.
+func applyDelta(src io.ReaderAt, dst File, ops []deltaOp) (int64, error) {
+	var backward, forward, transfers []deltaOp
+	for _, op := range ops {
+		switch {
+		case !op.copy:
+			transfers = append(transfers, op)
+		case op.from > op.off:
+			backward = append(backward, op)
+		default:
+			forward = append(forward, op)
+		}
+	}
+	sort.Slice(backward, func(i, j int) bool { return backward[i].off < backward[j].off })
+	sort.Slice(forward, func(i, j int) bool { return forward[i].off > forward[j].off })
+
+	var overwritten []deltaOp
+	var buf []byte
+	for _, op := range append(backward, forward...) {
+		clobbered := false
+		for _, w := range overwritten {
+			if op.from < w.off+w.n && w.off < op.from+op.n {
+				clobbered = true
+				break
+			}
+		}
+		if clobbered {
+			transfers = append(transfers, deltaOp{off: op.off, n: op.n})
+			continue
+		}
+		buf = grow(buf, op.n)
+		_, err := dst.ReadAt(buf, op.from)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return 0, err
+		}
+		_, err = dst.WriteAt(buf, op.off)
+		if err != nil {
+			return 0, err
+		}
+		overwritten = append(overwritten, op)
+	}
+
+	var written int64
+	for _, op := range transfers {
+		buf = grow(buf, op.n)
+		read, err := src.ReadAt(buf, op.off)
+		if int64(read) < op.n {
+			return written, err
+		}
+		_, err = dst.WriteAt(buf, op.off)
+		if err != nil {
+			return written, err
+		}
+		written += op.n
+	}
+	return written, nil
+}
+
+// grow returns a buffer of n bytes, reusing buf if it is large enough.
+func grow(buf []byte, n int64) []byte {
+	if int64(cap(buf)) < n {
+		return make([]byte, n)
+	}
+	return buf[:n]
+}
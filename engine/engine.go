@@ -0,0 +1,1075 @@
+// Package engine implements the protocol-neutral synchronization shared by the ftp and sftp packages.
+//
+// The engine owns the initial sync, the watch loop and the worker dispatch. It talks to the local file system
+// and to the remote server through the Backend interface, so every change in behaviour applies to both protocols.
+//
+// Example usage:
+//
+//	pool := worker.NewWorkerPool(10)
+//	e, err := engine.New(engine.Local{}, remoteBackend, pool, engine.Config{
+//	    Direction: engine.LocalToRemote,
+//	    LocalDir:  "/path/to/local/directory",
+//	    RemoteDir: "/path/to/remote/directory",
+//	    StateFile: "/path/to/state.json",
+//	})
+//	if err != nil {
+//	    return err
+//	}
+//	err = e.Start(ctx)
+//	if err != nil {
+//	    return err
+//	}
+//	defer e.Stop()
+package engine
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cploutarchou/syncpkg/ignore"
+	"github.com/cploutarchou/syncpkg/state"
+	"github.com/cploutarchou/syncpkg/worker"
+	"github.com/fsnotify/fsnotify"
+)
+
+// Config is the struct that holds the configuration of the engine
+type Config struct {
+	//Direction is the direction of the sync (LocalToRemote, RemoteToLocal or Bidirectional)
+	Direction SyncDirection
+	//LocalDir is the local directory that is synced with the remote directory
+	LocalDir string
+	//RemoteDir is the remote directory that is synced with the local directory
+	RemoteDir string
+	//MaxRetries is the number of attempts made to transfer a file before giving up. It is only used when
+	//RetryPolicy.MaxAttempts is not set.
+	MaxRetries int
+	//RetryPolicy decides how transfers, deletions, directory creations and remote listings are retried after a
+	//transient error
+	RetryPolicy RetryPolicy
+	//ConflictPolicy decides which version wins when a file changed on both sides. It is only used by Bidirectional syncs.
+	ConflictPolicy ConflictPolicy
+	//PollInterval is the time between two scans of the remote directory. It defaults to one second.
+	PollInterval time.Duration
+	//KeepAlive is the time between two checks of the connection to the server, if the remote backend is a
+	//Reconnector. A dead connection is re-established and the operations it interrupted are replayed. It defaults
+	//to 30 seconds, a negative value disables the checks, but not the ones made after a transient error.
+	KeepAlive time.Duration
+	//StateFile is the file that persists the last synced state of every path, so that deletions made while the
+	//process was down are propagated on the next start. It defaults to a file of the sync pair in the user cache
+	//directory, see DefaultStateFile. The state is kept in memory only if it is MemoryState.
+	StateFile string
+	//Pair identifies the sync pair in the state file. It defaults to LocalDir and RemoteDir.
+	Pair string
+	//HashAlgorithm enables the comparison of file contents, so that files are only transferred when their content
+	//differs. Local hashes are cached, remote ones are computed by the server if the backend is a Hasher.
+	//Files are compared by size and modification time only if it is HashNone.
+	HashAlgorithm HashAlgorithm
+	//DeltaThreshold is the size from which modified files are transferred as a delta: both copies are hashed
+	//block by block and only the blocks that differ are written in place. It requires the remote backend to be a
+	//BlockHasher and the destination backend to be RandomAccess. Downloads also look for the blocks that moved in
+	//the local copy if the remote backend is a BlockSigner. Delta transfers are disabled if it is 0.
+	DeltaThreshold int64
+	//DeltaBlockSize is the size of the blocks compared by delta transfers. It defaults to 128 KiB.
+	DeltaBlockSize int64
+	//Atomic makes transfers write to a temporary file next to the target, which is renamed over the target once
+	//it is complete, so that readers never see a partially written file. Temporary files left behind by a previous
+	//run are removed by InitialSync. Delta transfers update files in place and are not used in atomic mode.
+	Atomic bool
+	//TempPrefix and TempSuffix are added to the name of a file to form the name of its temporary file in atomic
+	//mode. They default to "." and ".syncpkg-tmp" if both are empty. Files named like this are never synced.
+	TempPrefix, TempSuffix string
+	//Observer receives the events of the engine, such as the start, progress and end of every transfer. It is
+	//optional.
+	Observer Observer
+	//Logger receives the structured logs of the engine. Nothing is logged if it is nil.
+	Logger *slog.Logger
+	//Exclude holds gitignore patterns of the paths that are not synced, in addition to the .syncignore files
+	Exclude []string
+	//Include holds gitignore patterns of the paths that are synced even if Exclude, a preset or a .syncignore file
+	//excludes them. Paths inside an excluded directory stay excluded.
+	Include []string
+	//Debounce is the time a local path must be quiet before its events, merged into the newest change, are
+	//processed. It defaults to 100 milliseconds, a negative value processes every event right away.
+	Debounce time.Duration
+	//IgnorePresets names the built-in patterns of ignore.Presets that are excluded. It defaults to
+	//ignore.DefaultPresets, set it to an empty slice to exclude none.
+	IgnorePresets []string
+}
+
+// saveInterval is the time between two saves of a changed state file.
+const saveInterval = 5 * time.Second
+
+// Engine is the struct that synchronizes a local and a remote directory through their backends
+type Engine struct {
+	//local is the local side of the sync pair
+	local endpoint
+	//remote is the remote side of the sync pair
+	remote endpoint
+	//config is the configuration of the engine
+	config Config
+	//records holds the last synced state of the files, which tells changes apart from the engine's own writes
+	records records
+	//store is the state store the records are persisted to
+	store *state.Store
+	//stateFile is the path of the state file relative to the local directory, if it is inside of it
+	stateFile string
+	//hashes caches the hashes of local files
+	hashes hashCache
+	//log is the logger of the engine, it discards everything if Config.Logger is nil
+	log *slog.Logger
+	//metrics holds the counters and histograms returned by Stats
+	metrics metrics
+	//ignore matches the paths that are not synced
+	ignore *ignore.Matcher
+	//Watcher is the fsnotify watcher that is used to watch the local directory
+	Watcher *fsnotify.Watcher
+	//Pool is the worker pool that is used to process the sync tasks
+	Pool *worker.Pool[worker.Task]
+	//conn is the state of the connection of the remote backend
+	conn *connection
+	//ctx is the context of the running engine. It is done once the engine is asked to stop.
+	ctx context.Context
+	//cancel stops the engine
+	cancel context.CancelFunc
+	//mu guards the fields below
+	mu sync.Mutex
+	//done is closed once the engine stopped, it is nil until the engine is started
+	done chan struct{}
+	//err is the error that stopped the engine
+	err error
+	//producers tracks the goroutines that queue tasks, save the state and check the connection
+	producers sync.WaitGroup
+}
+
+// New returns an engine that syncs config.LocalDir on the local backend with config.RemoteDir on the remote
+// backend, processing the resulting tasks on pool.
+//
+// - Returns an error if the state file cannot be loaded or an ignore preset does not exist.
+func New(local, remote Backend, pool *worker.Pool[worker.Task], config Config) (*Engine, error) {
+	if config.PollInterval <= 0 {
+		config.PollInterval = time.Second
+	}
+	config.RetryPolicy = config.RetryPolicy.withDefaults(config.MaxRetries)
+	if config.KeepAlive == 0 {
+		config.KeepAlive = defaultKeepAlive
+	}
+	if config.Debounce == 0 {
+		config.Debounce = defaultDebounce
+	}
+	if config.Pair == "" {
+		config.Pair = config.LocalDir + " <-> " + config.RemoteDir
+	}
+	if config.Atomic && config.TempPrefix == "" && config.TempSuffix == "" {
+		config.TempPrefix, config.TempSuffix = defaultTempPrefix, defaultTempSuffix
+	}
+	log := config.Logger
+	if log == nil {
+		log = DiscardLogger
+	}
+	switch config.StateFile {
+	case "":
+		stateFile, err := DefaultStateFile(config.LocalDir, config.Pair)
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(stateFile), 0o700)
+		}
+		if err != nil {
+			log.Warn("cannot use the default state file, the state is kept in memory only", "op", "load",
+				"path", stateFile, "error", err)
+		} else {
+			config.StateFile = stateFile
+		}
+	case MemoryState:
+		config.StateFile = ""
+	}
+	if config.IgnorePresets == nil {
+		config.IgnorePresets = ignore.DefaultPresets
+	}
+	exclude, err := ignore.Preset(config.IgnorePresets...)
+	if err != nil {
+		return nil, err
+	}
+	store, err := state.Open(config.StateFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load state file: %w", err)
+	}
+	e := &Engine{
+		log:     log,
+		local:   endpoint{Backend: local, root: config.LocalDir, native: true, times: &precision{}},
+		remote:  endpoint{Backend: remote, root: config.RemoteDir, remote: true, times: &precision{}},
+		config:  config,
+		records: records{pair: store.Pair(config.Pair)},
+		store:   store,
+		Pool:    pool,
+		conn:    newConnection(),
+		ctx:     context.Background(),
+	}
+	e.ignore = ignore.New(append(exclude, config.Exclude...), config.Include, e.loadIgnore)
+	if config.StateFile != "" {
+		stateFile, err := filepath.Abs(config.StateFile)
+		if err == nil {
+			localDir, _ := filepath.Abs(config.LocalDir)
+			e.stateFile, err = endpoint{root: localDir, native: true}.rel(stateFile)
+			if err != nil {
+				e.stateFile = ""
+			}
+		}
+	}
+	return e, nil
+}
+
+// MemoryState is the Config.StateFile that keeps the state in memory only, so that every start is a first sync.
+const MemoryState = "none"
+
+// DefaultStateFile returns the state file of the sync pair of localDir named pair when Config.StateFile is not set:
+// a file of the syncpkg directory of the user cache directory, such as ~/.cache/syncpkg on Linux, named after a
+// hash of the absolute path of localDir and of pair, so that every sync pair gets its own file.
+func DefaultStateFile(localDir, pair string) (string, error) {
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	localDir, err = filepath.Abs(localDir)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(localDir + "\x00" + pair))
+	return filepath.Join(cache, "syncpkg", fmt.Sprintf("state-%x.json", sum[:8])), nil
+}
+
+// endpoint is one side of the sync pair. It maps the slash separated paths the engine works with, which are
+// relative to the synced directory, to the absolute paths of its backend.
+type endpoint struct {
+	Backend
+	//root is the synced directory on the backend
+	root string
+	//remote reports whether this is the remote side of the sync pair
+	remote bool
+	//native reports whether the backend uses the path conventions of the local operating system
+	native bool
+	//times holds the precision of the modification times of the backend
+	times *precision
+}
+
+// join joins path elements using the path conventions of the backend.
+func (p endpoint) join(elem ...string) string {
+	if p.native {
+		return filepath.Join(elem...)
+	}
+	return path.Join(elem...)
+}
+
+// abs returns the absolute backend path of the relative path rel.
+func (p endpoint) abs(rel string) string {
+	if p.native {
+		return filepath.Join(p.root, filepath.FromSlash(rel))
+	}
+	return path.Join(p.root, rel)
+}
+
+// rel returns the path of name relative to the synced directory.
+func (p endpoint) rel(name string) (string, error) {
+	if p.native {
+		rel, err := filepath.Rel(p.root, name)
+		if err != nil {
+			return "", err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == ".." || strings.HasPrefix(rel, "../") {
+			return "", fmt.Errorf("%s is outside of %s", name, p.root)
+		}
+		if rel == "." {
+			return "", nil
+		}
+		return rel, nil
+	}
+	root := path.Clean(p.root)
+	name = path.Clean(name)
+	if name == root {
+		return "", nil
+	}
+	prefix := strings.TrimSuffix(root, "/") + "/"
+	if !strings.HasPrefix(name, prefix) {
+		return "", fmt.Errorf("%s is outside of %s", name, p.root)
+	}
+	return strings.TrimPrefix(name, prefix), nil
+}
+
+// endpoints returns the side the changes of task are read from and the side they are applied to.
+func (e *Engine) endpoints(task worker.Task) (src, dst endpoint) {
+	if task.Remote {
+		return e.remote, e.local
+	}
+	return e.local, e.remote
+}
+
+// isNotExist reports whether err means that a file does not exist on a backend.
+func isNotExist(err error) bool {
+	return errors.Is(err, fs.ErrNotExist)
+}
+
+// skip reports whether the path rel of p is never synced. Besides the ignored paths and the temporary files of
+// atomic mode, this is the state file and its temporary copies when the state file lives in the local directory.
+// info describes rel on p, it may be nil.
+func (e *Engine) skip(p endpoint, rel string, info os.FileInfo) bool {
+	if e.ignored(p, rel, info) || e.isTemp(rel) {
+		return true
+	}
+	if e.stateFile == "" || parent(rel) != parent(e.stateFile) {
+		return false
+	}
+	name, stateName := path.Base(rel), path.Base(e.stateFile)
+	return name == stateName || strings.HasPrefix(name, "."+stateName+".")
+}
+
+// parent returns the parent directory of the relative path rel.
+func parent(rel string) string {
+	dir := path.Dir(rel)
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
+
+// InitialSync copies every file that exists on the source side of the sync but not on the destination side,
+// creating the missing directories along the way.
+//
+// A Bidirectional sync copies the missing files both ways. Files that exist on both sides but differ are
+// treated as conflicts and settled by the ConflictPolicy.
+//
+// The files are compared against the state recorded by the previous run, so that a file deleted while the
+// process was down is deleted on the other side too instead of being copied back, and a file changed on the
+// source side while the process was down is copied again.
+//
+// - Returns an error if any error occurs during the synchronization process.
+func (e *Engine) InitialSync() error {
+	if e.config.Atomic {
+		for _, p := range []endpoint{e.local, e.remote} {
+			err := e.removeTemps(p, "")
+			if err != nil {
+				e.log.Warn("cannot remove leftover temporary files", "op", "cleanup", "error", err)
+			}
+		}
+	}
+
+	var err error
+	switch e.config.Direction {
+	case RemoteToLocal:
+		err = e.syncDir(e.remote, e.local, "", true)
+		if err == nil {
+			err = e.pruneRecords(e.remote, e.local)
+		}
+	case Bidirectional:
+		err = e.syncDir(e.local, e.remote, "", true)
+		if err == nil {
+			err = e.syncDir(e.remote, e.local, "", true)
+		}
+		if err == nil {
+			err = e.pruneRecords(e.local, e.remote)
+		}
+	default:
+		err = e.syncDir(e.local, e.remote, "", true)
+		if err == nil {
+			err = e.pruneRecords(e.local, e.remote)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return e.store.Save()
+}
+
+// pruneRecords deals with the recorded paths that no longer exist on src, which were deleted while the process
+// was down. They are removed from dst, except in a Bidirectional sync where syncDir already handled them and only
+// the records of paths missing on both sides are dropped.
+func (e *Engine) pruneRecords(src, dst endpoint) error {
+	entries := e.records.pair.Entries()
+	rels := make([]string, 0, len(entries))
+	for rel := range entries {
+		rels = append(rels, rel)
+	}
+	sort.Strings(rels)
+
+	for _, rel := range rels {
+		// The record went away with its parent directory.
+		if _, ok := e.records.get(rel); !ok {
+			continue
+		}
+		if e.skip(src, rel, nil) {
+			continue
+		}
+		_, err := src.Stat(src.abs(rel))
+		if !isNotExist(err) {
+			continue
+		}
+		if e.config.Direction == Bidirectional {
+			_, err = dst.Stat(dst.abs(rel))
+			if isNotExist(err) {
+				e.records.delete(rel)
+			}
+			continue
+		}
+		e.log.Info("removing file deleted while offline", "op", "delete", "path", rel)
+		err = e.retry("delete", rel, func() error { return removeAll(dst, dst.abs(rel)) })
+		if err != nil {
+			return err
+		}
+		e.records.delete(rel)
+	}
+	return nil
+}
+
+// syncDir recursively copies the directory rel from src to dst. Files that already exist on dst are left alone,
+// unless they changed on src since the last sync or the sync is Bidirectional, in which case they are reconciled
+// by pushFile.
+//
+// During the initial sync a Bidirectional sync treats a recorded path that is missing on dst as deleted on dst
+// while the process was down, and removes it from src as well.
+func (e *Engine) syncDir(src, dst endpoint, rel string, initial bool) error {
+	entries, err := e.list(src, rel)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if initial && e.ctx.Err() != nil {
+			return e.ctx.Err()
+		}
+		child := path.Join(rel, entry.Name())
+		if e.skip(src, child, entry) {
+			continue
+		}
+		if initial && e.config.Direction == Bidirectional {
+			if _, ok := e.records.get(child); ok {
+				_, err = dst.Stat(dst.abs(child))
+				if isNotExist(err) {
+					e.log.Info("removing file deleted while offline", "op", "delete", "path", child)
+					err = e.remove(dst, src, child)
+					if err != nil {
+						return err
+					}
+					continue
+				}
+			}
+		}
+		if entry.IsDir() {
+			err = e.mkdir(dst, child)
+			if err != nil {
+				return err
+			}
+			e.remember(child)
+			err = e.syncDir(src, dst, child, initial)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if e.config.Direction == Bidirectional {
+			err = e.pushFile(src, dst, child, entry)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		// stat the destination file and if it doesn't exist copy it over
+		dstInfo, err := dst.Stat(dst.abs(child))
+		if err == nil {
+			if inSync(src, dst, entry, dstInfo) {
+				e.remember(child)
+				continue
+			}
+			same, ok := e.sameContent(src, dst, child, entry, dstInfo)
+			if ok && same {
+				e.remember(child)
+				continue
+			}
+			// Without content comparison, only files that changed on src since the last sync are copied again.
+			rec, recorded := e.records.get(child)
+			if !ok && (!recorded || src.matches(sideOf(rec, src), entry)) {
+				continue
+			}
+		}
+		err = e.transfer(src, dst, child, entry)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// push copies the file or directory rel from src to dst. Files that no longer exist on src are skipped.
+func (e *Engine) push(src, dst endpoint, rel string) error {
+	info, err := src.Stat(src.abs(rel))
+	if err != nil {
+		if isNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if info.IsDir() {
+		err = e.mkdir(dst, rel)
+		if err != nil {
+			return err
+		}
+		e.remember(rel)
+		return e.syncDir(src, dst, rel, false)
+	}
+	err = e.mkdir(dst, parent(rel))
+	if err != nil {
+		return err
+	}
+	if e.config.Direction == Bidirectional {
+		return e.pushFile(src, dst, rel, info)
+	}
+	dstInfo, err := dst.Stat(dst.abs(rel))
+	if err == nil && !dstInfo.IsDir() {
+		same, ok := e.sameContent(src, dst, rel, info, dstInfo)
+		if ok && same {
+			e.remember(rel)
+			return nil
+		}
+	}
+	return e.transfer(src, dst, rel, info)
+}
+
+// pushFile copies the file rel, described by srcInfo, from src to dst in a Bidirectional sync.
+//
+// Nothing is copied when both copies are already the same, or when the copy on src did not change since the
+// last sync, which is how the engine recognizes the echo of its own writes. When both copies changed since the
+// last sync, the conflict is settled by resolveConflict, unless their contents turn out to be the same.
+func (e *Engine) pushFile(src, dst endpoint, rel string, srcInfo os.FileInfo) error {
+	dstInfo, err := dst.Stat(dst.abs(rel))
+	if err != nil {
+		if isNotExist(err) {
+			return e.transfer(src, dst, rel, srcInfo)
+		}
+		return err
+	}
+	if dstInfo.IsDir() {
+		return fmt.Errorf("cannot copy file %s over a directory", rel)
+	}
+	if inSync(src, dst, srcInfo, dstInfo) {
+		e.remember(rel)
+		return nil
+	}
+	rec, ok := e.records.get(rel)
+	if ok && src.matches(sideOf(rec, src), srcInfo) {
+		return nil
+	}
+	if same, compared := e.sameContent(src, dst, rel, srcInfo, dstInfo); compared && same {
+		e.remember(rel)
+		return nil
+	}
+	if !ok || !dst.matches(sideOf(rec, dst), dstInfo) {
+		return e.resolveConflict(src, dst, rel, srcInfo, dstInfo)
+	}
+	return e.transfer(src, dst, rel, srcInfo)
+}
+
+// transfer copies the file rel from src to dst, retrying transient errors as the retry policy allows, and records the
+// synced state.
+// An attempt that fails partway is resumed by the next one where the backends allow it.
+func (e *Engine) transfer(src, dst endpoint, rel string, info os.FileInfo) error {
+	attempts := e.config.RetryPolicy.MaxAttempts
+	e.records.acquire(dst, rel)
+	defer e.records.release(dst, rel)
+
+	start := time.Now()
+	event := SyncEvent{Type: TransferStarted, Path: rel, Direction: directionTo(dst), Size: info.Size()}
+	e.emit(event)
+
+	var err error
+	// copied is the number of bytes of the file written to dst by the previous attempts.
+	var copied int64
+	var i int
+	for i = 0; i < attempts; i++ {
+		if i > 0 {
+			e.metrics.retries.Add(1)
+		}
+		var offset int64
+		if copied > 0 {
+			offset = e.resumeOffset(src, dst, rel, info, copied)
+		}
+		var n int64
+		n, err = e.copyFile(src, dst, rel, info, offset)
+		copied = offset + n
+		if err == nil && offset > 0 {
+			err = e.verifyResumed(src, dst, rel, info)
+			if err != nil {
+				copied = 0
+			}
+		}
+		if err == nil {
+			e.log.Info("transferred file", "op", "transfer", "path", rel, "remote_path", e.remote.abs(rel),
+				"attempt", i+1, "bytes", copied, "duration", time.Since(start))
+			e.remember(rel)
+			e.metrics.transferred(dst, copied, time.Since(start))
+			event.Type, event.Bytes, event.Duration = TransferCompleted, copied, time.Since(start)
+			e.emit(event)
+			return nil
+		}
+		e.log.Warn("cannot transfer file", "op", "transfer", "path", rel, "remote_path", e.remote.abs(rel),
+			"attempt", i+1, "attempts", attempts, "error", err)
+		if e.reconnected(err) {
+			// The connection dropped, the attempt is replayed over the new one and does not count.
+			i--
+			continue
+		}
+		if !e.transient(err) || (i+1 < attempts && !e.backoff(i+1)) {
+			i++
+			break
+		}
+	}
+	err = fmt.Errorf("failed to transfer file %s after %d attempts: %w", rel, i, err)
+	e.metrics.transferFailed(dst)
+	event.Type, event.Duration, event.Err = TransferFailed, time.Since(start), err
+	e.emit(event)
+	return err
+}
+
+// copyFile copies the content of the file rel from src to dst and carries its modification time over. Files of at
+// least Config.DeltaThreshold bytes are transferred as a delta when possible, and through a temporary file in
+// atomic mode. If offset is not 0, the copy resumes
+// a previous one that wrote the first offset bytes of the file to dst.
+//
+// - Returns the number of bytes written to dst, which do not include offset nor the blocks of a delta transfer.
+func (e *Engine) copyFile(src, dst endpoint, rel string, info os.FileInfo, offset int64) (int64, error) {
+	if offset == 0 && !e.config.Atomic && e.config.DeltaThreshold > 0 && info.Size() >= e.config.DeltaThreshold {
+		err := e.deltaCopy(src, dst, rel, info)
+		if !errors.Is(err, errNoDelta) {
+			return 0, err
+		}
+	}
+
+	var r io.ReadCloser
+	var w io.WriteCloser
+	var err error
+	if offset > 0 {
+		e.log.Info("resuming transfer", "op", "transfer", "path", rel, "bytes", offset, "size", info.Size())
+		r, err = src.Backend.(Resumer).OpenAt(src.abs(rel), offset)
+	} else {
+		r, err = src.Open(src.abs(rel))
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer func(r io.ReadCloser) {
+		_ = r.Close()
+	}(r)
+
+	target := dst.abs(e.target(rel))
+	if offset > 0 {
+		w, err = dst.Backend.(Resumer).Append(target, offset)
+	} else {
+		w, err = dst.Create(target)
+	}
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	if e.config.Observer == nil {
+		n, err = io.Copy(w, r)
+	} else {
+		now := time.Now()
+		n, err = copyProgress(w, r, src.remote, info.Size()-offset, &progress{
+			e:     e,
+			event: SyncEvent{Type: TransferProgress, Path: rel, Direction: directionTo(dst), Size: info.Size(), Bytes: offset},
+			start: now,
+			last:  now,
+		})
+	}
+	if err != nil {
+		_ = w.Close()
+		return n, err
+	}
+	return n, e.commit(dst, rel, info, w)
+}
+
+// remove removes the file or directory rel from dst after it was removed from src.
+//
+// In a Bidirectional sync a file is only removed when it did not change on dst since the last sync. Otherwise the
+// change wins over the removal and the file is copied back to src.
+func (e *Engine) remove(src, dst endpoint, rel string) error {
+	if e.config.Direction == Bidirectional {
+		// The file came back, for example because an editor saved it by renaming a new file over it.
+		_, err := src.Stat(src.abs(rel))
+		if err == nil {
+			return nil
+		}
+		dstInfo, err := dst.Stat(dst.abs(rel))
+		if err == nil && !dstInfo.IsDir() {
+			rec, ok := e.records.get(rel)
+			if !ok || !dst.matches(sideOf(rec, dst), dstInfo) {
+				e.log.Warn("conflict: removed on one side but changed on the other, keeping the change", "op", "conflict", "path", rel)
+				e.emit(SyncEvent{Type: ConflictDetected, Path: rel, Direction: directionTo(src), Size: dstInfo.Size()})
+				return e.push(dst, src, rel)
+			}
+		}
+	}
+	err := e.retry("delete", rel, func() error { return removeAll(dst, dst.abs(rel)) })
+	if err != nil {
+		return err
+	}
+	e.records.delete(rel)
+	e.metrics.deleted.Add(1)
+	e.emit(SyncEvent{Type: Deleted, Path: rel, Direction: directionTo(dst)})
+	return nil
+}
+
+// removeAll removes the file or directory name, including its content, from p. Missing files are not an error.
+func removeAll(p endpoint, name string) error {
+	info, err := p.Stat(name)
+	if err != nil {
+		if isNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if info.IsDir() {
+		entries, err := p.List(name)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			err = removeAll(p, p.join(name, entry.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = p.Remove(name)
+	if err != nil && !isNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// WatchDirectory starts the engine with Start and blocks until it stops, returning the error that stopped it.
+func (e *Engine) WatchDirectory() error {
+	err := e.Start(context.Background())
+	if err != nil {
+		return err
+	}
+	return e.Wait()
+}
+
+// saveState saves the state store every saveInterval until the context is done.
+func (e *Engine) saveState() {
+	defer e.producers.Done()
+	ticker := time.NewTicker(saveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-ticker.C:
+			err := e.store.Save()
+			if err != nil {
+				e.log.Error("cannot save state", "op", "save", "path", e.config.StateFile, "error", err)
+			}
+		}
+	}
+}
+
+// watchLocal sets up the fsnotify watcher on the local directory tree and forwards its events to the worker pool.
+func (e *Engine) watchLocal() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	e.Watcher = watcher
+
+	e.producers.Add(1)
+	go func() {
+		defer e.producers.Done()
+		// Events are merged per path until the path was quiet for the debounce window, and flushed when timer fires.
+		// The paths the last sync recorded existed before their events, even if they start with a Create.
+		pending := newCoalescer(func(name string) bool {
+			rel, err := e.local.rel(name)
+			if err != nil {
+				return false
+			}
+			_, ok := e.records.get(rel)
+			return ok
+		})
+		timer := time.NewTimer(time.Hour)
+		timer.Stop()
+		armed := false
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					tasks, _ := pending.due(time.Time{})
+					e.queue(tasks...)
+					return
+				}
+				e.log.Debug("received event", "op", event.Op.String(), "path", event.Name)
+				rel, err := e.local.rel(event.Name)
+				if err == nil {
+					e.rulesChanged(rel)
+					if e.skip(e.local, rel, nil) {
+						continue
+					}
+				}
+				if event.Has(fsnotify.Create) {
+					// New directories need watches of their own.
+					info, err := os.Stat(event.Name)
+					if err == nil && info.IsDir() {
+						err = e.addWatches(watcher, event.Name)
+						if err != nil {
+							e.log.Error("cannot watch directory", "op", "watch", "path", event.Name, "error", err)
+						}
+					}
+				}
+				if e.config.Debounce < 0 {
+					e.queue(worker.Task{EventType: event.Op, Name: event.Name})
+					continue
+				}
+				pending.add(event.Name, event.Op, time.Now().Add(e.config.Debounce))
+				if !armed {
+					timer.Reset(e.config.Debounce)
+					armed = true
+				}
+			case <-timer.C:
+				tasks, next := pending.due(time.Now())
+				e.queue(tasks...)
+				armed = next > 0
+				if armed {
+					timer.Reset(next)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					tasks, _ := pending.due(time.Time{})
+					e.queue(tasks...)
+					return
+				}
+				e.log.Error("watcher error", "op", "watch", "error", err)
+			}
+		}
+	}()
+
+	// Add root directory and all subdirectories to the watcher
+	err = e.addWatches(watcher, e.config.LocalDir)
+	if err != nil {
+		_ = watcher.Close()
+		return err
+	}
+	return nil
+}
+
+// addWatches adds rootDir and all its subdirectories to the watcher.
+func (e *Engine) addWatches(watcher *fsnotify.Watcher, rootDir string) error {
+	return filepath.Walk(rootDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			rel, err := e.local.rel(path)
+			if err == nil && e.skip(e.local, rel, info) {
+				return filepath.SkipDir
+			}
+			err = watcher.Add(path)
+			if err != nil {
+				return err
+			}
+			e.log.Debug("watching directory", "op", "watch", "path", path)
+		}
+		return nil
+	})
+}
+
+// pollRemote scans the remote directory tree every PollInterval and queues a Create task for every new file,
+// a Write task for every modified file and a Remove task for every removed file. It returns when the context is done.
+//
+// The first scan is compared against the snapshot of the recorded state, so that changes made between the initial
+// sync and the first scan are not missed.
+func (e *Engine) pollRemote() error {
+	prevFiles := e.snapshot()
+	var prevScan time.Time
+	for {
+		// Read the remote directory and its subdirectories.
+		scan := time.Now()
+		_, epoch := e.conn.state()
+		newFiles := make(map[string]os.FileInfo)
+		err := e.walkRemoteDir(e.config.RemoteDir, newFiles)
+		if err != nil {
+			if e.ctx.Err() != nil {
+				return nil
+			}
+			e.metrics.pollFailures.Add(1)
+			return err
+		}
+		if _, now := e.conn.state(); now != epoch {
+			// The connection dropped during the scan. The listings made before and after the reconnection may
+			// disagree, so the scan is made again rather than reporting phantom changes.
+			e.log.Debug("scanning again after reconnecting", "op", "poll", "remote_path", e.config.RemoteDir)
+			continue
+		}
+		e.metrics.polls.observe(time.Since(scan))
+		// Check for new, modified or removed files. The tasks are queued sorted by path, so that new directories
+		// are created before the files in them.
+		var tasks []worker.Task
+		for p, file := range newFiles {
+			prevFile, exists := prevFiles[p]
+			switch {
+			case !exists:
+				tasks = append(tasks, worker.Task{EventType: fsnotify.Create, Name: p, Remote: true})
+				e.log.Debug("new remote file", "op", "poll", "remote_path", p)
+			case !file.IsDir() && (changed(prevFile, file) || e.racy(file, prevScan)):
+				tasks = append(tasks, worker.Task{EventType: fsnotify.Write, Name: p, Remote: true})
+				e.log.Debug("modified remote file", "op", "poll", "remote_path", p)
+			}
+		}
+		for p := range prevFiles {
+			_, exists := newFiles[p]
+			if !exists {
+				tasks = append(tasks, worker.Task{EventType: fsnotify.Remove, Name: p, Remote: true})
+				e.log.Debug("removed remote file", "op", "poll", "remote_path", p)
+			}
+		}
+		sort.Slice(tasks, func(i, j int) bool { return tasks[i].Name < tasks[j].Name })
+		e.queue(tasks...)
+		prevFiles, prevScan = newFiles, scan
+
+		select {
+		case <-e.ctx.Done():
+			return nil
+		case <-time.After(e.config.PollInterval):
+		}
+	}
+}
+
+// changed reports whether the size or modification time of a file changed between two scans.
+func changed(prev, cur os.FileInfo) bool {
+	return prev.Size() != cur.Size() || !prev.ModTime().Equal(cur.ModTime())
+}
+
+// racy reports whether info describes a file modified in the same second the previous scan started, or the same
+// minute for a server that gives times to the minute, if content comparison is enabled. Such a file can have changed
+// again after the scan without its size or its modification time, as reported by the server, telling. It is then
+// compared by content.
+func (e *Engine) racy(info os.FileInfo, prevScan time.Time) bool {
+	if e.config.HashAlgorithm == HashNone || prevScan.IsZero() {
+		return false
+	}
+	precision := e.remote.precision()
+	return !info.ModTime().Truncate(precision).Before(prevScan.Truncate(precision))
+}
+
+// snapshot returns the remote files of the recorded state in the form walkRemoteDir returns them. Since it is taken
+// after the initial sync, it holds every remote file the poller must not report as new.
+func (e *Engine) snapshot() map[string]os.FileInfo {
+	entries := e.records.pair.Entries()
+	files := make(map[string]os.FileInfo, len(entries))
+	for rel, entry := range entries {
+		files[e.remote.abs(rel)] = recordInfo{name: path.Base(rel), entry: entry}
+	}
+	return files
+}
+
+// recordInfo is the os.FileInfo of the remote copy of a recorded path.
+type recordInfo struct {
+	name  string
+	entry state.Entry
+}
+
+func (i recordInfo) Name() string       { return i.name }
+func (i recordInfo) Size() int64        { return i.entry.Remote.Size }
+func (i recordInfo) ModTime() time.Time { return i.entry.Remote.ModTime }
+func (i recordInfo) IsDir() bool        { return i.entry.Dir }
+func (i recordInfo) Sys() interface{}   { return nil }
+
+func (i recordInfo) Mode() os.FileMode {
+	if i.entry.Dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+// walkRemoteDir recursively lists the remote directory dir and adds every file and directory it finds to files.
+func (e *Engine) walkRemoteDir(dir string, files map[string]os.FileInfo) error {
+	rel, err := e.remote.rel(dir)
+	if err != nil {
+		return err
+	}
+	entries, err := e.list(e.remote, rel)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := e.remote.join(dir, entry.Name())
+		rel, err := e.remote.rel(name)
+		if err == nil && e.skip(e.remote, rel, entry) {
+			continue
+		}
+		files[name] = entry
+		if entry.IsDir() {
+			err = e.walkRemoteDir(name, files)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// handle is the worker.Handler of the engine, which processes the tasks received from the worker pool. Tasks on the
+// same path, or on a directory and the paths inside of it, are processed one at a time in the order they were queued.
+//
+// Each task names a path on the side of the sync it was seen on, which is the remote side when task.Remote is set
+// and the local side otherwise. The change is applied to the other side:
+//
+//   - fsnotify.Create and fsnotify.Write copy the file or directory to the other side.
+//   - fsnotify.Remove and fsnotify.Rename remove it from the other side. A rename is always followed by a
+//     Create event for the new name, which copies the file over again.
+//   - fsnotify.Chmod is only logged.
+//
+// The error of the task is returned to the worker pool.
+func (e *Engine) handle(_ context.Context, task worker.Task) error {
+	e.log.Debug("processing task", "op", task.EventType.String(), "path", task.Name, "remote", task.Remote)
+	return e.process(task)
+}
+
+// process applies a single task to the destination side and returns the error that prevented it, if any.
+func (e *Engine) process(task worker.Task) error {
+	src, dst := e.endpoints(task)
+	rel, err := src.rel(task.Name)
+	if err != nil {
+		e.log.Error("cannot resolve path", "path", task.Name, "error", err)
+		return err
+	}
+	if e.skip(src, rel, nil) {
+		return nil
+	}
+	defer e.rulesChanged(rel)
+	// The event was caused by a file the engine is writing itself.
+	if e.records.isBusy(src, rel) {
+		return nil
+	}
+	switch {
+	case task.EventType.Has(fsnotify.Remove), task.EventType.Has(fsnotify.Rename):
+		err = e.remove(src, dst, rel)
+		if err != nil {
+			e.metrics.deleteFailures.Add(1)
+			e.log.Error("cannot remove file", "op", "delete", "path", rel, "remote_path", e.remote.abs(rel), "error", err)
+		}
+	case task.EventType.Has(fsnotify.Create), task.EventType.Has(fsnotify.Write):
+		err = e.push(src, dst, rel)
+		if err != nil {
+			e.log.Error("cannot transfer file", "op", "transfer", "path", rel, "remote_path", e.remote.abs(rel), "error", err)
+		}
+	case task.EventType.Has(fsnotify.Chmod):
+		e.log.Debug("permissions of file changed", "op", "chmod", "path", rel)
+	}
+	return err
+}
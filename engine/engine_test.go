@@ -0,0 +1,1262 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cploutarchou/syncpkg/worker"
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestMain(m *testing.M) {
+	// The engines of the tests save their default state files to a cache directory of their own.
+	cache, err := os.MkdirTemp("", "syncpkg-cache")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	_ = os.Setenv("XDG_CACHE_HOME", cache)
+	code := m.Run()
+	_ = os.RemoveAll(cache)
+	os.Exit(code)
+}
+
+func writeFile(t *testing.T, name, content string) {
+	t.Helper()
+	err := os.MkdirAll(filepath.Dir(name), 0755)
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	err = os.WriteFile(name, []byte(content), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+}
+
+func readFile(t *testing.T, name string) string {
+	t.Helper()
+	content, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	return string(content)
+}
+
+func newTestEngine(t *testing.T, direction SyncDirection) (*Engine, string, string) {
+	t.Helper()
+	localDir, remoteDir := t.TempDir(), t.TempDir()
+	return newTestEngineWithConfig(t, Config{
+		Direction:  direction,
+		LocalDir:   localDir,
+		RemoteDir:  remoteDir,
+		MaxRetries: 3,
+	}), localDir, remoteDir
+}
+
+func newTestEngineWithConfig(t *testing.T, config Config) *Engine {
+	t.Helper()
+	e, err := New(Local{}, Local{}, worker.NewWorkerPool(1), config)
+	if err != nil {
+		t.Fatalf("New returned an error: %v", err)
+	}
+	// The remote side of the tests is a local directory as well.
+	e.remote.native = true
+	return e
+}
+
+func TestInitialSync(t *testing.T) {
+	tests := []struct {
+		name      string
+		direction SyncDirection
+	}{
+		{"LocalToRemote", LocalToRemote},
+		{"RemoteToLocal", RemoteToLocal},
+		{"Bidirectional", Bidirectional},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, localDir, remoteDir := newTestEngine(t, tt.direction)
+			srcDir, dstDir := localDir, remoteDir
+			if tt.direction == RemoteToLocal {
+				srcDir, dstDir = remoteDir, localDir
+			}
+			writeFile(t, filepath.Join(srcDir, "a.txt"), "a")
+			writeFile(t, filepath.Join(srcDir, "sub", "b.txt"), "b")
+			writeFile(t, filepath.Join(srcDir, "sub", ".b.txt.swp"), "swap")
+			writeFile(t, filepath.Join(srcDir, "existing.txt"), "new")
+			writeFile(t, filepath.Join(dstDir, "existing.txt"), "old")
+
+			err := e.InitialSync()
+			if err != nil {
+				t.Fatalf("InitialSync returned an error: %v", err)
+			}
+
+			if got := readFile(t, filepath.Join(dstDir, "a.txt")); got != "a" {
+				t.Errorf("a.txt = %q, want %q", got, "a")
+			}
+			if got := readFile(t, filepath.Join(dstDir, "sub", "b.txt")); got != "b" {
+				t.Errorf("sub/b.txt = %q, want %q", got, "b")
+			}
+			if tt.direction != Bidirectional {
+				if got := readFile(t, filepath.Join(dstDir, "existing.txt")); got != "old" {
+					t.Errorf("existing.txt = %q, want it to be left alone", got)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(dstDir, "sub", ".b.txt.swp")); !os.IsNotExist(err) {
+				t.Errorf("swap file was synced: %v", err)
+			}
+		})
+	}
+}
+
+func TestProcess(t *testing.T) {
+	e, localDir, remoteDir := newTestEngine(t, LocalToRemote)
+
+	writeFile(t, filepath.Join(localDir, "dir", "file.txt"), "content")
+	e.process(worker.Task{EventType: fsnotify.Create, Name: filepath.Join(localDir, "dir")})
+	if got := readFile(t, filepath.Join(remoteDir, "dir", "file.txt")); got != "content" {
+		t.Fatalf("dir/file.txt = %q, want %q", got, "content")
+	}
+
+	writeFile(t, filepath.Join(localDir, "dir", "file.txt"), "changed")
+	e.process(worker.Task{EventType: fsnotify.Write, Name: filepath.Join(localDir, "dir", "file.txt")})
+	if got := readFile(t, filepath.Join(remoteDir, "dir", "file.txt")); got != "changed" {
+		t.Fatalf("dir/file.txt = %q, want %q", got, "changed")
+	}
+
+	err := os.RemoveAll(filepath.Join(localDir, "dir"))
+	if err != nil {
+		t.Fatalf("Failed to remove directory: %v", err)
+	}
+	e.process(worker.Task{EventType: fsnotify.Rename, Name: filepath.Join(localDir, "dir")})
+	if _, err := os.Stat(filepath.Join(remoteDir, "dir")); !os.IsNotExist(err) {
+		t.Fatalf("dir was not removed from the remote side: %v", err)
+	}
+}
+
+func TestEndpointRel(t *testing.T) {
+	tests := []struct {
+		root, name, want string
+		wantErr          bool
+	}{
+		{"/home/foo", "/home/foo", "", false},
+		{"/home/foo", "/home/foo/a/b.txt", "a/b.txt", false},
+		{"/", "/a/b.txt", "a/b.txt", false},
+		{"/home/foo", "/home/foobar/b.txt", "", true},
+	}
+	for _, tt := range tests {
+		got, err := endpoint{root: tt.root}.rel(tt.name)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("rel(%q, %q) = %q, %v; want %q, error %v", tt.root, tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestBidirectionalConflict(t *testing.T) {
+	tests := []struct {
+		policy     ConflictPolicy
+		wantLocal  string
+		wantRemote string
+		wantCopies int
+	}{
+		{NewestWins, "remote", "remote", 0},
+		{LocalWins, "local", "local", 0},
+		{RemoteWins, "remote", "remote", 0},
+		{KeepBoth, "local", "local", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy.String(), func(t *testing.T) {
+			e, localDir, remoteDir := newTestEngine(t, Bidirectional)
+			e.config.ConflictPolicy = tt.policy
+			localFile, remoteFile := filepath.Join(localDir, "file.txt"), filepath.Join(remoteDir, "file.txt")
+			writeFile(t, localFile, "synced")
+			err := e.InitialSync()
+			if err != nil {
+				t.Fatalf("InitialSync returned an error: %v", err)
+			}
+
+			// Change both copies, the remote one last.
+			now := time.Now()
+			writeFile(t, localFile, "local")
+			_ = os.Chtimes(localFile, now.Add(-time.Minute), now.Add(-time.Minute))
+			writeFile(t, remoteFile, "remote")
+			_ = os.Chtimes(remoteFile, now.Add(time.Minute), now.Add(time.Minute))
+
+			e.process(worker.Task{EventType: fsnotify.Write, Name: localFile})
+
+			if got := readFile(t, localFile); got != tt.wantLocal {
+				t.Errorf("local file = %q, want %q", got, tt.wantLocal)
+			}
+			if got := readFile(t, remoteFile); got != tt.wantRemote {
+				t.Errorf("remote file = %q, want %q", got, tt.wantRemote)
+			}
+			for _, dir := range []string{localDir, remoteDir} {
+				entries, _ := os.ReadDir(dir)
+				copies := 0
+				for _, entry := range entries {
+					if strings.Contains(entry.Name(), ".conflict-remote-") {
+						copies++
+						if got := readFile(t, filepath.Join(dir, entry.Name())); got != "remote" {
+							t.Errorf("conflict copy = %q, want %q", got, "remote")
+						}
+					}
+				}
+				if copies != tt.wantCopies {
+					t.Errorf("found %d conflict copies in %s, want %d", copies, dir, tt.wantCopies)
+				}
+			}
+		})
+	}
+}
+
+func TestBidirectionalEcho(t *testing.T) {
+	e, localDir, remoteDir := newTestEngine(t, Bidirectional)
+	localFile, remoteFile := filepath.Join(localDir, "file.txt"), filepath.Join(remoteDir, "file.txt")
+	writeFile(t, localFile, "v1")
+	e.process(worker.Task{EventType: fsnotify.Create, Name: localFile})
+	if got := readFile(t, remoteFile); got != "v1" {
+		t.Fatalf("remote file = %q, want %q", got, "v1")
+	}
+
+	// The poller sees the upload as a remote change, which must not be copied back.
+	writeFile(t, localFile, "v2")
+	e.process(worker.Task{EventType: fsnotify.Create, Name: remoteFile, Remote: true})
+	if got := readFile(t, localFile); got != "v2" {
+		t.Fatalf("echo overwrote the local file with %q", got)
+	}
+
+	// Removing a file that changed on the other side keeps the change.
+	err := os.Remove(localFile)
+	if err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+	writeFile(t, remoteFile, "v3")
+	later := time.Now().Add(time.Minute)
+	_ = os.Chtimes(remoteFile, later, later)
+	e.process(worker.Task{EventType: fsnotify.Remove, Name: localFile})
+	if got := readFile(t, localFile); got != "v3" {
+		t.Fatalf("local file = %q, want the remote change %q", got, "v3")
+	}
+}
+
+func TestInitialSyncPropagatesOfflineDeletions(t *testing.T) {
+	tests := []struct {
+		name      string
+		direction SyncDirection
+		remote    bool
+	}{
+		{"LocalToRemote", LocalToRemote, false},
+		{"RemoteToLocal", RemoteToLocal, true},
+		{"BidirectionalLocal", Bidirectional, false},
+		{"BidirectionalRemote", Bidirectional, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := Config{
+				Direction: tt.direction,
+				LocalDir:  t.TempDir(),
+				RemoteDir: t.TempDir(),
+				StateFile: filepath.Join(t.TempDir(), "state.json"),
+			}
+			srcDir, dstDir := config.LocalDir, config.RemoteDir
+			if tt.remote {
+				srcDir, dstDir = dstDir, srcDir
+			}
+			writeFile(t, filepath.Join(srcDir, "keep.txt"), "keep")
+			writeFile(t, filepath.Join(srcDir, "dir", "gone.txt"), "gone")
+
+			err := newTestEngineWithConfig(t, config).InitialSync()
+			if err != nil {
+				t.Fatalf("InitialSync returned an error: %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(dstDir, "dir", "gone.txt")); err != nil {
+				t.Fatalf("gone.txt was not synced: %v", err)
+			}
+
+			// Delete while the process is down, then start again from the saved state.
+			err = os.RemoveAll(filepath.Join(srcDir, "dir"))
+			if err != nil {
+				t.Fatalf("Failed to remove directory: %v", err)
+			}
+			err = newTestEngineWithConfig(t, config).InitialSync()
+			if err != nil {
+				t.Fatalf("InitialSync returned an error: %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(dstDir, "dir")); !os.IsNotExist(err) {
+				t.Errorf("dir was not removed from the other side: %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(srcDir, "dir")); !os.IsNotExist(err) {
+				t.Errorf("dir came back: %v", err)
+			}
+			if got := readFile(t, filepath.Join(dstDir, "keep.txt")); got != "keep" {
+				t.Errorf("keep.txt = %q, want %q", got, "keep")
+			}
+		})
+	}
+}
+
+func TestDefaultStateFile(t *testing.T) {
+	if _, err := os.UserCacheDir(); err != nil {
+		t.Skipf("no user cache directory: %v", err)
+	}
+	config := Config{LocalDir: t.TempDir(), RemoteDir: t.TempDir()}
+	writeFile(t, filepath.Join(config.LocalDir, "file.txt"), "content")
+	e := newTestEngineWithConfig(t, config)
+	want, err := DefaultStateFile(config.LocalDir, e.config.Pair)
+	if err != nil {
+		t.Fatalf("DefaultStateFile returned an error: %v", err)
+	}
+	if e.config.StateFile != want {
+		t.Fatalf("StateFile = %q, want %q", e.config.StateFile, want)
+	}
+	err = e.InitialSync()
+	if err == nil {
+		err = e.store.Save()
+	}
+	if err != nil {
+		t.Fatalf("the sync failed: %v", err)
+	}
+	if _, err := os.Stat(want); err != nil {
+		t.Errorf("the state was not saved to the default state file: %v", err)
+	}
+
+	other, err := DefaultStateFile(t.TempDir(), e.config.Pair)
+	if err != nil || other == want {
+		t.Errorf("another local directory got the state file %q, %v", other, err)
+	}
+	config.StateFile = MemoryState
+	if e := newTestEngineWithConfig(t, config); e.config.StateFile != "" {
+		t.Errorf("StateFile = %q with MemoryState, want the state in memory only", e.config.StateFile)
+	}
+}
+
+func TestHashCache(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "file.txt")
+	writeFile(t, name, "content")
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+
+	var cache hashCache
+	sum, err := cache.hash(name, info, HashSHA256)
+	if err != nil {
+		t.Fatalf("hash returned an error: %v", err)
+	}
+	if got, want := formatHash(HashSHA256, sum), "sha256:ed7002b439e9ac845f22357d822bac1444730fbdb6016d3ec9432297b9ec9f73"; got != want {
+		t.Fatalf("hash = %s, want %s", got, want)
+	}
+
+	// The cached hash is returned as long as the size and the modification time do not change.
+	writeFile(t, name, "CONTENT")
+	_ = os.Chtimes(name, info.ModTime(), info.ModTime())
+	cached, _ := cache.hash(name, info, HashSHA256)
+	if string(cached) != string(sum) {
+		t.Fatalf("hash was computed again")
+	}
+	later := info.ModTime().Add(time.Minute)
+	_ = os.Chtimes(name, later, later)
+	info, _ = os.Stat(name)
+	changed, _ := cache.hash(name, info, HashSHA256)
+	if string(changed) == string(sum) {
+		t.Fatalf("stale hash returned for a modified file")
+	}
+}
+
+func TestContentComparison(t *testing.T) {
+	e, localDir, remoteDir := newTestEngine(t, LocalToRemote)
+	e.config.HashAlgorithm = HashXXH64
+	localFile, remoteFile := filepath.Join(localDir, "file.txt"), filepath.Join(remoteDir, "file.txt")
+	writeFile(t, localFile, "local")
+	writeFile(t, remoteFile, "other")
+	earlier := time.Now().Add(-time.Hour)
+	_ = os.Chtimes(remoteFile, earlier, earlier)
+
+	// Files of the same size but different content are transferred.
+	err := e.InitialSync()
+	if err != nil {
+		t.Fatalf("InitialSync returned an error: %v", err)
+	}
+	if got := readFile(t, remoteFile); got != "local" {
+		t.Fatalf("remote file = %q, want %q", got, "local")
+	}
+
+	// Touching a file does not transfer it again.
+	earlier = earlier.Add(time.Minute)
+	_ = os.Chtimes(remoteFile, earlier, earlier)
+	later := time.Now().Add(time.Minute)
+	_ = os.Chtimes(localFile, later, later)
+	e.process(worker.Task{EventType: fsnotify.Write, Name: localFile})
+	info, err := os.Stat(remoteFile)
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+	if !info.ModTime().Equal(earlier) {
+		t.Fatalf("touched file was transferred")
+	}
+}
+
+// countingWriter counts the bytes written to it.
+type countingWriter struct {
+	*os.File
+	written int
+}
+
+func (w *countingWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.written += len(p)
+	return w.File.WriteAt(p, off)
+}
+
+func TestDeltaCopy(t *testing.T) {
+	insert := func(b []byte) []byte { return append(b[:3000:3000], append([]byte("0123456789"), b[3000:]...)...) }
+	tests := []struct {
+		name   string
+		size   int
+		change func([]byte) []byte
+		// wantFixed is written when blocks are compared at the same offsets, wantRolling when they are looked up
+		// with their rolling checksums.
+		wantFixed, wantRolling int
+	}{
+		{"ChangedByte", 10000, func(b []byte) []byte { b[5000] ^= 0xff; return b }, 1024, 1024},
+		{"Appended", 10000, func(b []byte) []byte { return append(b, "tail"...) }, 10004 - 9*1024, 10004 - 9*1024},
+		{"Truncated", 10000, func(b []byte) []byte { return b[:6000] }, 6000 - 5*1024, 0},
+		{"Inserted", 10000, insert, 10010 - 2*1024, 1024},
+		{"Deleted", 10000, func(b []byte) []byte { return append(b[:3000], b[3010:]...) }, 9990 - 2*1024, 1024},
+		{"Swapped", 4096, func(b []byte) []byte {
+			return append(append(append([]byte(nil), b[1024:2048]...), b[:1024]...), b[2048:]...)
+		}, 2048, 1024},
+	}
+	rng := rand.New(rand.NewSource(1))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, localDir, remoteDir := newTestEngine(t, LocalToRemote)
+			e.config.DeltaThreshold = 1
+			e.config.DeltaBlockSize = 1024
+			localFile, remoteFile := filepath.Join(localDir, "file.bin"), filepath.Join(remoteDir, "file.bin")
+			content := make([]byte, tt.size)
+			rng.Read(content)
+			changed := tt.change(append([]byte(nil), content...))
+			writeFile(t, localFile, string(changed))
+			info, err := os.Stat(localFile)
+			if err != nil {
+				t.Fatalf("Failed to stat file: %v", err)
+			}
+
+			for _, rolling := range []bool{false, true} {
+				writeFile(t, remoteFile, string(content))
+				src, _ := os.Open(localFile)
+				dst, _ := os.OpenFile(remoteFile, os.O_RDWR, 0)
+				w := &countingWriter{File: dst}
+				var ops []deltaOp
+				want := tt.wantFixed
+				if rolling {
+					want = tt.wantRolling
+					var sigs []BlockSignature
+					_, sigs, err = e.blockSignatures(e.local, "file.bin", info.Size(), 1024, HashSHA256)
+					if err == nil {
+						ops, err = rollingOps(dst, int64(tt.size), info.Size(), 1024, HashSHA256, sigs)
+					}
+				} else {
+					ops, err = e.fixedOps(e.local, e.remote, "file.bin", info.Size(), int64(tt.size), 1024)
+				}
+				var written int64
+				if err == nil {
+					written, err = applyDelta(src, w, ops)
+				}
+				if err == nil {
+					err = dst.Truncate(info.Size())
+				}
+				_ = src.Close()
+				_ = dst.Close()
+				if err != nil {
+					t.Fatalf("delta (rolling %v) returned an error: %v", rolling, err)
+				}
+				if written != int64(want) {
+					t.Errorf("delta (rolling %v) transferred %d bytes, want %d", rolling, written, want)
+				}
+				if got := readFile(t, remoteFile); got != string(changed) {
+					t.Errorf("remote file differs from the local one (rolling %v)", rolling)
+				}
+			}
+
+			// The engine transfers the file as a delta as well, looking blocks up since the remote side is local.
+			writeFile(t, remoteFile, string(content))
+			err = e.transfer(e.local, e.remote, "file.bin", info)
+			if err != nil {
+				t.Fatalf("transfer returned an error: %v", err)
+			}
+			if got := readFile(t, remoteFile); got != string(changed) {
+				t.Errorf("remote file differs from the local one after transfer")
+			}
+			if got := e.Stats().BytesUploaded; got != int64(tt.wantRolling) {
+				t.Errorf("transfer uploaded %d bytes, want %d", got, tt.wantRolling)
+			}
+		})
+	}
+}
+
+func TestRollingSum(t *testing.T) {
+	data := make([]byte, 300)
+	rand.New(rand.NewSource(2)).Read(data)
+	sum := weakSum(data[:64])
+	for i := 64; i < len(data); i++ {
+		sum.roll(data[i-64], data[i])
+		if want := weakSum(data[i-63 : i+1]); sum != want {
+			t.Fatalf("rolled checksum at %d = %#x, want %#x", i-63, sum.value(), want.value())
+		}
+	}
+}
+
+// flakyBackend is a local backend whose first upload fails after failAfter bytes.
+type flakyBackend struct {
+	Local
+	failAfter int64
+	failed    bool
+	resumedAt int64
+}
+
+// failingWriter fails once n bytes were written to it.
+type failingWriter struct {
+	io.WriteCloser
+	n int64
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > w.n {
+		n, _ := w.WriteCloser.Write(p[:w.n])
+		w.n = 0
+		return n, errors.New("connection lost")
+	}
+	w.n -= int64(len(p))
+	return w.WriteCloser.Write(p)
+}
+
+func (b *flakyBackend) Create(path string) (io.WriteCloser, error) {
+	w, err := b.Local.Create(path)
+	if err != nil || b.failed {
+		return w, err
+	}
+	b.failed = true
+	return &failingWriter{WriteCloser: w, n: b.failAfter}, nil
+}
+
+func (b *flakyBackend) Append(path string, offset int64) (io.WriteCloser, error) {
+	b.resumedAt = offset
+	return b.Local.Append(path, offset)
+}
+
+func TestTransferResumes(t *testing.T) {
+	localDir, remoteDir := t.TempDir(), t.TempDir()
+	remote := &flakyBackend{failAfter: 4000}
+	e, err := New(Local{}, remote, worker.NewWorkerPool(1), Config{
+		Direction:   LocalToRemote,
+		LocalDir:    localDir,
+		RemoteDir:   remoteDir,
+		MaxRetries:  2,
+		RetryPolicy: RetryPolicy{InitialDelay: time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("New returned an error: %v", err)
+	}
+	e.remote.native = true
+
+	content := strings.Repeat("0123456789", 1000)
+	writeFile(t, filepath.Join(localDir, "file.txt"), content)
+	info, err := os.Stat(filepath.Join(localDir, "file.txt"))
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+	err = e.transfer(e.local, e.remote, "file.txt", info)
+	if err != nil {
+		t.Fatalf("transfer returned an error: %v", err)
+	}
+	if remote.resumedAt != 4000 {
+		t.Errorf("transfer resumed at %d, want 4000", remote.resumedAt)
+	}
+	if got := readFile(t, filepath.Join(remoteDir, "file.txt")); got != content {
+		t.Errorf("resumed file differs from the source")
+	}
+}
+
+func TestAtomicTransfer(t *testing.T) {
+	localDir, remoteDir := t.TempDir(), t.TempDir()
+	remote := &flakyBackend{failAfter: 10}
+	e, err := New(Local{}, remote, worker.NewWorkerPool(1), Config{
+		Direction:   LocalToRemote,
+		LocalDir:    localDir,
+		RemoteDir:   remoteDir,
+		Atomic:      true,
+		RetryPolicy: RetryPolicy{MaxAttempts: 1},
+	})
+	if err != nil {
+		t.Fatalf("New returned an error: %v", err)
+	}
+	e.remote.native = true
+
+	writeFile(t, filepath.Join(remoteDir, "sub", ".crashed.txt.syncpkg-tmp"), "leftover")
+	writeFile(t, filepath.Join(localDir, "file.txt"), strings.Repeat("x", 100))
+	err = e.InitialSync()
+	if err == nil {
+		t.Fatalf("InitialSync did not report the failed upload")
+	}
+	if _, err := os.Stat(filepath.Join(remoteDir, "sub", ".crashed.txt.syncpkg-tmp")); !os.IsNotExist(err) {
+		t.Errorf("leftover temporary file was not removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(remoteDir, "file.txt")); !os.IsNotExist(err) {
+		t.Errorf("partial upload is visible under the final name: %v", err)
+	}
+
+	err = e.InitialSync()
+	if err != nil {
+		t.Fatalf("InitialSync returned an error: %v", err)
+	}
+	if got := readFile(t, filepath.Join(remoteDir, "file.txt")); got != strings.Repeat("x", 100) {
+		t.Errorf("file.txt = %q", got)
+	}
+	entries, _ := os.ReadDir(remoteDir)
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".syncpkg-tmp") {
+			t.Errorf("temporary file %s was left behind", entry.Name())
+		}
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	e, localDir, remoteDir := newTestEngine(t, Bidirectional)
+	e.config.PollInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := e.Start(ctx)
+	if err != nil {
+		t.Fatalf("Start returned an error: %v", err)
+	}
+	if err := e.Start(ctx); !errors.Is(err, ErrStarted) {
+		t.Fatalf("second Start returned %v, want ErrStarted", err)
+	}
+
+	writeFile(t, filepath.Join(remoteDir, "file.txt"), "remote")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(filepath.Join(localDir, "file.txt")); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("file.txt was not synced while the engine was running")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	err = e.Wait()
+	if err != nil {
+		t.Fatalf("Wait returned an error: %v", err)
+	}
+	e.Stop()
+}
+
+func TestStartReturnsErrors(t *testing.T) {
+	e := newTestEngineWithConfig(t, Config{
+		Direction: LocalToRemote,
+		LocalDir:  filepath.Join(t.TempDir(), "missing"),
+		RemoteDir: t.TempDir(),
+	})
+	err := e.Start(context.Background())
+	if err == nil {
+		t.Fatalf("Start did not report the missing local directory")
+	}
+	if err := e.Wait(); err == nil {
+		t.Fatalf("Wait did not report the error that stopped the engine")
+	}
+}
+
+func TestEvents(t *testing.T) {
+	var mu sync.Mutex
+	var events []SyncEvent
+	e, localDir, remoteDir := newTestEngine(t, Bidirectional)
+	e.config.Observer = ObserverFunc(func(event SyncEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	})
+	writeFile(t, filepath.Join(localDir, "file.txt"), "content")
+	e.process(worker.Task{EventType: fsnotify.Create, Name: filepath.Join(localDir, "file.txt")})
+	err := os.Remove(filepath.Join(remoteDir, "file.txt"))
+	if err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+	e.process(worker.Task{EventType: fsnotify.Remove, Name: filepath.Join(remoteDir, "file.txt"), Remote: true})
+
+	want := []SyncEvent{
+		{Type: TransferStarted, Path: "file.txt", Direction: LocalToRemote, Size: 7},
+		{Type: TransferCompleted, Path: "file.txt", Direction: LocalToRemote, Size: 7, Bytes: 7},
+		{Type: Deleted, Path: "file.txt", Direction: RemoteToLocal},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events, want %d: %+v", len(events), len(want), events)
+	}
+	for i, event := range events {
+		got := SyncEvent{Type: event.Type, Path: event.Path, Direction: event.Direction, Size: event.Size, Bytes: event.Bytes}
+		if got != want[i] {
+			t.Errorf("event %d = %+v, want %+v", i, got, want[i])
+		}
+		if event.Time.IsZero() {
+			t.Errorf("event %d has no time", i)
+		}
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	stream := NewEventStream(1)
+	stream.OnEvent(SyncEvent{Type: TransferStarted})
+	stream.OnEvent(SyncEvent{Type: TransferCompleted})
+	stream.Close()
+	stream.OnEvent(SyncEvent{Type: TransferFailed})
+
+	var got []EventType
+	for event := range stream.Events() {
+		got = append(got, event.Type)
+	}
+	if len(got) != 1 || got[0] != TransferStarted {
+		t.Fatalf("stream delivered %v, want only the events that fit", got)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var buf strings.Builder
+	e, localDir, _ := newTestEngine(t, LocalToRemote)
+	e.log = slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey || a.Key == "duration" {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+	writeFile(t, filepath.Join(localDir, "file.txt"), "content")
+	e.process(worker.Task{EventType: fsnotify.Create, Name: filepath.Join(localDir, "file.txt")})
+
+	want := `level=INFO msg="transferred file" op=transfer path=file.txt`
+	if !strings.Contains(buf.String(), want) || !strings.Contains(buf.String(), "attempt=1 bytes=7") {
+		t.Fatalf("log = %q, want a record containing %q", buf.String(), want)
+	}
+}
+
+func TestLoggerDefaultsToQuiet(t *testing.T) {
+	e, err := New(Local{}, Local{}, worker.NewWorkerPool(1), Config{LocalDir: t.TempDir(), RemoteDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if e.log.Enabled(context.Background(), slog.LevelError) {
+		t.Fatal("the default logger is enabled")
+	}
+	if e.log != DiscardLogger {
+		t.Error("the engine built a discarding logger of its own instead of using DiscardLogger")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	e, localDir, remoteDir := newTestEngine(t, Bidirectional)
+	writeFile(t, filepath.Join(localDir, "file.txt"), "content")
+	e.process(worker.Task{EventType: fsnotify.Create, Name: filepath.Join(localDir, "file.txt")})
+	err := os.Remove(filepath.Join(remoteDir, "file.txt"))
+	if err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+	e.process(worker.Task{EventType: fsnotify.Remove, Name: filepath.Join(remoteDir, "file.txt"), Remote: true})
+
+	stats := e.Stats()
+	if stats.Uploaded != 1 || stats.BytesUploaded != 7 || stats.Deleted != 1 || stats.Downloaded != 0 {
+		t.Errorf("Stats() = %+v, want one upload of 7 bytes and one deletion", stats)
+	}
+	if stats.TransferLatency.Count != 1 {
+		t.Errorf("TransferLatency.Count = %d, want 1", stats.TransferLatency.Count)
+	}
+
+	recorder := httptest.NewRecorder()
+	e.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	for _, want := range []string{
+		"# TYPE syncpkg_files_total counter\n",
+		`syncpkg_files_total{op="upload"} 1` + "\n",
+		`syncpkg_bytes_total{op="upload"} 7` + "\n",
+		`syncpkg_failures_total{op="poll"} 0` + "\n",
+		"syncpkg_queue_depth 0\n",
+		`syncpkg_transfer_duration_seconds_bucket{le="+Inf"} 1` + "\n",
+		"syncpkg_transfer_duration_seconds_count 1\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics do not contain %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestIgnore(t *testing.T) {
+	localDir, remoteDir := t.TempDir(), t.TempDir()
+	e := newTestEngineWithConfig(t, Config{
+		Direction: LocalToRemote,
+		LocalDir:  localDir,
+		RemoteDir: remoteDir,
+		Exclude:   []string{"*.tmp"},
+		Include:   []string{"keep.tmp"},
+	})
+	writeFile(t, filepath.Join(localDir, ".syncignore"), "*.log\nbuild/\n")
+	writeFile(t, filepath.Join(localDir, "file.txt"), "content")
+	writeFile(t, filepath.Join(localDir, "debug.log"), "log")
+	writeFile(t, filepath.Join(localDir, ".file.txt.swp"), "swap")
+	writeFile(t, filepath.Join(localDir, "a.tmp"), "tmp")
+	writeFile(t, filepath.Join(localDir, "keep.tmp"), "tmp")
+	writeFile(t, filepath.Join(localDir, "build", "out.bin"), "bin")
+	writeFile(t, filepath.Join(localDir, "sub", ".syncignore"), "!*.log\n")
+	writeFile(t, filepath.Join(localDir, "sub", "kept.log"), "log")
+
+	err := e.InitialSync()
+	if err != nil {
+		t.Fatalf("InitialSync returned an error: %v", err)
+	}
+	for _, rel := range []string{".syncignore", "file.txt", "keep.tmp", "sub/kept.log"} {
+		if _, err := os.Stat(filepath.Join(remoteDir, rel)); err != nil {
+			t.Errorf("%s was not synced: %v", rel, err)
+		}
+	}
+	for _, rel := range []string{"debug.log", ".file.txt.swp", "a.tmp", "build"} {
+		if _, err := os.Stat(filepath.Join(remoteDir, rel)); err == nil {
+			t.Errorf("ignored %s was synced", rel)
+		}
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer watcher.Close()
+	err = e.addWatches(watcher, localDir)
+	if err != nil {
+		t.Fatalf("addWatches returned an error: %v", err)
+	}
+	for _, dir := range watcher.WatchList() {
+		if filepath.Base(dir) == "build" {
+			t.Errorf("ignored directory %s is watched", dir)
+		}
+	}
+
+	writeFile(t, filepath.Join(remoteDir, "remote.log"), "log")
+	files := make(map[string]os.FileInfo)
+	err = e.walkRemoteDir(remoteDir, files)
+	if err != nil {
+		t.Fatalf("walkRemoteDir returned an error: %v", err)
+	}
+	if _, ok := files[filepath.Join(remoteDir, "remote.log")]; ok {
+		t.Errorf("walkRemoteDir returned an ignored file")
+	}
+
+	// Changing a .syncignore file takes effect once its event is processed.
+	writeFile(t, filepath.Join(localDir, ".syncignore"), "build/\n")
+	e.process(worker.Task{EventType: fsnotify.Write, Name: filepath.Join(localDir, ".syncignore")})
+	e.process(worker.Task{EventType: fsnotify.Write, Name: filepath.Join(localDir, "debug.log")})
+	if _, err := os.Stat(filepath.Join(remoteDir, "debug.log")); err != nil {
+		t.Errorf("debug.log was not synced after it was no longer ignored: %v", err)
+	}
+}
+
+func TestQueuePaths(t *testing.T) {
+	var buf strings.Builder
+	e, localDir, remoteDir := newTestEngine(t, Bidirectional)
+	e.log = slog.New(slog.NewTextHandler(&buf, nil))
+	var mu sync.Mutex
+	var paths []string
+	err := e.Pool.Start(context.Background(), func(ctx context.Context, task worker.Task) error {
+		mu.Lock()
+		defer mu.Unlock()
+		paths = append(paths, task.Path)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Start returned an error: %v", err)
+	}
+	e.queue(
+		worker.Task{EventType: fsnotify.Create, Name: localDir},
+		worker.Task{EventType: fsnotify.Write, Name: filepath.Join(remoteDir, "dir", "file.txt"), Remote: true},
+		worker.Task{EventType: fsnotify.Write, Name: filepath.Join(t.TempDir(), "outside.txt")},
+	)
+	err = e.Pool.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("Shutdown returned an error: %v", err)
+	}
+
+	// The synced directory contains every other path, and a path outside of it is ordered by its name.
+	want := []string{".", "dir/file.txt", ""}
+	if strings.Join(paths, ",") != strings.Join(want, ",") {
+		t.Errorf("queued the paths %q, want %q", paths, want)
+	}
+	if !strings.Contains(buf.String(), "outside.txt") {
+		t.Errorf("log = %q, want a warning about the path outside of the synced directory", buf.String())
+	}
+}
+
+func TestCoalescer(t *testing.T) {
+	tests := []struct {
+		name    string
+		events  []fsnotify.Op
+		existed bool
+		want    fsnotify.Op
+	}{
+		{"create and writes", []fsnotify.Op{fsnotify.Create, fsnotify.Write, fsnotify.Chmod, fsnotify.Write}, false, fsnotify.Create},
+		{"writes", []fsnotify.Op{fsnotify.Write, fsnotify.Write}, false, fsnotify.Write},
+		{"create and remove", []fsnotify.Op{fsnotify.Create, fsnotify.Write, fsnotify.Remove}, false, 0},
+		{"write and remove", []fsnotify.Op{fsnotify.Write, fsnotify.Remove}, false, fsnotify.Remove},
+		{"rename over", []fsnotify.Op{fsnotify.Rename, fsnotify.Create}, false, fsnotify.Write},
+		// A file renamed over an existing one gets only a Create, removing it then removes the existing file.
+		{"rename over and remove", []fsnotify.Op{fsnotify.Create, fsnotify.Write, fsnotify.Remove}, true, fsnotify.Remove},
+		{"create over existing", []fsnotify.Op{fsnotify.Create, fsnotify.Write}, true, fsnotify.Create},
+		{"chmod", []fsnotify.Op{fsnotify.Chmod}, false, fsnotify.Chmod},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newCoalescer(func(name string) bool { return tt.existed })
+			now := time.Now()
+			for i, op := range tt.events {
+				c.add("file.txt", op, now.Add(time.Duration(i+1)*time.Second))
+			}
+			tasks, next := c.due(now)
+			if len(tasks) != 0 {
+				t.Fatalf("due returned %v before the quiet window elapsed", tasks)
+			}
+			if tt.want != 0 && next != time.Duration(len(tt.events))*time.Second {
+				t.Errorf("next = %v, want %v", next, time.Duration(len(tt.events))*time.Second)
+			}
+			tasks, _ = c.due(now.Add(time.Hour))
+			switch {
+			case tt.want == 0 && len(tasks) != 0:
+				t.Errorf("due returned %v, want nothing", tasks)
+			case tt.want != 0 && (len(tasks) != 1 || tasks[0].EventType != tt.want):
+				t.Errorf("due returned %v, want a single %v", tasks, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetry(t *testing.T) {
+	localDir, remoteDir := t.TempDir(), t.TempDir()
+	e := newTestEngineWithConfig(t, Config{
+		Direction:   LocalToRemote,
+		LocalDir:    localDir,
+		RemoteDir:   remoteDir,
+		RetryPolicy: RetryPolicy{MaxAttempts: 3, InitialDelay: time.Millisecond},
+	})
+
+	calls := 0
+	err := e.retry("test", "file.txt", func() error {
+		calls++
+		return errors.New("connection reset")
+	})
+	if err == nil || calls != 3 {
+		t.Errorf("transient error: retry returned %v after %d calls, want an error after 3", err, calls)
+	}
+	calls = 0
+	err = e.retry("test", "file.txt", func() error {
+		calls++
+		return fmt.Errorf("cannot open: %w", os.ErrPermission)
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("permanent error: retry returned %v after %d calls, want an error after 1", err, calls)
+	}
+	if stats := e.Stats(); stats.Retries != 2 {
+		t.Errorf("Stats().Retries = %d, want 2", stats.Retries)
+	}
+
+	policy := RetryPolicy{InitialDelay: time.Second, MaxDelay: 5 * time.Second}.withDefaults(0)
+	for attempt, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second} {
+		delay := policy.Delay(attempt + 1)
+		if delay < want*8/10 || delay > want*12/10 {
+			t.Errorf("Delay(%d) = %v, want %v with 20%% jitter", attempt+1, delay, want)
+		}
+	}
+	if policy.MaxAttempts != defaultMaxAttempts {
+		t.Errorf("MaxAttempts defaults to %d, want %d", policy.MaxAttempts, defaultMaxAttempts)
+	}
+}
+
+// droppingBackend is a local backend whose connection can be dropped. It fails to reconnect once before it succeeds.
+type droppingBackend struct {
+	Local
+	mu    sync.Mutex
+	down  bool
+	dials int
+}
+
+func (b *droppingBackend) Create(path string) (io.WriteCloser, error) {
+	err := b.Ping()
+	if err != nil {
+		return nil, err
+	}
+	return b.Local.Create(path)
+}
+
+func (b *droppingBackend) Ping() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.down {
+		return errors.New("connection lost")
+	}
+	return nil
+}
+
+func (b *droppingBackend) Reconnect() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dials++
+	if b.dials == 1 {
+		return errors.New("connection refused")
+	}
+	b.down = false
+	return nil
+}
+
+func TestReconnect(t *testing.T) {
+	localDir, remoteDir := t.TempDir(), t.TempDir()
+	remote := &droppingBackend{down: true}
+	var mu sync.Mutex
+	var events []EventType
+	e, err := New(Local{}, remote, worker.NewWorkerPool(1), Config{
+		Direction:   LocalToRemote,
+		LocalDir:    localDir,
+		RemoteDir:   remoteDir,
+		RetryPolicy: RetryPolicy{MaxAttempts: 1, InitialDelay: time.Millisecond},
+		Observer: ObserverFunc(func(event SyncEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, event.Type)
+		}),
+	})
+	if err != nil {
+		t.Fatalf("New returned an error: %v", err)
+	}
+	e.remote.native = true
+
+	writeFile(t, filepath.Join(localDir, "file.txt"), "content")
+	err = e.process(worker.Task{EventType: fsnotify.Create, Name: filepath.Join(localDir, "file.txt")})
+	if err != nil {
+		t.Fatalf("the transfer interrupted by the dropped connection was not replayed: %v", err)
+	}
+	if got := readFile(t, filepath.Join(remoteDir, "file.txt")); got != "content" {
+		t.Errorf("remote file = %q, want %q", got, "content")
+	}
+	if remote.dials != 2 {
+		t.Errorf("dialed %d times, want 2", remote.dials)
+	}
+	want := []EventType{TransferStarted, Reconnecting, Reconnected, TransferCompleted}
+	if fmt.Sprint(events) != fmt.Sprint(want) {
+		t.Errorf("events = %v, want %v", events, want)
+	}
+	if stats := e.Stats(); stats.Reconnects != 1 || stats.Retries != 0 {
+		t.Errorf("Stats() reports %d reconnects and %d retries, want 1 and 0", stats.Reconnects, stats.Retries)
+	}
+}
+
+// coarseBackend is a local backend that gives modification times to the minute, like an FTP server that only lists
+// its files with LIST.
+type coarseBackend struct {
+	Local
+	uploads int
+	//unreachable makes Granularity fail, as it does when the server is down
+	unreachable bool
+}
+
+// coarseInfo is the os.FileInfo of a file whose modification time is truncated to the minute.
+type coarseInfo struct {
+	os.FileInfo
+}
+
+func (i coarseInfo) ModTime() time.Time { return i.FileInfo.ModTime().Truncate(time.Minute) }
+
+func (b *coarseBackend) List(dir string) ([]os.FileInfo, error) {
+	infos, err := b.Local.List(dir)
+	for i, info := range infos {
+		infos[i] = coarseInfo{info}
+	}
+	return infos, err
+}
+
+func (b *coarseBackend) Stat(path string) (os.FileInfo, error) {
+	info, err := b.Local.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return coarseInfo{info}, nil
+}
+
+func (b *coarseBackend) Create(path string) (io.WriteCloser, error) {
+	b.uploads++
+	return b.Local.Create(path)
+}
+
+func (b *coarseBackend) Granularity() (time.Duration, error) {
+	if b.unreachable {
+		return 0, errors.New("connection refused")
+	}
+	return time.Minute, nil
+}
+
+func TestGranularity(t *testing.T) {
+	localDir, remoteDir := t.TempDir(), t.TempDir()
+	remote := &coarseBackend{}
+	e, err := New(Local{}, remote, worker.NewWorkerPool(1), Config{
+		Direction: Bidirectional,
+		LocalDir:  localDir,
+		RemoteDir: remoteDir,
+	})
+	if err != nil {
+		t.Fatalf("New returned an error: %v", err)
+	}
+	e.remote.native = true
+
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Minute).Add(27 * time.Second)
+	for _, dir := range []string{localDir, remoteDir} {
+		name := filepath.Join(dir, "file.txt")
+		writeFile(t, name, "content")
+		err = os.Chtimes(name, mtime, mtime)
+		if err != nil {
+			t.Fatalf("Failed to set the modification time: %v", err)
+		}
+	}
+	err = e.InitialSync()
+	if err != nil {
+		t.Fatalf("InitialSync returned an error: %v", err)
+	}
+	if remote.uploads != 0 {
+		t.Errorf("the file was uploaded %d times, want 0 since both copies are the same to the minute", remote.uploads)
+	}
+	info, err := os.Stat(filepath.Join(localDir, "file.txt"))
+	if err != nil || !info.ModTime().Equal(mtime) {
+		t.Errorf("the local file was replaced by the remote one")
+	}
+}
+
+func TestGranularityUnreachable(t *testing.T) {
+	remote := &coarseBackend{unreachable: true}
+	e, err := New(Local{}, remote, worker.NewWorkerPool(1), Config{
+		Direction: Bidirectional,
+		LocalDir:  t.TempDir(),
+		RemoteDir: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("New returned an error: %v", err)
+	}
+	if p := e.remote.precision(); p != time.Second {
+		t.Errorf("precision = %s while the granularity is unknown, want %s", p, time.Second)
+	}
+	remote.unreachable = false
+	if p := e.remote.precision(); p != time.Minute {
+		t.Errorf("precision = %s once the server is back, want %s", p, time.Minute)
+	}
+}
+
+// fastBackend is a local backend whose files, like SFTP files, copy themselves with WriteTo and ReadFrom, which
+// record how they were called.
+type fastBackend struct {
+	Local
+	mu sync.Mutex
+	//readFromSize is the size the reader passed to ReadFrom reported, -1 if it reported none
+	readFromSize int64
+	//wroteTo counts the calls of WriteTo
+	wroteTo int
+}
+
+// fastFile is a file of fastBackend.
+type fastFile struct {
+	*os.File
+	b *fastBackend
+}
+
+func (f *fastFile) ReadFrom(r io.Reader) (int64, error) {
+	f.b.mu.Lock()
+	f.b.readFromSize = -1
+	if sized, ok := r.(interface{ Size() int64 }); ok {
+		f.b.readFromSize = sized.Size()
+	}
+	f.b.mu.Unlock()
+	return io.Copy(struct{ io.Writer }{f.File}, r)
+}
+
+func (f *fastFile) WriteTo(w io.Writer) (int64, error) {
+	f.b.mu.Lock()
+	f.b.wroteTo++
+	f.b.mu.Unlock()
+	return io.Copy(w, struct{ io.Reader }{f.File})
+}
+
+func (b *fastBackend) Open(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &fastFile{File: f, b: b}, nil
+}
+
+func (b *fastBackend) Create(path string) (io.WriteCloser, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &fastFile{File: f, b: b}, nil
+}
+
+func TestCopyFileFastPaths(t *testing.T) {
+	localDir, remoteDir := t.TempDir(), t.TempDir()
+	remote := &fastBackend{}
+	e, err := New(Local{}, remote, worker.NewWorkerPool(1), Config{
+		Direction: Bidirectional,
+		LocalDir:  localDir,
+		RemoteDir: remoteDir,
+		// An observer makes the engine count the bytes of every copy.
+		Observer: ObserverFunc(func(event SyncEvent) {}),
+	})
+	if err != nil {
+		t.Fatalf("New returned an error: %v", err)
+	}
+	e.remote.native = true
+	content := strings.Repeat("0123456789", 10000)
+
+	writeFile(t, filepath.Join(localDir, "up.bin"), content)
+	info, err := os.Stat(filepath.Join(localDir, "up.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = e.copyFile(e.local, e.remote, "up.bin", info, 0)
+	if err != nil {
+		t.Fatalf("copyFile returned an error: %v", err)
+	}
+	if remote.readFromSize != info.Size() {
+		t.Errorf("the upload passed a reader of size %d to ReadFrom, want %d", remote.readFromSize, info.Size())
+	}
+	if got := readFile(t, filepath.Join(remoteDir, "up.bin")); got != content {
+		t.Errorf("the uploaded file differs from the local one")
+	}
+
+	writeFile(t, filepath.Join(remoteDir, "down.bin"), content)
+	info, err = os.Stat(filepath.Join(remoteDir, "down.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = e.copyFile(e.remote, e.local, "down.bin", info, 0)
+	if err != nil {
+		t.Fatalf("copyFile returned an error: %v", err)
+	}
+	if remote.wroteTo != 1 {
+		t.Errorf("the download called WriteTo %d times, want 1", remote.wroteTo)
+	}
+	if got := readFile(t, filepath.Join(localDir, "down.bin")); got != content {
+		t.Errorf("the downloaded file differs from the remote one")
+	}
+}
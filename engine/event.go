@@ -0,0 +1,228 @@
+package engine
+
+import (
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// EventType is the kind of a SyncEvent.
+type EventType int
+
+const (
+	//TransferStarted is emitted before a file is copied
+	TransferStarted EventType = iota + 1
+	//TransferProgress is emitted while a file is copied, at most every progressInterval
+	TransferProgress
+	//TransferCompleted is emitted once a file was copied
+	TransferCompleted
+	//TransferFailed is emitted when a file could not be copied after all the attempts
+	TransferFailed
+	//Deleted is emitted once a file or directory was removed after it was removed on the other side
+	Deleted
+	//ConflictDetected is emitted when a file changed on both sides of a Bidirectional sync
+	ConflictDetected
+	//Reconnected is emitted when the connection to the server was re-established
+	Reconnected
+	//InitialSyncDone is emitted once the initial synchronization finished
+	InitialSyncDone
+	//Reconnecting is emitted when the connection to the server was found dead, before it is re-established
+	Reconnecting
+)
+
+// String returns the name of the event type.
+func (t EventType) String() string {
+	switch t {
+	case TransferStarted:
+		return "TransferStarted"
+	case TransferProgress:
+		return "TransferProgress"
+	case TransferCompleted:
+		return "TransferCompleted"
+	case TransferFailed:
+		return "TransferFailed"
+	case Deleted:
+		return "Deleted"
+	case ConflictDetected:
+		return "ConflictDetected"
+	case Reconnected:
+		return "Reconnected"
+	case InitialSyncDone:
+		return "InitialSyncDone"
+	case Reconnecting:
+		return "Reconnecting"
+	}
+	return "EventType(" + strconv.Itoa(int(t)) + ")"
+}
+
+// SyncEvent describes something the engine did.
+type SyncEvent struct {
+	//Type is the kind of the event
+	Type EventType
+	//Path is the slash separated path of the file relative to the synced directories. It is empty for the events
+	//that do not concern a single file.
+	Path string
+	//Direction is the direction the change was applied in, LocalToRemote or RemoteToLocal
+	Direction SyncDirection
+	//Size is the size of the file
+	Size int64
+	//Bytes is the number of bytes copied so far by a transfer
+	Bytes int64
+	//Duration is the time the operation took so far
+	Duration time.Duration
+	//Err is the error of a TransferFailed event, or the error the connection was found dead with of a Reconnecting
+	//event
+	Err error
+	//Time is the time the event was emitted at
+	Time time.Time
+}
+
+// Observer receives the events of the engine. OnEvent is called synchronously by the goroutine that did the work,
+// possibly by several of them at a time, so it must be safe for concurrent use and return quickly.
+type Observer interface {
+	OnEvent(event SyncEvent)
+}
+
+// ObserverFunc is an Observer implemented by a function.
+type ObserverFunc func(event SyncEvent)
+
+// OnEvent calls f(event).
+func (f ObserverFunc) OnEvent(event SyncEvent) {
+	f(event)
+}
+
+// EventStream is an Observer that delivers the events on a channel. Events are dropped while the channel is full,
+// so that a slow reader never stalls the sync. Use an Observer to receive every event.
+type EventStream struct {
+	//mu guards closed
+	mu sync.Mutex
+	//events is the channel the events are delivered on
+	events chan SyncEvent
+	//closed reports whether events was closed
+	closed bool
+}
+
+// NewEventStream returns an EventStream whose channel buffers size events.
+func NewEventStream(size int) *EventStream {
+	return &EventStream{events: make(chan SyncEvent, size)}
+}
+
+// OnEvent delivers event on the channel, unless it is full or closed.
+func (s *EventStream) OnEvent(event SyncEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.events <- event:
+	default:
+	}
+}
+
+// Events returns the channel the events are delivered on. It is closed by Close.
+func (s *EventStream) Events() <-chan SyncEvent {
+	return s.events
+}
+
+// Close closes the channel of the stream. Later events are dropped.
+func (s *EventStream) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.events)
+	}
+}
+
+// progressInterval is the minimum time between two TransferProgress events of the same transfer.
+const progressInterval = 500 * time.Millisecond
+
+// emit sends event to the observer of the engine, if any.
+func (e *Engine) emit(event SyncEvent) {
+	if e.config.Observer == nil {
+		return
+	}
+	event.Time = time.Now()
+	e.config.Observer.OnEvent(event)
+}
+
+// directionTo returns the direction of the changes applied to dst.
+func directionTo(dst endpoint) SyncDirection {
+	if dst.remote {
+		return LocalToRemote
+	}
+	return RemoteToLocal
+}
+
+// progress emits the TransferProgress events of a transfer.
+type progress struct {
+	e *Engine
+	//mu guards the fields below, since the copies that run several requests at once report from several goroutines
+	mu    sync.Mutex
+	event SyncEvent
+	start time.Time
+	last  time.Time
+}
+
+// add counts n more bytes copied and emits a TransferProgress event if the last one is older than progressInterval.
+func (p *progress) add(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.event.Bytes += int64(n)
+	if now := time.Now(); now.Sub(p.last) >= progressInterval {
+		p.last = now
+		p.event.Duration = now.Sub(p.start)
+		p.e.emit(p.event)
+	}
+}
+
+// progressReader reports the bytes read through it to progress.
+type progressReader struct {
+	io.Reader
+	progress *progress
+	//size is the number of bytes the copy reads
+	size int64
+}
+
+// Read reads into p and reports the bytes read.
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.progress.add(n)
+	return n, err
+}
+
+// Size returns the number of bytes the copy reads, which an SFTP upload needs to send several write requests at
+// once.
+func (r *progressReader) Size() int64 {
+	return r.size
+}
+
+// progressWriter reports the bytes written through it to progress.
+type progressWriter struct {
+	io.Writer
+	progress *progress
+}
+
+// Write writes p and reports the bytes written.
+func (w *progressWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.progress.add(n)
+	return n, err
+}
+
+// copyProgress copies r, which holds size bytes, to w like io.Copy and reports the progress to p. Counting the bytes
+// must not hide the fast paths io.Copy finds on r and w, such as the SFTP files that send several requests at once: a
+// remote reader that can write itself to w writes to a counting writer, and a writer that can read from r reads
+// from a counting reader that tells its size.
+func copyProgress(w io.Writer, r io.Reader, srcRemote bool, size int64, p *progress) (int64, error) {
+	if wt, ok := r.(io.WriterTo); ok && srcRemote {
+		return wt.WriteTo(&progressWriter{Writer: w, progress: p})
+	}
+	reader := &progressReader{Reader: r, progress: p, size: size}
+	if rf, ok := w.(io.ReaderFrom); ok {
+		return rf.ReadFrom(reader)
+	}
+	return io.Copy(w, reader)
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package engine
+
+import "os"
+
+// fileID reports that files cannot be identified by inode on this platform.
+func fileID(info os.FileInfo) (dev, ino uint64, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,247 @@
+package engine
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// HashAlgorithm is the algorithm used to compare the content of files.
+type HashAlgorithm int
+
+const (
+	//HashNone disables content comparison. Files are compared by size and modification time only.
+	HashNone HashAlgorithm = iota
+	//HashSHA256 compares files by their SHA-256 hash
+	HashSHA256
+	//HashXXH64 compares files by their xxHash (XXH64) hash, which is much faster to compute locally.
+	//Servers can rarely compute it, so SHA-256 or MD5 is used for remote files when needed.
+	HashXXH64
+	//HashMD5 is only used to compare local files with remote ones on servers that offer nothing better
+	HashMD5
+)
+
+// String returns the name of the algorithm, as used by the check-file SFTP extension.
+func (a HashAlgorithm) String() string {
+	switch a {
+	case HashNone:
+		return "none"
+	case HashSHA256:
+		return "sha256"
+	case HashXXH64:
+		return "xxh64"
+	case HashMD5:
+		return "md5"
+	}
+	return "HashAlgorithm(" + strconv.Itoa(int(a)) + ")"
+}
+
+// New returns a new hash.Hash computing the algorithm, or nil for HashNone.
+func (a HashAlgorithm) New() hash.Hash {
+	switch a {
+	case HashSHA256:
+		return sha256.New()
+	case HashXXH64:
+		return xxhash.New()
+	case HashMD5:
+		return md5.New()
+	}
+	return nil
+}
+
+// ErrHashUnsupported is returned by a Hasher that cannot hash a file with any of the requested algorithms.
+var ErrHashUnsupported = errors.New("hash algorithm not supported")
+
+// Hasher is implemented by backends that can hash a file on the server without transferring it.
+type Hasher interface {
+	// Hash returns the hash of path computed with the first of algorithms the server supports,
+	// along with the algorithm that was used. It returns ErrHashUnsupported if none is supported.
+	Hash(path string, algorithms ...HashAlgorithm) (HashAlgorithm, []byte, error)
+}
+
+// hashReader returns the hash of the content read from r.
+func hashReader(r io.Reader, algorithm HashAlgorithm) ([]byte, error) {
+	h := algorithm.New()
+	if h == nil {
+		return nil, ErrHashUnsupported
+	}
+	_, err := io.Copy(h, r)
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// formatHash returns the hash in the form it is recorded in the state file, for example "sha256:9f86d0...".
+func formatHash(algorithm HashAlgorithm, sum []byte) string {
+	return algorithm.String() + ":" + hex.EncodeToString(sum)
+}
+
+// cacheKey identifies a file in the hash cache. Files are identified by device and inode where the platform
+// offers them, so that a renamed file keeps its cached hash, and by path otherwise.
+type cacheKey struct {
+	dev, ino  uint64
+	path      string
+	algorithm HashAlgorithm
+}
+
+// cacheEntry is a cached hash, valid as long as the size and modification time of the file do not change.
+type cacheEntry struct {
+	size    int64
+	modTime time.Time
+	sum     []byte
+}
+
+// hashCache caches the hashes of local files.
+type hashCache struct {
+	mu      sync.Mutex
+	entries map[cacheKey]cacheEntry
+}
+
+// hash returns the hash of the local file name described by info, computing it only if it is not cached.
+func (c *hashCache) hash(name string, info os.FileInfo, algorithm HashAlgorithm) ([]byte, error) {
+	key := cacheKey{path: name, algorithm: algorithm}
+	if dev, ino, ok := fileID(info); ok {
+		key = cacheKey{dev: dev, ino: ino, algorithm: algorithm}
+	}
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+		return entry.sum, nil
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+	sum, err := hashReader(f, algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[cacheKey]cacheEntry)
+	}
+	c.entries[key] = cacheEntry{size: info.Size(), modTime: info.ModTime(), sum: sum}
+	return sum, nil
+}
+
+// algorithms returns the algorithms to ask a remote Hasher for, in order of preference.
+func (e *Engine) algorithms() []HashAlgorithm {
+	algorithms := []HashAlgorithm{HashSHA256, HashMD5}
+	if e.config.HashAlgorithm != HashNone && e.config.HashAlgorithm != HashSHA256 {
+		algorithms = append([]HashAlgorithm{e.config.HashAlgorithm}, algorithms...)
+	}
+	return algorithms
+}
+
+// recordAlgorithm returns the algorithm of the hashes recorded in the state file.
+func (e *Engine) recordAlgorithm() HashAlgorithm {
+	if e.config.HashAlgorithm == HashNone || e.config.HashAlgorithm == HashMD5 {
+		return HashSHA256
+	}
+	return e.config.HashAlgorithm
+}
+
+// hashOf returns the hash of the file rel on p computed with the first of algorithms p supports.
+// Local files are hashed through the cache, remote files through the Hasher of the backend.
+func (e *Engine) hashOf(p endpoint, rel string, info os.FileInfo, algorithms ...HashAlgorithm) (HashAlgorithm, []byte, error) {
+	if _, ok := p.Backend.(Local); ok {
+		sum, err := e.hashes.hash(p.abs(rel), info, algorithms[0])
+		return algorithms[0], sum, err
+	}
+	hasher, ok := p.Backend.(Hasher)
+	if !ok {
+		return HashNone, nil, ErrHashUnsupported
+	}
+	return hasher.Hash(p.abs(rel), algorithms...)
+}
+
+// sameContent reports whether the copies of rel on a and b, described by aInfo and bInfo, have the same content.
+// The result is only meaningful if ok is true, which requires content comparison to be enabled and both sides
+// to be able to hash the file.
+func (e *Engine) sameContent(a, b endpoint, rel string, aInfo, bInfo os.FileInfo) (same, ok bool) {
+	if e.config.HashAlgorithm == HashNone {
+		return false, false
+	}
+	return e.compareContent(a, b, rel, aInfo, bInfo)
+}
+
+// compareContent is sameContent regardless of whether content comparison is enabled.
+func (e *Engine) compareContent(a, b endpoint, rel string, aInfo, bInfo os.FileInfo) (same, ok bool) {
+	if aInfo.Size() != bInfo.Size() {
+		return false, true
+	}
+	// Hash the remote copy first, since the local one can be hashed with whatever algorithm the server used.
+	if !b.remote {
+		a, b = b, a
+		aInfo, bInfo = bInfo, aInfo
+	}
+	algorithm, bSum, err := e.hashOf(b, rel, bInfo, e.algorithms()...)
+	if err != nil {
+		if !errors.Is(err, ErrHashUnsupported) {
+			e.log.Warn("cannot hash file", "op", "hash", "path", rel, "error", err)
+		}
+		return false, false
+	}
+	_, aSum, err := e.hashOf(a, rel, aInfo, algorithm)
+	if err != nil {
+		if !errors.Is(err, ErrHashUnsupported) {
+			e.log.Warn("cannot hash file", "op", "hash", "path", rel, "error", err)
+		}
+		return false, false
+	}
+	return string(aSum) == string(bSum), true
+}
+
+// recordHash returns the recorded form of the hash of the local copy of rel.
+func (e *Engine) recordHash(rel string, info os.FileInfo) (string, error) {
+	algorithm := e.recordAlgorithm()
+	if _, ok := e.local.Backend.(Local); ok {
+		sum, err := e.hashes.hash(e.local.abs(rel), info, algorithm)
+		if err != nil {
+			return "", err
+		}
+		return formatHash(algorithm, sum), nil
+	}
+	r, err := e.local.Open(e.local.abs(rel))
+	if err != nil {
+		return "", err
+	}
+	defer func(r io.ReadCloser) {
+		_ = r.Close()
+	}(r)
+	sum, err := hashReader(r, algorithm)
+	if err != nil {
+		return "", err
+	}
+	return formatHash(algorithm, sum), nil
+}
+
+// hashAlgorithmOf returns the algorithm of a recorded hash.
+func hashAlgorithmOf(recorded string) HashAlgorithm {
+	name, _, _ := strings.Cut(recorded, ":")
+	for _, algorithm := range []HashAlgorithm{HashSHA256, HashXXH64, HashMD5} {
+		if algorithm.String() == name {
+			return algorithm
+		}
+	}
+	return HashNone
+}
@@ -0,0 +1,62 @@
+package engine
+
+import (
+	"io"
+	"os"
+	"path"
+
+	"github.com/cploutarchou/syncpkg/ignore"
+)
+
+// rulesSide returns the side the .syncignore files are read from, which is the side the initial sync starts from.
+func (e *Engine) rulesSide() endpoint {
+	if e.config.Direction == RemoteToLocal {
+		return e.remote
+	}
+	return e.local
+}
+
+// loadIgnore returns the content of the .syncignore file of the directory dir. It is the ignore.Loader of the engine.
+func (e *Engine) loadIgnore(dir string) ([]byte, error) {
+	p := e.rulesSide()
+	r, err := p.Open(p.abs(path.Join(dir, ignore.FileName)))
+	if err != nil {
+		if !isNotExist(err) {
+			e.log.Warn("cannot read ignore file", "op", "ignore", "path", path.Join(dir, ignore.FileName), "error", err)
+		}
+		return nil, err
+	}
+	defer func(r io.ReadCloser) {
+		_ = r.Close()
+	}(r)
+	return io.ReadAll(r)
+}
+
+// ignored reports whether the path rel of p matches the ignore patterns. Patterns that only match directories are
+// checked against info, or against the recorded state or p when info is nil.
+func (e *Engine) ignored(p endpoint, rel string, info os.FileInfo) bool {
+	asFile, asDir := e.ignore.Match(rel, false), e.ignore.Match(rel, true)
+	if asFile == asDir {
+		return asFile
+	}
+	if info == nil {
+		if rec, ok := e.records.get(rel); ok {
+			if rec.Dir {
+				return asDir
+			}
+			return asFile
+		}
+		info, _ = p.Stat(p.abs(rel))
+	}
+	if info != nil && info.IsDir() {
+		return asDir
+	}
+	return asFile
+}
+
+// rulesChanged makes the ignore patterns be read again if rel is a .syncignore file.
+func (e *Engine) rulesChanged(rel string) {
+	if path.Base(rel) == ignore.FileName {
+		e.ignore.Invalidate(parent(rel))
+	}
+}
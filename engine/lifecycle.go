@@ -0,0 +1,142 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrStarted is returned by Start when the engine was already started. An engine cannot be started twice.
+var ErrStarted = errors.New("engine already started")
+
+// Start starts the worker pool, performs the initial synchronization and then keeps the destination side in sync
+// with the source side in the background, until ctx is done or Stop is called.
+//
+//   - LocalToRemote: the local directory tree is watched with fsnotify and every event is queued on the worker pool.
+//   - RemoteToLocal: the remote directory tree is scanned every PollInterval and the differences with the previous
+//     scan are queued on the worker pool.
+//   - Bidirectional: both of the above run at the same time.
+//
+// Start returns once the initial synchronization is done. If it or the watcher fails, the engine is stopped and the
+// error is returned. Errors that stop the engine later on are returned by Wait.
+func (e *Engine) Start(ctx context.Context) error {
+	e.mu.Lock()
+	if e.done != nil {
+		e.mu.Unlock()
+		return ErrStarted
+	}
+	e.ctx, e.cancel = context.WithCancel(ctx)
+	e.done = make(chan struct{})
+	e.mu.Unlock()
+
+	// The workers are not stopped by ctx, so that the queued tasks are drained when the engine stops.
+	err := e.Pool.Start(context.Background(), e.handle)
+	if err != nil {
+		e.cancel()
+		e.finish(err)
+		return err
+	}
+
+	if r, ok := e.remote.Backend.(Reconnector); ok && e.config.KeepAlive > 0 {
+		e.producers.Add(1)
+		go e.keepAlive(r)
+	}
+
+	e.log.Info("starting initial sync", "op", "initial_sync", "direction", e.config.Direction)
+	start := time.Now()
+	err = e.InitialSync()
+	if err == nil && e.config.Direction != RemoteToLocal {
+		e.log.Debug("setting up watcher", "op", "watch", "path", e.config.LocalDir)
+		err = e.watchLocal()
+	}
+	if err != nil {
+		e.cancel()
+		e.finish(err)
+		return err
+	}
+	e.log.Info("initial sync done", "op", "initial_sync", "duration", time.Since(start))
+	e.emit(SyncEvent{Type: InitialSyncDone, Direction: e.config.Direction, Duration: time.Since(start)})
+
+	e.producers.Add(1)
+	go e.saveState()
+	if e.config.Direction != LocalToRemote {
+		e.log.Debug("polling remote directory", "op", "poll", "remote_path", e.config.RemoteDir)
+		e.producers.Add(1)
+		go func() {
+			defer e.producers.Done()
+			err := e.pollRemote()
+			if err != nil {
+				e.fail(err)
+			}
+		}()
+	}
+	go func() {
+		<-e.ctx.Done()
+		e.finish(nil)
+	}()
+	return nil
+}
+
+// fail records err as the error that stopped the engine, unless another one was recorded first, and stops it.
+func (e *Engine) fail(err error) {
+	e.mu.Lock()
+	if e.err == nil {
+		e.err = err
+	}
+	e.mu.Unlock()
+	e.cancel()
+}
+
+// finish shuts the stopped engine down. It closes the watcher, waits for the poller, drains the queued tasks, stops
+// the workers and saves the state one last time.
+func (e *Engine) finish(err error) {
+	if e.Watcher != nil {
+		_ = e.Watcher.Close()
+	}
+	e.producers.Wait()
+	_ = e.Pool.Shutdown(context.Background())
+
+	saveErr := e.store.Save()
+	if saveErr != nil {
+		e.log.Error("cannot save state", "op", "save", "path", e.config.StateFile, "error", saveErr)
+	}
+
+	e.mu.Lock()
+	if e.err == nil {
+		e.err = err
+	}
+	if e.err == nil {
+		e.err = saveErr
+	}
+	e.mu.Unlock()
+	e.log.Info("sync stopped", "error", e.err)
+	close(e.done)
+}
+
+// Stop stops the engine and waits until the tasks already queued are processed. It does nothing if the engine
+// was not started.
+func (e *Engine) Stop() {
+	e.mu.Lock()
+	done := e.done
+	e.mu.Unlock()
+	if done == nil {
+		return
+	}
+	e.cancel()
+	<-done
+}
+
+// Wait blocks until the engine stopped and returns the error that stopped it, if any. Stopping the engine with
+// Stop or through the context passed to Start is not an error. It returns immediately if the engine was not started.
+func (e *Engine) Wait() error {
+	e.mu.Lock()
+	done := e.done
+	e.mu.Unlock()
+	if done == nil {
+		return nil
+	}
+	<-done
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.err
+}
@@ -0,0 +1,25 @@
+package engine
+
+import (
+	"context"
+	"log/slog"
+)
+
+// DiscardLogger drops every record without evaluating its attributes. It is the logger of the engine and of the ftp
+// and sftp clients when no Logger is configured, so they are quiet unless asked otherwise.
+var DiscardLogger = slog.New(discardHandler{})
+
+// discardHandler is a slog.Handler that drops every record. It is the handler of DiscardLogger.
+type discardHandler struct{}
+
+// Enabled reports false for every level, so that the attributes of the records are not even evaluated.
+func (discardHandler) Enabled(context.Context, slog.Level) bool { return false }
+
+// Handle drops r.
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+
+// WithAttrs returns the handler itself.
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+
+// WithGroup returns the handler itself.
+func (h discardHandler) WithGroup(string) slog.Handler { return h }
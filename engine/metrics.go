@@ -0,0 +1,271 @@
+package engine
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The operations the metrics are broken down by.
+const (
+	//OpUpload is the copy of a local file to the remote side
+	OpUpload = "upload"
+	//OpDownload is the copy of a remote file to the local side
+	OpDownload = "download"
+	//OpDelete is the removal of a file or directory from either side
+	OpDelete = "delete"
+	//OpPoll is a scan of the remote directory
+	OpPoll = "poll"
+)
+
+// latencyBuckets are the upper bounds of the buckets of the latency histograms.
+var latencyBuckets = [...]time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+	time.Minute,
+	5 * time.Minute,
+}
+
+// histogram counts durations in latencyBuckets. The zero value is ready to use.
+type histogram struct {
+	//mu guards the fields below
+	mu sync.Mutex
+	//counts holds the number of observations of every bucket, the last one being the +Inf bucket
+	counts [len(latencyBuckets) + 1]int64
+	//sum is the sum of the observations
+	sum time.Duration
+}
+
+// observe adds d to the histogram.
+func (h *histogram) observe(d time.Duration) {
+	i := sort.Search(len(latencyBuckets), func(i int) bool { return d <= latencyBuckets[i] })
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	h.sum += d
+}
+
+// stats returns a snapshot of the histogram.
+func (h *histogram) stats() Histogram {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stats := Histogram{Sum: h.sum, Buckets: make([]Bucket, len(latencyBuckets))}
+	for i, bound := range latencyBuckets {
+		stats.Count += h.counts[i]
+		stats.Buckets[i] = Bucket{UpperBound: bound, Count: stats.Count}
+	}
+	stats.Count += h.counts[len(latencyBuckets)]
+	return stats
+}
+
+// metrics holds the counters and histograms maintained by the engine. The zero value is ready to use.
+type metrics struct {
+	//uploaded, downloaded and deleted count the files transferred or deleted
+	uploaded, downloaded, deleted atomic.Int64
+	//bytesUploaded and bytesDownloaded count the bytes written by transfers
+	bytesUploaded, bytesDownloaded atomic.Int64
+	//uploadFailures, downloadFailures, deleteFailures and pollFailures count the failed operations
+	uploadFailures, downloadFailures, deleteFailures, pollFailures atomic.Int64
+	//retries counts the transfer attempts made after a failed one
+	retries atomic.Int64
+	//reconnects counts the times the connection to the server was re-established
+	reconnects atomic.Int64
+	//polls is the duration of the scans of the remote directory
+	polls histogram
+	//transfers is the duration of the successful transfers
+	transfers histogram
+}
+
+// transferred records a successful transfer of n bytes towards dst that took d.
+func (m *metrics) transferred(dst endpoint, n int64, d time.Duration) {
+	if dst.remote {
+		m.uploaded.Add(1)
+	} else {
+		m.downloaded.Add(1)
+	}
+	m.wrote(dst, n)
+	m.transfers.observe(d)
+}
+
+// wrote records n bytes written to dst.
+func (m *metrics) wrote(dst endpoint, n int64) {
+	if dst.remote {
+		m.bytesUploaded.Add(n)
+	} else {
+		m.bytesDownloaded.Add(n)
+	}
+}
+
+// transferFailed records a transfer towards dst that failed after all the attempts.
+func (m *metrics) transferFailed(dst endpoint) {
+	if dst.remote {
+		m.uploadFailures.Add(1)
+	} else {
+		m.downloadFailures.Add(1)
+	}
+}
+
+// Bucket is a bucket of a Histogram.
+type Bucket struct {
+	//UpperBound is the inclusive upper bound of the bucket
+	UpperBound time.Duration
+	//Count is the number of observations lower than or equal to UpperBound
+	Count int64
+}
+
+// Histogram is a snapshot of a latency histogram.
+type Histogram struct {
+	//Count is the number of observations
+	Count int64
+	//Sum is the sum of the observations
+	Sum time.Duration
+	//Buckets holds the cumulative counts of the observations, by increasing upper bound. Observations above the last
+	//bound are only counted by Count.
+	Buckets []Bucket
+}
+
+// Stats is a snapshot of the metrics of an engine.
+type Stats struct {
+	//Uploaded, Downloaded and Deleted are the numbers of files uploaded, downloaded and deleted
+	Uploaded, Downloaded, Deleted int64
+	//BytesUploaded and BytesDownloaded are the numbers of bytes written by uploads and downloads, including the
+	//blocks written by delta transfers
+	BytesUploaded, BytesDownloaded int64
+	//Failures holds the number of failed operations by operation: OpUpload, OpDownload, OpDelete and OpPoll
+	Failures map[string]int64
+	//Retries is the number of transfer attempts made after a failed one
+	Retries int64
+	//Reconnects is the number of times the connection to the server was re-established
+	Reconnects int64
+	//QueueDepth is the number of tasks waiting on the worker pool
+	QueueDepth int
+	//PollDuration is the duration of the scans of the remote directory
+	PollDuration Histogram
+	//TransferLatency is the duration of the successful transfers, from the first attempt to the last
+	TransferLatency Histogram
+}
+
+// Stats returns a snapshot of the metrics of the engine. It can be called at any time, concurrently with the sync.
+func (e *Engine) Stats() Stats {
+	m := &e.metrics
+	return Stats{
+		Uploaded:        m.uploaded.Load(),
+		Downloaded:      m.downloaded.Load(),
+		Deleted:         m.deleted.Load(),
+		BytesUploaded:   m.bytesUploaded.Load(),
+		BytesDownloaded: m.bytesDownloaded.Load(),
+		Failures: map[string]int64{
+			OpUpload:   m.uploadFailures.Load(),
+			OpDownload: m.downloadFailures.Load(),
+			OpDelete:   m.deleteFailures.Load(),
+			OpPoll:     m.pollFailures.Load(),
+		},
+		Retries:         m.retries.Load(),
+		Reconnects:      m.reconnects.Load(),
+		QueueDepth:      e.Pool.Len(),
+		PollDuration:    m.polls.stats(),
+		TransferLatency: m.transfers.stats(),
+	}
+}
+
+// MetricsHandler returns an http.Handler that serves the metrics of the engine in the Prometheus text format.
+func (e *Engine) MetricsHandler() http.Handler {
+	return StatsHandler(e.Stats)
+}
+
+// StatsHandler returns an http.Handler that serves the Stats returned by stats in the Prometheus text format.
+//
+// Example:
+//
+//	http.Handle("/metrics", engine.StatsHandler(e.Stats))
+func StatsHandler(stats func() Stats) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = stats().WriteTo(w)
+	})
+}
+
+// WriteTo writes the stats to w in the Prometheus text format, with metric names prefixed by "syncpkg_".
+func (s Stats) WriteTo(w io.Writer) (int64, error) {
+	p := &promWriter{w: bufio.NewWriter(w)}
+	p.metric("syncpkg_files_total", "counter", "Files transferred or deleted.")
+	p.sample("syncpkg_files_total", `op="`+OpUpload+`"`, s.Uploaded)
+	p.sample("syncpkg_files_total", `op="`+OpDownload+`"`, s.Downloaded)
+	p.sample("syncpkg_files_total", `op="`+OpDelete+`"`, s.Deleted)
+	p.metric("syncpkg_bytes_total", "counter", "Bytes written by transfers.")
+	p.sample("syncpkg_bytes_total", `op="`+OpUpload+`"`, s.BytesUploaded)
+	p.sample("syncpkg_bytes_total", `op="`+OpDownload+`"`, s.BytesDownloaded)
+	p.metric("syncpkg_failures_total", "counter", "Failed operations.")
+	for _, op := range []string{OpUpload, OpDownload, OpDelete, OpPoll} {
+		p.sample("syncpkg_failures_total", `op="`+op+`"`, s.Failures[op])
+	}
+	p.metric("syncpkg_retries_total", "counter", "Transfer attempts made after a failed one.")
+	p.sample("syncpkg_retries_total", "", s.Retries)
+	p.metric("syncpkg_reconnects_total", "counter", "Times the connection to the server was re-established.")
+	p.sample("syncpkg_reconnects_total", "", s.Reconnects)
+	p.metric("syncpkg_queue_depth", "gauge", "Tasks waiting on the worker pool.")
+	p.sample("syncpkg_queue_depth", "", int64(s.QueueDepth))
+	p.histogram("syncpkg_poll_duration_seconds", "Duration of the scans of the remote directory.", s.PollDuration)
+	p.histogram("syncpkg_transfer_duration_seconds", "Duration of the successful transfers.", s.TransferLatency)
+	if p.err == nil {
+		p.err = p.w.Flush()
+	}
+	return p.n, p.err
+}
+
+// promWriter writes metrics in the Prometheus text format and keeps the first error.
+type promWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+// printf writes a formatted line.
+func (p *promWriter) printf(format string, args ...interface{}) {
+	if p.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(p.w, format, args...)
+	p.n += int64(n)
+	p.err = err
+}
+
+// metric writes the HELP and TYPE lines of a metric.
+func (p *promWriter) metric(name, kind, help string) {
+	p.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes a sample of a metric with the given labels, which may be empty.
+func (p *promWriter) sample(name, labels string, value int64) {
+	if labels != "" {
+		name += "{" + labels + "}"
+	}
+	p.printf("%s %d\n", name, value)
+}
+
+// histogram writes a histogram whose observations are durations, in seconds.
+func (p *promWriter) histogram(name, help string, h Histogram) {
+	p.metric(name, "histogram", help)
+	for _, b := range h.Buckets {
+		p.sample(name+"_bucket", `le="`+strconv.FormatFloat(b.UpperBound.Seconds(), 'g', -1, 64)+`"`, b.Count)
+	}
+	p.sample(name+"_bucket", `le="+Inf"`, h.Count)
+	p.printf("%s_sum %s\n", name, strconv.FormatFloat(h.Sum.Seconds(), 'g', -1, 64))
+	p.sample(name+"_count", "", h.Count)
+}
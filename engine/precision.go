@@ -0,0 +1,70 @@
+package engine
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cploutarchou/syncpkg/state"
+)
+
+// Granular is implemented by the backends whose modification times can be less precise than a second, such as the
+// FTP servers that only list their files with LIST, which gives the times to the minute.
+type Granular interface {
+	// Granularity returns the precision of the modification times the backend reports, or an error if it cannot
+	// tell, such as when it cannot reach its server.
+	Granularity() (time.Duration, error)
+}
+
+// precision holds the precision of the modification times of an endpoint, asked from its backend the first time it
+// is needed, since a remote backend may have to connect to its server to tell.
+type precision struct {
+	mu sync.Mutex
+	//known is set once the backend reported its granularity, which is then kept in value
+	known bool
+	value time.Duration
+}
+
+// precision returns the precision the modification times of p are compared with: a second, or the granularity of its
+// backend if it is Granular and reports a coarser one. A backend that fails to report it is asked again the next time,
+// and its times are compared to the second until then.
+func (p endpoint) precision() time.Duration {
+	if p.times == nil {
+		return time.Second
+	}
+	p.times.mu.Lock()
+	defer p.times.mu.Unlock()
+	if p.times.known {
+		return p.times.value
+	}
+	g, ok := p.Backend.(Granular)
+	if !ok {
+		p.times.known, p.times.value = true, time.Second
+		return p.times.value
+	}
+	granularity, err := g.Granularity()
+	if err != nil {
+		return time.Second
+	}
+	p.times.known, p.times.value = true, max(time.Second, granularity)
+	return p.times.value
+}
+
+// matches reports whether info, the file information of a file on p, describes the state s recorded for it.
+func (p endpoint) matches(s state.FileState, info os.FileInfo) bool {
+	return s.MatchesWithin(info, p.precision())
+}
+
+// inSync reports whether the copy of a file on src, described by srcInfo, and its copy on dst, described by dstInfo,
+// have the same size and modification time. The times are compared with the precision of the coarser side, so that
+// a file copied to a server that gives times to the minute is not copied again on every sync.
+func inSync(src, dst endpoint, srcInfo, dstInfo os.FileInfo) bool {
+	return state.StateOf(srcInfo).MatchesWithin(dstInfo, max(src.precision(), dst.precision()))
+}
+
+// newer reports whether a, the file information of a file on p, was modified after b, that of a file on q, at the
+// precision of the coarser side.
+func newer(p, q endpoint, a, b os.FileInfo) bool {
+	precision := max(p.precision(), q.precision())
+	return a.ModTime().Truncate(precision).After(b.ModTime().Truncate(precision))
+}
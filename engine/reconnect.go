@@ -0,0 +1,151 @@
+package engine
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultKeepAlive is the default interval of the checks of the connection to the server.
+const defaultKeepAlive = 30 * time.Second
+
+// Reconnector is implemented by the remote backends whose connection to the server can drop, such as the FTP and
+// SFTP clients. The engine checks the connection with Ping every Config.KeepAlive and after every transient error,
+// and re-establishes it with Reconnect once it is found dead.
+type Reconnector interface {
+	// Ping checks that the connection is alive with a round trip to the server. It must not block for longer than a
+	// few seconds on a connection that stopped answering.
+	Ping() error
+	// Reconnect closes the dead connection and dials a new one with the parameters of the original one.
+	Reconnect() error
+}
+
+// connection tracks the state of the connection of the remote backend.
+type connection struct {
+	//mu guards the fields below
+	mu sync.Mutex
+	//up is closed while the connection is up, and replaced by an open channel while it is being re-established
+	up chan struct{}
+	//down reports whether the connection is being re-established
+	down bool
+	//epoch counts the times the connection was re-established
+	epoch uint64
+}
+
+// newConnection returns the state of a connection that is up.
+func newConnection() *connection {
+	up := make(chan struct{})
+	close(up)
+	return &connection{up: up}
+}
+
+// markDown marks the connection as down. It returns false if it already was, in which case another goroutine is
+// re-establishing it.
+func (c *connection) markDown() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.down {
+		return false
+	}
+	c.down = true
+	c.up = make(chan struct{})
+	return true
+}
+
+// markUp marks the connection as re-established and wakes up the goroutines waiting for it.
+func (c *connection) markUp() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.down = false
+	c.epoch++
+	close(c.up)
+}
+
+// state returns the channel that is closed while the connection is up, and the number of times it was
+// re-established.
+func (c *connection) state() (chan struct{}, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.up, c.epoch
+}
+
+// keepAlive pings the server every Config.KeepAlive and re-establishes the connection when the ping fails, until the
+// engine stops.
+func (e *Engine) keepAlive(r Reconnector) {
+	defer e.producers.Done()
+	ticker := time.NewTicker(e.config.KeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		up, _ := e.conn.state()
+		select {
+		case <-up:
+		default:
+			// A worker is re-establishing the connection already.
+			continue
+		}
+		err := r.Ping()
+		if err != nil {
+			e.log.Debug("keepalive failed", "op", "keepalive", "error", err)
+			e.reconnect(r, err)
+		}
+	}
+}
+
+// reconnected is called when an operation on either side failed with err. If the error is transient and the
+// connection to the server turns out to be dead, it waits until the connection is re-established, by this goroutine
+// or another one, and returns true so that the operation is replayed. It returns false if the connection is alive,
+// the remote backend cannot reconnect or the engine stopped meanwhile.
+func (e *Engine) reconnected(err error) bool {
+	r, ok := e.remote.Backend.(Reconnector)
+	if !ok || !e.transient(err) {
+		return false
+	}
+	up, _ := e.conn.state()
+	select {
+	case <-up:
+		pingErr := r.Ping()
+		if pingErr == nil {
+			return false
+		}
+		e.reconnect(r, err)
+		up, _ = e.conn.state()
+	default:
+	}
+	select {
+	case <-up:
+		return e.ctx.Err() == nil
+	case <-e.ctx.Done():
+		return false
+	}
+}
+
+// reconnect re-establishes the connection lost with cause, unless another goroutine does already. It tries again
+// with the delays of the retry policy until it succeeds or the engine stops, and emits a Reconnecting event when it
+// starts and a Reconnected event once it succeeded.
+func (e *Engine) reconnect(r Reconnector, cause error) {
+	if !e.conn.markDown() {
+		return
+	}
+	e.log.Warn("connection lost, reconnecting", "op", "reconnect", "error", cause)
+	e.emit(SyncEvent{Type: Reconnecting, Err: cause})
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := r.Reconnect()
+		if err == nil {
+			break
+		}
+		e.log.Warn("cannot reconnect", "op", "reconnect", "attempt", attempt, "error", err)
+		if !e.backoff(attempt) {
+			// The engine stopped, the goroutines waiting for the connection return on their own.
+			return
+		}
+	}
+	e.metrics.reconnects.Add(1)
+	e.log.Info("reconnected", "op", "reconnect", "duration", time.Since(start))
+	e.emit(SyncEvent{Type: Reconnected, Duration: time.Since(start)})
+	e.conn.markUp()
+}
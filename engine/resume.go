@@ -0,0 +1,88 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cploutarchou/syncpkg/state"
+)
+
+// Resumer is implemented by backends that can resume an interrupted transfer.
+type Resumer interface {
+	// OpenAt opens path for reading, starting at offset.
+	OpenAt(path string, offset int64) (io.ReadCloser, error)
+	// Append opens the existing file path for writing after its first offset bytes, which is its size.
+	Append(path string, offset int64) (io.WriteCloser, error)
+}
+
+// OpenAt opens the local file path for reading, starting at offset.
+func (Local) OpenAt(path string, offset int64) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// Append opens the existing local file path for writing at offset.
+func (Local) Append(path string, offset int64) (io.WriteCloser, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// resumeOffset returns the offset at which the transfer of rel from src to dst, described by info, can be resumed
+// after an attempt that wrote copied bytes of it, or 0 if it has to start over.
+//
+// The transfer is only resumed if both backends are Resumers, the file did not change on src, and the partial copy
+// on dst is shorter than the file and no longer than what was written to it, so that it cannot be another file.
+func (e *Engine) resumeOffset(src, dst endpoint, rel string, info os.FileInfo, copied int64) int64 {
+	if _, ok := src.Backend.(Resumer); !ok {
+		return 0
+	}
+	if _, ok := dst.Backend.(Resumer); !ok {
+		return 0
+	}
+	srcInfo, err := src.Stat(src.abs(rel))
+	if err != nil || !src.matches(state.StateOf(info), srcInfo) {
+		return 0
+	}
+	dstInfo, err := dst.Stat(dst.abs(e.target(rel)))
+	if err != nil || dstInfo.IsDir() {
+		return 0
+	}
+	if dstInfo.Size() <= 0 || dstInfo.Size() >= info.Size() || dstInfo.Size() > copied {
+		return 0
+	}
+	return dstInfo.Size()
+}
+
+// verifyResumed checks that the copy of rel on dst, completed by a resumed transfer, is the same as the file on
+// src, described by info. Contents are compared by hash when both sides can hash the file, and by size otherwise.
+func (e *Engine) verifyResumed(src, dst endpoint, rel string, info os.FileInfo) error {
+	dstInfo, err := dst.Stat(dst.abs(rel))
+	if err != nil {
+		return err
+	}
+	if dstInfo.Size() != info.Size() {
+		return fmt.Errorf("resumed copy of %s has %d bytes, want %d", rel, dstInfo.Size(), info.Size())
+	}
+	same, ok := e.compareContent(src, dst, rel, info, dstInfo)
+	if ok && !same {
+		return fmt.Errorf("resumed copy of %s differs from the source", rel)
+	}
+	return nil
+}
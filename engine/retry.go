@@ -0,0 +1,158 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"math"
+	"math/rand"
+	"os"
+	"time"
+)
+
+// The defaults of RetryPolicy.
+const (
+	defaultInitialDelay = 500 * time.Millisecond
+	defaultMultiplier   = 2
+	defaultMaxDelay     = 30 * time.Second
+	defaultJitter       = 0.2
+	defaultMaxAttempts  = 3
+)
+
+// RetryPolicy decides how often and how fast the operations on a backend are retried after a transient error.
+// The zero value of a field selects its default.
+type RetryPolicy struct {
+	//MaxAttempts is the number of attempts made before giving up. It defaults to Config.MaxRetries, or to 3 if that
+	//is not set either.
+	MaxAttempts int
+	//InitialDelay is the delay before the second attempt. It defaults to 500 milliseconds.
+	InitialDelay time.Duration
+	//Multiplier is the factor the delay grows by after every attempt. It defaults to 2.
+	Multiplier float64
+	//MaxDelay caps the delay between two attempts. It defaults to 30 seconds.
+	MaxDelay time.Duration
+	//Jitter is the fraction of the delay it is randomly shortened or lengthened by, so that clients do not retry in
+	//lockstep. It defaults to 0.2, a negative value disables it.
+	Jitter float64
+}
+
+// withDefaults returns the policy with its zero fields set to their defaults. maxRetries is the number of attempts
+// of the legacy Config.MaxRetries.
+func (p RetryPolicy) withDefaults(maxRetries int) RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = maxRetries
+	}
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = defaultMaxAttempts
+	}
+	if p.InitialDelay <= 0 {
+		p.InitialDelay = defaultInitialDelay
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = defaultMultiplier
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = defaultMaxDelay
+	}
+	if p.Jitter == 0 {
+		p.Jitter = defaultJitter
+	}
+	return p
+}
+
+// Delay returns the delay before the attempt following the given one, counted from 1.
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	delay := float64(p.InitialDelay) * math.Pow(p.Multiplier, float64(attempt-1))
+	if delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		delay *= 1 + p.Jitter*(2*rand.Float64()-1)
+	}
+	return time.Duration(delay)
+}
+
+// Classifier is implemented by the backends that can tell the transient errors of their protocol, such as the 4xx
+// replies of FTP, apart from the permanent ones.
+type Classifier interface {
+	// Transient reports whether err is transient. known is false if err is not an error of the protocol, in which
+	// case IsTransient decides.
+	Transient(err error) (transient, known bool)
+}
+
+// IsTransient reports whether an operation that failed with err may succeed if it is tried again. Missing files,
+// existing files, denied permissions, invalid arguments and canceled contexts are permanent. Every other error, such
+// as a timeout, a reset connection or an unexpected end of file, is transient.
+func IsTransient(err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return false
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, fs.ErrPermission), errors.Is(err, fs.ErrExist),
+		errors.Is(err, fs.ErrInvalid), errors.Is(err, ErrHashUnsupported):
+		return false
+	}
+	return true
+}
+
+// transient reports whether err is transient. The remote backend classifies the errors of its protocol, the local
+// one has no errors of its own.
+func (e *Engine) transient(err error) bool {
+	if c, ok := e.remote.Backend.(Classifier); ok {
+		if transient, known := c.Transient(err); known {
+			return transient
+		}
+	}
+	return IsTransient(err)
+}
+
+// backoff waits before the attempt following the given one. It returns false if the engine stopped meanwhile.
+func (e *Engine) backoff(attempt int) bool {
+	timer := time.NewTimer(e.config.RetryPolicy.Delay(attempt))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-e.ctx.Done():
+		return false
+	}
+}
+
+// retry calls fn until it succeeds, fails with a permanent error or the attempts of the retry policy are exhausted,
+// and returns its last error. op and rel describe the operation in the logs.
+func (e *Engine) retry(op, rel string, fn func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err != nil && e.reconnected(err) {
+			// The connection dropped, the attempt is replayed over the new one and does not count.
+			attempt--
+			continue
+		}
+		if err == nil || attempt >= e.config.RetryPolicy.MaxAttempts || !e.transient(err) {
+			return err
+		}
+		e.log.Warn("retrying operation", "op", op, "path", rel, "attempt", attempt,
+			"attempts", e.config.RetryPolicy.MaxAttempts, "error", err)
+		e.metrics.retries.Add(1)
+		if !e.backoff(attempt) {
+			return err
+		}
+	}
+}
+
+// mkdir creates the directory rel on p, with its parents, retrying transient errors.
+func (e *Engine) mkdir(p endpoint, rel string) error {
+	return e.retry("mkdir", rel, func() error { return p.Mkdir(p.abs(rel)) })
+}
+
+// list lists the directory rel of p, retrying transient errors.
+func (e *Engine) list(p endpoint, rel string) ([]os.FileInfo, error) {
+	var entries []os.FileInfo
+	err := e.retry("list", rel, func() (err error) {
+		entries, err = p.List(p.abs(rel))
+		return err
+	})
+	return entries, err
+}
@@ -0,0 +1,283 @@
+package ftp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cploutarchou/syncpkg/engine"
+)
+
+// FTP implements the engine.Backend interface on top of the FTP server.
+var _ engine.Backend = (*FTP)(nil)
+
+// FTP resumes interrupted transfers.
+var _ engine.Resumer = (*FTP)(nil)
+
+// FTP classifies the errors of the FTP protocol for the retry policy.
+var _ engine.Classifier = (*FTP)(nil)
+
+// replyFileUnavailable is the FTP reply code for a file that does not exist or cannot be accessed.
+const replyFileUnavailable = 550
+
+// notExistError wraps an FTP error that reports a missing file so that it matches fs.ErrNotExist.
+type notExistError struct {
+	err error
+}
+
+func (e notExistError) Error() string { return e.err.Error() }
+
+func (e notExistError) Unwrap() error { return e.err }
+
+func (e notExistError) Is(target error) bool { return target == fs.ErrNotExist }
+
+// replyError is an unexpected reply of the server to a command sent over a raw connection.
+type replyError struct {
+	//cmd is the command, empty if the reply completes a transfer
+	cmd string
+	//code is the reply code
+	code int
+	//msg is the text of the reply
+	msg string
+}
+
+func (e *replyError) Error() string {
+	if e.cmd == "" {
+		return fmt.Sprintf("unexpected response: %d-%s", e.code, e.msg)
+	}
+	return fmt.Sprintf("%s: unexpected response: %d-%s", e.cmd, e.code, e.msg)
+}
+
+// newReplyError returns the error of the reply code msg to the command cmd, which matches fs.ErrNotExist for a
+// 550 reply.
+func newReplyError(cmd string, code int, msg string) error {
+	err := &replyError{cmd: cmd, code: code, msg: msg}
+	if code == replyFileUnavailable {
+		return notExistError{err: err}
+	}
+	return err
+}
+
+// replyCode returns the FTP reply code err carries, or 0 if it is not a reply of the server.
+func replyCode(err error) int {
+	var reply *replyError
+	if errors.As(err, &reply) {
+		return reply.code
+	}
+	return 0
+}
+
+// Transient reports whether err is a transient FTP error. The 4xx replies, such as 421 when the server closes the
+// connection or 450 when a file is busy, are transient, and the 5xx replies, such as 550 for a missing file or
+// denied permission, are permanent. Errors without a reply code, such as timeouts, are left to engine.IsTransient.
+func (f *FTP) Transient(err error) (transient, known bool) {
+	switch replyCode(err) / 100 {
+	case 4:
+		return true, true
+	case 5:
+		return false, true
+	}
+	return false, false
+}
+
+// List returns the entries of the remote directory dir.
+func (f *FTP) List(dir string) ([]os.FileInfo, error) {
+	var entries []os.FileInfo
+	err := f.pool().do(func(c *conn) (err error) {
+		entries, err = f.list(c, dir)
+		return err
+	})
+	return entries, err
+}
+
+// Stat is a method of the FTP struct that retrieves file information (os.FileInfo) for a remote file on the FTP server.
+//
+// - path is the absolute path of the remote file for which file information is required.
+//
+// - Returns the file information (os.FileInfo) for the remote file if the operation is successful.
+//
+// - Returns an error if there is a problem retrieving the file information from the FTP server.
+func (f *FTP) Stat(path string) (os.FileInfo, error) {
+	var fileInfo os.FileInfo
+	err := f.pool().do(func(c *conn) (err error) {
+		fileInfo, err = f.stat(c, path)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fileInfo, nil
+}
+
+// Open downloads the remote file path. A connection is checked out of the pool until the returned reader is closed.
+func (f *FTP) Open(path string) (io.ReadCloser, error) {
+	t, err := f.startTransfer("RETR", path, 0)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Create uploads the data written to the returned writer to the remote file path. A connection is checked out of
+// the pool until the writer is closed, which returns the outcome of the upload.
+func (f *FTP) Create(path string) (io.WriteCloser, error) {
+	t, err := f.startTransfer("STOR", path, 0)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// rawTransfer is a transfer running over a data connection of a connection checked out of the pool.
+type rawTransfer struct {
+	net.Conn
+	//c is the connection of the transfer
+	c *conn
+	//checkin gives the connection back to the pool it was checked out of, along with the outcome of the transfer
+	checkin func(err error)
+}
+
+// Close closes the data connection and returns the error the server reports for the transfer, if any.
+func (t *rawTransfer) Close() (err error) {
+	defer func() {
+		t.checkin(err)
+	}()
+	err = t.Conn.Close()
+	code, msg, respErr := t.c.raw.ReadResponse()
+	if respErr != nil {
+		return respErr
+	}
+	if code/100 != 2 {
+		return newReplyError("", code, msg)
+	}
+	return err
+}
+
+// startTransfer checks a connection out of the pool and sends command cmd for path, after a REST to offset if it is
+// not 0. It returns the data connection of the transfer, which gives the connection back once it is closed.
+func (f *FTP) startTransfer(cmd, path string, offset int64) (*rawTransfer, error) {
+	pool := f.pool()
+	c, err := pool.checkout()
+	fail := func(err error) (*rawTransfer, error) {
+		pool.checkin(c, err)
+		return nil, err
+	}
+	if err != nil {
+		return fail(err)
+	}
+
+	err = c.binaryMode()
+	if err != nil {
+		return fail(err)
+	}
+	pending, err := f.openData(c)
+	if err != nil {
+		return fail(err)
+	}
+	defer pending.close()
+	if offset > 0 {
+		_, err = c.command(350, "REST %d", offset)
+		if err != nil {
+			return fail(err)
+		}
+	}
+	_, err = c.command(1, "%s %s", cmd, path)
+	if err != nil {
+		return fail(err)
+	}
+	data, err := pending.open()
+	if err != nil {
+		return fail(err)
+	}
+	return &rawTransfer{Conn: data, c: c, checkin: func(err error) { pool.checkin(c, err) }}, nil
+}
+
+// OpenAt downloads the remote file path starting at offset, with the REST and RETR commands. A connection is
+// checked out of the pool until the returned reader is closed.
+func (f *FTP) OpenAt(path string, offset int64) (io.ReadCloser, error) {
+	t, err := f.startTransfer("RETR", path, offset)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Append uploads the data written to the returned writer to the end of the remote file path, with the APPE command,
+// to resume an upload. The size of the remote file must be offset. A connection is checked out of the pool until
+// the returned writer is closed.
+func (f *FTP) Append(path string, offset int64) (io.WriteCloser, error) {
+	t, err := f.startTransfer("APPE", path, 0)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Mkdir creates the remote directory path along with any missing parents.
+//
+// Each part of the path is created in turn. If creating a part fails, it is assumed to already exist,
+// which is checked by listing it.
+func (f *FTP) Mkdir(path string) error {
+	return f.pool().do(func(c *conn) error {
+		currentPath := ""
+		for _, part := range strings.Split(path, "/") {
+			if part == "" {
+				continue
+			}
+			currentPath = currentPath + "/" + part
+			// First, try to make the directory
+			_, err := c.command(257, "MKD %s", currentPath)
+			if err != nil {
+				// If that fails, assume it's because the directory already exists and check it
+				_, err = f.readDir(c, currentPath)
+				if err != nil {
+					// If that also fails, return the error
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Remove deletes the remote file or empty directory path.
+func (f *FTP) Remove(path string) error {
+	return f.pool().do(func(c *conn) error {
+		info, err := f.stat(c, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			_, err = c.command(250, "RMD %s", path)
+		} else {
+			_, err = c.command(250, "DELE %s", path)
+		}
+		return err
+	})
+}
+
+// Rename moves the remote file oldPath to newPath with the RNFR and RNTO commands. Most servers replace newPath if
+// it exists.
+func (f *FTP) Rename(oldPath, newPath string) error {
+	return f.pool().do(func(c *conn) error {
+		_, err := c.command(350, "RNFR %s", oldPath)
+		if err == nil {
+			_, err = c.command(250, "RNTO %s", newPath)
+		}
+		return err
+	})
+}
+
+// Chtimes sets the modification time of the remote file path with the MFMT command.
+// FTP has no notion of access times, so atime is ignored.
+func (f *FTP) Chtimes(path string, atime, mtime time.Time) error {
+	return f.pool().do(func(c *conn) error {
+		_, err := c.command(213, "MFMT %s %s", mtime.UTC().Format("20060102150405"), path)
+		return err
+	})
+}
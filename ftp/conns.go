@@ -0,0 +1,372 @@
+package ftp
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/secsy/goftp"
+)
+
+// defaultConnections is the default number of control connections to the FTP server.
+const defaultConnections = 5
+
+// defaultTimeout is the default time the server has to answer a command or to move data.
+const defaultTimeout = 5 * time.Second
+
+// defaultIdleTimeout is the default time a control connection can stay unused before it is reopened.
+const defaultIdleTimeout = time.Minute
+
+var (
+	// errDialTimeout is returned when a control connection could not be opened within ExtraConfig.DialTimeout.
+	errDialTimeout = errors.New("ftp: timed out opening the connection")
+	// errOperationTimeout is returned when an operation did not complete within ExtraConfig.OperationTimeout.
+	errOperationTimeout = errors.New("ftp: operation timed out")
+	// errPoolClosed is returned when a connection is needed after the pool was closed.
+	errPoolClosed = errors.New("ftp: connection closed")
+)
+
+// features holds the features of the server, learned from its reply to FEAT and from the commands it refused. It is
+// shared by the connections of a pool.
+type features struct {
+	//mu guards list
+	mu sync.Mutex
+	//list maps the names of the features, in upper case, to their parameters. It is nil until FEAT was sent.
+	list map[string]string
+}
+
+// has reports whether the server supports the feature name.
+func (s *features) has(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.list[name]
+	return ok
+}
+
+// params returns the parameters of the feature name, and whether the server supports it.
+func (s *features) params(name string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	params, ok := s.list[name]
+	return params, ok
+}
+
+// remove forgets the feature name, once the server refused the command it stands for.
+func (s *features) remove(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.list, name)
+}
+
+// detect sends FEAT over raw and records the features of the reply, unless they are already known. The features are
+// the lines of the reply that start with a space, so a server that replies with a single line, such as "211 No
+// features", or that does not implement FEAT has none.
+func (s *features) detect(raw goftp.RawConn) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.list != nil {
+		return nil
+	}
+	code, msg, err := raw.SendCommand("FEAT")
+	if err != nil {
+		return err
+	}
+	s.list = map[string]string{}
+	if code != 211 {
+		return nil
+	}
+	for _, line := range strings.Split(msg, "\n") {
+		if !strings.HasPrefix(line, " ") || strings.TrimSpace(line) == "" {
+			continue
+		}
+		name, arg, _ := strings.Cut(strings.TrimSpace(line), " ")
+		s.list[strings.ToUpper(name)] = arg
+	}
+	return nil
+}
+
+// conn is a control connection of the pool. It is opened when it is first used, and opened again after a failure
+// or once it stayed unused for too long.
+type conn struct {
+	//id identifies the connection in the logs
+	id int
+	//raw is the control connection, nil while it is not open. It is set by the pool, the operation that checked the
+	//connection out uses it.
+	raw goftp.RawConn
+	//features are the features of the server
+	features *features
+	//binary reports whether the transfer type of raw is binary, set with TYPE I
+	binary bool
+	//lastUsed is the time the connection was last given back
+	lastUsed time.Time
+	//failures counts the operations in a row that failed because of the connection rather than a reply of the server
+	failures int
+	//dataMu guards data
+	dataMu sync.Mutex
+	//data is the data connection of the running operation, if any
+	data net.Conn
+}
+
+// setData records dc as the data connection of the running operation, nil once it is closed.
+func (c *conn) setData(dc net.Conn) {
+	c.dataMu.Lock()
+	defer c.dataMu.Unlock()
+	c.data = dc
+}
+
+// connPool holds the control connections to the FTP server. Every operation checks a connection out for as long as
+// it runs, so that as many operations run at the same time as there are connections, and a transfer stuck on its
+// data connection holds up only its own control connection. A connection that fails, such as one whose data
+// connection timed out, is closed and opened again before it is used again.
+type connPool struct {
+	//dial opens a new control connection, logged in
+	dial func() (goftp.RawConn, error)
+	//dialTimeout is the time dial has to open a connection
+	dialTimeout time.Duration
+	//idleTimeout is the time a connection can stay unused before it is opened again, 0 to keep it forever
+	idleTimeout time.Duration
+	//operationTimeout is the time an operation run by do has to complete, 0 for no limit
+	operationTimeout time.Duration
+	//log receives the health changes of the connections
+	log *slog.Logger
+	//mu guards closed and the raw connections of conns
+	mu sync.Mutex
+	//conns holds every connection of the pool
+	conns []*conn
+	//closed reports whether the pool was closed, after which no connection is opened
+	closed bool
+	//free holds the connections that are not checked out
+	free chan *conn
+}
+
+// newConnPool returns a pool of ExtraConfig.ConnectionsPerHost connections opened by dial. No connection is opened
+// before the first operation.
+func newConnPool(dial func() (goftp.RawConn, error), config *ExtraConfig, log *slog.Logger) *connPool {
+	n := config.ConnectionsPerHost
+	if n < 1 {
+		n = defaultConnections
+	}
+	p := &connPool{
+		dial:             dial,
+		dialTimeout:      config.DialTimeout,
+		idleTimeout:      config.IdleTimeout,
+		operationTimeout: config.OperationTimeout,
+		log:              log,
+		free:             make(chan *conn, n),
+	}
+	if p.dialTimeout <= 0 {
+		p.dialTimeout = config.Timeout
+	}
+	if p.dialTimeout <= 0 {
+		p.dialTimeout = defaultTimeout
+	}
+	switch {
+	case p.idleTimeout == 0:
+		p.idleTimeout = defaultIdleTimeout
+	case p.idleTimeout < 0:
+		p.idleTimeout = 0
+	}
+	shared := &features{}
+	for i := 0; i < n; i++ {
+		c := &conn{id: i + 1, features: shared}
+		p.conns = append(p.conns, c)
+		p.free <- c
+	}
+	return p
+}
+
+// checkout waits until a connection is free and returns it, open. It must be given back with checkin, even if it
+// could not be opened.
+func (p *connPool) checkout() (*conn, error) {
+	c := <-p.free
+	return c, p.open(c)
+}
+
+// tryCheckout returns a free connection, or nil if every connection is checked out. The connection is not opened.
+func (p *connPool) tryCheckout() *conn {
+	select {
+	case c := <-p.free:
+		return c
+	default:
+		return nil
+	}
+}
+
+// open opens the control connection of c, a checked out connection, unless it is open and was used recently. The
+// features of the server are detected over the first connection opened.
+func (p *connPool) open(c *conn) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return errPoolClosed
+	}
+	if c.raw != nil && p.idleTimeout > 0 && time.Since(c.lastUsed) > p.idleTimeout {
+		p.log.Debug("reopening idle FTP connection", "op", "connect", "connection", c.id)
+		_ = c.raw.Close()
+		c.raw = nil
+	}
+	if c.raw != nil {
+		p.mu.Unlock()
+		return nil
+	}
+	p.mu.Unlock()
+
+	raw, err := p.dialRaw()
+	if err == nil {
+		err = c.features.detect(raw)
+		if err != nil {
+			_ = raw.Close()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		_ = raw.Close()
+		return errPoolClosed
+	}
+	c.raw, c.binary, c.lastUsed = raw, false, time.Now()
+	return nil
+}
+
+// dialRaw opens a control connection within dialTimeout. A connection opened too late is closed.
+func (p *connPool) dialRaw() (goftp.RawConn, error) {
+	type result struct {
+		raw goftp.RawConn
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		raw, err := p.dial()
+		done <- result{raw: raw, err: err}
+	}()
+	timer := time.NewTimer(p.dialTimeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.raw, r.err
+	case <-timer.C:
+		go func() {
+			if r := <-done; r.err == nil {
+				_ = r.raw.Close()
+			}
+		}()
+		return nil, fmt.Errorf("%w after %s", errDialTimeout, p.dialTimeout)
+	}
+}
+
+// abort closes the control connection of c and its data connection, which fails the operation running on it.
+func (p *connPool) abort(c *conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c.raw != nil {
+		_ = c.raw.Close()
+	}
+	c.dataMu.Lock()
+	defer c.dataMu.Unlock()
+	if c.data != nil {
+		_ = c.data.Close()
+	}
+}
+
+// checkin gives back a connection returned by checkout, along with the error of the operation it ran. The control
+// connection of an operation that failed without a reply of the server is closed, so that a broken or stuck
+// connection is never reused.
+func (p *connPool) checkin(c *conn, err error) {
+	p.mu.Lock()
+	if !connectionFailed(err) {
+		c.failures = 0
+		c.lastUsed = time.Now()
+		p.mu.Unlock()
+		p.free <- c
+		return
+	}
+	c.failures++
+	if c.raw != nil {
+		_ = c.raw.Close()
+		c.raw = nil
+	}
+	closed := p.closed
+	p.mu.Unlock()
+	if !closed {
+		p.log.Warn("replacing FTP connection", "op", "connect", "connection", c.id, "failures", c.failures, "error", err)
+	}
+	p.free <- c
+}
+
+// connectionFailed reports whether err is a failure of the connection, such as a timeout or a reset, rather than a
+// reply of the server.
+func connectionFailed(err error) bool {
+	return err != nil && replyCode(err) == 0 && !errors.Is(err, fs.ErrNotExist)
+}
+
+// do runs fn on a connection checked out for as long as it runs. The control connection is closed if fn does not
+// return within the operation timeout.
+func (p *connPool) do(fn func(c *conn) error) error {
+	c, err := p.checkout()
+	if err != nil {
+		p.checkin(c, err)
+		return err
+	}
+	if p.operationTimeout <= 0 {
+		err = fn(c)
+		p.checkin(c, err)
+		return err
+	}
+	timedOut := make(chan struct{})
+	timer := time.AfterFunc(p.operationTimeout, func() {
+		close(timedOut)
+		p.abort(c)
+	})
+	err = fn(c)
+	if !timer.Stop() {
+		<-timedOut
+		err = fmt.Errorf("%w after %s: %v", errOperationTimeout, p.operationTimeout, err)
+	}
+	p.checkin(c, err)
+	return err
+}
+
+// close closes every connection of the pool, which fails the operations running on them.
+func (p *connPool) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, c := range p.conns {
+		if c.raw != nil {
+			_ = c.raw.Close()
+		}
+	}
+	return nil
+}
+
+// command sends a command over the control connection and returns the text of the reply. The code of the reply
+// must be want, or start with want if want is a single digit, otherwise a *replyError is returned, which matches
+// fs.ErrNotExist for a 550 reply.
+func (c *conn) command(want int, format string, args ...interface{}) (string, error) {
+	code, msg, err := c.raw.SendCommand(format, args...)
+	if err != nil {
+		return "", err
+	}
+	if code == want || want < 10 && code/100 == want {
+		return msg, nil
+	}
+	return "", newReplyError(fmt.Sprintf(format, args...), code, msg)
+}
+
+// binaryMode sets the transfer type of the control connection to binary, unless it already is.
+func (c *conn) binaryMode() error {
+	if c.binary {
+		return nil
+	}
+	_, err := c.command(200, "TYPE I")
+	c.binary = err == nil
+	return err
+}
@@ -0,0 +1,367 @@
+package ftp
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DataMode is the way the data connections of the transfers and of the listings are opened
+type DataMode int
+
+const (
+	//AutoMode opens passive data connections, and switches to active mode for good if one cannot be opened, as
+	//happens when a firewall or a NAT gateway blocks the port the server listens on
+	AutoMode DataMode = iota
+	//PassiveMode has the client open the data connections to the server
+	PassiveMode
+	//ActiveMode has the server open the data connections to the client, which must be reachable from the server
+	ActiveMode
+)
+
+// dataConn is a data connection whose reads and writes fail once the other side was silent for timeout.
+type dataConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *dataConn) Read(p []byte) (int, error) {
+	_ = c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(p)
+}
+
+func (c *dataConn) Write(p []byte) (int, error) {
+	_ = c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(p)
+}
+
+// pendingData is a data connection prepared by openData. The command that uses it must be sent before open is
+// called, and close gives it up if the command fails before.
+type pendingData struct {
+	//accept returns the data connection
+	accept func() (net.Conn, error)
+	//abort releases the data connection that accept was not called for
+	abort func()
+	//opened is true once open was called
+	opened bool
+}
+
+// open returns the data connection, once the command that uses it was sent.
+func (d *pendingData) open() (net.Conn, error) {
+	d.opened = true
+	return d.accept()
+}
+
+// close releases the data connection if open was not called, and does nothing otherwise.
+func (d *pendingData) close() {
+	if !d.opened {
+		d.opened = true
+		d.abort()
+	}
+}
+
+// openData prepares a data connection over the control connection of c, in the mode of ExtraConfig.DataMode.
+func (f *FTP) openData(c *conn) (*pendingData, error) {
+	mode := f.dataMode()
+	if mode == ActiveMode {
+		return f.active(c)
+	}
+	dc, err := f.passive(c)
+	if err == nil {
+		return &pendingData{
+			accept: func() (net.Conn, error) { return f.secureData(dc) },
+			abort:  func() { _ = dc.Close() },
+		}, nil
+	}
+	var dialErr *net.OpError
+	if mode != AutoMode || !errors.As(err, &dialErr) || dialErr.Op != "dial" {
+		return nil, err
+	}
+	f.log().Warn("cannot open a passive data connection, switching to active mode", "op", "connect",
+		"address", f.address, "error", err)
+	f.modeMu.Lock()
+	f.mode = ActiveMode
+	f.modeMu.Unlock()
+	return f.active(c)
+}
+
+// dataMode returns the mode the data connections are opened in, which AutoMode leaves once a passive data connection
+// could not be opened.
+func (f *FTP) dataMode() DataMode {
+	f.modeMu.Lock()
+	defer f.modeMu.Unlock()
+	return f.mode
+}
+
+// passive asks the server to listen for a data connection, with EPSV if the server lists it in its features or
+// connects over IPv6 and with PASV otherwise, and dials it.
+func (f *FTP) passive(c *conn) (net.Conn, error) {
+	address := ""
+	if f.serverIP.To4() == nil || !f.config.DisableEPSV && c.features.has("EPSV") {
+		msg, err := c.command(229, "EPSV")
+		switch {
+		case err == nil:
+			port, err := parseEPSV(msg)
+			if err != nil {
+				return nil, err
+			}
+			address = net.JoinHostPort(f.serverIP.String(), strconv.Itoa(port))
+		case replyCode(err)/100 == 5 && f.serverIP.To4() != nil:
+			// The server does not implement EPSV after all.
+			c.features.remove("EPSV")
+		default:
+			return nil, err
+		}
+	}
+	if address == "" {
+		msg, err := c.command(227, "PASV")
+		if err != nil {
+			return nil, err
+		}
+		ip, port, err := parsePASV(msg)
+		if err != nil {
+			return nil, err
+		}
+		address = net.JoinHostPort(f.passiveHost(ip), strconv.Itoa(port))
+	}
+	return net.DialTimeout("tcp", address, f.dialTimeout())
+}
+
+// passiveHost returns the host to open the data connection a PASV reply advertises ip for to: ExtraConfig.
+// PassiveAddress if it is set, otherwise the address of the server if ip cannot be reached from the client, such as
+// the private address of a server behind a NAT gateway, and ip itself otherwise.
+func (f *FTP) passiveHost(ip net.IP) string {
+	if f.config.PassiveAddress != "" {
+		return f.config.PassiveAddress
+	}
+	if ip.IsUnspecified() || !routable(ip) && routable(f.serverIP) {
+		return f.serverIP.String()
+	}
+	return ip.String()
+}
+
+// routable reports whether ip is a public address.
+func routable(ip net.IP) bool {
+	return !ip.IsUnspecified() && !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast()
+}
+
+// active listens for a data connection and announces it to the server, with EPRT for IPv6 and PORT otherwise. The
+// returned data connection is the connection of the server.
+func (f *FTP) active(c *conn) (*pendingData, error) {
+	ip, ports, err := f.activeAddress()
+	if err != nil {
+		return nil, err
+	}
+	listener, err := f.listenActive(ports)
+	if err != nil {
+		return nil, err
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	if ip4 := ip.To4(); ip4 != nil {
+		_, err = c.command(200, "PORT %d,%d,%d,%d,%d,%d", ip4[0], ip4[1], ip4[2], ip4[3], port>>8, port&0xff)
+	} else {
+		_, err = c.command(200, "EPRT |2|%s|%d|", ip, port)
+	}
+	if err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	return &pendingData{
+		accept: func() (net.Conn, error) {
+			defer func() {
+				_ = listener.Close()
+			}()
+			_ = listener.SetDeadline(time.Now().Add(f.dialTimeout()))
+			dc, err := listener.Accept()
+			if err != nil {
+				return nil, err
+			}
+			return f.secureData(dc)
+		},
+		abort: func() { _ = listener.Close() },
+	}, nil
+}
+
+// portRange is the range of ports, first to last, the active data connections listen on. The zero portRange is a
+// random port for every connection.
+type portRange struct {
+	first, last int
+}
+
+// portListener is a listener on a port of ExtraConfig.ActiveAddress, which gives the port back once it is closed.
+type portListener struct {
+	*net.TCPListener
+	port     int
+	release  func(port int)
+	released sync.Once
+}
+
+func (l *portListener) Close() error {
+	err := l.TCPListener.Close()
+	l.released.Do(func() { l.release(l.port) })
+	return err
+}
+
+// activeListener is the listener of an active data connection.
+type activeListener interface {
+	net.Listener
+	SetDeadline(t time.Time) error
+}
+
+// listenActive listens on a random port if ports is the zero portRange, and otherwise on the first port of ports
+// that no other data connection uses, waiting for one to be given back if they are all in use. Concurrent transfers
+// thus each get their own port, and are serialized when the range is a single port.
+func (f *FTP) listenActive(ports portRange) (activeListener, error) {
+	if ports.first == 0 {
+		listener, err := net.ListenTCP("tcp", &net.TCPAddr{})
+		if err != nil {
+			return nil, err
+		}
+		return listener, nil
+	}
+	f.portsOnce.Do(func() {
+		f.ports = make(chan int, ports.last-ports.first+1)
+		for port := ports.first; port <= ports.last; port++ {
+			f.ports <- port
+		}
+	})
+	port := <-f.ports
+	release := func(port int) { f.ports <- port }
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: port})
+	if err != nil {
+		release(port)
+		return nil, err
+	}
+	return &portListener{TCPListener: listener, port: port, release: release}, nil
+}
+
+// activeAddress returns the address announced to the server in active mode: ExtraConfig.ActiveAddress, and
+// otherwise the local address of the route to the server and a random port.
+func (f *FTP) activeAddress() (net.IP, portRange, error) {
+	host, ports := f.config.ActiveAddress, portRange{}
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		host = h
+		ports, err = parsePortRange(p)
+		if err != nil {
+			return nil, ports, err
+		}
+	}
+	if host != "" {
+		ip := net.ParseIP(host)
+		if ip == nil {
+			ips, err := net.LookupIP(host)
+			if err != nil {
+				return nil, ports, fmt.Errorf("cannot resolve ActiveAddress: %w", err)
+			}
+			ip = ips[0]
+		}
+		return ip, ports, nil
+	}
+	// Dialing UDP sends nothing, it only picks the local address of the route.
+	route, err := net.Dial("udp", net.JoinHostPort(f.serverIP.String(), "21"))
+	if err != nil {
+		return nil, ports, err
+	}
+	defer func() {
+		_ = route.Close()
+	}()
+	return route.LocalAddr().(*net.UDPAddr).IP, ports, nil
+}
+
+// parsePortRange parses the port of ExtraConfig.ActiveAddress, a port or a range of ports first-last. The port 0 is
+// a random port.
+func parsePortRange(s string) (portRange, error) {
+	first, last, isRange := strings.Cut(s, "-")
+	if !isRange {
+		last = first
+	}
+	from, err1 := strconv.Atoi(first)
+	to, err2 := strconv.Atoi(last)
+	if err1 != nil || err2 != nil || from < 0 || to > 65535 || from > to || from == 0 && to != 0 {
+		return portRange{}, fmt.Errorf("invalid ActiveAddress port: %s", s)
+	}
+	return portRange{first: from, last: to}, nil
+}
+
+// secureData wraps the data connection dc with TLS if the control connection is protected by TLS, and with the
+// timeout of the reads and writes. The client is the TLS client whichever side opened the connection, and resumes
+// the TLS session of the control connection.
+func (f *FTP) secureData(dc net.Conn) (net.Conn, error) {
+	if f.tlsConfig != nil {
+		secure := tls.Client(dc, f.tlsConfig)
+		_ = secure.SetDeadline(time.Now().Add(f.dialTimeout()))
+		err := secure.Handshake()
+		if err != nil {
+			_ = dc.Close()
+			return nil, err
+		}
+		_ = secure.SetDeadline(time.Time{})
+		dc = secure
+	}
+	return &dataConn{Conn: dc, timeout: f.timeout()}, nil
+}
+
+// timeout returns the time the server has to answer or to move data.
+func (f *FTP) timeout() time.Duration {
+	if f.config.Timeout > 0 {
+		return f.config.Timeout
+	}
+	return defaultTimeout
+}
+
+// dialTimeout returns the time allowed to open a connection.
+func (f *FTP) dialTimeout() time.Duration {
+	if f.config.DialTimeout > 0 {
+		return f.config.DialTimeout
+	}
+	return f.timeout()
+}
+
+// parseEPSV returns the port of the reply to EPSV, "Entering Extended Passive Mode (|||port|)".
+func parseEPSV(msg string) (int, error) {
+	start := strings.Index(msg, "(")
+	end := strings.LastIndex(msg, ")")
+	if start < 0 || end < start+5 {
+		return 0, fmt.Errorf("invalid EPSV reply: %s", msg)
+	}
+	fields := strings.Split(msg[start+1:end], msg[start+1:start+2])
+	if len(fields) != 5 {
+		return 0, fmt.Errorf("invalid EPSV reply: %s", msg)
+	}
+	port, err := strconv.Atoi(fields[3])
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, fmt.Errorf("invalid EPSV reply: %s", msg)
+	}
+	return port, nil
+}
+
+// parsePASV returns the address and the port of the reply to PASV, "Entering Passive Mode (h1,h2,h3,h4,p1,p2)".
+// Some servers leave the parentheses out.
+func parsePASV(msg string) (net.IP, int, error) {
+	start := strings.IndexAny(msg, "0123456789")
+	if start < 0 {
+		return nil, 0, fmt.Errorf("invalid PASV reply: %s", msg)
+	}
+	end := start
+	for end < len(msg) && strings.IndexByte("0123456789,", msg[end]) >= 0 {
+		end++
+	}
+	fields := strings.Split(msg[start:end], ",")
+	if len(fields) != 6 {
+		return nil, 0, fmt.Errorf("invalid PASV reply: %s", msg)
+	}
+	var n [6]byte
+	for i, field := range fields {
+		v, err := strconv.Atoi(field)
+		if err != nil || v > 255 {
+			return nil, 0, fmt.Errorf("invalid PASV reply: %s", msg)
+		}
+		n[i] = byte(v)
+	}
+	return net.IPv4(n[0], n[1], n[2], n[3]), int(n[4])<<8 | int(n[5]), nil
+}
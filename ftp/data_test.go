@@ -0,0 +1,360 @@
+package ftp
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// checkOperations uploads, downloads, lists and stats a file over f.
+func checkOperations(t *testing.T, srv *testServer, f *FTP) {
+	t.Helper()
+	w, err := f.Create("/data.txt")
+	if err != nil {
+		t.Fatalf("Create returned an error: %v", err)
+	}
+	_, err = io.WriteString(w, "payload")
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		t.Fatalf("the upload failed: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(srv.root, "data.txt"))
+	if err != nil || string(data) != "payload" {
+		t.Fatalf("uploaded file = %q, %v, want %q", data, err, "payload")
+	}
+
+	r, err := f.Open("/data.txt")
+	if err != nil {
+		t.Fatalf("Open returned an error: %v", err)
+	}
+	data, err = io.ReadAll(r)
+	if closeErr := r.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || string(data) != "payload" {
+		t.Fatalf("downloaded file = %q, %v, want %q", data, err, "payload")
+	}
+
+	entries, err := f.List("/")
+	if err != nil {
+		t.Fatalf("List returned an error: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "data.txt" || entries[0].Size() != 7 {
+		t.Fatalf("List returned %v", entries)
+	}
+	info, err := f.Stat("/data.txt")
+	if err != nil {
+		t.Fatalf("Stat returned an error: %v", err)
+	}
+	if info.Name() != "data.txt" || info.Size() != 7 || info.IsDir() {
+		t.Errorf("Stat returned %s, size %d, dir %t", info.Name(), info.Size(), info.IsDir())
+	}
+	_, err = f.Stat("/missing.txt")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat of a missing file returned %v", err)
+	}
+}
+
+func TestDataModes(t *testing.T) {
+	tests := []struct {
+		name     string
+		features []string
+		config   ExtraConfig
+		want     []string
+		unwanted []string
+	}{
+		{name: "EPSV listed", config: ExtraConfig{}, want: []string{"EPSV", "MLSD", "MLST"}, unwanted: []string{"PASV", "PORT"}},
+		{name: "EPSV not listed", features: []string{"MLST type*;size*;modify*;"}, want: []string{"PASV"}, unwanted: []string{"EPSV"}},
+		{name: "EPSV disabled", config: ExtraConfig{DataMode: PassiveMode, DisableEPSV: true}, want: []string{"PASV"}, unwanted: []string{"EPSV"}},
+		{name: "active", config: ExtraConfig{DataMode: ActiveMode}, want: []string{"PORT"}, unwanted: []string{"EPSV", "PASV"}},
+		{name: "no MLST", features: []string{"EPSV"}, want: []string{"LIST"}, unwanted: []string{"MLSD", "MLST"}},
+		// A one line reply to FEAT lists no features.
+		{name: "no features", features: []string{}, want: []string{"FEAT", "LIST", "PASV"}, unwanted: []string{"EPSV", "MLSD"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := newTestServer(t)
+			if test.features != nil {
+				srv.setFeatures(test.features...)
+			}
+			config := test.config
+			checkOperations(t, srv, connectTestServer(t, srv, &config))
+			for _, cmd := range test.want {
+				if srv.received(cmd) == 0 {
+					t.Errorf("%s was not used", cmd)
+				}
+			}
+			for _, cmd := range test.unwanted {
+				if n := srv.received(cmd); n != 0 {
+					t.Errorf("%s was used %d times", cmd, n)
+				}
+			}
+		})
+	}
+}
+
+func TestPassiveAddress(t *testing.T) {
+	srv := newTestServer(t)
+	srv.setFeatures("MLST type*;size*;modify*;")
+
+	// An address the client cannot reach, from the documentation range.
+	srv.advertise("192.0.2.1")
+	f := connectTestServer(t, srv, &ExtraConfig{DataMode: PassiveMode, PassiveAddress: srv.host})
+	checkOperations(t, srv, f)
+
+	srv.advertise("0.0.0.0")
+	f = connectTestServer(t, srv, &ExtraConfig{DataMode: PassiveMode})
+	checkOperations(t, srv, f)
+	if n := srv.received("PORT"); n != 0 {
+		t.Errorf("PORT was used %d times in passive mode", n)
+	}
+}
+
+func TestAutoModeFallback(t *testing.T) {
+	srv := newTestServer(t)
+	srv.setFeatures("MLST type*;size*;modify*;")
+	srv.advertise("192.0.2.1")
+	f := connectTestServer(t, srv, &ExtraConfig{DialTimeout: 200 * time.Millisecond})
+	checkOperations(t, srv, f)
+	if srv.received("PORT") == 0 {
+		t.Errorf("the client did not switch to active mode")
+	}
+	if n := srv.received("PASV"); n != 1 {
+		t.Errorf("PASV was sent %d times, want 1 before switching to active mode", n)
+	}
+}
+
+func TestIPv6(t *testing.T) {
+	listener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	_ = listener.Close()
+
+	for _, mode := range []DataMode{PassiveMode, ActiveMode} {
+		srv := newTestServerAt(t, "[::1]:0")
+		// EPSV is needed over IPv6 even if the server does not list it.
+		srv.setFeatures("MLST type*;size*;modify*;")
+		config := &ExtraConfig{Username: "foo", Password: "pass", DataMode: mode, DisableEPSV: true}
+		f, err := Connect("::1", srv.port, LocalToRemote, config)
+		if err != nil {
+			t.Fatalf("Connect returned an error: %v", err)
+		}
+		checkOperations(t, srv, f)
+		_ = f.Close()
+		want := "EPSV"
+		if mode == ActiveMode {
+			want = "EPRT"
+		}
+		if srv.received(want) == 0 {
+			t.Errorf("%s was not used in mode %d", want, mode)
+		}
+	}
+}
+
+func TestActivePorts(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	_ = listener.Close()
+
+	srv := newTestServer(t)
+	address := net.JoinHostPort(srv.host, strconv.Itoa(port))
+	f := connectTestServer(t, srv, &ExtraConfig{DataMode: ActiveMode, ActiveAddress: address, ConnectionsPerHost: 2})
+	var releases []func()
+	for _, name := range []string{"first.txt", "second.txt"} {
+		err := os.WriteFile(filepath.Join(srv.root, name), []byte(name), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		releases = append(releases, srv.stall("/"+name))
+	}
+
+	// Both transfers are started before either of them sends any data.
+	readers := make(chan io.ReadCloser, 2)
+	errs := make(chan error, 2)
+	for _, name := range []string{"/first.txt", "/second.txt"} {
+		go func(name string) {
+			reader, err := f.Open(name)
+			if err != nil {
+				errs <- err
+				return
+			}
+			readers <- reader
+		}(name)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.parallelTransfers() < 2 && time.Now().Before(deadline) {
+		select {
+		case err := <-errs:
+			t.Fatalf("Open returned an error: %v", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if n := srv.parallelTransfers(); n != 2 {
+		t.Fatalf("%d downloads ran at the same time on the active port, want 2", n)
+	}
+	for _, release := range releases {
+		release()
+	}
+	for i := 0; i < 2; i++ {
+		reader := <-readers
+		_, err := io.ReadAll(reader)
+		if err != nil {
+			t.Errorf("ReadAll returned an error: %v", err)
+		}
+		_ = reader.Close()
+	}
+	if n := srv.received("PORT"); n != 2 {
+		t.Errorf("PORT was sent %d times, want 2", n)
+	}
+
+	for _, spec := range []string{"0", "2000", "2000-2010"} {
+		_, err := parsePortRange(spec)
+		if err != nil {
+			t.Errorf("parsePortRange(%q) returned an error: %v", spec, err)
+		}
+	}
+	for _, spec := range []string{"", "2010-2000", "0-10", "70000", "a-b"} {
+		_, err := parsePortRange(spec)
+		if err == nil {
+			t.Errorf("parsePortRange(%q) accepted an invalid port", spec)
+		}
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	t.Run("dial", func(t *testing.T) {
+		// A server that never greets the client.
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = listener.Close()
+		}()
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer func(conn net.Conn) {
+					_ = conn.Close()
+				}(conn)
+			}
+		}()
+		port := listener.Addr().(*net.TCPAddr).Port
+		f, err := Connect("127.0.0.1", port, LocalToRemote, &ExtraConfig{DialTimeout: 100 * time.Millisecond, Timeout: 10 * time.Second})
+		if err != nil {
+			t.Fatalf("Connect returned an error: %v", err)
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		start := time.Now()
+		err = f.Ping()
+		if err == nil {
+			t.Fatalf("Ping succeeded without a greeting")
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("Ping returned after %s, want about 100ms", elapsed)
+		}
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		srv := newTestServer(t)
+		f := connectTestServer(t, srv, &ExtraConfig{ConnectionsPerHost: 1, IdleTimeout: 50 * time.Millisecond})
+		for i := 0; i < 2; i++ {
+			_, err := f.Stat("/")
+			if err != nil {
+				t.Fatalf("Stat returned an error: %v", err)
+			}
+		}
+		if n := srv.connections(); n != 1 {
+			t.Errorf("%d connections were opened for two operations in a row, want 1", n)
+		}
+		time.Sleep(100 * time.Millisecond)
+		_, err := f.Stat("/")
+		if err != nil {
+			t.Fatalf("Stat returned an error after the idle timeout: %v", err)
+		}
+		if n := srv.connections(); n != 2 {
+			t.Errorf("%d connections were opened, want 2 once the first one was idle", n)
+		}
+	})
+
+	t.Run("operation", func(t *testing.T) {
+		srv := newTestServer(t)
+		err := os.Mkdir(filepath.Join(srv.root, "slow"), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		release := srv.stall("/slow")
+		defer release()
+		f := connectTestServer(t, srv, &ExtraConfig{ConnectionsPerHost: 1, Timeout: 10 * time.Second, OperationTimeout: 100 * time.Millisecond})
+		start := time.Now()
+		_, err = f.List("/slow")
+		if err == nil {
+			t.Fatalf("the stalled listing did not time out")
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("List returned after %s, want about 100ms", elapsed)
+		}
+		_, err = f.List("/")
+		if err != nil {
+			t.Errorf("List failed after the timed out listing: %v", err)
+		}
+	})
+}
+
+func TestParseReplies(t *testing.T) {
+	port, err := parseEPSV("Entering Extended Passive Mode (|||6446|)")
+	if err != nil || port != 6446 {
+		t.Errorf("parseEPSV = %d, %v, want 6446", port, err)
+	}
+	ip, port, err := parsePASV("Entering Passive Mode (192,168,1,2,4,1)")
+	if err != nil || !ip.Equal(net.IPv4(192, 168, 1, 2)) || port != 1025 {
+		t.Errorf("parsePASV = %s, %d, %v, want 192.168.1.2, 1025", ip, port, err)
+	}
+	_, _, err = parsePASV("Entering Passive Mode")
+	if err == nil {
+		t.Errorf("parsePASV accepted a reply without an address")
+	}
+
+	info, err := parseMLSx("type=file;size=12;modify=20150216084148.123;UNIX.mode=0640; my notes.txt")
+	if err != nil {
+		t.Fatalf("parseMLSx returned an error: %v", err)
+	}
+	want := time.Date(2015, 2, 16, 8, 41, 48, 123e6, time.UTC)
+	if info.Name() != "my notes.txt" || info.Size() != 12 || info.Mode() != 0o640 || !info.ModTime().Equal(want) {
+		t.Errorf("parseMLSx = %s %d %s %s", info.Name(), info.Size(), info.Mode(), info.ModTime())
+	}
+	info, err = parseMLSx("type=cdir;modify=20150216084148; /home")
+	if err != nil || info != nil {
+		t.Errorf("parseMLSx of the directory itself = %v, %v, want nil", info, err)
+	}
+
+	info, err = parseLIST("drwxr-x---   8 ftp      ftp           272 Jul 28  2014 my docs", time.Now().UTC())
+	if err != nil {
+		t.Fatalf("parseLIST returned an error: %v", err)
+	}
+	want = time.Date(2014, 7, 28, 0, 0, 0, 0, time.UTC)
+	if info.Name() != "my docs" || !info.IsDir() || info.Mode().Perm() != 0o750 || !info.ModTime().Equal(want) {
+		t.Errorf("parseLIST = %s %s %s", info.Name(), info.Mode(), info.ModTime())
+	}
+	info, err = parseLIST("lrwxrwxrwx 1 0 0 7 Jan  2 03:04 current -> release", time.Now().UTC())
+	if err != nil || info.Name() != "current" || info.Mode()&fs.ModeSymlink == 0 {
+		t.Errorf("parseLIST of a link = %v, %v", info, err)
+	}
+}
@@ -2,47 +2,149 @@ package ftp
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
-	"log"
-	"os"
-	"path/filepath"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/secsy/goftp"
 
+	"github.com/cploutarchou/syncpkg/engine"
 	"github.com/cploutarchou/syncpkg/worker"
-	"github.com/fsnotify/fsnotify"
 )
 
-var logger = log.New(os.Stdout, "ftp: ", log.Lshortfile)
+// SyncEvent describes something the sync did, such as the start, progress or end of a transfer
+type SyncEvent = engine.SyncEvent
 
-// SyncDirection is the direction of the sync (LocalToRemote or RemoteToLocal)
-type SyncDirection int
+// EventType is the kind of a SyncEvent
+type EventType = engine.EventType
+
+const (
+	//TransferStarted is emitted before a file is copied
+	TransferStarted = engine.TransferStarted
+	//TransferProgress is emitted while a file is copied
+	TransferProgress = engine.TransferProgress
+	//TransferCompleted is emitted once a file was copied
+	TransferCompleted = engine.TransferCompleted
+	//TransferFailed is emitted when a file could not be copied after all the attempts
+	TransferFailed = engine.TransferFailed
+	//Deleted is emitted once a file or directory was removed after it was removed on the other side
+	Deleted = engine.Deleted
+	//ConflictDetected is emitted when a file changed on both sides of a Bidirectional sync
+	ConflictDetected = engine.ConflictDetected
+	//Reconnecting is emitted when the connection to the server was found dead, before it is re-established
+	Reconnecting = engine.Reconnecting
+	//Reconnected is emitted when the connection to the server was re-established
+	Reconnected = engine.Reconnected
+	//InitialSyncDone is emitted once the initial synchronization finished
+	InitialSyncDone = engine.InitialSyncDone
+)
+
+// Stats is a snapshot of the metrics of the sync, returned by Stats
+type Stats = engine.Stats
+
+// Observer receives every SyncEvent. It is called synchronously and must return quickly.
+type Observer = engine.Observer
+
+// RetryPolicy decides how the operations that fail with a transient error are retried, see ExtraConfig.RetryPolicy
+type RetryPolicy = engine.RetryPolicy
+
+// TLSMode is the way the connections to the FTP server are encrypted
+type TLSMode int
+
+const (
+	//TLSNone sends the credentials and the files in cleartext, unless ExtraConfig.TLSConfig is set
+	TLSNone TLSMode = iota
+	//TLSExplicit connects in cleartext and upgrades the connection with AUTH TLS before logging in
+	TLSExplicit
+	//TLSImplicit connects with TLS from the start, usually to port 990
+	TLSImplicit
+)
+
+// eventBuffer is the number of events buffered by the channel returned by Events.
+const eventBuffer = 100
+
+// SyncDirection is the direction of the sync (LocalToRemote, RemoteToLocal or Bidirectional)
+type SyncDirection = engine.SyncDirection
 
 const (
 	//LocalToRemote is the direction of the sync from local to remote pc/server
-	LocalToRemote SyncDirection = iota
+	LocalToRemote = engine.LocalToRemote
 	//RemoteToLocal is the direction of the sync from remote to local pc/server
-	RemoteToLocal
+	RemoteToLocal = engine.RemoteToLocal
+	//Bidirectional is the direction of the sync in both directions, with conflict detection
+	Bidirectional = engine.Bidirectional
+)
+
+// ConflictPolicy decides which version of a file survives when it changed on both sides of a Bidirectional sync
+type ConflictPolicy = engine.ConflictPolicy
+
+const (
+	//NewestWins keeps the version with the most recent modification time
+	NewestWins = engine.NewestWins
+	//LocalWins keeps the local version
+	LocalWins = engine.LocalWins
+	//RemoteWins keeps the remote version
+	RemoteWins = engine.RemoteWins
+	//KeepBoth keeps both versions, the losing one under a conflict-suffixed name
+	KeepBoth = engine.KeepBoth
+)
+
+// MemoryState is the ExtraConfig.StateFile that keeps the state of the sync in memory only
+const MemoryState = engine.MemoryState
+
+// HashAlgorithm is the algorithm used to compare the content of files
+type HashAlgorithm = engine.HashAlgorithm
+
+const (
+	//HashNone compares files by size and modification time only
+	HashNone = engine.HashNone
+	//HashSHA256 compares files by their SHA-256 hash
+	HashSHA256 = engine.HashSHA256
+	//HashXXH64 compares files by their xxHash hash locally, and by SHA-256 or MD5 against the server
+	HashXXH64 = engine.HashXXH64
 )
 
 // FTP is the struct that holds the ftp client and the sync direction
 type FTP struct {
-	sync.Mutex
-	//client is the ftp client that is used to connect to the ftp server
-	client *goftp.Client
-	//Direction is the direction of the sync (LocalToRemote or RemoteToLocal)
+	//conns holds the control connections to the ftp server. It is replaced when the connection to the server is
+	//re-established.
+	conns *connPool
+	//connsMu guards conns
+	connsMu sync.RWMutex
+	//dial opens a new control connection to the server with the parameters of Connect
+	dial func() (goftp.RawConn, error)
+	//serverIP is the address of the server the connections are opened to
+	serverIP net.IP
+	//tlsConfig is the TLS configuration of the connections, nil without FTPS
+	tlsConfig *tls.Config
+	//mode is the way the data connections are opened, see ExtraConfig.DataMode
+	mode DataMode
+	//modeMu guards mode
+	modeMu sync.Mutex
+	//ports holds the ports of ExtraConfig.ActiveAddress that no active data connection listens on
+	ports chan int
+	//portsOnce fills ports
+	portsOnce sync.Once
+	//Direction is the direction of the sync (LocalToRemote, RemoteToLocal or Bidirectional)
 	Direction SyncDirection
 	//config is the struct that holds the extra config for the ftp connection
 	config *ExtraConfig
-	//Watcher is the fsnotify watcher that is used to watch the local directory
-	Watcher *fsnotify.Watcher
 	//Pool is the worker pool that is used to process the fsnotify events
-	Pool *worker.Pool
-	//ctx is the context that is used to cancel the watcher
-	ctx context.Context
+	Pool *worker.Pool[worker.Task]
+	//engine is the sync engine that keeps the local and the remote directory in sync
+	engine *engine.Engine
+	//events delivers the events of the sync to Events
+	events *engine.EventStream
+	//lifecycle guards engine
+	lifecycle sync.Mutex
+	//address is the host:port of the ftp server
+	address string
 }
 
 // ExtraConfig is the struct that holds the extra config for the ftp connection
@@ -55,10 +157,108 @@ type ExtraConfig struct {
 	LocalDir string
 	//RemoteDir is the remote directory that is used to sync with the local directory
 	RemoteDir string
-	//Retries is the number of retries that the ftp client will try to upload/download a file
+	//Retries is not used.
+	//
+	//Deprecated: use RetryPolicy.MaxAttempts.
 	Retries int
-	//MaxRetries is the number of retries that the ftp client will try to upload/download a file
+	//MaxRetries is the number of attempts made to upload, download or delete a file, create a directory or list a
+	//remote directory. It is only used if RetryPolicy.MaxAttempts is not set.
 	MaxRetries int
+	//RetryPolicy decides how often and how fast the operations that fail with a transient error, such as a timeout
+	//or a lost connection, are retried. Permanent errors, such as a missing file or a denied permission, are not.
+	RetryPolicy RetryPolicy
+	//ConflictPolicy decides which version wins when a file changed on both sides of a Bidirectional sync
+	ConflictPolicy ConflictPolicy
+	//StateFile is the file that records the last synced state of every path, so that files deleted while the
+	//process was down are deleted on the other side too. It defaults to a file of the sync pair in the syncpkg
+	//directory of the user cache directory, such as ~/.cache/syncpkg on Linux. The state is kept in memory only if
+	//it is MemoryState.
+	StateFile string
+	//HashAlgorithm enables the comparison of file contents, so that only files whose content differs are
+	//transferred. Remote files are hashed by the server with the HASH, XSHA256 or XMD5 commands, and files are
+	//transferred whenever the server offers none of them. Files are compared by size and modification time if it
+	//is HashNone.
+	HashAlgorithm HashAlgorithm
+	//Atomic makes transfers write to a hidden temporary file that is renamed over the target once it is complete,
+	//so that readers never see a partially written file. Temporary files left behind by a crash are removed on startup.
+	Atomic bool
+	//TempPrefix and TempSuffix form the name of the temporary file of an atomic transfer around the name of the
+	//target. They default to "." and ".syncpkg-tmp".
+	TempPrefix, TempSuffix string
+	//Observer receives every event of the sync. Unlike the channel returned by Events, it never misses one.
+	Observer Observer
+	//Logger receives the structured logs of the client and of the sync. Nothing is logged if it is nil.
+	Logger *slog.Logger
+	//Workers is the number of files transferred at the same time. It defaults to 10.
+	Workers int
+	//QueueSize is the number of changes that can wait for a worker before the watcher and the poller block. It
+	//defaults to Workers.
+	QueueSize int
+	//TLS enables FTPS: the control connections and the data connections are encrypted with TLS. It defaults to
+	//TLSExplicit if TLSConfig is set, and to TLSNone otherwise.
+	TLS TLSMode
+	//TLSConfig configures the TLS connections: RootCAs replaces the system CA pool, Certificates holds the client
+	//certificates and ServerName overrides the name the certificate of the server is verified against, which
+	//defaults to the address passed to Connect. The data connections resume the TLS session of their control
+	//connection, as most servers require, through ClientSessionCache, which defaults to an LRU cache.
+	TLSConfig *tls.Config
+	//ConnectionsPerHost is the number of control connections to the ftp server, and so the number of uploads,
+	//downloads, listings and deletes that run at the same time. A connection whose operation fails without a reply
+	//of the server, such as a transfer whose data connection timed out, is replaced by a new one. It defaults to 5.
+	ConnectionsPerHost int
+	//Timeout is the time the server has to answer a command or to move data over a data connection before the
+	//operation fails. It defaults to 5 seconds.
+	Timeout time.Duration
+	//DialTimeout is the time allowed to open a connection: to connect a control connection, set up its TLS session
+	//and log in, or to open a data connection. It defaults to Timeout.
+	DialTimeout time.Duration
+	//IdleTimeout is the time a control connection can stay unused before it is closed and opened again on its next
+	//use, ahead of the servers and the NAT gateways that silently drop idle connections. It defaults to 1 minute, a
+	//negative value keeps the connections open for as long as they work.
+	IdleTimeout time.Duration
+	//OperationTimeout is the time a listing, a stat, a directory creation, a delete, a rename or a change of
+	//modification time has to complete, however quickly the server answers each command. Transfers are bounded by
+	//Timeout only, since their duration depends on the size of the file. There is no limit if it is 0.
+	OperationTimeout time.Duration
+	//DataMode is the way the data connections are opened. The default, AutoMode, opens passive data connections and
+	//switches to active mode if one cannot be opened.
+	DataMode DataMode
+	//DisableEPSV makes passive mode use PASV even if the server lists EPSV in its features. The servers that list
+	//EPSV get EPSV otherwise, the others PASV. The servers reached over IPv6 always get EPSV.
+	DisableEPSV bool
+	//PassiveAddress is the host the passive data connections are opened to instead of the address the server
+	//advertises in its reply to PASV, for the servers that advertise an address the client cannot reach. Without it,
+	//a private address advertised by a server reached over a public one is replaced by the address of the server.
+	PassiveAddress string
+	//ActiveAddress is the address, host, host:port or host:first-last, announced to the server for the active data
+	//connections, such as the public address of a NAT gateway that forwards the ports to the client. The client
+	//listens on the ports on every interface, each data connection on a port no other one uses: the concurrent
+	//transfers wait for a port of the range to be free, and are run one at a time with a single port. It defaults to
+	//the local address of the route to the server and a random port for every data connection.
+	ActiveAddress string
+	//IPv6 prefers the IPv6 addresses of the server name over its IPv4 addresses. An IPv6 address passed to Connect
+	//is used either way.
+	IPv6 bool
+	//ServerLocation is the time zone of the modification times of the servers that list files with LIST only, such
+	//as time.FixedZone("", 2*60*60) for a server two hours ahead of UTC. The times of MLSD, MLST and MDTM are in UTC.
+	//It defaults to UTC.
+	ServerLocation *time.Location
+	//KeepAlive is the time between two checks of the connection to the server. A dropped connection is dialed
+	//again with the parameters of the connect function and the interrupted transfers are replayed. It defaults to
+	//30 seconds, a negative value disables the periodic checks.
+	KeepAlive time.Duration
+	//Debounce is the time a local file must be quiet before its changes are synced, so that the burst of events of a
+	//single save results in a single upload. It defaults to 100 milliseconds, a negative value disables it.
+	Debounce time.Duration
+	//Exclude holds gitignore patterns of the paths that are not synced, in addition to the .syncignore files of the
+	//synced directories
+	Exclude []string
+	//Include holds gitignore patterns of the paths that are synced even if Exclude, a preset or a .syncignore file
+	//excludes them. Paths inside an excluded directory stay excluded.
+	Include []string
+	//IgnorePresets names the built-in patterns that are excluded: "editor", "os" and "vcs". It defaults to "editor"
+	//and "os", set it to an empty slice to exclude none.
+	IgnorePresets []string
 }
 
 // Connect is a function used to establish a connection to an FTP server and return an FTP client for file synchronization.
@@ -67,7 +267,7 @@ type ExtraConfig struct {
 //
 // - port is the port of the FTP server.
 //
-// - direction is the direction of the synchronization, which can be either LocalToRemote or RemoteToLocal.
+// - direction is the direction of the synchronization, which can be LocalToRemote, RemoteToLocal or Bidirectional.
 //
 //   - config is a pointer to the ExtraConfig struct that holds additional configuration settings for the FTP connection,
 //     including FTP server credentials (username and password), local and remote directories, and synchronization retries.
@@ -79,7 +279,6 @@ type ExtraConfig struct {
 //	    Password:   "password",
 //	    LocalDir:   "localDir",
 //	    RemoteDir:  "remoteDir",
-//	    Retries:    3,
 //	    MaxRetries: 3,
 //	})
 //
@@ -87,597 +286,263 @@ type ExtraConfig struct {
 //	    log.Fatal(err)
 //	}
 func Connect(address string, port int, direction SyncDirection, config *ExtraConfig) (*FTP, error) {
-	address = fmt.Sprintf("%s:%d", address, port)
+	host := strings.Trim(address, "[]")
+	address = net.JoinHostPort(host, strconv.Itoa(port))
+	serverIP, err := resolveServer(host, config.IPv6)
+	if err != nil {
+		return nil, err
+	}
 
 	ftpConfig := goftp.Config{
-		User:     config.Username,
-		Password: config.Password,
+		User:               config.Username,
+		Password:           config.Password,
+		ConnectionsPerHost: 1,
+		Timeout:            config.Timeout,
+	}
+	if config.TLS != TLSNone || config.TLSConfig != nil {
+		ftpConfig.TLSConfig = newTLSConfig(config.TLSConfig, host)
+		if config.TLS == TLSImplicit {
+			ftpConfig.TLSMode = goftp.TLSImplicit
+		}
 	}
 
-	client, err := goftp.DialConfig(ftpConfig, address)
+	client, err := goftp.DialConfig(ftpConfig, net.JoinHostPort(serverIP.String(), strconv.Itoa(port)))
 	if err != nil {
 		return nil, err
 	}
 
 	ftp := &FTP{
-		client:    client,
 		Direction: direction,
-		ctx:       context.Background(),
-		Pool:      worker.NewWorkerPool(10),
+		Pool:      newPool(config),
+		events:    engine.NewEventStream(eventBuffer),
+		address:   address,
+		serverIP:  serverIP,
+		tlsConfig: ftpConfig.TLSConfig,
+		mode:      config.DataMode,
+		dial:      client.OpenRawConn,
 	}
 	ftp.config = config
+	ftp.conns = ftp.openConns()
 
-	logger.Println("Connected to FTP server.")
+	ftp.log().Info("connected to FTP server", "op", "connect", "address", address)
 	return ftp, nil
 }
 
-// initialSync is a method of the FTP struct that performs the initial synchronization between the local directory
-// and the remote directory. It calls the syncDir method to handle the synchronization process.
-//
-// This method is used internally to synchronize the directories when the FTP connection is initially established.
-// The synchronization direction is determined by the value of f.Direction, which can be either LocalToRemote or RemoteToLocal.
-//
-// - Returns an error if any error occurs during the synchronization process.
-func (f *FTP) initialSync() error {
-	return f.syncDir(f.config.LocalDir, f.config.RemoteDir)
-}
-
-// syncDir is a method of the FTP struct that synchronizes files between the local directory and the remote directory.
-// The synchronization direction depends on the value of f.Direction, which can be either LocalToRemote or RemoteToLocal.
-//
-// - localDir is the path to the local directory to be synchronized.
-//
-// - remoteDir is the path to the remote directory to be synchronized with.
-//
-// If f.Direction is LocalToRemote, this method will perform the following actions:
-// - Recursively traverse the local directory and its subdirectories.
-// - Check if each file exists on the remote server. If not, it will upload the file to the server.
-// - If the file is a directory, it will create the corresponding directory on the remote server if it doesn't exist.
-//
-// If f.Direction is RemoteToLocal, this method will perform the following actions:
-// - Recursively traverse the remote directory and its subdirectories.
-// - Check if each file exists in the local file system. If not, it will download the file from the server.
-// - If the file is a directory, it will create the corresponding directory in the local file system if it doesn't exist.
-//
-// This method is used internally by the synchronization process and is not intended to be called directly.
-func (f *FTP) syncDir(localDir, remoteDir string) error {
-	logger.Println("syncDir localDir", localDir)
-	switch f.Direction {
-	case LocalToRemote:
-		localFiles, err := os.ReadDir(localDir)
-		if err != nil {
-			return err
-		}
-		for _, file := range localFiles {
-			localFilePath := filepath.Join(localDir, file.Name())
-			remoteFilePath := filepath.Join(remoteDir, file.Name())
-			if file.IsDir() {
-				err = f.checkOrCreateDir(remoteFilePath)
-				if err != nil {
-					return err
-				}
-				err = f.syncDir(localFilePath, remoteFilePath)
-				if err != nil {
-					return err
-				}
-			} else {
-				// stat remote file and if it doesn't exist upload it to the server
-				_, err = f.client.Stat(remoteFilePath)
-				if err != nil {
-					localFile, err := os.Open(localFilePath)
-					if err != nil {
-						return err
-					}
-					defer func(localFile *os.File) {
-						_ = localFile.Close()
-					}(localFile)
-					err = f.client.Store(remoteFilePath, localFile)
-					if err != nil {
-						return err
-					}
-				}
-			}
-		}
-	case RemoteToLocal:
-		// Read the remote directory and all subdirectories.
-		remoteFiles, err := f.client.ReadDir(remoteDir)
-		if err != nil {
-			return err
-		}
-		for _, file := range remoteFiles {
-			remoteFilePath := filepath.Join(remoteDir, file.Name())
-			localFilePath := filepath.Join(localDir, file.Name())
-			if file.IsDir() {
-				err = f.checkOrCreateDir(localFilePath)
-				if err != nil {
-					return err
-				}
-				err = f.syncDir(localFilePath, remoteFilePath)
-				if err != nil {
-					return err
-				}
-			} else {
-				// stat local file and if it doesn't exist download it from the server
-				_, err = os.Stat(localFilePath)
-				if os.IsNotExist(err) {
-					localFile, err := os.Create(localFilePath)
-					if err != nil {
-						return err
-					}
-					defer func(localFile *os.File) {
-						_ = localFile.Close()
-					}(localFile)
-					err = f.client.Retrieve(remoteFilePath, localFile)
-					if err != nil {
-						return err
-					}
-				}
-			}
-		}
+// newTLSConfig returns a copy of config, or of an empty configuration if it is nil, that verifies the certificate
+// of the server against host unless it sets ServerName, and shares its TLS sessions between the connections.
+func newTLSConfig(config *tls.Config, host string) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
 	}
-	return nil
-}
-
-// WatchDirectory is a method of the FTP struct that sets up a file system watcher to monitor changes in the local directory.
-// It starts a worker pool and performs an initial synchronization between the local directory and the remote directory
-// based on the specified synchronization direction (LocalToRemote or RemoteToLocal).
-//
-// The method uses fsnotify package to monitor file system events such as file creations, modifications, and deletions.
-// When a file system event is detected, it creates a worker task and adds it to the worker pool for processing.
-// The worker tasks are handled by the Worker method, which performs the necessary file transfers to keep the directories in sync.
-//
-// The synchronization is bidirectional, meaning that changes made in the local directory will be propagated to the remote directory,
-// and changes made in the remote directory will be reflected in the local directory.
-//
-//   - Please note that this method enters an infinite loop to continuously monitor file system events until the context is canceled.
-//     The method will block until the context is done or an error occurs during the synchronization process.
-func (f *FTP) WatchDirectory() {
-	// Starting the worker pool
-	for i := 0; i < cap(f.Pool.Tasks); i++ {
-		go f.Worker()
+	config = config.Clone()
+	if config.ServerName == "" {
+		config.ServerName = host
 	}
-	logger.Println("Starting initial sync...")
-	err := f.initialSync()
-	if err != nil {
-		logger.Fatal(err)
+	if config.ClientSessionCache == nil {
+		config.ClientSessionCache = tls.NewLRUClientSessionCache(0)
 	}
-	logger.Println("Initial sync done.")
+	return config
+}
 
-	logger.Println("Setting up watcher...")
-	watcher, err := fsnotify.NewWatcher()
+// resolveServer returns the address of the server host, an IPv4 address unless ipv6 is set or it has none.
+func resolveServer(host string, ipv6 bool) (net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip, nil
+	}
+	ips, err := net.LookupIP(host)
 	if err != nil {
-		logger.Fatal(err)
+		return nil, fmt.Errorf("cannot resolve FTP server: %w", err)
 	}
-	defer func(watcher *fsnotify.Watcher) {
-		_ = watcher.Close()
-	}(watcher) // Moved defer to here.
-
-	go func() {
-		for {
-			select {
-			case event, ok := <-watcher.Events:
-				if !ok {
-					return
-				}
-				logger.Println("Received event:", event)
-
-				f.Pool.WG.Add(1)
-				f.Pool.Tasks <- worker.Task{EventType: event.Op, Name: event.Name}
-			case err, ok := <-watcher.Errors:
-				if !ok {
-					return
-				}
-				logger.Println("Error:", err)
-			}
+	for _, ip := range ips {
+		if (ip.To4() == nil) == ipv6 {
+			return ip, nil
 		}
-	}()
-
-	// Add root directory and all subdirectories to the watcher
-	err = f.AddDirectoriesToWatcher(watcher, f.config.LocalDir)
-	if err != nil {
-		logger.Fatal(err)
 	}
+	return ips[0], nil
+}
 
-	<-f.ctx.Done()
-	logger.Println("Directory watch ended.")
+// openConns returns a new pool of ExtraConfig.ConnectionsPerHost connections to the server.
+func (f *FTP) openConns() *connPool {
+	return newConnPool(f.dial, f.config, f.log())
 }
 
-// uploadFile is a method of the FTP struct that uploads a file to the remote FTP server.
-//
-// - filePath is the path to the local file that needs to be uploaded.
-//
-// The method attempts to upload the file to the FTP server for a maximum number of retries specified in f.config.MaxRetries.
-// If the upload fails for any reason, the method will log the error and retry until the maximum number of retries is reached.
-//
-// The method calculates the remote file path based on the local file path and the remote directory specified in f.config.RemoteDir.
-// It then opens the local file for reading and uploads it to the FTP server using the f.client.Store method.
-//
-// - Returns an error if the file upload fails after the maximum number of retries.
-func (f *FTP) uploadFile(filePath string) error {
-	// Open the file for reading
-	file, err := os.Open(filePath)
-	if err != nil {
-		return err
-	}
-	defer func(file *os.File) {
-		_ = file.Close()
-	}(file)
-
-	// Try to upload the file for MaxRetries times
-	for i := 0; i < f.config.MaxRetries; i++ {
-		// Calculate the remote file path
-		correctedFilePath := strings.Replace(filePath, f.config.LocalDir, "", 1)
-		correctedFilePath = filepath.Join(f.config.RemoteDir, correctedFilePath)
-
-		// Reset the file pointer to the beginning of the file
-		_, err = file.Seek(0, 0)
-		if err != nil {
-			return err
-		}
+// log returns the logger of the client, see logger.
+func (f *FTP) log() *slog.Logger {
+	return logger(f.config)
+}
 
-		// Upload the file to the FTP server
-		err = f.client.Store(correctedFilePath, file)
-		if err != nil {
-			// If upload fails, log the error and try again
-			logger.Printf("Attempt %d/%d: Error uploading file: %v", i+1, f.config.MaxRetries, err)
-			continue
-		} else {
-			// If upload succeeds, log the success and return nil
-			logger.Printf("Uploaded file: %s", filePath)
-			return nil
-		}
+// logger returns config.Logger, or engine.DiscardLogger if it is nil.
+func logger(config *ExtraConfig) *slog.Logger {
+	if config.Logger != nil {
+		return config.Logger
 	}
-
-	// If we reach this point, all attempts to upload the file have failed
-	return fmt.Errorf("failed to upload file after %d attempts", f.config.MaxRetries)
+	return engine.DiscardLogger
 }
 
-// downloadFile is a method of the FTP struct that downloads a file from the remote FTP server to the local file system.
-//
-// - name is the name of the file to be downloaded from the remote server.
-//
-// The method attempts to download the file from the FTP server for a maximum number of retries specified in f.config.MaxRetries.
-// If the download fails for any reason, the method will log the error and retry until the maximum number of retries is reached.
-//
-// The method calculates the remote file path based on the file name and the remote directory specified in f.config.RemoteDir.
-// It then creates a new local file and downloads the remote file from the FTP server using the f.client.Retrieve method.
-//
-// - Returns an error if the file download fails after the maximum number of retries.
-func (f *FTP) downloadFile(name string) error {
-	f.Lock()
-	defer f.Unlock()
+// defaultWorkers is the default number of workers of the pool.
+const defaultWorkers = 10
 
-	// Create the local file
-	file, err := os.Create(filepath.Join(f.config.LocalDir, name))
-	if err != nil {
-		return err
-	}
-	defer func(file *os.File) {
-		_ = file.Close()
-	}(file)
-
-	for i := 0; i < f.config.MaxRetries; i++ {
-		// Calculate the remote file path
-		remotePath := filepath.Join(f.config.RemoteDir, name)
-
-		// Download the file from the FTP server
-		err = f.client.Retrieve(remotePath, file)
-		if err != nil {
-			// If download fails, log the error and try again
-			logger.Printf("Attempt %d/%d: Error downloading file: %v", i+1, f.config.MaxRetries, err)
-			continue
-		} else {
-			// If download succeeds, log the success and return nil
-			logger.Printf("Downloaded file: %s", name)
-			return nil
-		}
+// newPool returns the worker pool configured by config.
+func newPool(config *ExtraConfig) *worker.Pool[worker.Task] {
+	workers := config.Workers
+	if workers <= 0 {
+		workers = defaultWorkers
 	}
-
-	// If we reach this point, all attempts to download the file have failed
-	return fmt.Errorf("failed to download file after %d attempts", f.config.MaxRetries)
+	return worker.New(worker.Config[worker.Task]{Workers: workers, Capacity: config.QueueSize, Key: worker.TaskKey})
 }
 
-// removeRemoteFile is a method of the FTP struct that deletes a file from the remote FTP server.
-//
-// - filePath is the path to the local file whose remote counterpart needs to be deleted.
-//
-// The method calculates the remote file path based on the local file path and the remote directory specified in f.config.RemoteDir.
-// It then sends a delete command to the FTP server using the f.client.Delete method to remove the file from the server.
-//
-// - Returns an error if the file deletion operation fails.
-func (f *FTP) removeRemoteFile(filePath string) error {
-	f.Lock()
-	defer f.Unlock()
-
-	// Get the remote file path from the local file path and the remote directory
-	remotePath := strings.Replace(filePath, f.config.LocalDir, f.config.RemoteDir, 1)
-
-	// Delete the file from the FTP server
-	err := f.client.Delete(remotePath)
-	if err != nil {
-		return err
+// engineConfig returns the configuration of the sync engine.
+func (f *FTP) engineConfig() engine.Config {
+	return engine.Config{
+		Direction:      f.Direction,
+		LocalDir:       f.config.LocalDir,
+		RemoteDir:      f.config.RemoteDir,
+		MaxRetries:     f.config.MaxRetries,
+		RetryPolicy:    f.config.RetryPolicy,
+		ConflictPolicy: f.config.ConflictPolicy,
+		StateFile:      f.config.StateFile,
+		HashAlgorithm:  f.config.HashAlgorithm,
+		Atomic:         f.config.Atomic,
+		TempPrefix:     f.config.TempPrefix,
+		TempSuffix:     f.config.TempSuffix,
+		Observer:       f.observer(),
+		Logger:         f.config.Logger,
+		Debounce:       f.config.Debounce,
+		KeepAlive:      f.config.KeepAlive,
+		Exclude:        f.config.Exclude,
+		Include:        f.config.Include,
+		IgnorePresets:  f.config.IgnorePresets,
+		Pair:           fmt.Sprintf("ftp://%s@%s%s", f.config.Username, f.address, f.config.RemoteDir),
 	}
-
-	return nil
 }
 
-// removeLocalFile is a method of the FTP struct that deletes a file from the local file system.
-//
-// - filePath is the path to the local file that needs to be deleted.
+// Events returns the channel the events of the sync are delivered on. Events are dropped while the channel is full,
+// use ExtraConfig.Observer to receive every one of them. The channel is closed by Close.
 //
-// The method uses the os.Remove function to delete the specified file from the local file system.
+// Example:
 //
-// - Returns an error if the file deletion operation fails.
-func (f *FTP) removeLocalFile(filePath string) error {
-	f.Lock()
-	defer f.Unlock()
-
-	err := os.Remove(filePath)
-	if err != nil {
-		return err
-	}
-
-	return nil
+//	go func() {
+//	    for event := range ftpConn.Events() {
+//	        if event.Type == TransferFailed {
+//	            log.Println("Upload failed:", event.Path, event.Err)
+//	        }
+//	    }
+//	}()
+func (f *FTP) Events() <-chan SyncEvent {
+	return f.events.Events()
 }
 
-// AddDirectoriesToWatcher is a method of the FTP struct that adds directories and their subdirectories to the fsnotify watcher.
-//
-// - watcher is a pointer to the fsnotify.Watcher that will be used to watch for file system events.
-//
-// - rootDir is the root directory from which directories and subdirectories will be added to the watcher.
-//
-// The method behaves differently based on the sync direction specified in f.Direction:
-//
-//   - LocalToRemote: It walks the local directory tree starting from rootDir and adds all directories to the fsnotify watcher.
-//     Each time a new directory is added, the method logs the event and starts watching for file system events in that directory.
-//
-//   - RemoteToLocal: It continuously reads the remote directory tree and its subdirectories and compares it with the previous state.
-//     When new files are detected or files are modified on the remote server, the method enqueues tasks to the worker pool for processing.
-//     If files are removed from the remote server, the method enqueues tasks to the worker pool to handle the file removal.
-//     The method keeps monitoring for changes in the remote directory tree until the context (f.ctx) is canceled or an error occurs.
-//
-// - Returns an error if there is a problem while adding directories to the fsnotify watcher or monitoring the remote directory tree.
-func (f *FTP) AddDirectoriesToWatcher(watcher *fsnotify.Watcher, rootDir string) error {
-	switch f.Direction {
-	case LocalToRemote:
-		return filepath.Walk(rootDir, func(path string, info os.FileInfo, err error) error {
-			if info.IsDir() {
-				err = watcher.Add(path)
-				if err != nil {
-					return err
-				}
-				logger.Println("Adding watcher to directory:", path)
-			}
-			return nil
-		})
-	case RemoteToLocal:
-		var prevFiles map[string]os.FileInfo
-		for {
-			// Read the remote directory and its subdirectories.
-			newFiles := make(map[string]os.FileInfo)
-			err := f.walkRemoteDir(rootDir, newFiles)
-			if err != nil {
-				return err
-			}
-			// Check for new or removed files.
-			if prevFiles != nil {
-				for p, file := range newFiles {
-					prevFile, exists := prevFiles[p]
-					if !exists || prevFile.ModTime().Before(file.ModTime()) {
-						f.Pool.WG.Add(1)
-						f.Pool.Tasks <- worker.Task{EventType: fsnotify.Write, Name: p}
-					}
-				}
-				for p := range prevFiles {
-					_, exists := newFiles[p]
-					if !exists {
-						f.Pool.WG.Add(1)
-						f.Pool.Tasks <- worker.Task{EventType: fsnotify.Remove, Name: p}
-						logger.Println("File removed:", p)
-					}
-				}
-			}
-			prevFiles = newFiles
-
-			// TODO : Add a condition to stop the infinite loop.
-			// For instance, if the context (f.ctx) has been canceled:
-			select {
-			case <-f.ctx.Done():
-				return nil
-			default:
-				// Wait for a while before checking again.
-				time.Sleep(time.Second * 1)
-			}
-		}
+// observer returns the Observer of the sync engine, which feeds Events and ExtraConfig.Observer.
+func (f *FTP) observer() engine.Observer {
+	if f.config.Observer == nil {
+		return f.events
 	}
-	return nil
+	return engine.ObserverFunc(func(event engine.SyncEvent) {
+		f.events.OnEvent(event)
+		f.config.Observer.OnEvent(event)
+	})
 }
 
-// Stat is a method of the FTP struct that retrieves file information (os.FileInfo) for a remote file on the FTP server.
+// Start builds the sync engine, with the FTP client as the remote backend, and starts it. It performs an initial
+// synchronization based on the synchronization direction and then keeps the local and the remote directory in sync
+// in the background, until ctx is done or Stop is called.
 //
-// - path is the path of the remote file for which file information is required.
+//   - LocalToRemote: the local directory is watched with fsnotify and every change is uploaded to or removed from the FTP server.
+//   - RemoteToLocal: the remote directory is polled and every change is downloaded to or removed from the local directory.
+//   - Bidirectional: both of the above run at the same time. Files changed on both sides are settled by ConflictPolicy.
 //
-// The method calculates the remote file path by joining the remote directory (f.config.RemoteDir) with the base name of the specified path.
-// It then fetches the file information from the FTP server using the f.client.Stat method.
+// Start returns once the initial synchronization is done, or with the error that prevented it. Errors that stop the
+// synchronization later on are returned by Wait.
 //
-// - Returns the file information (os.FileInfo) for the remote file if the operation is successful.
+// Example:
 //
-// - Returns an error if there is a problem retrieving the file information from the FTP server.
-func (f *FTP) Stat(path string) (os.FileInfo, error) {
-	f.Lock()
-	defer f.Unlock()
-
-	// Calculate the remote file path
-	remotePath := filepath.Join(f.config.RemoteDir, filepath.Base(path))
-
-	// Fetch the file info from the FTP server
-	fileInfo, err := f.client.Stat(remotePath)
+//	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+//	defer cancel()
+//	err := ftpConn.Start(ctx)
+//	if err != nil {
+//	    return err
+//	}
+//	return ftpConn.Wait()
+func (f *FTP) Start(ctx context.Context) error {
+	f.lifecycle.Lock()
+	if f.engine != nil {
+		f.lifecycle.Unlock()
+		return engine.ErrStarted
+	}
+	e, err := engine.New(engine.Local{}, f, f.Pool, f.engineConfig())
 	if err != nil {
-		return nil, err
+		f.lifecycle.Unlock()
+		return err
 	}
-
-	return fileInfo, nil
+	f.engine = e
+	f.lifecycle.Unlock()
+	return e.Start(ctx)
 }
 
-// walkRemoteDir is a method of the FTP struct that recursively lists the contents of a remote directory on the FTP server and populates the provided map with file information (os.FileInfo) for each file found.
-//
-// - dir is the path of the remote directory to be traversed.
-//
-// - files is the map that will be populated with file information for each file found in the remote directory and its subdirectories.
-//
-// The method uses f.client.ReadDir to list the contents of the specified remote directory. For each item in the directory, it checks if it represents a file or a subdirectory. If it's a subdirectory, it adds it to the files map and recursively calls itself with the subdirectory path. If it's a file, it adds it to the files map with its path.
-//
-// - Returns an error if there is a problem reading the remote directory or its subdirectories.
-//
-// Note: The provided map (files) should be initialized before calling this method to collect the file information. The method only collects file information and does not modify the map if it already contains data.
-func (f *FTP) walkRemoteDir(dir string, files map[string]os.FileInfo) error {
-	// Use the ReadDir to list the contents of the directory.
-	fileInfos, err := f.client.ReadDir(dir)
-	if err != nil {
-		return err
+// Stop stops the synchronization and waits until the changes already queued on the worker pool are processed.
+func (f *FTP) Stop() {
+	f.lifecycle.Lock()
+	e := f.engine
+	f.lifecycle.Unlock()
+	if e != nil {
+		e.Stop()
 	}
+}
 
-	for _, fileInfo := range fileInfos {
-		// Check if the fileInfo represents a file or a directory.
-		if fileInfo.IsDir() {
-			// If it's a directory, add it to the files map and recursively call walkRemoteDir.
-			files[filepath.Join(dir, fileInfo.Name())] = fileInfo
-			err = f.walkRemoteDir(filepath.Join(dir, fileInfo.Name()), files)
-			if err != nil {
-				return err
-			}
-		} else {
-			// If it's a file, add it to the files map.
-			files[filepath.Join(dir, fileInfo.Name())] = fileInfo
-		}
+// Wait blocks until the synchronization stopped and returns the error that stopped it, if any.
+func (f *FTP) Wait() error {
+	f.lifecycle.Lock()
+	e := f.engine
+	f.lifecycle.Unlock()
+	if e == nil {
+		return nil
 	}
+	return e.Wait()
+}
 
-	return nil
+// Stats returns a snapshot of the metrics of the synchronization: the files and bytes transferred, the failures,
+// the retries, the depth of the task queue and the latency histograms. It returns zero counters before Start.
+func (f *FTP) Stats() Stats {
+	f.lifecycle.Lock()
+	e := f.engine
+	f.lifecycle.Unlock()
+	if e == nil {
+		return Stats{QueueDepth: f.Pool.Len()}
+	}
+	return e.Stats()
 }
 
-// checkOrCreateDir is a method of the FTP struct that checks if the specified directory exists on either the local or remote side (depending on the sync direction) and creates it if it doesn't exist.
-//
-// - dirPath is the path of the directory to be checked and created (if necessary).
-//
-// The method first splits the directory path into individual parts using strings.Split. Then, depending on the sync direction (LocalToRemote or RemoteToLocal), it either checks and creates the directory on the remote FTP server using f.client.Mkdir or on the local machine using os.MkdirAll.
-//
-// - For LocalToRemote sync direction, the method uses f.client.Mkdir to try creating the directory on the FTP server. If the directory already exists on the server, it assumes the operation is successful. If the directory does not exist, it returns an error.
+// MetricsHandler returns an http.Handler that serves Stats in the Prometheus text format. It can be registered
+// before Start.
 //
-// - For RemoteToLocal sync direction, the method uses os.MkdirAll to create the directory on the local machine. If the directory already exists locally, it assumes the operation is successful. If the directory does not exist, it creates all necessary parent directories recursively.
+// Example:
 //
-// - Returns an error if there is a problem creating the directory on either the local or remote side.
-func (f *FTP) checkOrCreateDir(dirPath string) error {
-	pathParts := strings.Split(dirPath, "/")
-	currentPath := ""
-
-	switch f.Direction {
-	case LocalToRemote:
-		for _, part := range pathParts {
-			currentPath = currentPath + "/" + part
-			// First, try to make the directory
-			_, err := f.client.Mkdir(currentPath)
-			if err != nil {
-				// If that fails, assume it's because the directory already exists and check it
-				_, err := f.client.ReadDir(currentPath)
-				if err != nil {
-					// If that also fails, return the error
-					return err
-				}
-			}
-		}
-	case RemoteToLocal:
-		for _, part := range pathParts {
-			currentPath = filepath.Join(currentPath, part)
-			err := os.MkdirAll(currentPath, os.ModePerm)
-			if err != nil {
-				// If that fails, assume it's because the directory already exists
-				if !os.IsExist(err) {
-					// If the error is not because the directory already exists, return the error
-					return err
-				}
-			}
-		}
-	}
+//	http.Handle("/metrics", ftpConn.MetricsHandler())
+//	go http.ListenAndServe(":9100", nil)
+func (f *FTP) MetricsHandler() http.Handler {
+	return engine.StatsHandler(f.Stats)
+}
 
-	return nil
+// Close stops the synchronization, like Stop, closes the channel returned by Events and closes the connections to
+// the FTP server.
+func (f *FTP) Close() error {
+	f.Stop()
+	f.events.Close()
+	return f.pool().close()
 }
 
-// Worker starts a new worker goroutine that processes tasks received from the worker pool.
-//
-// The method listens for tasks on the f.Pool.Tasks channel, which is a buffered channel used for queuing tasks. Each task contains an EventType (fsnotify.Write, fsnotify.Remove, fsnotify.Rename, fsnotify.Chmod) and a Name (the file path of the task).
-//
-// Depending on the EventType and the sync direction (LocalToRemote or RemoteToLocal), the method performs different actions:
-//
-// - For fsnotify.Write events:
-//   - LocalToRemote: Calls f.uploadFile to upload the modified or newly created file to the remote FTP server.
-//   - RemoteToLocal: Calls f.downloadFile to download the modified or newly created file from the remote FTP server to the local machine.
+// WatchDirectory starts the synchronization with Start and blocks until it stops, returning the error that stopped it.
 //
-// - For fsnotify.Remove events:
-//   - LocalToRemote: Calls f.removeRemoteFile to delete the specified file from the remote FTP server.
-//   - RemoteToLocal: Calls f.removeLocalFile to delete the specified file from the local machine.
-//
-// - For fsnotify.Rename events:
-//   - LocalToRemote: Calls f.uploadFile to upload the renamed file to the remote FTP server, then calls f.removeRemoteFile to delete the original file from the server.
-//   - RemoteToLocal: Calls f.downloadFile to download the renamed file from the remote FTP server to the local machine, then calls f.removeLocalFile to delete the original file from the local machine.
-//
-// - For fsnotify.Chmod events: The method logs a message indicating that the permissions of a file have changed.
+// Example:
 //
-// After processing each task, the method marks it as done using f.Pool.WG.Done(), which decrements the worker pool's WaitGroup counter.
-func (f *FTP) Worker() {
-	defer f.Pool.WG.Done()
-	for task := range f.Pool.Tasks {
-		logger.Println("Processing task:", task)
-		switch task.EventType {
-		case fsnotify.Write:
-			switch f.Direction {
-			case LocalToRemote:
-				err := f.uploadFile(task.Name)
-				if err != nil {
-					logger.Println("Error uploading file:", err)
-				}
-			case RemoteToLocal:
-				err := f.downloadFile(task.Name)
-				if err != nil {
-					logger.Println("Error downloading file:", err)
-				}
-			}
-		case fsnotify.Remove:
-			switch f.Direction {
-			case LocalToRemote:
-				err := f.removeRemoteFile(task.Name)
-				if err != nil {
-					logger.Println("Error removing remote file:", err)
-				}
-			case RemoteToLocal:
-				err := f.removeLocalFile(task.Name)
-				if err != nil {
-					logger.Println("Error removing local file:", err)
-				}
-			}
-		case fsnotify.Rename:
-			switch f.Direction {
-			case LocalToRemote:
-				err := f.uploadFile(task.Name)
-				if err != nil {
-					logger.Println("Error uploading file:", err)
-				}
-				err = f.removeRemoteFile(task.Name)
-				if err != nil {
-					logger.Println("Error removing remote file:", err)
-				}
-			case RemoteToLocal:
-				err := f.downloadFile(task.Name)
-				if err != nil {
-					logger.Println("Error downloading file:", err)
-				}
-				err = f.removeLocalFile(task.Name)
-				if err != nil {
-					logger.Println("Error removing local file:", err)
-				}
-			}
-		case fsnotify.Chmod:
-			logger.Println("Permissions of file changed:", task.Name)
-		}
-		f.Pool.WG.Done()
+//	err := ftpConn.WatchDirectory()
+//	if err != nil {
+//	    log.Println("Synchronization stopped:", err)
+//	}
+func (f *FTP) WatchDirectory() error {
+	err := f.Start(context.Background())
+	if err != nil {
+		return err
 	}
+	return f.Wait()
 }
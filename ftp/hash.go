@@ -0,0 +1,101 @@
+package ftp
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/cploutarchou/syncpkg/engine"
+)
+
+// FTP hashes remote files on the server.
+var _ engine.Hasher = (*FTP)(nil)
+
+// hashNames holds the names of the algorithms in the HASH command and the commands that hash a file with them on the
+// servers that predate it.
+var hashNames = map[engine.HashAlgorithm]struct{ name, command string }{
+	engine.HashSHA256: {name: "SHA-256", command: "XSHA256"},
+	engine.HashMD5:    {name: "MD5", command: "XMD5"},
+}
+
+// Hash returns the hash of the remote path computed with the first of algorithms the server supports. It uses the
+// HASH command when the server lists the algorithm in its HASH feature, and the XSHA256 or XMD5 commands when it
+// lists them. It returns engine.ErrHashUnsupported if the server offers none of them.
+func (f *FTP) Hash(path string, algorithms ...engine.HashAlgorithm) (engine.HashAlgorithm, []byte, error) {
+	used := engine.HashNone
+	var sum []byte
+	err := f.pool().do(func(c *conn) error {
+		for _, algorithm := range algorithms {
+			var err error
+			sum, err = c.hash(path, algorithm)
+			if err != nil || sum != nil {
+				used = algorithm
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return engine.HashNone, nil, err
+	}
+	if sum == nil {
+		return engine.HashNone, nil, engine.ErrHashUnsupported
+	}
+	return used, sum, nil
+}
+
+// hash hashes path with algorithm on the server, and returns nil without an error if the server cannot. The
+// unsupported algorithms are not reported as errors, which would make the pool replace the connection.
+func (c *conn) hash(path string, algorithm engine.HashAlgorithm) ([]byte, error) {
+	names, ok := hashNames[algorithm]
+	if !ok {
+		return nil, nil
+	}
+	if supported, ok := c.features.params("HASH"); ok && hashListed(supported, names.name) {
+		_, err := c.command(200, "OPTS HASH %s", names.name)
+		if err == nil {
+			var msg string
+			msg, err = c.command(213, "HASH %s", path)
+			if err == nil {
+				// The reply holds the algorithm, the range of bytes hashed, the hash and the name of the file.
+				return parseHash(msg, algorithm, 2)
+			}
+		}
+		if replyCode(err) == replyFileUnavailable || replyCode(err) == 0 {
+			return nil, err
+		}
+	}
+	if c.features.has(names.command) {
+		msg, err := c.command(2, "%s %s", names.command, path)
+		if err == nil {
+			return parseHash(msg, algorithm, 0)
+		}
+		if replyCode(err) == replyFileUnavailable || replyCode(err) == 0 {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// hashListed reports whether name is one of the algorithms of the HASH feature, such as "SHA-1;SHA-256*;MD5", where
+// the star marks the algorithm selected by default.
+func hashListed(supported, name string) bool {
+	for _, algorithm := range strings.Split(supported, ";") {
+		if strings.EqualFold(strings.TrimSuffix(strings.TrimSpace(algorithm), "*"), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHash returns the hash of algorithm found in the field of the reply msg at index field.
+func parseHash(msg string, algorithm engine.HashAlgorithm, field int) ([]byte, error) {
+	fields := strings.Fields(msg)
+	if len(fields) > field {
+		sum, err := hex.DecodeString(fields[field])
+		if err == nil && len(sum) == algorithm.New().Size() {
+			return sum, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected %s hash reply: %q", algorithm, msg)
+}
@@ -0,0 +1,73 @@
+package ftp
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cploutarchou/syncpkg/engine"
+)
+
+func TestHash(t *testing.T) {
+	content := []byte("some content")
+	sha256sum, md5sum := sha256.Sum256(content), md5.Sum(content)
+	tests := []struct {
+		name       string
+		features   []string
+		algorithms []engine.HashAlgorithm
+		want       engine.HashAlgorithm
+		wantSum    []byte
+		wantCmd    string
+	}{
+		{name: "HASH", features: []string{"EPSV", "HASH SHA-1;SHA-256*;MD5", "XSHA256"},
+			algorithms: []engine.HashAlgorithm{engine.HashSHA256}, want: engine.HashSHA256, wantSum: sha256sum[:],
+			wantCmd: "HASH"},
+		{name: "HASH selects MD5", features: []string{"EPSV", "HASH SHA-1*;MD5"},
+			algorithms: []engine.HashAlgorithm{engine.HashSHA256, engine.HashMD5}, want: engine.HashMD5,
+			wantSum: md5sum[:], wantCmd: "OPTS"},
+		{name: "XSHA256", features: []string{"EPSV", "XSHA256", "XMD5"},
+			algorithms: []engine.HashAlgorithm{engine.HashSHA256, engine.HashMD5}, want: engine.HashSHA256,
+			wantSum: sha256sum[:], wantCmd: "XSHA256"},
+		{name: "XMD5", features: []string{"EPSV", "XMD5"},
+			algorithms: []engine.HashAlgorithm{engine.HashSHA256, engine.HashMD5}, want: engine.HashMD5,
+			wantSum: md5sum[:], wantCmd: "XMD5"},
+		{name: "unsupported", features: []string{"EPSV"},
+			algorithms: []engine.HashAlgorithm{engine.HashSHA256, engine.HashMD5}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := newTestServer(t)
+			srv.setFeatures(test.features...)
+			err := os.WriteFile(filepath.Join(srv.root, "notes.txt"), content, 0o644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f := connectTestServer(t, srv, &ExtraConfig{})
+
+			algorithm, sum, err := f.Hash("/notes.txt", test.algorithms...)
+			if test.want == engine.HashNone {
+				if !errors.Is(err, engine.ErrHashUnsupported) {
+					t.Fatalf("Hash returned %v, want ErrHashUnsupported", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Hash returned an error: %v", err)
+			}
+			if algorithm != test.want || string(sum) != string(test.wantSum) {
+				t.Errorf("Hash = %s %x, want %s %x", algorithm, sum, test.want, test.wantSum)
+			}
+			if srv.received(test.wantCmd) == 0 {
+				t.Errorf("%s was not used", test.wantCmd)
+			}
+
+			_, _, err = f.Hash("/missing.txt", test.algorithms...)
+			if !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("Hash of a missing file returned %v, want a not exist error", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,316 @@
+package ftp
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fileInfo is the os.FileInfo of a remote file, parsed from a listing.
+type fileInfo struct {
+	name  string
+	size  int64
+	mode  fs.FileMode
+	mtime time.Time
+	//raw is the line of the listing
+	raw string
+	//precise reports whether mtime is to the second, as MLSx and MDTM give it, rather than to the minute of LIST
+	precise bool
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) Mode() fs.FileMode  { return fi.mode }
+func (fi *fileInfo) ModTime() time.Time { return fi.mtime }
+func (fi *fileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *fileInfo) Sys() interface{}   { return fi.raw }
+
+// list returns the entries of the remote directory dir, with MLSD if the server lists MLST in its features and with
+// LIST otherwise. The modification times of the files listed with LIST are then asked with MDTM, if the server lists
+// it, since LIST gives them to the minute at best.
+func (f *FTP) list(c *conn, dir string) ([]os.FileInfo, error) {
+	entries, err := f.readDir(c, dir)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		err = f.modTime(c, path.Join(dir, entry.name), entry)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, entry)
+	}
+	return infos, nil
+}
+
+// readDir returns the entries of the remote directory dir as the server lists them, with MLSD if the server lists
+// MLST in its features and with LIST otherwise.
+func (f *FTP) readDir(c *conn, dir string) ([]*fileInfo, error) {
+	machine := c.features.has("MLST")
+	cmd := "LIST"
+	if machine {
+		cmd = "MLSD"
+	}
+	lines, err := f.readLines(c, cmd, dir)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().In(f.location())
+	var entries []*fileInfo
+	for _, line := range lines {
+		var info *fileInfo
+		if machine {
+			info, err = parseMLSx(line)
+		} else {
+			info, err = parseLIST(line, now)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if info == nil || info.name == "." || info.name == ".." {
+			continue
+		}
+		entries = append(entries, info)
+	}
+	return entries, nil
+}
+
+// modTime replaces the modification time of info, the entry of the remote file p listed with LIST, with the one
+// MDTM returns, if the server lists MDTM in its features. The listed time is kept if the server refuses MDTM for
+// the file, as some do for special files.
+func (f *FTP) modTime(c *conn, p string, info *fileInfo) error {
+	if info.precise || info.IsDir() || !c.features.has("MDTM") {
+		return nil
+	}
+	msg, err := c.command(213, "MDTM %s", p)
+	if replyCode(err)/100 == 5 {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	mtime, err := parseTimeVal(strings.TrimSpace(msg))
+	if err != nil {
+		return fmt.Errorf("invalid MDTM reply: %s", msg)
+	}
+	info.mtime, info.precise = mtime, true
+	return nil
+}
+
+// stat returns the information of the remote file p, with MLST if the server lists it in its features and by
+// listing its parent directory otherwise.
+func (f *FTP) stat(c *conn, p string) (os.FileInfo, error) {
+	p = path.Clean("/" + p)
+	if c.features.has("MLST") {
+		msg, err := c.command(250, "MLST %s", p)
+		if err != nil {
+			return nil, err
+		}
+		lines := strings.Split(msg, "\n")
+		if len(lines) < 3 {
+			return nil, fmt.Errorf("invalid MLST reply: %s", msg)
+		}
+		info, err := parseMLSx(strings.TrimLeft(lines[1], " "))
+		if err != nil {
+			return nil, err
+		}
+		if info == nil {
+			return nil, fmt.Errorf("invalid MLST reply: %s", msg)
+		}
+		info.name = path.Base(p)
+		return info, nil
+	}
+
+	if p == "/" {
+		return &fileInfo{name: "/", mode: fs.ModeDir | 0o755}, nil
+	}
+	entries, err := f.readDir(c, path.Dir(p))
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.name == path.Base(p) {
+			return entry, f.modTime(c, p, entry)
+		}
+	}
+	return nil, notExistError{err: fmt.Errorf("%s: no such file or directory", p)}
+}
+
+// Granularity returns the precision of the modification times the server reports, detected from its features: a
+// second if it lists MLST or MDTM, and a minute if the times come from LIST only. LIST gives the files modified more
+// than six months ago to the day, which the engine then tells apart by their size and their recorded state. It
+// returns an error if no connection to the server can be made to detect the features.
+func (f *FTP) Granularity() (time.Duration, error) {
+	granularity := time.Minute
+	err := f.pool().do(func(c *conn) error {
+		if c.features.has("MLST") || c.features.has("MDTM") {
+			granularity = time.Second
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return granularity, nil
+}
+
+// location returns the time zone of the times listed with LIST.
+func (f *FTP) location() *time.Location {
+	if f.config.ServerLocation != nil {
+		return f.config.ServerLocation
+	}
+	return time.UTC
+}
+
+// readLines runs the command cmd with the argument arg over a data connection and returns the lines sent over it.
+func (f *FTP) readLines(c *conn, cmd, arg string) ([]string, error) {
+	pending, err := f.openData(c)
+	if err != nil {
+		return nil, err
+	}
+	defer pending.close()
+	_, err = c.command(1, "%s %s", cmd, arg)
+	if err != nil {
+		return nil, err
+	}
+	data, err := pending.open()
+	if err != nil {
+		return nil, err
+	}
+	c.setData(data)
+	defer c.setData(nil)
+	var lines []string
+	scanner := bufio.NewScanner(data)
+	for scanner.Scan() {
+		if line := strings.TrimRight(scanner.Text(), "\r"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	readErr := scanner.Err()
+	_ = data.Close()
+	code, msg, err := c.raw.ReadResponse()
+	if err != nil {
+		return nil, err
+	}
+	if code/100 != 2 {
+		return nil, newReplyError("", code, msg)
+	}
+	return lines, readErr
+}
+
+// parseMLSx parses an entry of an MLSD or MLST listing, facts followed by a space and the name, such as
+// "type=file;size=12;modify=20150216084148;UNIX.mode=0644; notes.txt". It returns nil for the entries of the
+// directory itself and of its parent.
+func parseMLSx(line string) (*fileInfo, error) {
+	factList, name, ok := strings.Cut(line, " ")
+	if !ok {
+		return nil, fmt.Errorf("invalid MLSx entry: %s", line)
+	}
+	info := &fileInfo{name: name, raw: line, precise: true}
+	facts := map[string]string{}
+	for _, fact := range strings.Split(strings.TrimSuffix(factList, ";"), ";") {
+		key, value, _ := strings.Cut(fact, "=")
+		facts[strings.ToLower(key)] = value
+	}
+	switch typ := strings.ToLower(facts["type"]); {
+	case typ == "cdir" || typ == "pdir":
+		return nil, nil
+	case typ == "dir":
+		info.mode |= fs.ModeDir
+	case strings.HasPrefix(typ, "os.unix=slink") || strings.HasPrefix(typ, "os.unix=symlink"):
+		info.mode |= fs.ModeSymlink
+	}
+	if mode, err := strconv.ParseUint(facts["unix.mode"], 8, 32); err == nil {
+		info.mode |= fs.FileMode(mode) & fs.ModePerm
+	} else if info.IsDir() {
+		info.mode |= 0o755
+	} else {
+		info.mode |= 0o644
+	}
+	if size, ok := facts["size"]; ok {
+		var err error
+		info.size, err = strconv.ParseInt(size, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size in MLSx entry: %s", line)
+		}
+	}
+	if modify, ok := facts["modify"]; ok {
+		var err error
+		info.mtime, err = parseTimeVal(modify)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modify fact in MLSx entry: %s", line)
+		}
+	}
+	return info, nil
+}
+
+// parseTimeVal parses a time of the MLSx facts, YYYYMMDDHHMMSS in UTC with optional fractions of a second.
+func parseTimeVal(value string) (time.Time, error) {
+	layout := "20060102150405"
+	if i := strings.IndexByte(value, '.'); i >= 0 {
+		layout += "." + strings.Repeat("0", len(value)-i-1)
+	}
+	return time.Parse(layout, value)
+}
+
+// listRegexp matches an entry of a Unix style LIST listing, such as
+// "drwxr-xr-x   8 ftp      ftp           272 Jul 28 05:03 docs".
+var listRegexp = regexp.MustCompile(`^([-dlbcps])([-rwxsStT]{9})\S*\s+\d+\s+\S+\s+(?:\S+\s+)?(\d+)\s+(\w{3}\s+\d{1,2}\s+(?:\d{1,2}:\d{2}|\d{4}))\s+(.+)$`)
+
+// parseLIST parses an entry of a Unix style LIST listing made at the time now of the server. It returns nil for the
+// "total" line. The modification times of the listing have no time zone and are read in the location of now.
+func parseLIST(line string, now time.Time) (*fileInfo, error) {
+	if strings.HasPrefix(line, "total ") {
+		return nil, nil
+	}
+	m := listRegexp.FindStringSubmatch(line)
+	if m == nil {
+		return nil, fmt.Errorf("invalid LIST entry: %s", line)
+	}
+	info := &fileInfo{name: m[5], raw: line}
+	switch m[1] {
+	case "d":
+		info.mode |= fs.ModeDir
+	case "l":
+		info.mode |= fs.ModeSymlink
+		info.name, _, _ = strings.Cut(info.name, " -> ")
+	}
+	for i, c := range m[2] {
+		if c != '-' && c != 'S' && c != 'T' {
+			info.mode |= 1 << (8 - i)
+		}
+	}
+	var err error
+	info.size, err = strconv.ParseInt(m[3], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid size in LIST entry: %s", line)
+	}
+	info.mtime, err = parseLISTTime(strings.Join(strings.Fields(m[4]), " "), now)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time in LIST entry: %s", line)
+	}
+	return info, nil
+}
+
+// parseLISTTime parses the time of a LIST entry in the location of now, "Jan 2 15:04" for the files modified in the
+// last six months, whose year is the one that puts them in the past of now, or "Jan 2 2006".
+func parseLISTTime(value string, now time.Time) (time.Time, error) {
+	if !strings.Contains(value, ":") {
+		return time.ParseInLocation("Jan 2 2006", value, now.Location())
+	}
+	t, err := time.ParseInLocation("Jan 2 15:04 2006", value+" "+strconv.Itoa(now.Year()), now.Location())
+	if err != nil {
+		return time.Time{}, err
+	}
+	if t.After(now.Add(24 * time.Hour)) {
+		t = t.AddDate(-1, 0, 0)
+	}
+	return t, nil
+}
@@ -0,0 +1,116 @@
+package ftp
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestModificationTimes(t *testing.T) {
+	serverZone := time.FixedZone("server", 2*60*60)
+	tests := []struct {
+		name        string
+		features    []string
+		location    *time.Location
+		granularity time.Duration
+		want        []string
+		unwanted    []string
+	}{
+		{name: "MLSD", features: []string{"EPSV", "MLST type*;size*;modify*;", "MDTM"}, granularity: time.Second,
+			want: []string{"MLSD", "MLST"}, unwanted: []string{"LIST", "MDTM"}},
+		{name: "MDTM", features: []string{"EPSV", "MDTM"}, granularity: time.Second,
+			want: []string{"LIST", "MDTM"}, unwanted: []string{"MLSD", "MLST"}},
+		{name: "LIST", features: []string{"EPSV"}, granularity: time.Minute,
+			want: []string{"LIST"}, unwanted: []string{"MLSD", "MDTM"}},
+		{name: "LIST in the time zone of the server", features: []string{"EPSV"}, location: serverZone,
+			granularity: time.Minute, want: []string{"LIST"}},
+	}
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Minute).Add(27 * time.Second)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := newTestServer(t)
+			srv.setFeatures(test.features...)
+			srv.setLocation(test.location)
+			name := filepath.Join(srv.root, "notes.txt")
+			err := os.WriteFile(name, []byte("notes"), 0o644)
+			if err == nil {
+				err = os.Chtimes(name, mtime, mtime)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			f := connectTestServer(t, srv, &ExtraConfig{ServerLocation: test.location})
+
+			want := mtime.Truncate(test.granularity)
+			entries, err := f.List("/")
+			if err != nil {
+				t.Fatalf("List returned an error: %v", err)
+			}
+			if len(entries) != 1 || !entries[0].ModTime().Equal(want) {
+				t.Fatalf("List returned %v, want notes.txt modified at %s", entries, want)
+			}
+			info, err := f.Stat("/notes.txt")
+			if err != nil {
+				t.Fatalf("Stat returned an error: %v", err)
+			}
+			if !info.ModTime().Equal(want) {
+				t.Errorf("Stat returned the modification time %s, want %s", info.ModTime(), want)
+			}
+			if g, err := f.Granularity(); err != nil || g != test.granularity {
+				t.Errorf("Granularity = %s, %v, want %s", g, err, test.granularity)
+			}
+			for _, cmd := range test.want {
+				if srv.received(cmd) == 0 {
+					t.Errorf("%s was not used", cmd)
+				}
+			}
+			for _, cmd := range test.unwanted {
+				if n := srv.received(cmd); n != 0 {
+					t.Errorf("%s was used %d times", cmd, n)
+				}
+			}
+		})
+	}
+}
+
+func TestGranularityUnreachable(t *testing.T) {
+	srv := newTestServer(t)
+	srv.setFeatures("EPSV")
+	f := connectTestServer(t, srv, &ExtraConfig{ConnectionsPerHost: 1})
+	address := srv.listener.Addr().String()
+	_ = srv.listener.Close()
+	srv.drop()
+	_ = f.Ping()
+	_, err := f.Granularity()
+	if err == nil {
+		t.Fatalf("Granularity returned no error while the server is down")
+	}
+
+	srv = newTestServerAt(t, address)
+	srv.setFeatures("EPSV", "MDTM")
+	g, err := f.Granularity()
+	if err != nil || g != time.Second {
+		t.Errorf("Granularity = %s, %v after the server came back, want %s", g, err, time.Second)
+	}
+}
+
+func TestParseLISTTime(t *testing.T) {
+	zone := time.FixedZone("", -5*60*60)
+	now := time.Date(2024, 1, 5, 12, 0, 0, 0, zone)
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		{value: "Jan 5 09:30", want: time.Date(2024, 1, 5, 9, 30, 0, 0, zone)},
+		// A time later than now is from the previous year.
+		{value: "Dec 30 23:15", want: time.Date(2023, 12, 30, 23, 15, 0, 0, zone)},
+		{value: "Jul 28 2014", want: time.Date(2014, 7, 28, 0, 0, 0, 0, zone)},
+	}
+	for _, test := range tests {
+		got, err := parseLISTTime(test.value, now)
+		if err != nil || !got.Equal(test.want) {
+			t.Errorf("parseLISTTime(%q) = %s, %v, want %s", test.value, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package ftp
+
+import (
+	"errors"
+	"time"
+
+	"github.com/cploutarchou/syncpkg/engine"
+)
+
+// FTP re-establishes the connection to the server when it drops.
+var _ engine.Reconnector = (*FTP)(nil)
+
+// pingTimeout is the time the server has to answer a ping before the connection is considered dead.
+const pingTimeout = 10 * time.Second
+
+// errPingTimeout is returned by Ping when the server did not answer in time.
+var errPingTimeout = errors.New("ftp: server did not answer the keepalive")
+
+// pool returns the current pool of connections.
+func (f *FTP) pool() *connPool {
+	f.connsMu.RLock()
+	defer f.connsMu.RUnlock()
+	return f.conns
+}
+
+// Ping checks the connection with a PWD command over a free connection of the pool. A connection whose server does
+// not answer within pingTimeout is closed, which fails the operations blocked on it. The connection is assumed to be
+// alive if every connection is busy.
+func (f *FTP) Ping() error {
+	pool := f.pool()
+	c := pool.tryCheckout()
+	if c == nil {
+		return nil
+	}
+	done := make(chan error, 1)
+	go func() {
+		err := pool.open(c)
+		if err == nil {
+			_, err = c.command(257, "PWD")
+		}
+		done <- err
+	}()
+	timer := time.NewTimer(pingTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		pool.checkin(c, err)
+		return err
+	case <-timer.C:
+		pool.abort(c)
+		<-done
+		pool.checkin(c, errPingTimeout)
+		return errPingTimeout
+	}
+}
+
+// Reconnect dials the server again with the parameters of Connect, replaces the pool of connections with a new one
+// and closes the old one. The connections are opened lazily, so a connection of the new pool is checked with a PWD
+// command first.
+func (f *FTP) Reconnect() error {
+	conns := f.openConns()
+	err := conns.do(func(c *conn) error {
+		_, err := c.command(257, "PWD")
+		return err
+	})
+	if err != nil {
+		_ = conns.close()
+		return err
+	}
+
+	f.connsMu.Lock()
+	old := f.conns
+	f.conns = conns
+	f.connsMu.Unlock()
+
+	_ = old.close()
+	f.log().Info("reconnected to FTP server", "op", "connect", "address", f.address)
+	return nil
+}
@@ -0,0 +1,778 @@
+package ftp
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cploutarchou/syncpkg/engine"
+)
+
+// testServer is an in-process FTP server serving the directory root to the user foo with the password pass. It
+// implements the subset of the protocol the FTP client uses, in passive and active mode, and FTPS once useTLS is
+// called.
+type testServer struct {
+	//host and port are the address the server listens on
+	host string
+	port int
+	//root is the directory the server serves
+	root string
+	//listener accepts the control connections
+	listener net.Listener
+	//mu guards the fields below
+	mu sync.Mutex
+	//conns holds the open control connections
+	conns []net.Conn
+	//accepted counts the accepted control connections
+	accepted int
+	//transfers is the number of RETR and STOR commands running, and maxTransfers the highest it was
+	transfers, maxTransfers int
+	//stalled holds the paths whose RETR sends no data until the channel is closed
+	stalled map[string]chan struct{}
+	//tlsConfig, if set, is the TLS configuration of the server, which then refuses to log in over a cleartext
+	//connection. implicit makes it expect TLS from the start instead of an AUTH TLS command.
+	tlsConfig *tls.Config
+	implicit  bool
+	//secureTransfers counts the data connections protected by TLS, and resumed those that resumed a TLS session
+	secureTransfers, resumed int
+	//features are the features listed in the reply to FEAT
+	features []string
+	//pasvHost, if set, is the address advertised in the replies to PASV
+	pasvHost string
+	//commands counts the commands received, by name
+	commands map[string]int
+	//location is the time zone of the times listed with LIST, UTC if it is nil
+	location *time.Location
+}
+
+// newTestServer starts a test server that is stopped at the end of the test.
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	return newTestServerAt(t, "127.0.0.1:0")
+}
+
+// newTestServerAt starts a test server listening on address that is stopped at the end of the test.
+func newTestServerAt(t *testing.T, address string) *testServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	srv := &testServer{
+		host:     host,
+		root:     t.TempDir(),
+		listener: listener,
+		stalled:  map[string]chan struct{}{},
+		features: []string{"EPSV", "MLST type*;size*;modify*;", "SIZE", "MFMT"},
+		commands: map[string]int{},
+	}
+	srv.port, _ = strconv.Atoi(port)
+	go srv.accept()
+	t.Cleanup(func() {
+		_ = listener.Close()
+		srv.mu.Lock()
+		for _, release := range srv.stalled {
+			close(release)
+		}
+		srv.stalled = nil
+		srv.mu.Unlock()
+		srv.drop()
+	})
+	return srv
+}
+
+// accept serves the control connections until the listener is closed.
+func (srv *testServer) accept() {
+	for {
+		conn, err := srv.listener.Accept()
+		if err != nil {
+			return
+		}
+		srv.mu.Lock()
+		srv.conns = append(srv.conns, conn)
+		srv.accepted++
+		srv.mu.Unlock()
+		go srv.serve(conn)
+	}
+}
+
+// useTLS makes the server require FTPS with the TLS configuration config, implicit or explicit.
+func (srv *testServer) useTLS(config *tls.Config, implicit bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.tlsConfig, srv.implicit = config, implicit
+}
+
+// tlsTransfers returns the number of data connections protected by TLS and the number of those that resumed a TLS
+// session.
+func (srv *testServer) tlsTransfers() (secure, resumed int) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.secureTransfers, srv.resumed
+}
+
+// setFeatures replaces the features listed in the reply to FEAT.
+func (srv *testServer) setFeatures(features ...string) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.features = features
+}
+
+// advertise makes the replies to PASV advertise host instead of the address of the server.
+func (srv *testServer) advertise(host string) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.pasvHost = host
+}
+
+// setLocation makes LIST list the modification times in the time zone loc.
+func (srv *testServer) setLocation(loc *time.Location) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.location = loc
+}
+
+// received returns the number of commands cmd received so far.
+func (srv *testServer) received(cmd string) int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.commands[cmd]
+}
+
+// connections returns the number of control connections accepted so far.
+func (srv *testServer) connections() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.accepted
+}
+
+// parallelTransfers returns the highest number of transfers that ran at the same time.
+func (srv *testServer) parallelTransfers() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.maxTransfers
+}
+
+// stall makes the downloads of the remote file name send no data until the returned function is called.
+func (srv *testServer) stall(name string) func() {
+	release := make(chan struct{})
+	srv.mu.Lock()
+	srv.stalled[name] = release
+	srv.mu.Unlock()
+	return func() {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		if srv.stalled[name] == release {
+			delete(srv.stalled, name)
+			close(release)
+		}
+	}
+}
+
+// drop closes every open control connection, as a restarting server does.
+func (srv *testServer) drop() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for _, conn := range srv.conns {
+		_ = conn.Close()
+	}
+	srv.conns = nil
+}
+
+// session is the state of a control connection.
+type session struct {
+	srv *testServer
+	//conn is the control connection, wrapped by TLS once it is secure
+	conn net.Conn
+	//commands reads the commands and ctrl writes the replies
+	commands *bufio.Reader
+	ctrl     *bufio.Writer
+	//tlsConfig is the TLS configuration of the server, nil if it does not support TLS
+	tlsConfig *tls.Config
+	//secure is true once the control connection is protected by TLS, and protected once the data connections are
+	secure, protected bool
+	//passive accepts the next data connection, and active is the address the next data connection is opened to
+	passive net.Listener
+	active  string
+	//rest is the offset of the next transfer
+	rest int64
+	//renameFrom is the path of the last RNFR command
+	renameFrom string
+	//hash is the algorithm of the HASH command selected with OPTS HASH
+	hash string
+}
+
+// serve runs the commands received over conn.
+func (srv *testServer) serve(conn net.Conn) {
+	srv.mu.Lock()
+	s := &session{srv: srv, tlsConfig: srv.tlsConfig, hash: "SHA-256"}
+	implicit := srv.implicit
+	srv.mu.Unlock()
+	if s.tlsConfig != nil && implicit {
+		conn = tls.Server(conn, s.tlsConfig)
+		s.secure = true
+	}
+	s.setConn(conn)
+	defer func() {
+		_ = s.conn.Close()
+	}()
+	defer s.closePassive()
+	s.reply(220, "ready")
+	for {
+		line, err := s.commands.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		cmd = strings.ToUpper(cmd)
+		srv.mu.Lock()
+		srv.commands[cmd]++
+		srv.mu.Unlock()
+		if !s.run(cmd, arg) {
+			return
+		}
+	}
+}
+
+// setConn makes conn the control connection.
+func (s *session) setConn(conn net.Conn) {
+	s.conn = conn
+	s.commands = bufio.NewReader(conn)
+	s.ctrl = bufio.NewWriter(conn)
+}
+
+// reply sends a single-line reply.
+func (s *session) reply(code int, msg string) {
+	_, _ = fmt.Fprintf(s.ctrl, "%d %s\r\n", code, msg)
+	_ = s.ctrl.Flush()
+}
+
+// replyLines sends a multi-line reply whose first line is first and whose last line is last.
+func (s *session) replyLines(code int, first string, lines []string, last string) {
+	_, _ = fmt.Fprintf(s.ctrl, "%d-%s\r\n", code, first)
+	for _, line := range lines {
+		_, _ = fmt.Fprintf(s.ctrl, " %s\r\n", line)
+	}
+	s.reply(code, last)
+}
+
+// local returns the local path of the remote path p.
+func (s *session) local(p string) string {
+	return filepath.Join(s.srv.root, filepath.FromSlash(path.Clean("/"+p)))
+}
+
+// closePassive closes the passive listener, if any, and forgets the active address.
+func (s *session) closePassive() {
+	if s.passive != nil {
+		_ = s.passive.Close()
+		s.passive = nil
+	}
+	s.active = ""
+}
+
+// listen opens the passive listener and returns its port.
+func (s *session) listen() (int, error) {
+	listener, err := net.Listen("tcp", net.JoinHostPort(s.srv.host, "0"))
+	if err != nil {
+		return 0, err
+	}
+	s.closePassive()
+	s.passive = listener
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// run runs a command and reports whether the connection stays open.
+func (s *session) run(cmd, arg string) bool {
+	switch cmd {
+	case "AUTH":
+		if s.tlsConfig == nil || s.secure || !strings.EqualFold(arg, "TLS") {
+			s.reply(504, "AUTH not supported")
+			return true
+		}
+		s.reply(234, "starting TLS")
+		s.setConn(tls.Server(s.conn, s.tlsConfig))
+		s.secure = true
+	case "PBSZ":
+		s.reply(200, "PBSZ=0")
+	case "PROT":
+		if !s.secure {
+			s.reply(503, "use AUTH TLS first")
+			return true
+		}
+		s.protected = strings.EqualFold(arg, "P")
+		s.reply(200, "protection level set")
+	case "USER":
+		if s.tlsConfig != nil && !s.secure {
+			s.reply(530, "TLS required")
+			return true
+		}
+		s.reply(331, "password required")
+	case "PASS":
+		if arg != "pass" {
+			s.reply(530, "login incorrect")
+			return true
+		}
+		s.reply(230, "logged in")
+	case "FEAT":
+		s.srv.mu.Lock()
+		features := s.srv.features
+		s.srv.mu.Unlock()
+		if len(features) == 0 {
+			s.reply(211, "No features")
+			return true
+		}
+		s.replyLines(211, "Features:", features, "End")
+	case "TYPE":
+		s.reply(200, "type set")
+	case "PWD":
+		s.reply(257, `"/" is the current directory`)
+	case "EPSV":
+		port, err := s.listen()
+		if err != nil {
+			s.reply(425, err.Error())
+			return true
+		}
+		s.reply(229, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", port))
+	case "PASV":
+		port, err := s.listen()
+		if err != nil {
+			s.reply(425, err.Error())
+			return true
+		}
+		s.srv.mu.Lock()
+		host := s.srv.pasvHost
+		s.srv.mu.Unlock()
+		if host == "" {
+			host = s.srv.host
+		}
+		ip := net.ParseIP(host).To4()
+		s.reply(227, fmt.Sprintf("Entering Passive Mode (%d,%d,%d,%d,%d,%d)", ip[0], ip[1], ip[2], ip[3], port>>8, port&0xff))
+	case "PORT":
+		fields := strings.Split(arg, ",")
+		if len(fields) != 6 {
+			s.reply(501, "invalid PORT")
+			return true
+		}
+		p1, _ := strconv.Atoi(fields[4])
+		p2, _ := strconv.Atoi(fields[5])
+		s.closePassive()
+		s.active = net.JoinHostPort(strings.Join(fields[:4], "."), strconv.Itoa(p1<<8|p2))
+		s.reply(200, "PORT ok")
+	case "EPRT":
+		fields := strings.Split(arg, arg[:1])
+		if len(fields) != 5 {
+			s.reply(501, "invalid EPRT")
+			return true
+		}
+		s.closePassive()
+		s.active = net.JoinHostPort(fields[2], fields[3])
+		s.reply(200, "EPRT ok")
+	case "REST":
+		offset, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			s.reply(501, err.Error())
+			return true
+		}
+		s.rest = offset
+		s.reply(350, "restarting")
+	case "SIZE":
+		info, err := os.Stat(s.local(arg))
+		if err != nil {
+			s.reply(550, err.Error())
+			return true
+		}
+		s.reply(213, strconv.FormatInt(info.Size(), 10))
+	case "MLST":
+		info, err := os.Stat(s.local(arg))
+		if err != nil {
+			s.reply(550, err.Error())
+			return true
+		}
+		s.replyLines(250, "Listing "+arg, []string{facts(info) + " " + arg}, "End")
+	case "MDTM":
+		info, err := os.Stat(s.local(arg))
+		if err == nil && info.IsDir() {
+			err = fmt.Errorf("%s: not a plain file", arg)
+		}
+		if err != nil {
+			s.reply(550, err.Error())
+			return true
+		}
+		s.reply(213, info.ModTime().UTC().Format("20060102150405"))
+	case "MLSD", "LIST":
+		entries, err := os.ReadDir(s.local(arg))
+		if err != nil {
+			s.reply(550, err.Error())
+			return true
+		}
+		s.srv.mu.Lock()
+		release := s.srv.stalled[path.Clean("/"+arg)]
+		loc := s.srv.location
+		s.srv.mu.Unlock()
+		if loc == nil {
+			loc = time.UTC
+		}
+		s.transfer(func(data net.Conn) error {
+			if release != nil {
+				<-release
+			}
+			for _, entry := range entries {
+				info, err := entry.Info()
+				if err != nil {
+					return err
+				}
+				if cmd == "LIST" {
+					_, err = fmt.Fprintf(data, "%s\r\n", lsLine(info, loc))
+				} else {
+					_, err = fmt.Fprintf(data, "%s %s\r\n", facts(info), entry.Name())
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	case "RETR":
+		file, err := os.Open(s.local(arg))
+		if err != nil {
+			s.reply(550, err.Error())
+			return true
+		}
+		s.srv.mu.Lock()
+		release := s.srv.stalled[path.Clean("/"+arg)]
+		s.srv.mu.Unlock()
+		s.transfer(func(data net.Conn) error {
+			defer func() {
+				_ = file.Close()
+			}()
+			if release != nil {
+				<-release
+			}
+			_, err := file.Seek(s.rest, io.SeekStart)
+			if err == nil {
+				_, err = io.Copy(data, file)
+			}
+			return err
+		})
+	case "STOR", "APPE":
+		flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if cmd == "APPE" {
+			flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		}
+		file, err := os.OpenFile(s.local(arg), flags, 0o644)
+		if err != nil {
+			s.reply(550, err.Error())
+			return true
+		}
+		s.transfer(func(data net.Conn) error {
+			_, err := io.Copy(file, data)
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			return err
+		})
+	case "MKD":
+		err := os.Mkdir(s.local(arg), 0o755)
+		if err != nil {
+			s.reply(550, err.Error())
+			return true
+		}
+		s.reply(257, fmt.Sprintf("%q created", arg))
+	case "RMD", "DELE":
+		err := os.Remove(s.local(arg))
+		if err != nil {
+			s.reply(550, err.Error())
+			return true
+		}
+		s.reply(250, "removed")
+	case "RNFR":
+		s.renameFrom = arg
+		s.reply(350, "ready for RNTO")
+	case "RNTO":
+		err := os.Rename(s.local(s.renameFrom), s.local(arg))
+		if err != nil {
+			s.reply(550, err.Error())
+			return true
+		}
+		s.reply(250, "renamed")
+	case "MFMT":
+		stamp, name, _ := strings.Cut(arg, " ")
+		mtime, err := time.Parse("20060102150405", stamp)
+		if err == nil {
+			err = os.Chtimes(s.local(name), mtime, mtime)
+		}
+		if err != nil {
+			s.reply(550, err.Error())
+			return true
+		}
+		s.reply(213, "Modify="+stamp+"; "+name)
+	case "OPTS":
+		name, value, _ := strings.Cut(arg, " ")
+		if !strings.EqualFold(name, "HASH") || value != "SHA-256" && value != "MD5" {
+			s.reply(501, "option not supported")
+			return true
+		}
+		s.hash = value
+		s.reply(200, value)
+	case "HASH", "XSHA256", "XMD5":
+		data, err := os.ReadFile(s.local(arg))
+		if err != nil {
+			s.reply(550, err.Error())
+			return true
+		}
+		algorithm := map[string]string{"HASH": s.hash, "XSHA256": "SHA-256", "XMD5": "MD5"}[cmd]
+		var sum []byte
+		if algorithm == "MD5" {
+			md5sum := md5.Sum(data)
+			sum = md5sum[:]
+		} else {
+			sha256sum := sha256.Sum256(data)
+			sum = sha256sum[:]
+		}
+		if cmd == "HASH" {
+			s.reply(213, fmt.Sprintf("%s 0-%d %x %s", algorithm, len(data), sum, arg))
+			return true
+		}
+		s.reply(250, fmt.Sprintf("%x", sum))
+	case "QUIT":
+		s.reply(221, "bye")
+		return false
+	default:
+		s.reply(502, "command not implemented")
+	}
+	return true
+}
+
+// transfer accepts the data connection of the passive listener and runs fn over it.
+func (s *session) transfer(fn func(data net.Conn) error) {
+	defer func() {
+		s.rest = 0
+	}()
+	if s.passive == nil && s.active == "" {
+		s.reply(425, "use PASV or PORT first")
+		return
+	}
+	s.reply(150, "opening data connection")
+	var data net.Conn
+	var err error
+	if s.active != "" {
+		data, err = net.DialTimeout("tcp", s.active, 5*time.Second)
+	} else {
+		data, err = s.passive.Accept()
+	}
+	s.closePassive()
+	if err != nil {
+		s.reply(425, err.Error())
+		return
+	}
+	if s.protected {
+		secure := tls.Server(data, s.tlsConfig)
+		_ = secure.SetDeadline(time.Now().Add(5 * time.Second))
+		err = secure.Handshake()
+		_ = secure.SetDeadline(time.Time{})
+		if err != nil {
+			_ = data.Close()
+			s.reply(425, err.Error())
+			return
+		}
+		data = secure
+		s.srv.mu.Lock()
+		s.srv.secureTransfers++
+		if secure.ConnectionState().DidResume {
+			s.srv.resumed++
+		}
+		s.srv.mu.Unlock()
+	}
+
+	s.srv.mu.Lock()
+	s.srv.transfers++
+	s.srv.maxTransfers = max(s.srv.maxTransfers, s.srv.transfers)
+	s.srv.mu.Unlock()
+	err = fn(data)
+	s.srv.mu.Lock()
+	s.srv.transfers--
+	s.srv.mu.Unlock()
+
+	_ = data.Close()
+	if err != nil {
+		s.reply(426, err.Error())
+		return
+	}
+	s.reply(226, "transfer complete")
+}
+
+// facts returns the MLST facts of info.
+func facts(info os.FileInfo) string {
+	typ := "file"
+	if info.IsDir() {
+		typ = "dir"
+	}
+	return fmt.Sprintf("type=%s;size=%d;modify=%s;", typ, info.Size(), info.ModTime().UTC().Format("20060102150405"))
+}
+
+// lsLine returns the line of info in a Unix style LIST listing, with the modification time in the time zone loc: to
+// the minute if it is less than six months old, to the day otherwise.
+func lsLine(info os.FileInfo, loc *time.Location) string {
+	layout := "Jan _2  2006"
+	if time.Since(info.ModTime()) < 180*24*time.Hour {
+		layout = "Jan _2 15:04"
+	}
+	return fmt.Sprintf("%s 1 ftp ftp %d %s %s", info.Mode(), info.Size(), info.ModTime().In(loc).Format(layout),
+		info.Name())
+}
+
+// connectTestServer connects to srv with the extra config config, which gets the credentials of the server.
+func connectTestServer(t *testing.T, srv *testServer, config *ExtraConfig) *FTP {
+	t.Helper()
+	config.Username, config.Password = "foo", "pass"
+	f, err := Connect(srv.host, srv.port, LocalToRemote, config)
+	if err != nil {
+		t.Fatalf("Connect returned an error: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = f.Close()
+	})
+	return f
+}
+
+func TestConnPool(t *testing.T) {
+	srv := newTestServer(t)
+	f := connectTestServer(t, srv, &ExtraConfig{ConnectionsPerHost: 3})
+
+	var readers []io.ReadCloser
+	var releases []func()
+	for i := 0; i < 3; i++ {
+		name := fmt.Sprintf("/file%d.txt", i)
+		err := os.WriteFile(filepath.Join(srv.root, name), []byte(name), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		releases = append(releases, srv.stall(name))
+		reader, err := f.Open(name)
+		if err != nil {
+			t.Fatalf("Open returned an error: %v", err)
+		}
+		readers = append(readers, reader)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.parallelTransfers() < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := srv.parallelTransfers(); n != 3 {
+		t.Fatalf("%d downloads ran at the same time, want 3", n)
+	}
+
+	listed := make(chan error, 1)
+	go func() {
+		_, err := f.List("/")
+		listed <- err
+	}()
+	select {
+	case err := <-listed:
+		t.Fatalf("List did not wait for a free connection, it returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	for _, release := range releases {
+		release()
+	}
+	for i, reader := range readers {
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("ReadAll returned an error: %v", err)
+		}
+		if want := fmt.Sprintf("/file%d.txt", i); string(data) != want {
+			t.Errorf("downloaded file = %q, want %q", data, want)
+		}
+		_ = reader.Close()
+	}
+	select {
+	case err := <-listed:
+		if err != nil {
+			t.Fatalf("List returned an error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("List did not get a connection given back")
+	}
+}
+
+func TestStalledTransfer(t *testing.T) {
+	srv := newTestServer(t)
+	f := connectTestServer(t, srv, &ExtraConfig{ConnectionsPerHost: 2, Timeout: 200 * time.Millisecond})
+	for _, name := range []string{"slow.txt", "fast.txt"} {
+		err := os.WriteFile(filepath.Join(srv.root, name), []byte(name), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv.stall("/slow.txt")
+
+	slow, err := f.Open("/slow.txt")
+	if err != nil {
+		t.Fatalf("Open returned an error: %v", err)
+	}
+	fast, err := f.Open("/fast.txt")
+	if err != nil {
+		t.Fatalf("Open returned an error: %v", err)
+	}
+	data, err := io.ReadAll(fast)
+	if err != nil || string(data) != "fast.txt" {
+		t.Errorf("downloaded file = %q, %v, want %q", data, err, "fast.txt")
+	}
+	_ = fast.Close()
+
+	_, err = io.ReadAll(slow)
+	if err == nil {
+		t.Fatalf("the stalled download did not time out")
+	}
+	_ = slow.Close()
+	before := srv.connections()
+	for i := 0; i < 2; i++ {
+		_, err = f.Stat("/fast.txt")
+		if err != nil {
+			t.Fatalf("Stat failed after the stalled download: %v", err)
+		}
+	}
+	if srv.connections() == before {
+		t.Errorf("the connection of the stalled download was reused")
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	srv := newTestServer(t)
+	f := connectTestServer(t, srv, &ExtraConfig{ConnectionsPerHost: 1})
+	err := f.Ping()
+	if err != nil {
+		t.Fatalf("Ping returned an error: %v", err)
+	}
+
+	srv.drop()
+	err = f.Ping()
+	if err == nil {
+		t.Fatalf("Ping did not notice the dropped connection")
+	}
+	if transient, known := f.Transient(err); known && !transient || !known && !engine.IsTransient(err) {
+		t.Errorf("the error of the dropped connection is not transient: %v", err)
+	}
+	err = f.Reconnect()
+	if err != nil {
+		t.Fatalf("Reconnect returned an error: %v", err)
+	}
+	_, err = f.Stat("/")
+	if err != nil {
+		t.Errorf("Stat failed after reconnecting: %v", err)
+	}
+}
@@ -0,0 +1,189 @@
+package ftp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority issuing the certificates of the FTPS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	//pool holds the certificate of the authority
+	pool *x509.CertPool
+}
+
+// newTestCA returns a new certificate authority.
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "syncpkg test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue returns a new certificate for name, valid for usage.
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// newFTPSServer starts a test server requiring FTPS, implicit or explicit, with a certificate for ftp.test issued
+// by ca.
+func newFTPSServer(t *testing.T, ca *testCA, implicit bool) *testServer {
+	t.Helper()
+	srv := newTestServer(t)
+	srv.useTLS(&tls.Config{Certificates: []tls.Certificate{ca.issue(t, "ftp.test", x509.ExtKeyUsageServerAuth)}}, implicit)
+	return srv
+}
+
+// checkTransfers uploads and downloads a file over f and checks that the data connections were protected by TLS
+// and resumed the TLS session of their control connection.
+func checkTransfers(t *testing.T, srv *testServer, f *FTP) {
+	t.Helper()
+	w, err := f.Create("/upload.txt")
+	if err != nil {
+		t.Fatalf("Create returned an error: %v", err)
+	}
+	_, err = io.WriteString(w, "secret")
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		t.Fatalf("the upload failed: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(srv.root, "upload.txt"))
+	if err != nil || string(data) != "secret" {
+		t.Fatalf("uploaded file = %q, %v, want %q", data, err, "secret")
+	}
+
+	r, err := f.Open("/upload.txt")
+	if err != nil {
+		t.Fatalf("Open returned an error: %v", err)
+	}
+	data, err = io.ReadAll(r)
+	_ = r.Close()
+	if err != nil || string(data) != "secret" {
+		t.Fatalf("downloaded file = %q, %v, want %q", data, err, "secret")
+	}
+
+	secure, resumed := srv.tlsTransfers()
+	if secure < 2 {
+		t.Errorf("%d data connections were protected by TLS, want at least 2", secure)
+	}
+	if resumed != secure {
+		t.Errorf("%d of %d data connections resumed the TLS session", resumed, secure)
+	}
+}
+
+func TestFTPSExplicit(t *testing.T) {
+	ca := newTestCA(t)
+	srv := newFTPSServer(t, ca, false)
+
+	f := connectTestServer(t, srv, &ExtraConfig{})
+	err := f.Ping()
+	if err == nil {
+		t.Fatalf("the credentials were sent in cleartext")
+	}
+
+	f = connectTestServer(t, srv, &ExtraConfig{TLS: TLSExplicit, TLSConfig: &tls.Config{RootCAs: ca.pool}})
+	_, err = f.Stat("/")
+	if err == nil {
+		t.Fatalf("the certificate for ftp.test was accepted for %s", srv.host)
+	}
+
+	f = connectTestServer(t, srv, &ExtraConfig{TLSConfig: &tls.Config{RootCAs: ca.pool, ServerName: "ftp.test"}})
+	checkTransfers(t, srv, f)
+}
+
+func TestFTPSImplicit(t *testing.T) {
+	ca := newTestCA(t)
+	srv := newFTPSServer(t, ca, true)
+
+	// Both ends wait for the other to speak first.
+	f := connectTestServer(t, srv, &ExtraConfig{
+		TLS:       TLSExplicit,
+		TLSConfig: &tls.Config{RootCAs: ca.pool, ServerName: "ftp.test"},
+		Timeout:   200 * time.Millisecond,
+	})
+	err := f.Ping()
+	if err == nil {
+		t.Fatalf("explicit FTPS connected to an implicit FTPS server")
+	}
+
+	f = connectTestServer(t, srv, &ExtraConfig{TLS: TLSImplicit, TLSConfig: &tls.Config{RootCAs: ca.pool, ServerName: "ftp.test"}})
+	checkTransfers(t, srv, f)
+}
+
+func TestFTPSClientCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	srv := newTestServer(t)
+	srv.useTLS(&tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "ftp.test", x509.ExtKeyUsageServerAuth)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+	}, false)
+
+	config := &tls.Config{RootCAs: ca.pool, ServerName: "ftp.test"}
+	f := connectTestServer(t, srv, &ExtraConfig{TLS: TLSExplicit, TLSConfig: config})
+	err := f.Ping()
+	if err == nil {
+		t.Fatalf("the server accepted a client without a certificate")
+	}
+
+	config = config.Clone()
+	config.Certificates = []tls.Certificate{ca.issue(t, "foo", x509.ExtKeyUsageClientAuth)}
+	f = connectTestServer(t, srv, &ExtraConfig{TLS: TLSExplicit, TLSConfig: config})
+	checkTransfers(t, srv, f)
+}
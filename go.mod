@@ -1,8 +1,9 @@
 module github.com/cploutarchou/syncpkg
 
-go 1.20
+go 1.21
 
 require (
+	github.com/cespare/xxhash/v2 v2.3.0
 	github.com/fsnotify/fsnotify v1.6.0
 	github.com/ory/dockertest v3.3.5+incompatible
 	github.com/pkg/sftp v1.13.5
@@ -0,0 +1,335 @@
+// Package ignore decides which paths of a sync pair are never synced.
+//
+// Paths are matched against patterns that follow the rules of gitignore files: blank lines and lines starting with
+// "#" are skipped, a leading "!" re-includes what a previous pattern excluded, a trailing "/" only matches
+// directories, a pattern containing a "/" elsewhere is anchored to the directory of the file it comes from, "*" and
+// "?" do not match "/", and "**" matches any number of directories. A path inside an ignored directory is always
+// ignored, since the directory is never walked.
+//
+// The patterns come from three places, the later ones taking precedence over the earlier ones: the presets and the
+// exclude patterns of the configuration, the .syncignore files of the synced directory tree, the deeper ones taking
+// precedence over the ones above them, and the include patterns of the configuration.
+//
+// Example usage:
+//
+//	exclude, err := ignore.Preset("editor", "os", "vcs")
+//	if err != nil {
+//	    return err
+//	}
+//	m := ignore.New(append(exclude, "*.log", "/build/"), []string{"important.log"}, load)
+//	if m.Match("logs/debug.log", false) {
+//	    // not synced
+//	}
+package ignore
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// FileName is the name of the files that hold the patterns of the directory they are in.
+const FileName = ".syncignore"
+
+// Presets holds the built-in sets of patterns by name.
+var Presets = map[string][]string{
+	//editor matches the swap, backup and temporary files of common editors
+	"editor": {
+		"*.swp", "*.swo", "*.swx", "4913", "*~", "#*#", ".#*",
+		"*___jb_tmp___", "*___jb_old___", ".*.kate-swp",
+	},
+	//os matches the metadata files created by operating systems and file managers
+	"os": {
+		".DS_Store", "._*", ".AppleDouble/", ".Spotlight-V100/", ".Trashes/", ".fseventsd/",
+		"Thumbs.db", "ehthumbs.db", "desktop.ini", "$RECYCLE.BIN/", ".directory", ".Trash-*/", ".nfs*",
+	},
+	//vcs matches the directories of version control systems
+	"vcs": {".git/", ".hg/", ".svn/", ".bzr/"},
+}
+
+// DefaultPresets are the presets applied when the configuration does not name any.
+var DefaultPresets = []string{"editor", "os"}
+
+// Preset returns the patterns of the named presets.
+//
+// - Returns an error if a name is not a key of Presets.
+func Preset(names ...string) ([]string, error) {
+	var patterns []string
+	for _, name := range names {
+		preset, ok := Presets[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown ignore preset %q", name)
+		}
+		patterns = append(patterns, preset...)
+	}
+	return patterns, nil
+}
+
+// Loader returns the content of the .syncignore file of the directory dir, a slash separated path relative to the
+// synced directory that is empty for the synced directory itself. It returns an error matching fs.ErrNotExist if
+// the file does not exist.
+type Loader func(dir string) ([]byte, error)
+
+// Matcher matches paths against the patterns of the configuration and of the .syncignore files. It is safe for
+// concurrent use.
+type Matcher struct {
+	//exclude holds the rules of the presets and exclude patterns
+	exclude []rule
+	//include holds the rules of the include patterns, which re-include what the other rules exclude
+	include []rule
+	//load reads the .syncignore files, it is nil if they are not used
+	load Loader
+	//mu guards dirs and generation
+	mu sync.Mutex
+	//dirs caches the rules of the .syncignore files by directory
+	dirs map[string][]rule
+	//generation counts the calls to Invalidate, so that a file read before one of them is not cached
+	generation uint64
+}
+
+// New returns a Matcher that excludes the paths matching exclude, unless they match include, and reads the
+// .syncignore files with load, which may be nil.
+func New(exclude, include []string, load Loader) *Matcher {
+	m := &Matcher{
+		exclude: parse("", exclude),
+		load:    load,
+		dirs:    make(map[string][]rule),
+	}
+	for _, r := range parse("", include) {
+		r.negate = !r.negate
+		m.include = append(m.include, r)
+	}
+	return m
+}
+
+// Match reports whether the slash separated path rel, relative to the synced directory, is ignored. dir reports
+// whether rel is a directory.
+func (m *Matcher) Match(rel string, dir bool) bool {
+	if rel == "" {
+		return false
+	}
+	for i := strings.IndexByte(rel, '/'); i >= 0; i = nextSlash(rel, i) {
+		if m.match(rel[:i], true) {
+			return true
+		}
+	}
+	return m.match(rel, dir)
+}
+
+// nextSlash returns the index of the first "/" of s after i, or -1.
+func nextSlash(s string, i int) int {
+	j := strings.IndexByte(s[i+1:], '/')
+	if j < 0 {
+		return -1
+	}
+	return i + 1 + j
+}
+
+// Invalidate drops the cached patterns of the .syncignore file of the directory dir, so that it is read again.
+// It must be called when the file changed.
+func (m *Matcher) Invalidate(dir string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.dirs, dir)
+	m.generation++
+}
+
+// match reports whether the last rule matching rel excludes it, without looking at the parent directories of rel.
+func (m *Matcher) match(rel string, dir bool) bool {
+	ignored := false
+	apply := func(rules []rule) {
+		for _, r := range rules {
+			if r.match(rel, dir) {
+				ignored = !r.negate
+			}
+		}
+	}
+	apply(m.exclude)
+	if m.load != nil {
+		apply(m.rules(""))
+		for i := strings.IndexByte(rel, '/'); i >= 0; i = nextSlash(rel, i) {
+			apply(m.rules(rel[:i]))
+		}
+	}
+	apply(m.include)
+	return ignored
+}
+
+// rules returns the rules of the .syncignore file of dir, reading it if they are not cached. Files that cannot be
+// read for another reason than not existing are treated as empty, and read again the next time.
+func (m *Matcher) rules(dir string) []rule {
+	m.mu.Lock()
+	rules, ok := m.dirs[dir]
+	generation := m.generation
+	m.mu.Unlock()
+	if ok {
+		return rules
+	}
+
+	// The file is read without the lock, as it may take a round trip to the server, so that the paths of the other
+	// directories are matched in the meantime. Two goroutines may then read the same file, the first one caches it.
+	data, err := m.load(dir)
+	if err == nil {
+		rules = parse(dir, strings.Split(string(data), "\n"))
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cached, ok := m.dirs[dir]; ok {
+		return cached
+	}
+	if m.generation == generation {
+		m.dirs[dir] = rules
+	}
+	return rules
+}
+
+// rule is a parsed pattern.
+type rule struct {
+	//base is the directory the pattern is relative to
+	base string
+	//re matches the paths relative to base
+	re *regexp.Regexp
+	//negate reports whether the pattern re-includes the paths it matches
+	negate bool
+	//dirOnly reports whether the pattern only matches directories
+	dirOnly bool
+}
+
+// match reports whether the rule matches rel.
+func (r rule) match(rel string, dir bool) bool {
+	if r.dirOnly && !dir {
+		return false
+	}
+	if r.base != "" {
+		if !strings.HasPrefix(rel, r.base+"/") {
+			return false
+		}
+		rel = rel[len(r.base)+1:]
+	}
+	return r.re.MatchString(rel)
+}
+
+// parse parses the patterns of lines, which are relative to the directory base. Invalid patterns are skipped.
+func parse(base string, lines []string) []rule {
+	var rules []rule
+	for _, line := range lines {
+		r, ok := parseLine(base, line)
+		if ok {
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+// parseLine parses a single pattern.
+func parseLine(base, line string) (rule, bool) {
+	line = strings.TrimSuffix(line, "\r")
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || line[0] == '#' {
+		return rule{}, false
+	}
+	r := rule{base: base}
+	if line[0] == '!' {
+		r.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return rule{}, false
+	}
+	expr := "^"
+	if !strings.Contains(line, "/") {
+		// Patterns without a slash match at any depth.
+		expr += "(?:.*/)?"
+	}
+	expr += translate(strings.TrimPrefix(line, "/")) + "$"
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return rule{}, false
+	}
+	r.re = re
+	return r, true
+}
+
+// translate returns the regular expression of the glob pattern p.
+func translate(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		switch c := p[i]; c {
+		case '*':
+			if i+1 < len(p) && p[i+1] == '*' && (i == 0 || p[i-1] == '/') {
+				if i+2 == len(p) {
+					b.WriteString(".*")
+					i++
+					continue
+				}
+				if p[i+2] == '/' {
+					b.WriteString("(?:.*/)?")
+					i += 2
+					continue
+				}
+			}
+			b.WriteString("[^/]*")
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			class, n := translateClass(p[i:])
+			if n == 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			b.WriteString(class)
+			i += n - 1
+		case '\\':
+			if i+1 < len(p) {
+				i++
+			}
+			b.WriteString(regexp.QuoteMeta(string(p[i])))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// translateClass returns the regular expression of the bracket expression at the start of p and its length in p.
+// The length is 0 if the expression is not terminated.
+func translateClass(p string) (string, int) {
+	var b strings.Builder
+	b.WriteByte('[')
+	i := 1
+	if i < len(p) && (p[i] == '!' || p[i] == '^') {
+		b.WriteByte('^')
+		i++
+	}
+	for start := i; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case c == ']' && i > start:
+			b.WriteByte(']')
+			return b.String(), i + 1
+		case c == '\\' && i+1 < len(p):
+			i++
+			if strings.IndexByte(`[]\^-`, p[i]) >= 0 {
+				b.WriteByte('\\')
+			}
+			b.WriteByte(p[i])
+		case c == '[' || c == ']' || c == '\\' || c == '^':
+			b.WriteString(`\`)
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0
+}
@@ -0,0 +1,121 @@
+package ignore
+
+import (
+	"io/fs"
+	"testing"
+	"time"
+)
+
+func TestMatch(t *testing.T) {
+	files := map[string]string{
+		"":         "*.log\n!keep.log\n# comment\n\n/build/\ndocs/**/*.pdf\ncache/\n\\#literal\n",
+		"sub":      "/local.txt\n!*.log\n",
+		"sub/deep": "[abc].bin\n",
+	}
+	load := func(dir string) ([]byte, error) {
+		data, ok := files[dir]
+		if !ok {
+			return nil, fs.ErrNotExist
+		}
+		return []byte(data), nil
+	}
+	m := New([]string{"*.swp"}, []string{"important.swp"}, load)
+
+	tests := []struct {
+		rel  string
+		dir  bool
+		want bool
+	}{
+		{"file.txt", false, false},
+		{"a.log", false, true},
+		{"dir/a.log", false, true},
+		{"keep.log", false, false},
+		{"build", true, true},
+		{"build", false, false},
+		{"build/out.bin", false, true},
+		{"sub/build", true, false},
+		{"docs/a.pdf", false, true},
+		{"docs/x/y/a.pdf", false, true},
+		{"other/docs/a.pdf", false, false},
+		{"cache/file", false, true},
+		{"x/cache/file", false, true},
+		{"#literal", false, true},
+		{"sub/local.txt", false, true},
+		{"local.txt", false, false},
+		{"sub/x/local.txt", false, false},
+		{"sub/a.log", false, false},
+		{"sub/deep/a.bin", false, true},
+		{"sub/deep/d.bin", false, false},
+		{"a.bin", false, false},
+		{"file.swp", false, true},
+		{"dir/important.swp", false, false},
+	}
+	for _, tt := range tests {
+		if got := m.Match(tt.rel, tt.dir); got != tt.want {
+			t.Errorf("Match(%q, %v) = %v, want %v", tt.rel, tt.dir, got, tt.want)
+		}
+	}
+
+	files[""] = ""
+	if !m.Match("a.log", false) {
+		t.Errorf("the patterns were read again before Invalidate")
+	}
+	m.Invalidate("")
+	if m.Match("a.log", false) {
+		t.Errorf("the patterns were not read again after Invalidate")
+	}
+}
+
+func TestSlowLoader(t *testing.T) {
+	release := make(chan struct{})
+	load := func(dir string) ([]byte, error) {
+		if dir == "slow" {
+			<-release
+			return []byte("*.tmp\n"), nil
+		}
+		return nil, fs.ErrNotExist
+	}
+	m := New(nil, nil, load)
+	done := make(chan bool)
+	go func() {
+		done <- m.Match("slow/a.tmp", false)
+	}()
+	// The paths of the other directories are matched while the slow file is read.
+	matched := make(chan bool)
+	go func() {
+		matched <- m.Match("fast/a.tmp", false)
+	}()
+	select {
+	case ignored := <-matched:
+		if ignored {
+			t.Errorf("fast/a.tmp is ignored")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Match waited for the file of another directory to be read")
+	}
+	close(release)
+	if !<-done {
+		t.Errorf("slow/a.tmp is not ignored")
+	}
+}
+
+func TestPreset(t *testing.T) {
+	patterns, err := Preset(DefaultPresets...)
+	if err != nil {
+		t.Fatalf("Preset returned an error: %v", err)
+	}
+	m := New(patterns, nil, nil)
+	for _, rel := range []string{".file.txt.swp", "dir/.DS_Store", "file.txt~", "dir/4913"} {
+		if !m.Match(rel, false) {
+			t.Errorf("%s is not ignored by the default presets", rel)
+		}
+	}
+	if m.Match("file.txt", false) {
+		t.Errorf("file.txt is ignored by the default presets")
+	}
+
+	_, err = Preset("unknown")
+	if err == nil {
+		t.Errorf("Preset accepted an unknown name")
+	}
+}
@@ -0,0 +1,247 @@
+package sftp
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// errNoAgent is returned by AuthAgent when SSH_AUTH_SOCK is not set.
+var errNoAgent = errors.New("sftp: SSH_AUTH_SOCK is not set, no ssh-agent is running")
+
+// AuthMethod is a way of authenticating to the SSH server, see ExtraConfig.Auth. The keys of the public key methods
+// are loaded every time a connection is dialed.
+type AuthMethod struct {
+	//name describes the method in the errors
+	name string
+	//signers loads the keys of a public key method. The returned function releases them once the connection is
+	//authenticated.
+	signers func() ([]ssh.Signer, func(), error)
+	//method is the method of the other methods
+	method ssh.AuthMethod
+	//implicit reports whether the method was picked up from the defaults of the OpenSSH client or from its
+	//configuration file rather than listed in ExtraConfig.Auth. Like the OpenSSH client, the keys of such a method
+	//that cannot be loaded are skipped.
+	implicit bool
+}
+
+// implicitly returns method, marked as picked up without being listed in ExtraConfig.Auth.
+func implicitly(method AuthMethod) AuthMethod {
+	method.implicit = true
+	return method
+}
+
+// AuthPassword authenticates with password.
+func AuthPassword(password string) AuthMethod {
+	return AuthMethod{name: "password", method: ssh.Password(password)}
+}
+
+// AuthKeyboardInteractive authenticates by answering the questions of the server with challenge, which is how
+// servers ask for one-time passwords.
+func AuthKeyboardInteractive(challenge ssh.KeyboardInteractiveChallenge) AuthMethod {
+	return AuthMethod{name: "keyboard-interactive", method: ssh.KeyboardInteractive(challenge)}
+}
+
+// AuthPrivateKey authenticates with the PEM encoded private key pemBytes, in any of the formats ssh-keygen writes.
+// passphrase decrypts the key, it is ignored if the key is not encrypted.
+func AuthPrivateKey(pemBytes []byte, passphrase string) AuthMethod {
+	return AuthMethod{name: "private key", signers: func() ([]ssh.Signer, func(), error) {
+		signer, err := parsePrivateKey(pemBytes, passphrase)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []ssh.Signer{signer}, func() {}, nil
+	}}
+}
+
+// AuthPrivateKeyFile authenticates with the private key stored in the file path, such as "~/.ssh/id_ed25519".
+// passphrase decrypts the key, it is ignored if the key is not encrypted.
+func AuthPrivateKeyFile(path, passphrase string) AuthMethod {
+	return AuthMethod{name: path, signers: func() ([]ssh.Signer, func(), error) {
+		signer, err := readPrivateKey(path, passphrase)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []ssh.Signer{signer}, func() {}, nil
+	}}
+}
+
+// AuthCertificateFile authenticates with the OpenSSH user certificate stored in the file certPath, such as
+// "~/.ssh/id_ed25519-cert.pub", signed for the private key stored in the file keyPath. passphrase decrypts the key,
+// it is ignored if the key is not encrypted.
+func AuthCertificateFile(certPath, keyPath, passphrase string) AuthMethod {
+	return AuthMethod{name: certPath, signers: func() ([]ssh.Signer, func(), error) {
+		data, err := os.ReadFile(expandHome(certPath))
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to read certificate: %w", err)
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to parse certificate: %w", err)
+		}
+		cert, ok := key.(*ssh.Certificate)
+		if !ok {
+			return nil, nil, fmt.Errorf("unable to parse certificate: %s holds a %s public key", certPath, key.Type())
+		}
+		signer, err := readPrivateKey(keyPath, passphrase)
+		if err != nil {
+			return nil, nil, err
+		}
+		signer, err = ssh.NewCertSigner(cert, signer)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to use certificate: %w", err)
+		}
+		return []ssh.Signer{signer}, func() {}, nil
+	}}
+}
+
+// AuthAgent authenticates with the keys and certificates of the ssh-agent listening on SSH_AUTH_SOCK, including
+// a forwarded agent.
+func AuthAgent() AuthMethod {
+	return AuthMethod{name: "ssh-agent", signers: func() ([]ssh.Signer, func(), error) {
+		socket := os.Getenv("SSH_AUTH_SOCK")
+		if socket == "" {
+			return nil, nil, errNoAgent
+		}
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot connect to ssh-agent: %w", err)
+		}
+		signers, err := agent.NewClient(conn).Signers()
+		if err != nil {
+			_ = conn.Close()
+			return nil, nil, fmt.Errorf("cannot list the keys of ssh-agent: %w", err)
+		}
+		return signers, func() { _ = conn.Close() }, nil
+	}}
+}
+
+// defaultIdentities returns the methods ConnectSSHPair uses when ExtraConfig.Auth is empty: the ssh-agent if
+// SSH_AUTH_SOCK is set, then the default identity files of the current user that exist, in the order of the
+// OpenSSH client.
+func defaultIdentities() ([]AuthMethod, error) {
+	usr, err := user.Current()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get user home directory: %w", err)
+	}
+	return defaultIdentitiesIn(usr.HomeDir)
+}
+
+// defaultIdentitiesIn returns the default methods of the user whose home directory is home. A key that cannot be
+// loaded, such as an encrypted one, is skipped when the connection is dialed.
+func defaultIdentitiesIn(home string) ([]AuthMethod, error) {
+	var methods []AuthMethod
+	if os.Getenv("SSH_AUTH_SOCK") != "" {
+		methods = append(methods, implicitly(AuthAgent()))
+	}
+	for _, name := range []string{"id_rsa", "id_ecdsa", "id_ed25519"} {
+		path := filepath.Join(home, ".ssh", name)
+		_, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		methods = append(methods, implicitly(AuthPrivateKeyFile(path, "")))
+	}
+	if len(methods) == 0 {
+		return nil, errors.New("unable to read private key: no ssh-agent and no key in ~/.ssh")
+	}
+	return methods, nil
+}
+
+// sshAuth returns the ssh methods of methods, tried in their order, and the function that releases their keys once
+// the connection is authenticated. The SSH client tries every method name once only, so the keys of all the public
+// key methods are offered by a single method, at the position of the first one, in their order.
+//
+// The keys of the methods picked up implicitly that cannot be loaded are logged to log and skipped, and so is a
+// missing agent if there are other methods. The keys of the other methods must load.
+func sshAuth(methods []AuthMethod, log *slog.Logger) ([]ssh.AuthMethod, func(), error) {
+	var auth []ssh.AuthMethod
+	var signers []ssh.Signer
+	var skipped []error
+	var releases []func()
+	release := func() {
+		for _, release := range releases {
+			release()
+		}
+	}
+	publicKeys := -1
+	for _, method := range methods {
+		if method.signers == nil {
+			auth = append(auth, method.method)
+			continue
+		}
+		methodSigners, methodRelease, err := method.signers()
+		if err != nil {
+			err = fmt.Errorf("%s: %w", method.name, err)
+			if !method.implicit && (len(methods) == 1 || !errors.Is(err, errNoAgent)) {
+				release()
+				return nil, nil, err
+			}
+			// Like the OpenSSH client, go on with the other methods.
+			if method.implicit {
+				log.Warn("skipping SSH key", "op", "connect", "key", method.name, "error", err)
+			}
+			skipped = append(skipped, err)
+			continue
+		}
+		releases = append(releases, methodRelease)
+		signers = append(signers, methodSigners...)
+		if publicKeys < 0 {
+			publicKeys = len(auth)
+			auth = append(auth, nil)
+		}
+	}
+	if len(auth) == 0 && len(skipped) > 0 {
+		release()
+		return nil, nil, fmt.Errorf("no usable authentication method: %w", errors.Join(skipped...))
+	}
+	if publicKeys >= 0 {
+		auth[publicKeys] = ssh.PublicKeys(signers...)
+	}
+	return auth, release, nil
+}
+
+// readPrivateKey reads and parses the private key stored in the file path.
+func readPrivateKey(path, passphrase string) (ssh.Signer, error) {
+	key, err := os.ReadFile(expandHome(path))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read private key: %w", err)
+	}
+	return parsePrivateKey(key, passphrase)
+}
+
+// parsePrivateKey parses the PEM encoded private key pemBytes, decrypting it with passphrase if it is encrypted.
+func parsePrivateKey(pemBytes []byte, passphrase string) (ssh.Signer, error) {
+	signer, err := ssh.ParsePrivateKey(pemBytes)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		if passphrase == "" {
+			return nil, fmt.Errorf("unable to parse private key: the key is encrypted and no passphrase was given")
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pemBytes, []byte(passphrase))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse private key: %w", err)
+	}
+	return signer, nil
+}
+
+// expandHome replaces the leading ~/ of path with the home directory of the current user.
+func expandHome(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	usr, err := user.Current()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(usr.HomeDir, path[2:])
+}
@@ -0,0 +1,255 @@
+package sftp
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// newKey returns a new ed25519 private key, PEM encoded, and its public key.
+func newKey(t *testing.T) ([]byte, ssh.PublicKey) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), key
+}
+
+// newEncryptedKey returns a new ECDSA private key, PEM encoded and encrypted with passphrase, and its public key.
+func newEncryptedKey(t *testing.T, passphrase string) ([]byte, ssh.PublicKey) {
+	t.Helper()
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Legacy PEM encryption, which ssh-keygen still reads.
+	block, err := x509.EncryptPEMBlock(rand.Reader, "EC PRIVATE KEY", der, []byte(passphrase), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(&private.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(block), key
+}
+
+// writeFile writes data to the file name of a temporary directory and returns its path.
+func writeFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, data, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// connectAuth connects to srv as the user foo with the methods auth.
+func connectAuth(srv *testServer, auth ...AuthMethod) error {
+	s, err := Connect(srv.host, srv.port, LocalToRemote, &ExtraConfig{
+		Username:            "foo",
+		Auth:                auth,
+		HostKeyFingerprints: []string{srv.fingerprint()},
+	})
+	if err != nil {
+		return err
+	}
+	return s.Close()
+}
+
+func TestAuthPrivateKeys(t *testing.T) {
+	srv := newTestServer(t)
+	unknown, _ := newKey(t)
+	encrypted, key := newEncryptedKey(t, "secret")
+	srv.authorize(key)
+
+	// The keys are offered in order, the unknown key first.
+	err := connectAuth(srv,
+		AuthPrivateKeyFile(writeFile(t, "id_ed25519", unknown), ""),
+		AuthPrivateKey(encrypted, "secret"),
+		AuthPassword("wrong"),
+	)
+	if err != nil {
+		t.Fatalf("the encrypted key was not offered: %v", err)
+	}
+
+	err = connectAuth(srv, AuthPrivateKey(encrypted, ""))
+	if err == nil || !strings.Contains(err.Error(), "no passphrase") {
+		t.Errorf("Connect with an encrypted key and no passphrase returned %v", err)
+	}
+	err = connectAuth(srv, AuthPrivateKeyFile(filepath.Join(t.TempDir(), "missing"), ""))
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Connect with a missing key file returned %v", err)
+	}
+}
+
+func TestAuthDefaultIdentities(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	srv := newTestServer(t)
+	encrypted, _ := newEncryptedKey(t, "secret")
+	keyPEM, key := newKey(t)
+	srv.authorize(key)
+	home := t.TempDir()
+	err := os.Mkdir(filepath.Join(home, ".ssh"), 0o700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeKey := func(name string, data []byte) {
+		err := os.WriteFile(filepath.Join(home, ".ssh", name), data, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The encrypted id_rsa comes first and cannot be loaded without a passphrase.
+	writeKey("id_rsa", encrypted)
+	writeKey("id_ed25519", keyPEM)
+	methods, err := defaultIdentitiesIn(home)
+	if err != nil {
+		t.Fatalf("defaultIdentitiesIn returned an error: %v", err)
+	}
+	err = connectAuth(srv, methods...)
+	if err != nil {
+		t.Fatalf("the key after the encrypted default key was not offered: %v", err)
+	}
+
+	// Without a key that loads, the error tells why.
+	err = os.Remove(filepath.Join(home, ".ssh", "id_ed25519"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	methods, err = defaultIdentitiesIn(home)
+	if err != nil {
+		t.Fatalf("defaultIdentitiesIn returned an error: %v", err)
+	}
+	err = connectAuth(srv, methods...)
+	if err == nil || !strings.Contains(err.Error(), "no passphrase") {
+		t.Errorf("Connect with an encrypted default key only returned %v", err)
+	}
+}
+
+func TestAuthCertificate(t *testing.T) {
+	srv := newTestServer(t)
+	caPEM, _ := newKey(t)
+	ca, err := ssh.ParsePrivateKey(caPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.trustAuthority(ca.PublicKey())
+
+	userPEM, userKey := newKey(t)
+	cert := &ssh.Certificate{
+		Key:             userKey,
+		CertType:        ssh.UserCert,
+		KeyId:           "foo",
+		ValidPrincipals: []string{"foo"},
+		ValidAfter:      uint64(time.Now().Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),
+	}
+	err = cert.SignCert(rand.Reader, ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := writeFile(t, "id_ed25519", userPEM)
+	certPath := writeFile(t, "id_ed25519-cert.pub", ssh.MarshalAuthorizedKey(cert))
+
+	err = connectAuth(srv, AuthPrivateKeyFile(keyPath, ""))
+	if err == nil {
+		t.Fatalf("the key was accepted without its certificate")
+	}
+	err = connectAuth(srv, AuthCertificateFile(certPath, keyPath, ""))
+	if err != nil {
+		t.Fatalf("the certificate was rejected: %v", err)
+	}
+}
+
+func TestAuthAgent(t *testing.T) {
+	srv := newTestServer(t)
+	keyPEM, key := newKey(t)
+	srv.authorize(key)
+	private, err := ssh.ParseRawPrivateKey(keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	err = keyring.Add(agent.AddedKey{PrivateKey: private})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_ = agent.ServeAgent(keyring, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	t.Setenv("SSH_AUTH_SOCK", socket)
+	err = connectAuth(srv, AuthAgent())
+	if err != nil {
+		t.Fatalf("the key of the agent was rejected: %v", err)
+	}
+
+	t.Setenv("SSH_AUTH_SOCK", "")
+	err = connectAuth(srv, AuthAgent(), AuthPassword("pass"))
+	if err != nil {
+		t.Fatalf("the password was not tried without an agent: %v", err)
+	}
+}
+
+func TestAuthKeyboardInteractive(t *testing.T) {
+	srv := newTestServer(t)
+	var questions []string
+	err := connectAuth(srv, AuthKeyboardInteractive(func(name, instruction string, q []string, echos []bool) ([]string, error) {
+		questions = append(questions, q...)
+		return []string{"123456"}, nil
+	}))
+	if err != nil {
+		t.Fatalf("the verification code was rejected: %v", err)
+	}
+	if len(questions) != 1 || questions[0] != "Verification code: " {
+		t.Errorf("questions = %q", questions)
+	}
+}
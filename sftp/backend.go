@@ -0,0 +1,178 @@
+package sftp
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/cploutarchou/syncpkg/engine"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTP implements the engine.Backend interface on top of the SFTP server.
+var _ engine.Backend = (*SFTP)(nil)
+
+// SFTP updates remote files in place for delta transfers.
+var _ engine.RandomAccess = (*SFTP)(nil)
+
+// SFTP resumes interrupted transfers.
+var _ engine.Resumer = (*SFTP)(nil)
+
+// SFTP classifies the errors of the SFTP protocol for the retry policy.
+var _ engine.Classifier = (*SFTP)(nil)
+
+// Transient reports whether err is a transient SFTP error. A lost connection and an SSH channel that could not be
+// opened are transient, every other status the server replies with, such as a failure or an unsupported operation,
+// is permanent. Errors that are not SFTP errors are left to engine.IsTransient.
+func (s *SFTP) Transient(err error) (transient, known bool) {
+	var status *sftp.StatusError
+	var channelErr *ssh.OpenChannelError
+	switch {
+	case errors.Is(err, sftp.ErrSSHFxConnectionLost), errors.Is(err, sftp.ErrSSHFxNoConnection):
+		return true, true
+	case errors.As(err, &channelErr):
+		return true, true
+	case errors.As(err, &status):
+		code := status.FxCode()
+		return code == sftp.ErrSSHFxConnectionLost || code == sftp.ErrSSHFxNoConnection, true
+	}
+	return false, false
+}
+
+// client returns the SFTP client of one of the sessions, for an operation that does not check a session out.
+func (s *SFTP) client() *sftp.Client {
+	return s.pool().any().client
+}
+
+// List returns the entries of the remote directory dir.
+func (s *SFTP) List(dir string) ([]os.FileInfo, error) {
+	return s.client().ReadDir(dir)
+}
+
+// Stat returns the file information of the remote path.
+func (s *SFTP) Stat(path string) (os.FileInfo, error) {
+	return s.client().Stat(path)
+}
+
+// Open opens the remote path for reading. A session is checked out of the pool until the returned file is closed.
+func (s *SFTP) Open(path string) (io.ReadCloser, error) {
+	return s.OpenAt(path, 0)
+}
+
+// sessionFile is a remote file that keeps its session checked out of the pool until it is closed.
+type sessionFile struct {
+	*sftp.File
+	//checkin gives the session back to the pool
+	checkin func()
+	//fsync reports whether the server supports the fsync@openssh.com extension
+	fsync bool
+}
+
+// Sync commits the content of the file to stable storage on the server, if the server supports it.
+func (f *sessionFile) Sync() error {
+	if !f.fsync {
+		return nil
+	}
+	return f.File.Sync()
+}
+
+// Close closes the remote file and gives its session back to the pool.
+func (f *sessionFile) Close() error {
+	defer f.checkin()
+	return f.File.Close()
+}
+
+// openFile checks a session out of the pool, waiting for one to be free, opens the remote path on it with flags and
+// seeks to offset. The session is given back when the returned file is closed, so that as many files are
+// transferred at the same time as there are sessions.
+func (s *SFTP) openFile(path string, flags int, offset int64) (*sessionFile, error) {
+	pool := s.pool()
+	session := pool.checkout()
+	checkin := func() { pool.checkin(session) }
+	file, err := session.client.OpenFile(path, flags)
+	if err != nil {
+		checkin()
+		return nil, err
+	}
+	if offset > 0 {
+		_, err = file.Seek(offset, io.SeekStart)
+		if err != nil {
+			_ = file.Close()
+			checkin()
+			return nil, err
+		}
+	}
+	_, fsync := session.client.HasExtension("fsync@openssh.com")
+	return &sessionFile{File: file, checkin: checkin, fsync: fsync}, nil
+}
+
+// Create creates or truncates the remote path for writing, on a session checked out of the pool until the returned
+// file is closed.
+func (s *SFTP) Create(path string) (io.WriteCloser, error) {
+	return s.openFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0)
+}
+
+// OpenFile opens the existing remote path for reading and writing at arbitrary offsets. Like Create, it checks a
+// session out of the pool until the returned file is closed.
+func (s *SFTP) OpenFile(path string) (engine.File, error) {
+	return s.openFile(path, os.O_RDWR, 0)
+}
+
+// OpenAt opens the remote path for reading, starting at offset. Like Open, it checks a session out of the pool until
+// the returned file is closed.
+func (s *SFTP) OpenAt(path string, offset int64) (io.ReadCloser, error) {
+	return s.openFile(path, os.O_RDONLY, offset)
+}
+
+// Append opens the existing remote path for writing at offset, to resume an upload. Like Create, it checks a session
+// out of the pool until the returned file is closed.
+func (s *SFTP) Append(path string, offset int64) (io.WriteCloser, error) {
+	return s.openFile(path, os.O_WRONLY, offset)
+}
+
+// Mkdir creates the remote directory path along with any missing parents and sets its permissions to 755.
+func (s *SFTP) Mkdir(path string) error {
+	info, err := s.client().Stat(path)
+	if err == nil && info.IsDir() {
+		return nil
+	}
+	err = s.client().MkdirAll(path)
+	if err != nil {
+		return err
+	}
+	return s.client().Chmod(path, 0755)
+}
+
+// Remove removes the remote file or empty directory path.
+func (s *SFTP) Remove(path string) error {
+	return s.client().Remove(path)
+}
+
+// Rename moves the remote file oldPath to newPath, replacing newPath if it exists. It uses the
+// posix-rename@openssh.com extension, which replaces newPath atomically, when the server offers it. Otherwise
+// newPath is removed first, since a plain SFTP rename fails if it exists.
+func (s *SFTP) Rename(oldPath, newPath string) error {
+	if s.hasExtension("posix-rename@openssh.com") {
+		return s.client().PosixRename(oldPath, newPath)
+	}
+	err := s.client().Rename(oldPath, newPath)
+	if err == nil {
+		return nil
+	}
+	info, statErr := s.client().Stat(newPath)
+	if statErr != nil || info.IsDir() {
+		return err
+	}
+	err = s.client().Remove(newPath)
+	if err != nil {
+		return err
+	}
+	return s.client().Rename(oldPath, newPath)
+}
+
+// Chtimes sets the access and modification times of the remote path.
+func (s *SFTP) Chtimes(path string, atime, mtime time.Time) error {
+	return s.client().Chtimes(path, atime, mtime)
+}
@@ -0,0 +1,406 @@
+package sftp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/cploutarchou/syncpkg/engine"
+)
+
+// SFTP hashes remote files on the server.
+var (
+	_ engine.Hasher      = (*SFTP)(nil)
+	_ engine.BlockSigner = (*SFTP)(nil)
+)
+
+// SFTP packet types and status codes used to send extended requests.
+const (
+	fxpInit          = 1
+	fxpVersion       = 2
+	fxpStatus        = 101
+	fxpExtended      = 200
+	fxpExtendedReply = 201
+	fxOK             = 0
+	fxNoSuchFile     = 2
+)
+
+// Hash returns the hash of the remote path computed with the first of algorithms the server supports. It uses
+// the check-file and md5-hash SFTP extensions when the server offers them, and runs sha256sum or md5sum over an
+// SSH exec channel otherwise. It returns engine.ErrHashUnsupported if the server cannot compute any of them.
+func (s *SFTP) Hash(path string, algorithms ...engine.HashAlgorithm) (engine.HashAlgorithm, []byte, error) {
+	for _, algorithm := range algorithms {
+		if algorithm != engine.HashSHA256 && algorithm != engine.HashMD5 {
+			continue
+		}
+		if s.hasExtension("check-file") {
+			sum, err := s.checkFile(path, algorithm, 0)
+			if err == nil || !errors.Is(err, engine.ErrHashUnsupported) {
+				return algorithm, sum, err
+			}
+		}
+		if algorithm == engine.HashMD5 && s.hasExtension("md5-hash") {
+			sum, err := s.md5Hash(path)
+			if err == nil || !errors.Is(err, engine.ErrHashUnsupported) {
+				return algorithm, sum, err
+			}
+		}
+		sum, err := s.hashCommand(path, algorithm)
+		if err == nil || !errors.Is(err, engine.ErrHashUnsupported) {
+			return algorithm, sum, err
+		}
+	}
+	return engine.HashNone, nil, engine.ErrHashUnsupported
+}
+
+// hasExtension reports whether the server offers the SFTP extension name.
+func (s *SFTP) hasExtension(name string) bool {
+	_, ok := s.client().HasExtension(name)
+	return ok
+}
+
+// BlockHashes returns the hashes of the consecutive blocks of blockSize bytes of the remote path, computed on the
+// server with the first of algorithms it supports. It uses the check-file SFTP extension when the server offers it,
+// and otherwise runs a Perl script over an SSH exec channel, which hashes the whole file in a single pass.
+func (s *SFTP) BlockHashes(path string, size, blockSize int64, algorithms ...engine.HashAlgorithm) (engine.HashAlgorithm, [][]byte, error) {
+	count := (size + blockSize - 1) / blockSize
+	for _, algorithm := range algorithms {
+		if algorithm != engine.HashSHA256 && algorithm != engine.HashMD5 {
+			continue
+		}
+		var sums []byte
+		var err error
+		if s.hasExtension("check-file") && blockSize <= math.MaxUint32 {
+			sums, err = s.checkFile(path, algorithm, uint32(blockSize))
+			if errors.Is(err, engine.ErrHashUnsupported) {
+				sums, err = s.blockHashCommand(path, algorithm, blockSize)
+			}
+		} else {
+			sums, err = s.blockHashCommand(path, algorithm, blockSize)
+		}
+		if errors.Is(err, engine.ErrHashUnsupported) {
+			continue
+		}
+		if err != nil {
+			return engine.HashNone, nil, err
+		}
+		n := algorithm.New().Size()
+		if int64(len(sums)) != count*int64(n) {
+			return engine.HashNone, nil, fmt.Errorf("got %d bytes of block hashes for %s, want %d", len(sums), path, count*int64(n))
+		}
+		blocks := make([][]byte, count)
+		for i := range blocks {
+			blocks[i] = sums[i*n : (i+1)*n]
+		}
+		return algorithm, blocks, nil
+	}
+	return engine.HashNone, nil, engine.ErrHashUnsupported
+}
+
+// maxRollingSize is the size of the largest file BlockSignatures computes rolling checksums for. The server computes
+// them at about 15 MB/s, so that beyond it resending the file is usually faster than finding the blocks that moved.
+const maxRollingSize = 256 << 20
+
+// BlockSignatures returns the signatures of the consecutive blocks of blockSize bytes of the remote path, computed on
+// the server by a Perl script run over an SSH exec channel, which reads the file once. It returns
+// engine.ErrHashUnsupported if the server cannot run it, or if the file is larger than maxRollingSize, in which case
+// the delta transfer only compares blocks at the same offsets.
+func (s *SFTP) BlockSignatures(path string, size, blockSize int64, algorithms ...engine.HashAlgorithm) (engine.HashAlgorithm, []engine.BlockSignature, error) {
+	if size > maxRollingSize {
+		return engine.HashNone, nil, engine.ErrHashUnsupported
+	}
+	count := (size + blockSize - 1) / blockSize
+	for _, algorithm := range algorithms {
+		if algorithm != engine.HashSHA256 && algorithm != engine.HashMD5 {
+			continue
+		}
+		lines, err := s.blockScript(path, algorithm, blockSize, true)
+		if errors.Is(err, engine.ErrHashUnsupported) {
+			continue
+		}
+		if err != nil {
+			return engine.HashNone, nil, err
+		}
+		if int64(len(lines)) != count {
+			return engine.HashNone, nil, fmt.Errorf("got %d block signatures for %s, want %d", len(lines), path, count)
+		}
+		sigs := make([]engine.BlockSignature, count)
+		for i, line := range lines {
+			var field string
+			var a, b uint32
+			_, err = fmt.Sscan(line, &field, &a, &b)
+			strong, hexErr := hex.DecodeString(field)
+			if err != nil || hexErr != nil || len(strong) != algorithm.New().Size() || a > 0xffff || b > 0xffff {
+				return engine.HashNone, nil, fmt.Errorf("unexpected block signature of %s: %q", path, line)
+			}
+			sigs[i] = engine.BlockSignature{Weak: b<<16 | a, Strong: strong}
+		}
+		return algorithm, sigs, nil
+	}
+	return engine.HashNone, nil, engine.ErrHashUnsupported
+}
+
+// checkFile hashes path with the check-file-name extension request. The file is hashed as a whole if blockSize is 0,
+// and block by block otherwise, in which case the hashes of the blocks are returned one after the other.
+func (s *SFTP) checkFile(path string, algorithm engine.HashAlgorithm, blockSize uint32) ([]byte, error) {
+	var payload bytes.Buffer
+	writeString(&payload, path)
+	writeString(&payload, algorithm.String())
+	// Hash from the start to the end of the file.
+	_ = binary.Write(&payload, binary.BigEndian, uint64(0))
+	_ = binary.Write(&payload, binary.BigEndian, uint64(0))
+	_ = binary.Write(&payload, binary.BigEndian, blockSize)
+
+	reply, err := s.extended("check-file-name", payload.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	// The reply starts with the name of the extension, followed by the algorithm used and the hash.
+	used, reply, ok := readString(reply)
+	if ok && used == "check-file" {
+		used, reply, ok = readString(reply)
+	}
+	if !ok || used != algorithm.String() {
+		return nil, engine.ErrHashUnsupported
+	}
+	if blockSize == 0 && len(reply) != algorithm.New().Size() {
+		return nil, fmt.Errorf("check-file returned a %d byte hash for %s", len(reply), path)
+	}
+	return reply, nil
+}
+
+// md5Hash hashes path with the md5-hash extension request.
+func (s *SFTP) md5Hash(path string) ([]byte, error) {
+	var payload bytes.Buffer
+	writeString(&payload, path)
+	_ = binary.Write(&payload, binary.BigEndian, uint64(0))
+	_ = binary.Write(&payload, binary.BigEndian, uint64(0))
+	writeString(&payload, "")
+
+	reply, err := s.extended("md5-hash", payload.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	sum, _, ok := readString(reply)
+	if !ok || len(sum) != 16 {
+		return nil, engine.ErrHashUnsupported
+	}
+	return []byte(sum), nil
+}
+
+// extended sends a single extended request over a new SFTP session and returns the payload of its reply.
+// pkg/sftp offers no way to send extended requests, so the session speaks the few packets needed itself.
+func (s *SFTP) extended(request string, payload []byte) ([]byte, error) {
+	session, err := s.sshConn().NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = session.Close()
+	}()
+	w, err := session.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	r, err := session.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = session.RequestSubsystem("sftp")
+	if err != nil {
+		return nil, err
+	}
+
+	var init bytes.Buffer
+	_ = binary.Write(&init, binary.BigEndian, uint32(3))
+	err = writePacket(w, fxpInit, init.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	typ, _, err := readPacket(r)
+	if err != nil {
+		return nil, err
+	}
+	if typ != fxpVersion {
+		return nil, fmt.Errorf("unexpected SFTP packet %d", typ)
+	}
+
+	var req bytes.Buffer
+	_ = binary.Write(&req, binary.BigEndian, uint32(1))
+	writeString(&req, request)
+	req.Write(payload)
+	err = writePacket(w, fxpExtended, req.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	typ, data, err := readPacket(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 4 {
+		return nil, fmt.Errorf("short SFTP packet %d", typ)
+	}
+	data = data[4:] // request id
+	switch typ {
+	case fxpExtendedReply:
+		return data, nil
+	case fxpStatus:
+		if len(data) >= 4 {
+			switch binary.BigEndian.Uint32(data) {
+			case fxOK:
+				return nil, fmt.Errorf("%s returned no hash", request)
+			case fxNoSuchFile:
+				return nil, os.ErrNotExist
+			}
+		}
+		return nil, engine.ErrHashUnsupported
+	}
+	return nil, fmt.Errorf("unexpected SFTP packet %d", typ)
+}
+
+// hashCommand hashes path by running sha256sum or md5sum on the server.
+func (s *SFTP) hashCommand(path string, algorithm engine.HashAlgorithm) ([]byte, error) {
+	command := algorithm.String() + "sum"
+	session, err := s.sshConn().NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = session.Close()
+	}()
+	out, err := session.Output(command + " -- " + shellQuote(path))
+	if err != nil {
+		// The command is missing, the server has no shell, or the file cannot be read. The caller
+		// cannot tell these apart and falls back to comparing sizes and modification times.
+		return nil, engine.ErrHashUnsupported
+	}
+	field, _, _ := strings.Cut(string(out), " ")
+	sum, err := hex.DecodeString(strings.TrimPrefix(field, "\\"))
+	if err != nil || len(sum) != algorithm.New().Size() {
+		return nil, fmt.Errorf("unexpected output of %s: %q", command, out)
+	}
+	return sum, nil
+}
+
+// signatureScript is the Perl script that prints, for every block of $n bytes of the file $f, its hash computed with
+// $alg and, if $weak is set, the two halves of its rolling checksum, on a line of its own. The halves are reduced
+// every 64 KiB, so that they stay exact whatever the block size. It exits with an error if the file cannot be read.
+const signatureScript = `use Digest::SHA; use Digest::MD5;
+my ($n, $weak, $alg, $f) = @ARGV;
+open(my $h, "<", $f) or exit 1;
+binmode $h;
+while (1) {
+	my $r = read($h, my $buf, $n);
+	defined $r or exit 1;
+	last if $r == 0;
+	my $d = $alg eq "md5" ? Digest::MD5::md5_hex($buf) : Digest::SHA::sha256_hex($buf);
+	if (!$weak) { print "$d\n"; next }
+	my ($a, $b) = (0, 0);
+	for (my $o = 0; $o < $r; $o += 65536) {
+		for (unpack("C*", substr($buf, $o, 65536))) { $a += $_; $b += $a }
+		$a %= 65536; $b %= 65536;
+	}
+	print "$d $a $b\n";
+}`
+
+// blockScript runs signatureScript over the blocks of blockSize bytes of path and returns the lines it printed. It
+// returns engine.ErrHashUnsupported if the server cannot run it.
+func (s *SFTP) blockScript(path string, algorithm engine.HashAlgorithm, blockSize int64, weak bool) ([]string, error) {
+	session, err := s.sshConn().NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = session.Close()
+	}()
+	flag := "0"
+	if weak {
+		flag = "1"
+	}
+	out, err := session.Output(fmt.Sprintf("perl -e %s %d %s %s %s", shellQuote(signatureScript), blockSize, flag,
+		algorithm, shellQuote(path)))
+	if err != nil {
+		// Perl or its digest modules are missing, the server has no shell, or the file cannot be read.
+		return nil, engine.ErrHashUnsupported
+	}
+	text := strings.TrimSpace(string(out))
+	if text == "" {
+		return nil, nil
+	}
+	return strings.Split(text, "\n"), nil
+}
+
+// blockHashCommand hashes the blocks of blockSize bytes of path with signatureScript and returns their hashes one after
+// the other.
+func (s *SFTP) blockHashCommand(path string, algorithm engine.HashAlgorithm, blockSize int64) ([]byte, error) {
+	lines, err := s.blockScript(path, algorithm, blockSize, false)
+	if err != nil {
+		return nil, err
+	}
+	var sums []byte
+	for _, line := range lines {
+		sum, err := hex.DecodeString(line)
+		if err != nil || len(sum) != algorithm.New().Size() {
+			return nil, fmt.Errorf("unexpected block hash of %s: %q", path, line)
+		}
+		sums = append(sums, sum...)
+	}
+	return sums, nil
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// writeString writes s as an SFTP string.
+func writeString(b *bytes.Buffer, s string) {
+	_ = binary.Write(b, binary.BigEndian, uint32(len(s)))
+	b.WriteString(s)
+}
+
+// readString reads an SFTP string from the start of b and returns it along with the rest of b.
+func readString(b []byte) (string, []byte, bool) {
+	if len(b) < 4 {
+		return "", nil, false
+	}
+	n := binary.BigEndian.Uint32(b)
+	if uint32(len(b)-4) < n {
+		return "", nil, false
+	}
+	return string(b[4 : 4+n]), b[4+n:], true
+}
+
+// writePacket writes an SFTP packet of type typ.
+func writePacket(w io.Writer, typ byte, data []byte) error {
+	packet := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(packet, uint32(1+len(data)))
+	packet[4] = typ
+	_, err := w.Write(append(packet, data...))
+	return err
+}
+
+// readPacket reads an SFTP packet and returns its type and data.
+func readPacket(r io.Reader) (byte, []byte, error) {
+	var header [5]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(header[:4])
+	if n < 1 || n > 1<<20 {
+		return 0, nil, fmt.Errorf("invalid SFTP packet length %d", n)
+	}
+	data := make([]byte, n-1)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return 0, nil, err
+	}
+	return header[4], data, nil
+}
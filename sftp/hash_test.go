@@ -0,0 +1,65 @@
+package sftp
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cploutarchou/syncpkg/engine"
+)
+
+func TestBlockSignatures(t *testing.T) {
+	srv := newTestServer(t)
+	s, err := Connect(srv.host, srv.port, LocalToRemote, &ExtraConfig{
+		Username:            "foo",
+		Password:            "pass",
+		HostKeyFingerprints: []string{srv.fingerprint()},
+	})
+	if err != nil {
+		t.Fatalf("Connect returned an error: %v", err)
+	}
+	defer func() {
+		_ = s.Close()
+	}()
+
+	content := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(content)
+	name := filepath.Join(t.TempDir(), "file.bin")
+	err = os.WriteFile(name, content, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	algorithm, got, err := s.BlockSignatures(name, int64(len(content)), 1024, engine.HashSHA256)
+	if err != nil {
+		t.Fatalf("BlockSignatures returned an error: %v", err)
+	}
+	_, want, _ := engine.Local{}.BlockSignatures(name, int64(len(content)), 1024, engine.HashSHA256)
+	if algorithm != engine.HashSHA256 || len(got) != len(want) {
+		t.Fatalf("BlockSignatures returned %d %s signatures, want %d", len(got), algorithm, len(want))
+	}
+	for i := range want {
+		if got[i].Weak != want[i].Weak || !bytes.Equal(got[i].Strong, want[i].Strong) {
+			t.Errorf("signature of block %d = %x %x, want %x %x", i, got[i].Weak, got[i].Strong, want[i].Weak, want[i].Strong)
+		}
+	}
+
+	_, sums, err := s.BlockHashes(name, int64(len(content)), 1024, engine.HashMD5)
+	if err != nil || len(sums) != len(want) {
+		t.Fatalf("BlockHashes returned %d hashes, %v, want %d", len(sums), err, len(want))
+	}
+	for i := range sums {
+		if sum := md5.Sum(content[i*1024 : min((i+1)*1024, len(content))]); !bytes.Equal(sums[i], sum[:]) {
+			t.Errorf("hash of block %d = %x, want %x", i, sums[i], sum)
+		}
+	}
+
+	// Larger files are only compared at the same offsets.
+	_, _, err = s.BlockSignatures(name, maxRollingSize+1, 1024, engine.HashSHA256)
+	if !errors.Is(err, engine.ErrHashUnsupported) {
+		t.Errorf("BlockSignatures of a file larger than maxRollingSize returned %v, want ErrHashUnsupported", err)
+	}
+}
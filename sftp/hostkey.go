@@ -0,0 +1,229 @@
+package sftp
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// HostKeyMismatchError is returned by the connect functions when the server presents a host key that differs from
+// the keys known for it, in a known_hosts file or in ExtraConfig.HostKeyFingerprints. Either the key of the server
+// changed or the connection is intercepted.
+type HostKeyMismatchError struct {
+	//Host is the address of the server, as it is written in known_hosts
+	Host string
+	//Fingerprint is the SHA256 fingerprint of the key the server presented
+	Fingerprint string
+	//Want holds the SHA256 fingerprints of the keys known for the server, followed by the file and line they were
+	//read from, if any
+	Want []string
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	return fmt.Sprintf("sftp: host key mismatch for %s: got %s, want %s", e.Host, e.Fingerprint, strings.Join(e.Want, ", "))
+}
+
+// UnknownHostKeyError is returned by the connect functions when no key is known for the server and
+// ExtraConfig.TrustOnFirstUse is not set. Key can be added to a known_hosts file once its fingerprint was verified.
+type UnknownHostKeyError struct {
+	//Host is the address of the server, as it is written in known_hosts
+	Host string
+	//Fingerprint is the SHA256 fingerprint of the key the server presented
+	Fingerprint string
+	//Key is the key the server presented
+	Key ssh.PublicKey
+}
+
+func (e *UnknownHostKeyError) Error() string {
+	return fmt.Sprintf("sftp: unknown host key %s for %s", e.Fingerprint, e.Host)
+}
+
+// hostKeys checks the host keys presented by the server against the known_hosts files and the pinned fingerprints.
+type hostKeys struct {
+	//files are the known_hosts files, the first one receives the keys trusted on first use
+	files []string
+	//pins holds the pinned SHA256 fingerprints
+	pins []string
+	//tofu records the key of a server no key is known for instead of rejecting it
+	tofu bool
+	//hash records the host names of the keys trusted on first use in hashed form
+	hash bool
+	//log receives the keys trusted on first use
+	log *slog.Logger
+	//mu serialises the reads and the writes of the known_hosts files
+	mu sync.Mutex
+}
+
+// newHostKeys returns the host key checks configured by config. The known_hosts file of the current user is used
+// unless known_hosts files or fingerprints are configured.
+func newHostKeys(config *ExtraConfig) (*hostKeys, error) {
+	h := &hostKeys{files: config.KnownHostsFiles, tofu: config.TrustOnFirstUse, hash: config.HashKnownHosts, log: logger(config)}
+	for _, pin := range config.HostKeyFingerprints {
+		if !strings.HasPrefix(pin, "SHA256:") {
+			pin = "SHA256:" + pin
+		}
+		h.pins = append(h.pins, strings.TrimRight(pin, "="))
+	}
+	if len(h.files) == 0 && len(h.pins) == 0 {
+		usr, err := user.Current()
+		if err != nil {
+			return nil, fmt.Errorf("cannot get user home directory: %w", err)
+		}
+		h.files = []string{filepath.Join(usr.HomeDir, ".ssh", "known_hosts")}
+	}
+	return h, nil
+}
+
+// database returns the callback of the known_hosts files that exist, or nil if none does.
+func (h *hostKeys) database() (ssh.HostKeyCallback, error) {
+	var files []string
+	for _, file := range h.files {
+		_, err := os.Stat(file)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		files = append(files, file)
+	}
+	if len(files) == 0 {
+		return nil, nil
+	}
+	return knownhosts.New(files...)
+}
+
+// check is the ssh.HostKeyCallback of the checks. The files are read again on every check, so that keys added by
+// another process or trusted on first use by another connection are taken into account.
+func (h *hostKeys) check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	fingerprint := ssh.FingerprintSHA256(key)
+	for _, pin := range h.pins {
+		if pin == fingerprint {
+			return nil
+		}
+	}
+	want := append([]string(nil), h.pins...)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	db, err := h.database()
+	if err != nil {
+		return err
+	}
+	if db != nil {
+		err = db(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		switch {
+		case err == nil:
+			return nil
+		case errors.As(err, &keyErr):
+			for _, known := range keyErr.Want {
+				want = append(want, fmt.Sprintf("%s (%s:%d)", ssh.FingerprintSHA256(known.Key), known.Filename, known.Line))
+			}
+		default:
+			return err
+		}
+	}
+
+	host := knownhosts.Normalize(hostname)
+	if len(want) > 0 {
+		return &HostKeyMismatchError{Host: host, Fingerprint: fingerprint, Want: want}
+	}
+	if !h.tofu || len(h.files) == 0 {
+		return &UnknownHostKeyError{Host: host, Fingerprint: fingerprint, Key: key}
+	}
+	return h.record(host, key)
+}
+
+// record appends key to the first known_hosts file, creating it if needed.
+func (h *hostKeys) record(host string, key ssh.PublicKey) error {
+	file := h.files[0]
+	err := os.MkdirAll(filepath.Dir(file), 0o700)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	name := host
+	if h.hash {
+		name = knownhosts.HashHostname(host)
+	}
+	_, err = fmt.Fprintln(f, knownhosts.Line([]string{name}, key))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	h.log.Warn("trusting host key on first use", "op", "connect", "host", host, "fingerprint",
+		ssh.FingerprintSHA256(key), "file", file)
+	return nil
+}
+
+// algorithms returns the host key algorithms of the keys the known_hosts files hold for address, in order of
+// preference, so that a server with several host keys presents a known one. It returns nil if no key is known.
+func (h *hostKeys) algorithms(address string) ([]string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	db, err := h.database()
+	if db == nil || err != nil {
+		return nil, err
+	}
+	// A key no server has lists the keys known for the address.
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	probe, err := ssh.NewPublicKey(public)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		remote = &net.TCPAddr{}
+	}
+	var keyErr *knownhosts.KeyError
+	if !errors.As(db(address, remote, probe), &keyErr) {
+		return nil, nil
+	}
+	var algorithms []string
+	for _, known := range keyErr.Want {
+		switch typ := known.Key.Type(); typ {
+		case ssh.KeyAlgoRSA:
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+		default:
+			algorithms = append(algorithms, typ)
+		}
+	}
+	return algorithms, nil
+}
+
+// hostKeyCallback returns the host key callback configured by config for the server at address, along with the host
+// key algorithms to offer.
+func hostKeyCallback(config *ExtraConfig, address string) (ssh.HostKeyCallback, []string, error) {
+	if config.InsecureIgnoreHostKey {
+		return ssh.InsecureIgnoreHostKey(), config.HostKeyAlgorithms, nil
+	}
+	h, err := newHostKeys(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	algorithms := config.HostKeyAlgorithms
+	if len(algorithms) == 0 && len(h.pins) == 0 {
+		algorithms, err = h.algorithms(address)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return h.check, algorithms, nil
+}
@@ -0,0 +1,139 @@
+package sftp
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// writeKnownHosts writes a known_hosts file with the given lines and returns its path.
+func writeKnownHosts(t *testing.T, lines ...string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	err := os.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// connectHostKey connects to srv with the host key checks of config.
+func connectHostKey(srv *testServer, config *ExtraConfig) error {
+	config.Username, config.Password = "foo", "pass"
+	s, err := Connect(srv.host, srv.port, LocalToRemote, config)
+	if err != nil {
+		return err
+	}
+	return s.Close()
+}
+
+func TestHostKeyFingerprint(t *testing.T) {
+	srv := newTestServer(t)
+	err := connectHostKey(srv, &ExtraConfig{HostKeyFingerprints: []string{srv.fingerprint()}})
+	if err != nil {
+		t.Fatalf("the pinned key was rejected: %v", err)
+	}
+	err = connectHostKey(srv, &ExtraConfig{HostKeyFingerprints: []string{strings.TrimPrefix(srv.fingerprint(), "SHA256:")}})
+	if err != nil {
+		t.Fatalf("the pinned key without its prefix was rejected: %v", err)
+	}
+
+	pin := ssh.FingerprintSHA256(srv.ed25519Key.PublicKey())
+	err = connectHostKey(srv, &ExtraConfig{HostKeyFingerprints: []string{pin}})
+	var mismatch *HostKeyMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("Connect returned %v, want a HostKeyMismatchError", err)
+	}
+	if mismatch.Fingerprint != srv.fingerprint() || len(mismatch.Want) != 1 || mismatch.Want[0] != pin {
+		t.Errorf("HostKeyMismatchError = %+v", mismatch)
+	}
+
+	err = connectHostKey(srv, &ExtraConfig{HostKeyFingerprints: []string{pin}, HostKeyAlgorithms: []string{ssh.KeyAlgoED25519}})
+	if err != nil {
+		t.Fatalf("the pinned key of the configured algorithm was rejected: %v", err)
+	}
+}
+
+func TestKnownHosts(t *testing.T) {
+	srv := newTestServer(t)
+	address := knownhosts.Normalize(net.JoinHostPort(srv.host, fmt.Sprint(srv.port)))
+
+	file := writeKnownHosts(t, knownhosts.Line([]string{knownhosts.HashHostname(address)}, srv.key.PublicKey()))
+	err := connectHostKey(srv, &ExtraConfig{KnownHostsFiles: []string{file}})
+	if err != nil {
+		t.Fatalf("the key of the hashed host name was rejected: %v", err)
+	}
+
+	// Only the second key of the server is known, which it must be asked for.
+	file = writeKnownHosts(t, knownhosts.Line([]string{address}, srv.ed25519Key.PublicKey()))
+	err = connectHostKey(srv, &ExtraConfig{KnownHostsFiles: []string{file}})
+	if err != nil {
+		t.Fatalf("the known key of the server was not negotiated: %v", err)
+	}
+
+	_, other, err := ed25519Signer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file = writeKnownHosts(t, knownhosts.Line([]string{address}, other))
+	err = connectHostKey(srv, &ExtraConfig{KnownHostsFiles: []string{file}})
+	var mismatch *HostKeyMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("Connect returned %v, want a HostKeyMismatchError", err)
+	}
+	if mismatch.Host != address || len(mismatch.Want) != 1 || !strings.HasPrefix(mismatch.Want[0], ssh.FingerprintSHA256(other)) {
+		t.Errorf("HostKeyMismatchError = %+v", mismatch)
+	}
+}
+
+func TestTrustOnFirstUse(t *testing.T) {
+	srv := newTestServer(t)
+	file := filepath.Join(t.TempDir(), "ssh", "known_hosts")
+
+	err := connectHostKey(srv, &ExtraConfig{KnownHostsFiles: []string{file}})
+	var unknown *UnknownHostKeyError
+	if !errors.As(err, &unknown) {
+		t.Fatalf("Connect returned %v, want an UnknownHostKeyError", err)
+	}
+	if unknown.Fingerprint != srv.fingerprint() {
+		t.Errorf("UnknownHostKeyError = %+v", unknown)
+	}
+
+	err = connectHostKey(srv, &ExtraConfig{KnownHostsFiles: []string{file}, TrustOnFirstUse: true, HashKnownHosts: true})
+	if err != nil {
+		t.Fatalf("the key was not trusted on first use: %v", err)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("the key was not recorded: %v", err)
+	}
+	if !strings.HasPrefix(string(data), "|1|") {
+		t.Errorf("the host name was not hashed: %s", data)
+	}
+	err = connectHostKey(srv, &ExtraConfig{KnownHostsFiles: []string{file}})
+	if err != nil {
+		t.Fatalf("the recorded key was rejected: %v", err)
+	}
+}
+
+// ed25519Signer returns a new ed25519 signer and its public key.
+func ed25519Signer() (ssh.Signer, ssh.PublicKey, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		return nil, nil, err
+	}
+	return signer, signer.PublicKey(), nil
+}
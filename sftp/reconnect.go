@@ -0,0 +1,75 @@
+package sftp
+
+import (
+	"errors"
+	"time"
+
+	"github.com/cploutarchou/syncpkg/engine"
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTP re-establishes the connection to the server when it drops.
+var _ engine.Reconnector = (*SFTP)(nil)
+
+// pingTimeout is the time the server has to answer a ping before the connection is considered dead.
+const pingTimeout = 10 * time.Second
+
+// errPingTimeout is returned by Ping when the server did not answer in time.
+var errPingTimeout = errors.New("sftp: server did not answer the keepalive")
+
+// pool returns the current pool of sessions.
+func (s *SFTP) pool() *sessionPool {
+	s.connMu.RLock()
+	defer s.connMu.RUnlock()
+	return s.sessions
+}
+
+// sshConn returns one of the SSH connections of the pool.
+func (s *SFTP) sshConn() *ssh.Client {
+	return s.pool().any().conn
+}
+
+// Ping checks the connections with a round trip over every session. Connections that do not answer within
+// pingTimeout are closed, which fails the operations blocked on them.
+func (s *SFTP) Ping() error {
+	pool := s.pool()
+	done := make(chan error, len(pool.sessions))
+	for _, sess := range pool.sessions {
+		go func(sess *session) {
+			_, err := sess.client.Getwd()
+			done <- err
+		}(sess)
+	}
+	timer := time.NewTimer(pingTimeout)
+	defer timer.Stop()
+	for range pool.sessions {
+		select {
+		case err := <-done:
+			if err != nil {
+				return err
+			}
+		case <-timer.C:
+			_ = pool.close()
+			return errPingTimeout
+		}
+	}
+	return nil
+}
+
+// Reconnect dials the server again with the parameters of Connect or ConnectSSHPair, replaces the pool of sessions
+// with a new one and closes the old one.
+func (s *SFTP) Reconnect() error {
+	sessions, err := s.openSessions()
+	if err != nil {
+		return err
+	}
+
+	s.connMu.Lock()
+	old := s.sessions
+	s.sessions, s.Client = sessions, sessions.sessions[0].client
+	s.connMu.Unlock()
+
+	_ = old.close()
+	s.log().Info("reconnected to SFTP server", "op", "connect", "address", s.address)
+	return nil
+}
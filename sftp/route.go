@@ -0,0 +1,158 @@
+package sftp
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// defaultDialTimeout is the time allowed to connect to each hop and to run its SSH handshake by default.
+const defaultDialTimeout = 30 * time.Second
+
+// endpoint is an SSH server on the way to the SFTP server: a jump host or the SFTP server itself.
+type endpoint struct {
+	//address is the host:port of the server
+	address string
+	//user is the user to log in as
+	user string
+	//auth lists the methods to authenticate with
+	auth []AuthMethod
+}
+
+// hop is an endpoint along with the configuration of its SSH client.
+type hop struct {
+	endpoint
+	//config is the configuration of the SSH client, without the auth methods, which are loaded on every dial
+	config *ssh.ClientConfig
+	//log receives the keys skipped because they cannot be loaded
+	log *slog.Logger
+}
+
+// newHops returns the hops of route, whose host keys are checked as config says.
+func newHops(route []endpoint, config *ExtraConfig) ([]hop, error) {
+	timeout := config.DialTimeout
+	if timeout <= 0 {
+		timeout = defaultDialTimeout
+	}
+	var hops []hop
+	for _, e := range route {
+		callback, algorithms, err := hostKeyCallback(config, e.address)
+		if err != nil {
+			return nil, err
+		}
+		hops = append(hops, hop{endpoint: e, config: &ssh.ClientConfig{
+			User:              e.user,
+			HostKeyCallback:   callback,
+			HostKeyAlgorithms: algorithms,
+			Timeout:           timeout,
+		}, log: logger(config)})
+	}
+	return hops, nil
+}
+
+// dialRoute dials the first hop and every following one through the connection to the previous one, and returns the
+// client of the last one. The jump hosts are disconnected once the connection to the last one closes.
+func dialRoute(hops []hop) (*ssh.Client, error) {
+	var clients []*ssh.Client
+	closeClients := func() {
+		for i := len(clients) - 1; i >= 0; i-- {
+			_ = clients[i].Close()
+		}
+	}
+	for i, h := range hops {
+		var client *ssh.Client
+		var err error
+		if i == 0 {
+			client, err = h.dial()
+		} else {
+			client, err = h.dialThrough(clients[i-1])
+		}
+		if err != nil {
+			closeClients()
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+
+	last := clients[len(clients)-1]
+	if len(clients) > 1 {
+		clients = clients[:len(clients)-1]
+		go func() {
+			_ = last.Wait()
+			closeClients()
+		}()
+	}
+	return last, nil
+}
+
+// dial connects to the hop and runs its SSH handshake, which must both complete within the timeout of the hop.
+func (h hop) dial() (*ssh.Client, error) {
+	conn, err := net.DialTimeout("tcp", h.address, h.config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(h.config.Timeout))
+	client, err := h.handshake(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return client, nil
+}
+
+// dialThrough connects to the hop through the jump host, the client of the previous hop, and runs its SSH
+// handshake, which must both complete within the timeout of the hop. The channels of a jump host have no deadlines,
+// so the jump host is disconnected if they are late, which fails the route.
+func (h hop) dialThrough(jump *ssh.Client) (*ssh.Client, error) {
+	timer := time.AfterFunc(h.config.Timeout, func() {
+		_ = jump.Close()
+	})
+	conn, err := jump.Dial("tcp", h.address)
+	var client *ssh.Client
+	if err == nil {
+		client, err = h.handshake(conn)
+		if err != nil {
+			_ = conn.Close()
+		}
+	}
+	if !timer.Stop() {
+		if client != nil {
+			_ = client.Close()
+		}
+		return nil, fmt.Errorf("cannot connect to %s through the jump host in %s: %w", h.address, h.config.Timeout,
+			os.ErrDeadlineExceeded)
+	}
+	return client, err
+}
+
+// handshake runs the SSH handshake of the hop over conn. The handshake flattens the error of the host key callback
+// into a string, so the error is returned as it is, which keeps the HostKeyMismatchError and UnknownHostKeyError
+// types.
+func (h hop) handshake(conn net.Conn) (*ssh.Client, error) {
+	auth, release, err := sshAuth(h.auth, h.log)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var hostKeyErr error
+	config := *h.config
+	config.Auth = auth
+	config.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		hostKeyErr = h.config.HostKeyCallback(hostname, remote, key)
+		return hostKeyErr
+	}
+	c, channels, requests, err := ssh.NewClientConn(conn, h.address, &config)
+	if hostKeyErr != nil {
+		return nil, hostKeyErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewClient(c, channels, requests), nil
+}
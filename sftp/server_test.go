@@ -0,0 +1,379 @@
+package sftp
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// testServer is an in-process SSH server with the sftp subsystem, serving the local file system to the user foo
+// with the password pass.
+type testServer struct {
+	//host and port are the address the server listens on
+	host string
+	port int
+	//key is the host key the clients negotiate by default, and ed25519Key the second host key of the server
+	key, ed25519Key ssh.Signer
+	//listener accepts the connections
+	listener net.Listener
+	//mu guards the fields below
+	mu sync.Mutex
+	//conns holds the open connections
+	conns []net.Conn
+	//accepted counts the accepted connections
+	accepted int
+	//forwarded counts the connections forwarded to other servers, as a jump host does
+	forwarded int
+	//authorized holds the public keys the user foo can authenticate with
+	authorized []ssh.PublicKey
+	//ca is the key of the authority whose user certificates are accepted, if any
+	ca ssh.PublicKey
+}
+
+// newTestServer starts a test server that is stopped at the end of the test.
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate host key: %v", err)
+	}
+	ed25519Key, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatalf("cannot create signer: %v", err)
+	}
+	ecdsaPrivate, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate host key: %v", err)
+	}
+	key, err := ssh.NewSignerFromKey(ecdsaPrivate)
+	if err != nil {
+		t.Fatalf("cannot create signer: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	srv := &testServer{host: host, key: key, ed25519Key: ed25519Key, listener: listener}
+	srv.port, _ = strconv.Atoi(port)
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == "foo" && string(password) == "pass" {
+				return nil, nil
+			}
+			return nil, errors.New("access denied")
+		},
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			checker := &ssh.CertChecker{
+				IsUserAuthority: func(auth ssh.PublicKey) bool {
+					srv.mu.Lock()
+					defer srv.mu.Unlock()
+					return srv.ca != nil && bytes.Equal(auth.Marshal(), srv.ca.Marshal())
+				},
+				UserKeyFallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+					srv.mu.Lock()
+					defer srv.mu.Unlock()
+					for _, authorized := range srv.authorized {
+						if conn.User() == "foo" && bytes.Equal(key.Marshal(), authorized.Marshal()) {
+							return nil, nil
+						}
+					}
+					return nil, errors.New("access denied")
+				},
+			}
+			return checker.Authenticate(conn, key)
+		},
+		KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			answers, err := client("", "", []string{"Verification code: "}, []bool{false})
+			if err != nil {
+				return nil, err
+			}
+			if conn.User() != "foo" || len(answers) != 1 || answers[0] != "123456" {
+				return nil, errors.New("access denied")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(key)
+	config.AddHostKey(ed25519Key)
+	go srv.accept(config)
+	t.Cleanup(func() {
+		_ = listener.Close()
+		srv.drop()
+	})
+	return srv
+}
+
+// accept serves the connections until the listener is closed.
+func (srv *testServer) accept(config *ssh.ServerConfig) {
+	for {
+		conn, err := srv.listener.Accept()
+		if err != nil {
+			return
+		}
+		srv.mu.Lock()
+		srv.conns = append(srv.conns, conn)
+		srv.accepted++
+		srv.mu.Unlock()
+		go srv.serve(conn, config)
+	}
+}
+
+// serve runs the SSH handshake on conn and serves the sftp subsystem and the commands of exec requests on its
+// session channels.
+func (srv *testServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() == "direct-tcpip" {
+			go srv.forward(newChannel)
+			continue
+		}
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range requests {
+				if req.Type == "exec" && len(req.Payload) >= 4 {
+					_ = req.Reply(true, nil)
+					srv.exec(channel, string(req.Payload[4:]))
+					continue
+				}
+				if req.Type != "subsystem" || len(req.Payload) < 4 || string(req.Payload[4:]) != "sftp" {
+					_ = req.Reply(false, nil)
+					continue
+				}
+				_ = req.Reply(true, nil)
+				server, err := sftp.NewServer(channel)
+				if err == nil {
+					_ = server.Serve()
+				}
+				_ = channel.Close()
+			}
+		}()
+	}
+}
+
+// exec runs command with sh on channel and sends its exit status.
+func (srv *testServer) exec(channel ssh.Channel, command string) {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdout, cmd.Stderr = channel, channel.Stderr()
+	status := 0
+	err := cmd.Run()
+	if err != nil {
+		status = 1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			status = exitErr.ExitCode()
+		}
+	}
+	_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+	_ = channel.Close()
+}
+
+// authorize lets the user foo authenticate with key.
+func (srv *testServer) authorize(key ssh.PublicKey) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.authorized = append(srv.authorized, key)
+}
+
+// trustAuthority makes the server accept the user certificates signed by ca.
+func (srv *testServer) trustAuthority(ca ssh.PublicKey) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.ca = ca
+}
+
+// fingerprint returns the SHA256 fingerprint of the host key the clients negotiate by default of the server.
+func (srv *testServer) fingerprint() string {
+	return ssh.FingerprintSHA256(srv.key.PublicKey())
+}
+
+// forward connects a direct-tcpip channel, opened by a client that uses the server as a jump host, to the address
+// it asks for.
+func (srv *testServer) forward(newChannel ssh.NewChannel) {
+	var target struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	err := ssh.Unmarshal(newChannel.ExtraData(), &target)
+	if err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+	if err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	srv.mu.Lock()
+	srv.forwarded++
+	srv.mu.Unlock()
+	go ssh.DiscardRequests(requests)
+	go func() {
+		_, _ = io.Copy(conn, channel)
+		_ = conn.Close()
+	}()
+	_, _ = io.Copy(channel, conn)
+	_ = channel.Close()
+}
+
+// forwards returns the number of connections forwarded so far.
+func (srv *testServer) forwards() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.forwarded
+}
+
+// connections returns the number of connections accepted so far.
+func (srv *testServer) connections() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.accepted
+}
+
+// drop closes every open connection, as a restarting server does.
+func (srv *testServer) drop() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for _, conn := range srv.conns {
+		_ = conn.Close()
+	}
+	srv.conns = nil
+}
+
+func TestSessionPool(t *testing.T) {
+	srv := newTestServer(t)
+	s, err := Connect(srv.host, srv.port, LocalToRemote, &ExtraConfig{
+		Username:            "foo",
+		Password:            "pass",
+		HostKeyFingerprints: []string{srv.fingerprint()},
+		Sessions:            3,
+		Connections:         2,
+	})
+	if err != nil {
+		t.Fatalf("Connect returned an error: %v", err)
+	}
+	defer func() {
+		_ = s.Close()
+	}()
+	if n := srv.connections(); n != 2 {
+		t.Errorf("the sessions were spread over %d connections, want 2", n)
+	}
+
+	dir := t.TempDir()
+	var files []io.WriteCloser
+	for i := 0; i < 3; i++ {
+		file, err := s.Create(filepath.Join(dir, fmt.Sprintf("file%d.txt", i)))
+		if err != nil {
+			t.Fatalf("Create returned an error: %v", err)
+		}
+		files = append(files, file)
+	}
+	created := make(chan error, 1)
+	go func() {
+		file, err := s.Create(filepath.Join(dir, "file3.txt"))
+		if err == nil {
+			err = file.Close()
+		}
+		created <- err
+	}()
+	select {
+	case err = <-created:
+		t.Fatalf("Create did not wait for a free session, it returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	_, err = s.Stat(dir)
+	if err != nil {
+		t.Errorf("Stat waited for a free session: %v", err)
+	}
+
+	_, err = files[0].Write([]byte("content"))
+	if err != nil {
+		t.Fatalf("Write returned an error: %v", err)
+	}
+	for _, file := range files {
+		err = file.Close()
+		if err != nil {
+			t.Fatalf("Close returned an error: %v", err)
+		}
+	}
+	select {
+	case err = <-created:
+		if err != nil {
+			t.Fatalf("Create returned an error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Create did not get the session given back")
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "file0.txt"))
+	if err != nil || string(data) != "content" {
+		t.Errorf("uploaded file = %q, %v, want %q", data, err, "content")
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	srv := newTestServer(t)
+	s, err := Connect(srv.host, srv.port, LocalToRemote, &ExtraConfig{
+		Username:            "foo",
+		Password:            "pass",
+		HostKeyFingerprints: []string{srv.fingerprint()},
+	})
+	if err != nil {
+		t.Fatalf("Connect returned an error: %v", err)
+	}
+	defer func() {
+		_ = s.Close()
+	}()
+
+	srv.drop()
+	err = s.Ping()
+	if err == nil {
+		t.Fatalf("Ping did not notice the dropped connection")
+	}
+	if transient, _ := s.Transient(err); !transient {
+		t.Errorf("the error of the dropped connection is not transient: %v", err)
+	}
+	err = s.Reconnect()
+	if err != nil {
+		t.Fatalf("Reconnect returned an error: %v", err)
+	}
+	_, err = s.Stat(t.TempDir())
+	if err != nil {
+		t.Errorf("Stat failed after reconnecting: %v", err)
+	}
+}
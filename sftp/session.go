@@ -0,0 +1,97 @@
+package sftp
+
+import (
+	"sync/atomic"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// session is an SFTP session of the pool, along with the SSH connection it runs on.
+type session struct {
+	//client is the SFTP client of the session
+	client *sftp.Client
+	//conn is the SSH connection the session runs on, shared with the other sessions dialed over it
+	conn *ssh.Client
+}
+
+// sessionPool holds the SFTP sessions of a client. Transfers check a session out for as long as their file is open,
+// so that as many files as there are sessions are transferred in parallel, each over an SFTP channel of its own.
+// The other operations, which are single requests, use the sessions in turn without checking them out.
+type sessionPool struct {
+	//sessions holds every session of the pool
+	sessions []*session
+	//conns holds the SSH connections the sessions are spread over
+	conns []*ssh.Client
+	//free holds the sessions that are not checked out
+	free chan *session
+	//next is the index of the session used by the next operation that does not check one out
+	next atomic.Uint32
+}
+
+// newSessionPool dials connections SSH connections with dial and opens sessions SFTP sessions spread evenly over
+// them, with the SFTP client options opts. Both numbers are at least 1, and there are no more connections than
+// sessions.
+func newSessionPool(dial func() (*ssh.Client, error), sessions, connections int, opts ...sftp.ClientOption) (*sessionPool, error) {
+	if sessions < 1 {
+		sessions = 1
+	}
+	if connections < 1 {
+		connections = 1
+	}
+	if connections > sessions {
+		connections = sessions
+	}
+	p := &sessionPool{free: make(chan *session, sessions)}
+	for i := 0; i < connections; i++ {
+		conn, err := dial()
+		if err != nil {
+			_ = p.close()
+			return nil, err
+		}
+		p.conns = append(p.conns, conn)
+	}
+	for i := 0; i < sessions; i++ {
+		conn := p.conns[i%connections]
+		client, err := sftp.NewClient(conn, opts...)
+		if err != nil {
+			_ = p.close()
+			return nil, err
+		}
+		s := &session{client: client, conn: conn}
+		p.sessions = append(p.sessions, s)
+		p.free <- s
+	}
+	return p, nil
+}
+
+// checkout waits until a session is free and returns it. It must be given back with checkin.
+func (p *sessionPool) checkout() *session {
+	return <-p.free
+}
+
+// checkin gives back a session returned by checkout.
+func (p *sessionPool) checkin(s *session) {
+	p.free <- s
+}
+
+// any returns one of the sessions, in turn, for an operation that does not check one out.
+func (p *sessionPool) any() *session {
+	return p.sessions[int(p.next.Add(1)-1)%len(p.sessions)]
+}
+
+// close closes the sessions and the connections of the pool, and returns the first error.
+func (p *sessionPool) close() error {
+	var err error
+	for _, s := range p.sessions {
+		if closeErr := s.client.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	for _, conn := range p.conns {
+		if closeErr := conn.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -3,34 +3,96 @@ package sftp
 import (
 	"context"
 	"fmt"
-	"io"
-	"log"
-	"os"
-	"os/user"
-	"path"
-	"path/filepath"
-	"strings"
+	"log/slog"
+	"net/http"
 	"sync"
 	"time"
 
+	"github.com/cploutarchou/syncpkg/engine"
 	"github.com/cploutarchou/syncpkg/worker"
-	"github.com/fsnotify/fsnotify"
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 )
 
 // SyncDirection is the direction of the sync operation
-type SyncDirection int
+type SyncDirection = engine.SyncDirection
 
 const (
 	//LocalToRemote is the direction of the sync operation from local to remote
-	LocalToRemote SyncDirection = iota
+	LocalToRemote = engine.LocalToRemote
 	//RemoteToLocal is the direction of the sync operation from remote to local
-	RemoteToLocal
+	RemoteToLocal = engine.RemoteToLocal
+	//Bidirectional is the direction of the sync operation in both directions, with conflict detection
+	Bidirectional = engine.Bidirectional
 )
 
-// Logger is the logger used by the package. It defaults to log.New(os.Stdout, "sftp: ", log.Lshortfile)
-var logger = log.New(os.Stdout, "sftp: ", log.Lshortfile)
+// ConflictPolicy decides which version of a file survives when it changed on both sides of a Bidirectional sync
+type ConflictPolicy = engine.ConflictPolicy
+
+const (
+	//NewestWins keeps the version with the most recent modification time
+	NewestWins = engine.NewestWins
+	//LocalWins keeps the local version
+	LocalWins = engine.LocalWins
+	//RemoteWins keeps the remote version
+	RemoteWins = engine.RemoteWins
+	//KeepBoth keeps both versions, the losing one under a conflict-suffixed name
+	KeepBoth = engine.KeepBoth
+)
+
+// MemoryState is the ExtraConfig.StateFile that keeps the state of the sync in memory only
+const MemoryState = engine.MemoryState
+
+// HashAlgorithm is the algorithm used to compare the content of files
+type HashAlgorithm = engine.HashAlgorithm
+
+const (
+	//HashNone compares files by size and modification time only
+	HashNone = engine.HashNone
+	//HashSHA256 compares files by their SHA-256 hash
+	HashSHA256 = engine.HashSHA256
+	//HashXXH64 compares files by their xxHash hash locally, and by SHA-256 or MD5 against the server
+	HashXXH64 = engine.HashXXH64
+)
+
+// SyncEvent describes something the sync did, such as the start, progress or end of a transfer
+type SyncEvent = engine.SyncEvent
+
+// EventType is the kind of a SyncEvent
+type EventType = engine.EventType
+
+const (
+	//TransferStarted is emitted before a file is copied
+	TransferStarted = engine.TransferStarted
+	//TransferProgress is emitted while a file is copied
+	TransferProgress = engine.TransferProgress
+	//TransferCompleted is emitted once a file was copied
+	TransferCompleted = engine.TransferCompleted
+	//TransferFailed is emitted when a file could not be copied after all the attempts
+	TransferFailed = engine.TransferFailed
+	//Deleted is emitted once a file or directory was removed after it was removed on the other side
+	Deleted = engine.Deleted
+	//ConflictDetected is emitted when a file changed on both sides of a Bidirectional sync
+	ConflictDetected = engine.ConflictDetected
+	//Reconnecting is emitted when the connection to the server was found dead, before it is re-established
+	Reconnecting = engine.Reconnecting
+	//Reconnected is emitted when the connection to the server was re-established
+	Reconnected = engine.Reconnected
+	//InitialSyncDone is emitted once the initial synchronization finished
+	InitialSyncDone = engine.InitialSyncDone
+)
+
+// Stats is a snapshot of the metrics of the sync, returned by Stats
+type Stats = engine.Stats
+
+// Observer receives every SyncEvent. It is called synchronously and must return quickly.
+type Observer = engine.Observer
+
+// RetryPolicy decides how the operations that fail with a transient error are retried, see ExtraConfig.RetryPolicy
+type RetryPolicy = engine.RetryPolicy
+
+// eventBuffer is the number of events buffered by the channel returned by Events.
+const eventBuffer = 100
 
 // SFtp is the struct that holds the sftp client and the sync direction
 type SFTP struct {
@@ -38,16 +100,25 @@ type SFTP struct {
 	Direction SyncDirection
 	//config is the extra configuration for the sftp client
 	config *ExtraConfig
-	//Watcher is the fsnotify watcher used to watch for file changes
-	Watcher *fsnotify.Watcher
-	//ctx is the context used to cancel the watcher and the worker pool
-	ctx context.Context
-	//mu is the mutex used to lock the sftp client when uploading/downloading files
-	mu sync.Mutex
-	//Client is the sftp client
+	//Client is the sftp client of the first session of the pool. It is replaced when the connection to the server
+	//is re-established.
 	Client *sftp.Client
+	//sessions is the pool of SFTP sessions the operations run on
+	sessions *sessionPool
+	//connMu guards Client and sessions
+	connMu sync.RWMutex
+	//dial connects to the server with the parameters of Connect or ConnectSSHPair
+	dial func() (*ssh.Client, error)
 	//Pool is the worker pool
-	Pool *worker.Pool
+	Pool *worker.Pool[worker.Task]
+	//engine is the sync engine that keeps the local and the remote directory in sync
+	engine *engine.Engine
+	//events delivers the events of the sync to Events
+	events *engine.EventStream
+	//lifecycle guards engine
+	lifecycle sync.Mutex
+	//address is the host:port of the sftp server
+	address string
 }
 
 // ExtraConfig is the struct that holds the extra configuration for the sftp client
@@ -60,10 +131,112 @@ type ExtraConfig struct {
 	LocalDir string
 	//RemoteDir is the remote directory to sync with the local directory
 	RemoteDir string
-	//Retries is the number of retries to connect to the sftp server
+	//Auth lists the methods used to authenticate, tried in order like the OpenSSH client does: the keys of the
+	//public key methods, in their order, at the position of the first one, then the other methods. It replaces the
+	//password of Connect and the keys of ConnectSSHPair.
+	Auth []AuthMethod
+	//SSHConfigFile is the OpenSSH client configuration file ConnectHost resolves the host alias with. It defaults to
+	//~/.ssh/config.
+	SSHConfigFile string
+	//KnownHostsFiles are the OpenSSH known_hosts files the host key of the server is checked against, hashed host
+	//names included. It defaults to ~/.ssh/known_hosts, unless HostKeyFingerprints is set.
+	KnownHostsFiles []string
+	//HostKeyFingerprints pins the SHA256 fingerprints of the accepted host keys, as printed by ssh-keygen -l, such
+	//as "SHA256:uNiVztksCsDhcc0u9e8BujQXVUpKZIDTMczCvj3tD2s". Set HostKeyAlgorithms to the algorithm of the pinned
+	//key if the server has several host keys.
+	HostKeyFingerprints []string
+	//TrustOnFirstUse accepts the host key of a server no key is known for and records it in the first of the
+	//KnownHostsFiles, so that a different key is rejected on the next connection. Without it, such a server is
+	//rejected with an UnknownHostKeyError.
+	TrustOnFirstUse bool
+	//HashKnownHosts records the host names of the keys trusted on first use in hashed form, like HashKnownHosts in
+	//ssh_config
+	HashKnownHosts bool
+	//HostKeyAlgorithms lists the accepted host key algorithms in order of preference, such as "ssh-ed25519". It
+	//defaults to the algorithms of the keys the known_hosts files hold for the server, or to every supported
+	//algorithm if they hold none.
+	HostKeyAlgorithms []string
+	//InsecureIgnoreHostKey accepts any host key, which exposes the connection to man-in-the-middle attacks. It is
+	//meant for tests.
+	InsecureIgnoreHostKey bool
+	//Retries is not used.
+	//
+	//Deprecated: use RetryPolicy.MaxAttempts.
 	Retries int
-	//MaxRetries is the maximum number of retries to connect to the sftp server
+	//MaxRetries is the number of attempts made to upload, download or delete a file, create a directory or list a
+	//remote directory. It is only used if RetryPolicy.MaxAttempts is not set.
 	MaxRetries int
+	//RetryPolicy decides how often and how fast the operations that fail with a transient error, such as a timeout
+	//or a lost connection, are retried. Permanent errors, such as a missing file or a denied permission, are not.
+	RetryPolicy RetryPolicy
+	//ConflictPolicy decides which version wins when a file changed on both sides of a Bidirectional sync
+	ConflictPolicy ConflictPolicy
+	//StateFile is the file that records the last synced state of every path, so that files deleted while the
+	//process was down are deleted on the other side too. It defaults to a file of the sync pair in the syncpkg
+	//directory of the user cache directory, such as ~/.cache/syncpkg on Linux. The state is kept in memory only if
+	//it is MemoryState.
+	StateFile string
+	//HashAlgorithm enables the comparison of file contents, so that only files whose content differs are
+	//transferred. Remote files are hashed by the server. Files are compared by size and modification time if it
+	//is HashNone.
+	HashAlgorithm HashAlgorithm
+	//DeltaThreshold is the size from which modified files are transferred as a delta, writing only the blocks that
+	//differ. Both copies are hashed block by block, the remote one by the server. Downloads of files up to 256 MiB
+	//find the blocks that moved in the local copy with rolling checksums, while uploads and larger files compare
+	//blocks at the same offsets. Delta transfers are disabled if it is 0.
+	DeltaThreshold int64
+	//DeltaBlockSize is the size of the blocks compared by delta transfers. It defaults to 128 KiB.
+	DeltaBlockSize int64
+	//Atomic makes transfers write to a hidden temporary file that is renamed over the target once it is complete,
+	//so that readers never see a partially written file. Temporary files left behind by a crash are removed on startup.
+	Atomic bool
+	//TempPrefix and TempSuffix form the name of the temporary file of an atomic transfer around the name of the
+	//target. They default to "." and ".syncpkg-tmp".
+	TempPrefix, TempSuffix string
+	//Observer receives every event of the sync. Unlike the channel returned by Events, it never misses one.
+	Observer Observer
+	//Logger receives the structured logs of the client and of the sync. Nothing is logged if it is nil.
+	Logger *slog.Logger
+	//Workers is the number of files transferred at the same time. It defaults to 10.
+	Workers int
+	//QueueSize is the number of changes that can wait for a worker before the watcher and the poller block. It
+	//defaults to Workers.
+	QueueSize int
+	//Sessions is the number of SFTP sessions, and so of files transferred at the same time. Every transfer checks a
+	//session out for as long as its file is open. It defaults to 1. OpenSSH accepts 10 sessions per connection by
+	//default, see MaxSessions in sshd_config, including the ones used to hash files.
+	Sessions int
+	//Connections is the number of SSH connections the sessions are spread over. It defaults to 1, which multiplexes
+	//every session on a single connection.
+	Connections int
+	//DisableConcurrentReads makes downloads send one read request at a time instead of several in parallel.
+	DisableConcurrentReads bool
+	//ConcurrentWrites makes uploads send several write requests in parallel, which speeds up large files on links
+	//with a high latency. An upload that fails may then leave holes in the remote file, which the next attempt
+	//overwrites.
+	ConcurrentWrites bool
+	//MaxConcurrentRequests is the number of requests in flight per file with concurrent reads or writes. It defaults
+	//to 64.
+	MaxConcurrentRequests int
+	//KeepAlive is the time between two checks of the connection to the server. A dropped connection is dialed
+	//again with the parameters of the connect function and the interrupted transfers are replayed. It defaults to
+	//30 seconds, a negative value disables the periodic checks.
+	KeepAlive time.Duration
+	//DialTimeout is the time allowed to connect to the server and to run the SSH handshake, and the same for every
+	//jump host on the way. It defaults to 30 seconds.
+	DialTimeout time.Duration
+	//Debounce is the time a local file must be quiet before its changes are synced, so that the burst of events of a
+	//single save results in a single upload. It defaults to 100 milliseconds, a negative value disables it.
+	Debounce time.Duration
+	//Exclude holds gitignore patterns of the paths that are not synced, in addition to the .syncignore files of the
+	//synced directories
+	Exclude []string
+	//Include holds gitignore patterns of the paths that are synced even if Exclude, a preset or a .syncignore file
+	//excludes them. Paths inside an excluded directory stay excluded.
+	Include []string
+	//IgnorePresets names the built-in patterns that are excluded: "editor", "os" and "vcs". It defaults to "editor"
+	//and "os", set it to an empty slice to exclude none.
+	IgnorePresets []string
 }
 
 // Connect establishes an SFTP connection to the remote server at the specified address and port.
@@ -73,10 +246,11 @@ type ExtraConfig struct {
 // Parameters:
 //   - address: The IP address or hostname of the remote SFTP server.
 //   - port: The port number to connect to on the remote server.
-//   - direction: The direction of the sync operation, either LocalToRemote or RemoteToLocal.
+//   - direction: The direction of the sync operation, LocalToRemote, RemoteToLocal or Bidirectional.
 //   - config: An optional *ExtraConfig object that holds additional configuration for the SFTP client.
-//     If nil, anonymous authentication will be used. If provided, it may contain the username, password,
-//     local directory, remote directory, retries, and max retries for connecting to the SFTP server.
+//     If nil, anonymous authentication will be used. If provided, it may contain the username, password or
+//     other authentication methods, local directory, remote directory, retries, and max retries for connecting to
+//     the SFTP server.
 //
 // Return Values:
 //   - *SFTP: A pointer to the SFTP object representing the connection to the remote server.
@@ -101,41 +275,28 @@ type ExtraConfig struct {
 //	// Perform SFTP operations, such as initial sync and directory watching
 //	sftpConn.WatchDirectory()
 func Connect(address string, port int, direction SyncDirection, config *ExtraConfig) (*SFTP, error) {
-	var authMethod ssh.AuthMethod
+	var authMethod AuthMethod
 	if config != nil {
-		authMethod = ssh.Password(config.Password)
+		authMethod = AuthPassword(config.Password)
 	} else {
-		authMethod = ssh.Password("anonymous")
-	}
-
-	clientConfig := &ssh.ClientConfig{
-		User:            config.Username,
-		Auth:            []ssh.AuthMethod{authMethod},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-	}
-
-	conn, err := ssh.Dial("tcp", fmt.Sprintf("%s:%d", address, port), clientConfig)
-	if err != nil {
-		return nil, err
+		authMethod = AuthPassword("anonymous")
 	}
-
-	client, err := sftp.NewClient(conn)
-	if err != nil {
-		return nil, err
+	methods := config.Auth
+	if len(methods) == 0 {
+		methods = []AuthMethod{authMethod}
 	}
 
-	return &SFTP{
-		Client:    client,
-		Direction: direction,
-		config:    config,
-		ctx:       context.Background(),
-		Pool:      worker.NewWorkerPool(10),
-	}, nil
+	return connect([]endpoint{{
+		address: fmt.Sprintf("%s:%d", address, port),
+		user:    config.Username,
+		auth:    methods,
+	}}, direction, config)
 }
 
 // ConnectSSHPair establishes an SFTP connection to the remote server at the specified address and port
-// using SSH key pair authentication. It reads the private key from the current user's home directory
-// (typically the `~/.ssh/id_rsa` file) to use for authentication.
+// using SSH key pair authentication. Unless ExtraConfig.Auth is set, it offers the keys of the ssh-agent listening on
+// SSH_AUTH_SOCK, if any, followed by the `~/.ssh/id_rsa`, `~/.ssh/id_ecdsa` and `~/.ssh/id_ed25519` keys of the
+// current user that exist, like the OpenSSH client.
 //
 // The function returns an *SFTP object that represents the connection, allowing you to perform file synchronization
 // and other SFTP operations between the local and remote directories.
@@ -143,7 +304,7 @@ func Connect(address string, port int, direction SyncDirection, config *ExtraCon
 // Parameters:
 //   - address: The IP address or hostname of the remote SFTP server.
 //   - port: The port number to connect to on the remote server.
-//   - direction: The direction of the sync operation, either LocalToRemote or RemoteToLocal.
+//   - direction: The direction of the sync operation, LocalToRemote, RemoteToLocal or Bidirectional.
 //   - config: An optional *ExtraConfig object that holds additional configuration for the SFTP client.
 //     If nil, default settings will be used. If provided, it may contain the username, local directory,
 //     remote directory, retries, and max retries for connecting to the SFTP server.
@@ -170,571 +331,287 @@ func Connect(address string, port int, direction SyncDirection, config *ExtraCon
 //	// Perform SFTP operations, such as initial sync and directory watching
 //	sftpConn.WatchDirectory()
 func ConnectSSHPair(address string, port int, direction SyncDirection, config *ExtraConfig) (*SFTP, error) {
-	usr, err := user.Current()
-	if err != nil {
-		return nil, fmt.Errorf("cannot get user home directory: %w", err)
-	}
-
-	key, err := os.ReadFile(filepath.Join(usr.HomeDir, ".ssh", "id_rsa"))
-	if err != nil {
-		return nil, fmt.Errorf("unable to read private key: %w", err)
-	}
-
-	signer, err := ssh.ParsePrivateKey(key)
-	if err != nil {
-		return nil, fmt.Errorf("unable to parse private key: %w", err)
-	}
-
-	authMethod := ssh.PublicKeys(signer)
-
-	clientConfig := &ssh.ClientConfig{
-		User:            config.Username,
-		Auth:            []ssh.AuthMethod{authMethod},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-	}
-
-	conn, err := ssh.Dial("tcp", fmt.Sprintf("%s:%d", address, port), clientConfig)
-	if err != nil {
-		return nil, err
-	}
-
-	client, err := sftp.NewClient(conn)
-	if err != nil {
-		return nil, err
-	}
-
-	return &SFTP{
-		Client:    client,
-		Direction: direction,
-		config:    config,
-		ctx:       context.Background(),
-		Pool:      worker.NewWorkerPool(10),
-	}, nil
-}
-
-// initialSync synchronizes the local directory with the remote directory for the SFTP connection.
-// It recursively compares the files and subdirectories in the local and remote directories and performs
-// file transfers to ensure that both directories have the same content.
-//
-// The function returns an error if any issues occur during the synchronization process.
-//
-// Return Values:
-//   - error: If an error occurs during the synchronization process, it will be returned. Otherwise, it will be nil.
-func (s *SFTP) initialSync() error {
-	return s.syncDir(s.config.LocalDir, s.config.RemoteDir)
-}
-
-// syncDir synchronizes the content between the local directory and the remote directory for the SFTP connection.
-// The function recursively compares the files and subdirectories in the local and remote directories and performs
-// file transfers to ensure that both directories have the same content. The synchronization is based on the
-// specified SyncDirection (LocalToRemote or RemoteToLocal) of the SFTP connection.
-//
-// Parameters:
-//   - localDir: The local directory path to synchronize with the remote directory.
-//   - remoteDir: The remote directory path to synchronize with the local directory.
-//
-// Return Values:
-//   - error: If an error occurs during the synchronization process, it will be returned. Otherwise, it will be nil.
-func (s *SFTP) syncDir(localDir, remoteDir string) error {
-	switch s.Direction {
-	case LocalToRemote:
-		localFiles, err := os.ReadDir(localDir)
+	methods := config.Auth
+	if len(methods) == 0 {
+		var err error
+		methods, err = defaultIdentities()
 		if err != nil {
-			return err
-		}
-		for _, file := range localFiles {
-			localFilePath := filepath.Join(localDir, file.Name())
-			remoteFilePath := filepath.Join(remoteDir, file.Name())
-
-			if file.IsDir() {
-				err = s.checkOrCreateDir(remoteFilePath)
-				if err != nil {
-					return err
-				}
-				err = s.syncDir(localFilePath, remoteFilePath)
-				if err != nil {
-					return err
-				}
-			} else {
-				_, err := s.Client.Stat(remoteFilePath)
-				if err != nil {
-					err = s.uploadFile(localFilePath)
-					if err != nil {
-						return err
-					}
-				}
-			}
-		}
-
-	case RemoteToLocal:
-		remoteFiles, err := s.Client.ReadDir(remoteDir)
-		if err != nil {
-			return err
-		}
-
-		for _, file := range remoteFiles {
-			remoteFilePath := filepath.Join(remoteDir, file.Name())
-			localFilePath := filepath.Join(localDir, file.Name())
-
-			if file.IsDir() {
-				err = s.checkOrCreateDir(localFilePath)
-				if err != nil {
-					return err
-				}
-				err = s.syncDir(localFilePath, remoteFilePath)
-				if err != nil {
-					return err
-				}
-			} else {
-				_, err := os.Stat(localFilePath)
-				if err != nil {
-					err = s.downloadFile(remoteFilePath)
-					if err != nil {
-						return err
-					}
-				}
-			}
+			return nil, err
 		}
 	}
-	return nil
-}
 
-// checkOrCreateDir checks if the specified directory exists. If the directory does not exist, it creates it.
-// The behavior of the function depends on the SyncDirection (LocalToRemote or RemoteToLocal) of the SFTP connection.
-//
-// Parameters:
-//   - dirPath: The path of the directory to check or create.
-//
-// Return Values:
-//   - error: If an error occurs while checking or creating the directory, it will be returned. Otherwise, it will be nil.
-func (s *SFTP) checkOrCreateDir(dirPath string) error {
-	_, err := os.Stat(dirPath)
-	if os.IsNotExist(err) {
-		if s.Direction == LocalToRemote {
-			//create the directory to remote server if it doesn't exist  and all subdirectories
-			err := s.Client.MkdirAll(dirPath)
-			if err != nil {
-				return err
-			}
-			// set the permissions to 755
-			err = s.Client.Chmod(dirPath, 0755)
-			if err != nil {
-				return err
-			}
-
-		} else {
-			errDir := os.MkdirAll(dirPath, 0755)
-			if errDir != nil {
-				return err
-			}
-		}
-	}
-	return nil
+	return connect([]endpoint{{
+		address: fmt.Sprintf("%s:%d", address, port),
+		user:    config.Username,
+		auth:    methods,
+	}}, direction, config)
 }
 
-// WatchDirectory sets up a file system watcher to monitor changes in the local or remote directory,
-// depending on the SyncDirection of the SFTP connection. When a file or directory event is detected,
-// it triggers the corresponding worker to handle the event.
-//
-// The function first starts the worker pool, performs an initial synchronization of the local and remote
-// directories using the initialSync method, and then sets up the file system watcher to watch for changes.
-// The watcher is added to the specified local or remote directory, and when a file or directory is created,
-// modified, or removed, the corresponding worker is launched to handle the event.
+// ConnectHost establishes an SFTP connection to the host alias host of the OpenSSH client configuration file
+// ExtraConfig.SSHConfigFile, ~/.ssh/config by default, like the ssh command does. The HostName, Port, User,
+// IdentityFile and ProxyJump options of the host are applied; ExtraConfig.Username and ExtraConfig.Auth take
+// precedence over User and IdentityFile. The jump hosts of ProxyJump are resolved through the same file and dialed
+// in turn, each through the connection to the previous one, and their host keys are checked like the one of the
+// SFTP server. A host missing from the file is dialed on port 22.
 //
-// Note: The worker pool must be running before calling this function.
-//
-// Usage:
-//
-//	// Assume sftpConn is an established SFTP connection with a worker pool.
-//	sftpConn.WatchDirectory()
-//
-// Example:
+// Example Usage:
 //
-//	// Create an SFTP connection with a worker pool.
-//	config := &ExtraConfig{
-//	  Username:    "your_username",
-//	  Password:    "your_password",
-//	  LocalDir:    "/path/to/local/directory",
-//	  RemoteDir:   "/path/to/remote/directory",
-//	  Retries:     3,
-//	  MaxRetries:  5,
-//	}
-//	sftpConn, err := Connect("your_server_address", 22, LocalToRemote, config)
+//	// ~/.ssh/config:
+//	//   Host files
+//	//     HostName files.internal
+//	//     User deploy
+//	//     IdentityFile ~/.ssh/id_ed25519
+//	//     ProxyJump bastion.example.com
+//	sftpConn, err := ConnectHost("files", LocalToRemote, &ExtraConfig{
+//	  LocalDir:  "/path/to/local/directory",
+//	  RemoteDir: "/path/to/remote/directory",
+//	})
 //	if err != nil {
-//	  log.Fatal("Failed to connect:", err)
+//	  log.Fatal("Failed to connect to the SFTP server:", err)
 //	}
-//
-// defer sftpConn.Close()
-//
-//	// Watch for changes in the directory.
-//	go sftpConn.WatchDirectory()
-func (s *SFTP) WatchDirectory() {
-	// Starting the worker pool
-	for i := 0; i < cap(s.Pool.Tasks); i++ {
-		go s.Worker()
+//	defer sftpConn.Close()
+func ConnectHost(host string, direction SyncDirection, config *ExtraConfig) (*SFTP, error) {
+	path := config.SSHConfigFile
+	if path == "" {
+		path = "~/.ssh/config"
 	}
-	logger.Println("Starting initial sync...")
-	err := s.initialSync()
+	sshConfig, err := readSSHConfig(path, config.SSHConfigFile == "")
 	if err != nil {
-		logger.Fatal(err)
+		return nil, fmt.Errorf("cannot read ssh config: %w", err)
 	}
-	logger.Println("Initial sync done.")
-
-	logger.Println("Setting up watcher...")
-	watcher, err := fsnotify.NewWatcher()
+	route, err := sshConfig.route(host, config.Username, config.Auth)
 	if err != nil {
-		logger.Fatal(err)
-	}
-	defer func(watcher *fsnotify.Watcher) {
-		err = watcher.Close()
-		if err != nil {
-			logger.Println("Error closing watcher:", err)
-		}
-	}(watcher)
-
-	go func() {
-		for {
-			select {
-			case event, ok := <-watcher.Events:
-				if !ok {
-					return
-				}
-				logger.Println("Received event:", event)
-
-				s.Pool.WG.Add(1)
-				s.Pool.Tasks <- worker.Task{EventType: event.Op, Name: event.Name}
-			case err, ok := <-watcher.Errors:
-				if !ok {
-					return
-				}
-				logger.Println("Error:", err)
-			}
-		}
-	}()
-
-	logger.Println("Adding directories to watcher...")
-	switch s.Direction {
-	case LocalToRemote:
-		logger.Println("Adding watcher to local directory: ", s.config.LocalDir)
-		err = s.AddDirectoriesToWatcher(watcher, s.config.LocalDir)
-		if err != nil {
-			logger.Fatal(err)
-		}
-		logger.Println("Starting directory watch...")
-	case RemoteToLocal:
-		logger.Println("Adding watcher to remote directory: ", s.config.RemoteDir)
-		err = s.AddDirectoriesToWatcher(watcher, s.config.RemoteDir)
-		if err != nil {
-			logger.Fatal(err)
-		}
-		logger.Println("Starting directory watch...")
+		return nil, err
 	}
-
-	<-s.ctx.Done()
-	logger.Println("Directory watch ended.")
-}
-
-// AddDirectoriesToWatcher adds the specified directory and its subdirectories to the fsnotify watcher
-// based on the SyncDirection of the SFTP connection. For a LocalToRemote connection, it adds the local
-// directory and its subdirectories to the watcher. For a RemoteToLocal connection, it dynamically monitors
-// the remote directory and its subdirectories by continuously comparing the file modifications between
-// successive calls and triggering the corresponding worker to handle the events.
-//
-// Parameters:
-//   - watcher: The fsnotify.Watcher to which the directories should be added.
-//   - rootDir: The root directory to start watching.
-//
-// Note: The function will continuously monitor the directories for changes until the SFTP context is canceled.
-func (s *SFTP) AddDirectoriesToWatcher(watcher *fsnotify.Watcher, rootDir string) error {
-	switch s.Direction {
-	case LocalToRemote:
-		return filepath.Walk(rootDir, func(path string, info os.FileInfo, err error) error {
-			if info.IsDir() {
-				err = watcher.Add(path)
-				if err != nil {
-					return err
-				}
-				logger.Println("Adding watcher to directory:", path)
-			}
-			return nil
-		})
-	case RemoteToLocal:
-		var prevFiles map[string]os.FileInfo
-		for {
-			// Read the remote directory and its subdirectories.
-			newFiles := make(map[string]os.FileInfo)
-			err := s.walkRemoteDir(rootDir, newFiles)
-			if err != nil {
-				return err
-			}
-
-			// Check for new or removed files.
-			if prevFiles != nil {
-				for p, file := range newFiles {
-					prevFile, exists := prevFiles[p]
-					if !exists || prevFile.ModTime().Before(file.ModTime()) {
-
-						s.Pool.WG.Add(1)
-
-						s.Pool.Tasks <- worker.Task{EventType: fsnotify.Create, Name: p}
-						logger.Println("New or modified file:", p)
-					}
-				}
-				for p := range prevFiles {
-					_, exists := newFiles[p]
-					if !exists {
-
-						s.Pool.WG.Add(1)
-
-						s.Pool.Tasks <- worker.Task{EventType: fsnotify.Remove, Name: p}
-						logger.Println("File removed:", p)
-					}
-				}
-			}
-			prevFiles = newFiles
-			// Wait for a while before checking again.
-			time.Sleep(time.Second * 1)
-		}
+	if config.Username == "" {
+		resolved := *config
+		resolved.Username = route[len(route)-1].user
+		config = &resolved
 	}
-	return nil
+	return connect(route, direction, config)
 }
 
-// uploadFile uploads a file from the local directory to the remote directory using the SFTP client.
-// It locks the SFTP client to prevent concurrent uploads and ensures proper cleanup by closing
-// the source and destination files after the upload is complete or in case of an error.
-//
-// Parameters:
-//   - filePath: The path of the file in the local directory to upload.
-//
-// Returns:
-//   - error: If an error occurs during the upload process.
-//
-// Note: This function is meant to be used within the SFTP struct and should not be called directly.
-func (s *SFTP) uploadFile(filePath string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	relativePath, err := filepath.Rel(s.config.LocalDir, filePath)
+// connect dials the SSH server at the end of route, through the jump hosts before it, checking the host keys as
+// config says, starts the SFTP sessions and returns the SFTP object of the client. The connection is dialed the
+// same way when it is re-established.
+func connect(route []endpoint, direction SyncDirection, config *ExtraConfig) (*SFTP, error) {
+	hops, err := newHops(route, config)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	srcFile, err := os.Open(filePath)
-	if err != nil {
-		return err
+	s := &SFTP{
+		Direction: direction,
+		config:    config,
+		Pool:      newPool(config),
+		events:    engine.NewEventStream(eventBuffer),
+		address:   route[len(route)-1].address,
+		dial: func() (*ssh.Client, error) {
+			return dialRoute(hops)
+		},
 	}
-	defer func(srcFile *os.File) {
-		err = srcFile.Close()
-		if err != nil {
-			logger.Println("Error closing file:", err)
-		}
-	}(srcFile)
-
-	dstFile, err := s.Client.Create(filepath.Join(s.config.RemoteDir, relativePath))
+	sessions, err := s.openSessions()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer func(dstFile *sftp.File) {
-		err = dstFile.Close()
-		if err != nil {
-			logger.Println("Error closing file:", err)
-		}
-	}(dstFile)
+	s.sessions, s.Client = sessions, sessions.sessions[0].client
+	return s, nil
+}
 
-	if s.ctx.Err() != nil {
-		return s.ctx.Err()
+// openSessions dials a new pool of ExtraConfig.Sessions SFTP sessions spread over ExtraConfig.Connections SSH
+// connections.
+func (s *SFTP) openSessions() (*sessionPool, error) {
+	var opts []sftp.ClientOption
+	if s.config.DisableConcurrentReads {
+		opts = append(opts, sftp.UseConcurrentReads(false))
 	}
-
-	_, err = io.Copy(dstFile, srcFile)
-	return err
+	if s.config.ConcurrentWrites {
+		opts = append(opts, sftp.UseConcurrentWrites(true))
+	}
+	if s.config.MaxConcurrentRequests > 0 {
+		opts = append(opts, sftp.MaxConcurrentRequestsPerFile(s.config.MaxConcurrentRequests))
+	}
+	return newSessionPool(s.dial, s.config.Sessions, s.config.Connections, opts...)
 }
 
-// uploadFile uploads a file from the local directory to the remote directory using the SFTP client.
-// It locks the SFTP client to prevent concurrent uploads and ensures proper cleanup by closing
-// the source and destination files after the upload is complete or in case of an error.
-//
-// Parameters:
-//   - filePath: The path of the file in the local directory to upload.
-//
-// Returns:
-//   - error: If an error occurs during the upload process.
-//
-// Note: This function is meant to be used within the SFTP struct and should not be called directly.
-func (s *SFTP) downloadFile(remotePath string) error {
+// defaultWorkers is the default number of workers of the pool.
+const defaultWorkers = 10
 
-	if strings.Contains(remotePath, ".swp") {
-		return nil
-	}
-	logger.Println("Downloading file:", remotePath)
-	relativePath, err := filepath.Rel(s.config.RemoteDir, remotePath)
-	if err != nil {
-		return err
+// newPool returns the worker pool configured by config.
+func newPool(config *ExtraConfig) *worker.Pool[worker.Task] {
+	workers := config.Workers
+	if workers <= 0 {
+		workers = defaultWorkers
 	}
+	return worker.New(worker.Config[worker.Task]{Workers: workers, Capacity: config.QueueSize, Key: worker.TaskKey})
+}
 
-	srcFile, err := s.Client.Open(remotePath)
-	if err != nil {
-		return err
-	}
-	defer func(srcFile *sftp.File) {
-		err = srcFile.Close()
-		if err != nil {
-			logger.Println("Error closing file:", err)
-		}
-	}(srcFile)
+// log returns the logger of the client, see logger.
+func (s *SFTP) log() *slog.Logger {
+	return logger(s.config)
+}
 
-	dstFile, err := os.Create(filepath.Join(s.config.LocalDir, relativePath))
-	if err != nil {
-		return err
+// logger returns config.Logger, or engine.DiscardLogger if it is nil.
+func logger(config *ExtraConfig) *slog.Logger {
+	if config.Logger != nil {
+		return config.Logger
 	}
-	defer func(dstFile *os.File) {
-		err = dstFile.Close()
-		if err != nil {
-			logger.Println("Error closing file:", err)
-		}
-	}(dstFile)
+	return engine.DiscardLogger
+}
 
-	if s.ctx.Err() != nil {
-		return s.ctx.Err()
+// engineConfig returns the configuration of the sync engine.
+func (s *SFTP) engineConfig() engine.Config {
+	return engine.Config{
+		Direction:      s.Direction,
+		LocalDir:       s.config.LocalDir,
+		RemoteDir:      s.config.RemoteDir,
+		MaxRetries:     s.config.MaxRetries,
+		RetryPolicy:    s.config.RetryPolicy,
+		ConflictPolicy: s.config.ConflictPolicy,
+		StateFile:      s.config.StateFile,
+		HashAlgorithm:  s.config.HashAlgorithm,
+		DeltaThreshold: s.config.DeltaThreshold,
+		DeltaBlockSize: s.config.DeltaBlockSize,
+		Atomic:         s.config.Atomic,
+		TempPrefix:     s.config.TempPrefix,
+		TempSuffix:     s.config.TempSuffix,
+		Observer:       s.observer(),
+		Logger:         s.config.Logger,
+		Debounce:       s.config.Debounce,
+		KeepAlive:      s.config.KeepAlive,
+		Exclude:        s.config.Exclude,
+		Include:        s.config.Include,
+		IgnorePresets:  s.config.IgnorePresets,
+		Pair:           fmt.Sprintf("sftp://%s@%s%s", s.config.Username, s.address, s.config.RemoteDir),
 	}
-
-	_, err = io.Copy(dstFile, srcFile)
-	return err
 }
 
-// Mkdir creates a directory in the remote server based on the config
-// Parameters:
-//   - dir: The path of the directory to create.
+// Events returns the channel the events of the sync are delivered on. Events are dropped while the channel is full,
+// use ExtraConfig.Observer to receive every one of them. The channel is closed by Close.
 //
-// Returns:
-//   - error: If an error occurs during the upload process.
+// Example:
 //
-// Note: This function is meant to be used within the SFTP struct and should not be called directly.
-func (s *SFTP) Mkdir(dir string) error {
-	err := s.Client.Mkdir(filepath.Join(s.config.RemoteDir, dir))
-	return err
+//	go func() {
+//	    for event := range sftpConn.Events() {
+//	        if event.Type == TransferFailed {
+//	            log.Println("Upload failed:", event.Path, event.Err)
+//	        }
+//	    }
+//	}()
+func (s *SFTP) Events() <-chan SyncEvent {
+	return s.events.Events()
 }
 
-// RemoveRemoteFile removes a file from the remote server based on the config and the relative path
-// Parameters:
-//   - remotePath: The path of the file to remove.
-//
-// Returns:
-//   - error: If an error occurs during the upload process.
-//
-// Note: This function is meant to be used within the SFTP struct and should not be called directly.
-func (s *SFTP) RemoveRemoteFile(remotePath string) error {
-	relativePath, err := filepath.Rel(s.config.LocalDir, remotePath)
-	if err != nil {
-		return err
+// observer returns the Observer of the sync engine, which feeds Events and ExtraConfig.Observer.
+func (s *SFTP) observer() engine.Observer {
+	if s.config.Observer == nil {
+		return s.events
 	}
-	toRemotePath := filepath.Join(s.config.RemoteDir, relativePath)
-	err = s.Client.Remove(toRemotePath)
-	return err
+	return engine.ObserverFunc(func(event engine.SyncEvent) {
+		s.events.OnEvent(event)
+		s.config.Observer.OnEvent(event)
+	})
 }
 
-// RemoveLocalFile removes a file from the local server based on the config and the relative path
-// Parameters:
-//   - localPath: The path of the file to remove.
+// Start builds the sync engine, with the SFTP client as the remote backend, and starts it. It performs an initial
+// synchronization based on the synchronization direction and then keeps the local and the remote directory in sync
+// in the background, until ctx is done or Stop is called.
 //
-// Returns:
-//   - error: If an error occurs during the upload process.
+//   - LocalToRemote: the local directory is watched with fsnotify and every change is uploaded to or removed from the SFTP server.
+//   - RemoteToLocal: the remote directory is polled and every change is downloaded to or removed from the local directory.
+//   - Bidirectional: both of the above run at the same time. Files changed on both sides are settled by ConflictPolicy.
 //
-// Note: This function is meant to be used within the SFTP struct and should not be called directly.
-func (s *SFTP) RemoveLocalFile(localPath string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	toLocalPath := s.convertRemoteToLocalPath(localPath)
-	err := os.Remove(toLocalPath)
-	return err
-}
-
-// walkRemoteDir traverses a remote directory and its subdirectories using the SFTP client,
-// and adds all files it finds to the provided map.
-//
-// Parameters:
-//   - dir: The path of the remote directory to traverse.
-//   - files: A map to store the file paths and their corresponding os.FileInfo.
+// Start returns once the initial synchronization is done, or with the error that prevented it. Errors that stop the
+// synchronization later on are returned by Wait.
 //
-// Returns:
-//   - error: If an error occurs during the traversal process.
+// Example:
 //
-// Note: This function is meant to be used within the SFTP struct and should not be called directly.
-func (s *SFTP) walkRemoteDir(dir string, files map[string]os.FileInfo) error {
-	entries, err := s.Client.ReadDir(dir)
+//	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+//	defer cancel()
+//	err := sftpConn.Start(ctx)
+//	if err != nil {
+//	    return err
+//	}
+//	return sftpConn.Wait()
+func (s *SFTP) Start(ctx context.Context) error {
+	s.lifecycle.Lock()
+	if s.engine != nil {
+		s.lifecycle.Unlock()
+		return engine.ErrStarted
+	}
+	e, err := engine.New(engine.Local{}, s, s.Pool, s.engineConfig())
 	if err != nil {
+		s.lifecycle.Unlock()
 		return err
 	}
+	s.engine = e
+	s.lifecycle.Unlock()
+	return e.Start(ctx)
+}
 
-	for _, entry := range entries {
-		join := path.Join(dir, entry.Name())
-		if entry.IsDir() {
-			err = s.walkRemoteDir(join, files)
-			if err != nil {
-				return err
-			}
-		} else {
-			files[join] = entry
+// Stop stops the synchronization and waits until the changes already queued on the worker pool are processed.
+func (s *SFTP) Stop() {
+	s.lifecycle.Lock()
+	e := s.engine
+	s.lifecycle.Unlock()
+	if e != nil {
+		e.Stop()
+	}
+}
 
-		}
+// Wait blocks until the synchronization stopped and returns the error that stopped it, if any.
+func (s *SFTP) Wait() error {
+	s.lifecycle.Lock()
+	e := s.engine
+	s.lifecycle.Unlock()
+	if e == nil {
+		return nil
 	}
+	return e.Wait()
+}
 
-	return nil
+// Stats returns a snapshot of the metrics of the synchronization: the files and bytes transferred, the failures,
+// the retries, the depth of the task queue and the latency histograms. It returns zero counters before Start.
+func (s *SFTP) Stats() Stats {
+	s.lifecycle.Lock()
+	e := s.engine
+	s.lifecycle.Unlock()
+	if e == nil {
+		return Stats{QueueDepth: s.Pool.Len()}
+	}
+	return e.Stats()
 }
 
-// convertRemoteToLocalPath converts the remote path to a local path based on the config
-// Parameters:
-//   - remotePath: The path of the file to convert.
+// MetricsHandler returns an http.Handler that serves Stats in the Prometheus text format. It can be registered
+// before Start.
 //
-// Returns:
-//   - localPath: The converted path
+// Example:
 //
-// Note: This function is meant to be used within the SFTP struct and should not be called directly.
-func (s *SFTP) convertRemoteToLocalPath(remotePath string) string {
-	relativePath, _ := filepath.Rel(s.config.RemoteDir, remotePath)
-	localPath := filepath.Join(s.config.LocalDir, relativePath)
-	return localPath
+//	http.Handle("/metrics", sftpConn.MetricsHandler())
+//	go http.ListenAndServe(":9100", nil)
+func (s *SFTP) MetricsHandler() http.Handler {
+	return engine.StatsHandler(s.Stats)
+}
+
+// Close stops the synchronization, like Stop, closes the channel returned by Events and closes the SFTP sessions
+// and the SSH connections.
+func (s *SFTP) Close() error {
+	s.Stop()
+	s.events.Close()
+	return s.pool().close()
 }
 
-// Worker starts a new worker goroutine that processes tasks received from the worker pool's task channel.
-// The tasks can include file events such as creation, write, and removal events received from the
-// fsnotify watcher.
+// WatchDirectory starts the synchronization with Start and blocks until it stops, returning the error that stopped it.
 //
-// Note: This function is meant to be used within the SFTP struct and should not be called directly.
-func (s *SFTP) Worker() {
-	for task := range s.Pool.Tasks {
-		switch task.EventType {
-		case fsnotify.Create:
-			switch s.Direction {
-			case LocalToRemote:
-				err := s.uploadFile(task.Name)
-				if err != nil {
-					logger.Println("Error uploading file:", err)
-				}
-			case RemoteToLocal:
-				err := s.downloadFile(task.Name)
-				if err != nil {
-					logger.Println("Error downloading file:", err)
-				}
-			}
-		case fsnotify.Write:
-			err := s.uploadFile(task.Name)
-			if err != nil {
-				logger.Println("Error uploading file:", err)
-			}
-		case fsnotify.Remove:
-			switch s.Direction {
-			case LocalToRemote:
-				err := s.RemoveRemoteFile(task.Name)
-				if err != nil {
-					logger.Println("Error deleting file:", err)
-				}
-			case RemoteToLocal:
-				err := s.RemoveLocalFile(task.Name)
-				if err != nil {
-					logger.Println("Error removing remote file:", err)
-				}
-			}
-		}
-		s.Pool.WG.Done()
+// Example:
+//
+//	err := sftpConn.WatchDirectory()
+//	if err != nil {
+//	    log.Println("Synchronization stopped:", err)
+//	}
+func (s *SFTP) WatchDirectory() error {
+	err := s.Start(context.Background())
+	if err != nil {
+		return err
 	}
+	return s.Wait()
 }
@@ -63,6 +63,8 @@ func TestSftpUploadAndDownload(t *testing.T) {
 		RemoteDir:  "/home/foo/upload",
 		Retries:    3,
 		MaxRetries: 3,
+		// The container generates a new host key every time it starts.
+		InsecureIgnoreHostKey: true,
 	}
 
 	conn, err := Connect(address, port, LocalToRemote, config)
@@ -0,0 +1,316 @@
+package sftp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maxIncludeDepth is the number of nested Include directives followed, like the OpenSSH client.
+const maxIncludeDepth = 16
+
+// maxJumpDepth is the number of jump hosts reached through the ProxyJump option of another jump host, which stops
+// configurations whose jump hosts jump through each other.
+const maxJumpDepth = 16
+
+// sshConfig is an OpenSSH client configuration file, as documented in ssh_config(5). Only the Host blocks are read,
+// Match blocks never apply.
+type sshConfig struct {
+	blocks []sshConfigBlock
+}
+
+// sshConfigBlock is a Host block of an OpenSSH client configuration file.
+type sshConfigBlock struct {
+	//patterns are the host patterns of the block, nil for the options before the first Host line
+	patterns []string
+	//skip is true for a Match block, whose conditions are not evaluated
+	skip bool
+	//scope is the block of the Include directive that read the block, nil for the blocks of the configuration file
+	//itself. The block only applies where its scope does.
+	scope *sshConfigBlock
+	//options holds the keywords, in lower case, and the values of the block, in order
+	options [][2]string
+}
+
+// readSSHConfig reads the OpenSSH client configuration file path. A missing file is an empty configuration if
+// optional is true.
+func readSSHConfig(path string, optional bool) (*sshConfig, error) {
+	c := &sshConfig{}
+	path = expandHome(path)
+	err := c.read(path, filepath.Dir(path), 0, nil)
+	if optional && errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	return c, err
+}
+
+// read appends the blocks of the file path, read by an Include directive of the block scope if it is not nil, to the
+// configuration. dir is the directory of the top-level configuration file, which the relative paths of the Include
+// directives are relative to.
+func (c *sshConfig) read(path, dir string, depth int, scope *sshConfigBlock) error {
+	if depth > maxIncludeDepth {
+		return fmt.Errorf("%s: too many nested Include directives", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	block := sshConfigBlock{scope: scope}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		keyword, args, err := splitSSHConfigLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		switch keyword {
+		case "":
+		case "host":
+			c.blocks = append(c.blocks, block)
+			block = sshConfigBlock{patterns: args, scope: scope}
+		case "match":
+			c.blocks = append(c.blocks, block)
+			block = sshConfigBlock{skip: true, scope: scope}
+		case "include":
+			// The included files are read in place, and like with the OpenSSH client their blocks, including their
+			// Host blocks, only apply where the current block does. Relative paths are relative to the directory of
+			// the top-level file, ~/.ssh for the user configuration and /etc/ssh for the system one, even in the
+			// included files.
+			c.blocks = append(c.blocks, block)
+			included := &sshConfigBlock{patterns: block.patterns, skip: block.skip, scope: block.scope}
+			for _, pattern := range args {
+				pattern = expandHome(pattern)
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(dir, pattern)
+				}
+				files, _ := filepath.Glob(pattern)
+				for _, file := range files {
+					err = c.read(file, dir, depth+1, included)
+					if err != nil {
+						return err
+					}
+				}
+			}
+			block = sshConfigBlock{patterns: block.patterns, skip: block.skip, scope: block.scope}
+		default:
+			block.options = append(block.options, [2]string{keyword, strings.Join(args, " ")})
+		}
+	}
+	c.blocks = append(c.blocks, block)
+	return scanner.Err()
+}
+
+// splitSSHConfigLine returns the keyword, in lower case, and the arguments of a line. The keyword is empty for
+// blank lines and comments.
+func splitSSHConfigLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return "", nil, nil
+	}
+	end := strings.IndexAny(line, " \t=")
+	if end < 0 {
+		return "", nil, fmt.Errorf("missing argument for %s", line)
+	}
+	keyword := strings.ToLower(line[:end])
+	rest := strings.TrimLeft(line[end:], " \t")
+	rest = strings.TrimLeft(strings.TrimPrefix(rest, "="), " \t")
+
+	var args []string
+	for rest != "" {
+		var arg string
+		if rest[0] == '"' {
+			end = strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return "", nil, errors.New("unterminated quote")
+			}
+			arg, rest = rest[1:end+1], rest[end+2:]
+		} else {
+			end = strings.IndexAny(rest, " \t")
+			if end < 0 {
+				end = len(rest)
+			}
+			arg, rest = rest[:end], rest[end:]
+		}
+		args = append(args, arg)
+		rest = strings.TrimLeft(rest, " \t")
+	}
+	if len(args) == 0 {
+		return "", nil, fmt.Errorf("missing argument for %s", keyword)
+	}
+	return keyword, args, nil
+}
+
+// matches reports whether the block applies to host: its scope applies to it, one of its patterns matches it and
+// none of its negated patterns does.
+func (b sshConfigBlock) matches(host string) bool {
+	if b.skip || b.scope != nil && !b.scope.matches(host) {
+		return false
+	}
+	if b.patterns == nil {
+		return true
+	}
+	matched := false
+	for _, pattern := range b.patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		ok, _ := filepath.Match(strings.ToLower(strings.TrimPrefix(pattern, "!")), strings.ToLower(host))
+		if ok && negated {
+			return false
+		}
+		matched = matched || ok
+	}
+	return matched
+}
+
+// values returns the values of keyword, in lower case, for host, in order. The first one is the one that applies
+// for the keywords that take a single value.
+func (c *sshConfig) values(host, keyword string) []string {
+	var values []string
+	for _, block := range c.blocks {
+		if !block.matches(host) {
+			continue
+		}
+		for _, option := range block.options {
+			if option[0] == keyword {
+				values = append(values, option[1])
+			}
+		}
+	}
+	return values
+}
+
+// value returns the value of keyword, in lower case, for host, or an empty string if it is not set.
+func (c *sshConfig) value(host, keyword string) string {
+	values := c.values(host, keyword)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// resolve returns the endpoint of the host alias host, with the HostName, Port, User and IdentityFile options of the
+// configuration. user and port, if set, take precedence over the configuration, like on the ssh command line. The
+// endpoint authenticates with auth if it is set, and with the ssh-agent and the identity files otherwise.
+func (c *sshConfig) resolve(host, username string, port int, auth []AuthMethod) (endpoint, error) {
+	hostname := host
+	if value := c.value(host, "hostname"); value != "" {
+		hostname = strings.ReplaceAll(value, "%h", host)
+	}
+	if port == 0 {
+		port = 22
+		if value := c.value(host, "port"); value != "" {
+			var err error
+			port, err = strconv.Atoi(value)
+			if err != nil {
+				return endpoint{}, fmt.Errorf("invalid Port for %s: %s", host, value)
+			}
+		}
+	}
+	if username == "" {
+		username = c.value(host, "user")
+	}
+	local, err := user.Current()
+	if err != nil {
+		return endpoint{}, fmt.Errorf("cannot get current user: %w", err)
+	}
+	if username == "" {
+		username = local.Username
+	}
+
+	if len(auth) == 0 {
+		identities := c.values(host, "identityfile")
+		if len(identities) == 0 {
+			auth, err = defaultIdentities()
+			if err != nil {
+				return endpoint{}, err
+			}
+		} else {
+			if os.Getenv("SSH_AUTH_SOCK") != "" {
+				auth = append(auth, implicitly(AuthAgent()))
+			}
+			replacer := strings.NewReplacer("%d", local.HomeDir, "%u", local.Username, "%h", hostname, "%r", username, "%%", "%")
+			for _, identity := range identities {
+				// Like the OpenSSH client, skip the identity files that do not exist, and those that cannot be
+				// loaded when the connection is dialed.
+				identity = replacer.Replace(identity)
+				_, err = os.Stat(expandHome(identity))
+				if err == nil {
+					auth = append(auth, implicitly(AuthPrivateKeyFile(identity, "")))
+				}
+			}
+		}
+	}
+	return endpoint{address: net.JoinHostPort(hostname, strconv.Itoa(port)), user: username, auth: auth}, nil
+}
+
+// route returns the endpoints to go through to reach the host alias host: the jump hosts of its ProxyJump option,
+// each resolved through the configuration, followed by host itself.
+func (c *sshConfig) route(host, username string, auth []AuthMethod) ([]endpoint, error) {
+	return c.routeTo(host, username, 0, auth, 0)
+}
+
+// routeTo returns the route to host, reached with username and port if they are set, as the jump host number depth
+// of another route. Like the OpenSSH client, the first jump host of ProxyJump is reached through its own ProxyJump
+// option, and each of the others through the jump host before it.
+func (c *sshConfig) routeTo(host, username string, port int, auth []AuthMethod, depth int) ([]endpoint, error) {
+	if depth > maxJumpDepth {
+		return nil, fmt.Errorf("too many nested ProxyJump hosts to reach %s", host)
+	}
+	var route []endpoint
+	jumps := c.value(host, "proxyjump")
+	if jumps != "" && !strings.EqualFold(jumps, "none") {
+		for i, jump := range strings.Split(jumps, ",") {
+			jumpUser, jumpHost, jumpPort, err := parseJump(strings.TrimSpace(jump))
+			if err != nil {
+				return nil, fmt.Errorf("invalid ProxyJump for %s: %w", host, err)
+			}
+			if i == 0 {
+				route, err = c.routeTo(jumpHost, jumpUser, jumpPort, auth, depth+1)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			e, err := c.resolve(jumpHost, jumpUser, jumpPort, auth)
+			if err != nil {
+				return nil, err
+			}
+			route = append(route, e)
+		}
+	}
+	e, err := c.resolve(host, username, port, auth)
+	if err != nil {
+		return nil, err
+	}
+	return append(route, e), nil
+}
+
+// parseJump parses a jump host of ProxyJump, [user@]host[:port] or ssh://[user@]host[:port].
+func parseJump(jump string) (username, host string, port int, err error) {
+	if !strings.HasPrefix(jump, "ssh://") {
+		jump = "ssh://" + jump
+	}
+	u, err := url.Parse(jump)
+	if err != nil {
+		return "", "", 0, err
+	}
+	if u.Hostname() == "" {
+		return "", "", 0, fmt.Errorf("missing host in %s", jump)
+	}
+	if u.Port() != "" {
+		port, err = strconv.Atoi(u.Port())
+		if err != nil {
+			return "", "", 0, err
+		}
+	}
+	return u.User.Username(), u.Hostname(), port, nil
+}
@@ -0,0 +1,298 @@
+package sftp
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestSSHConfig(t *testing.T) {
+	dir := t.TempDir()
+	included := filepath.Join(dir, "config.d", "web")
+	err := os.MkdirAll(filepath.Dir(included), 0o700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(included, []byte("Host web\n  HostName web.internal\n  Port 2200\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config")
+	err = os.WriteFile(path, []byte(`# Comment
+Include config.d/*
+
+Host files files-*
+  HostName %h.internal
+  User=deploy
+  ProxyJump admin@bastion:2222,ssh://relay
+
+Host !files-old *
+  User nobody
+  Port 2022
+
+Match user root
+  User root
+
+Host bastion
+  HostName "bastion.example.com"
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := readSSHConfig(path, false)
+	if err != nil {
+		t.Fatalf("readSSHConfig returned an error: %v", err)
+	}
+
+	tests := []struct {
+		host, keyword, want string
+	}{
+		{"files", "hostname", "%h.internal"},
+		{"files", "user", "deploy"},
+		{"files-old", "user", "deploy"},
+		{"files-old", "port", ""},
+		{"files-new", "port", "2022"},
+		{"web", "hostname", "web.internal"},
+		{"web", "port", "2200"},
+		{"bastion", "hostname", "bastion.example.com"},
+		{"bastion", "user", "nobody"},
+		{"other", "user", "nobody"},
+	}
+	for _, test := range tests {
+		got := c.value(test.host, test.keyword)
+		if got != test.want {
+			t.Errorf("value(%q, %q) = %q, want %q", test.host, test.keyword, got, test.want)
+		}
+	}
+
+	route, err := c.route("files", "", []AuthMethod{AuthPassword("pass")})
+	if err != nil {
+		t.Fatalf("route returned an error: %v", err)
+	}
+	want := []endpoint{
+		{address: "bastion.example.com:2222", user: "admin"},
+		{address: "relay:2022", user: "nobody"},
+		{address: "files.internal:2022", user: "deploy"},
+	}
+	if len(route) != len(want) {
+		t.Fatalf("route = %+v, want %+v", route, want)
+	}
+	for i := range want {
+		if route[i].address != want[i].address || route[i].user != want[i].user {
+			t.Errorf("route[%d] = %s@%s, want %s@%s", i, route[i].user, route[i].address, want[i].user, want[i].address)
+		}
+	}
+}
+
+func TestSSHConfigIncludeInHost(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "web.conf"), []byte("User webuser\n\nHost *\n  Port 2200\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config")
+	err = os.WriteFile(path, []byte("Host web\n  Include web.conf\n  HostName web.internal\n\nHost *\n  User nobody\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := readSSHConfig(path, false)
+	if err != nil {
+		t.Fatalf("readSSHConfig returned an error: %v", err)
+	}
+
+	tests := []struct {
+		host, keyword, want string
+	}{
+		{"web", "user", "webuser"},
+		{"web", "port", "2200"},
+		{"web", "hostname", "web.internal"},
+		{"other", "user", "nobody"},
+		{"other", "port", ""},
+	}
+	for _, test := range tests {
+		got := c.value(test.host, test.keyword)
+		if got != test.want {
+			t.Errorf("value(%q, %q) = %q, want %q", test.host, test.keyword, got, test.want)
+		}
+	}
+}
+
+func TestSSHConfigNestedInclude(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"config":               "Include conf.d/first\n",
+		"conf.d/first":         "Host web\n  Include conf.d/second\n",
+		"conf.d/second":        "Port 2200\n",
+		"conf.d/conf.d/second": "Port 2222\n",
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(path), 0o700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, []byte(data), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	c, err := readSSHConfig(filepath.Join(dir, "config"), false)
+	if err != nil {
+		t.Fatalf("readSSHConfig returned an error: %v", err)
+	}
+	// The nested Include is relative to the directory of the top-level file, not to the one of the including file.
+	if got := c.value("web", "port"); got != "2200" {
+		t.Errorf("value(%q, %q) = %q, want %q", "web", "port", got, "2200")
+	}
+	if got := c.value("other", "port"); got != "" {
+		t.Errorf("value(%q, %q) = %q, want the Include scoped to web", "other", "port", got)
+	}
+}
+
+func TestSSHConfigNestedProxyJump(t *testing.T) {
+	path := writeFile(t, "config", []byte(`Host files
+  ProxyJump inner,relay
+
+Host inner
+  HostName inner.internal
+  ProxyJump deploy@outer:2222
+
+Host relay
+  ProxyJump outer
+
+Host loop
+  ProxyJump loop
+`))
+	c, err := readSSHConfig(path, false)
+	if err != nil {
+		t.Fatalf("readSSHConfig returned an error: %v", err)
+	}
+
+	route, err := c.route("files", "foo", []AuthMethod{AuthPassword("pass")})
+	if err != nil {
+		t.Fatalf("route returned an error: %v", err)
+	}
+	// The relay is reached through inner, the jump host before it, rather than its own ProxyJump.
+	want := []endpoint{
+		{address: "outer:2222", user: "deploy"},
+		{address: "inner.internal:22"},
+		{address: "relay:22"},
+		{address: "files:22", user: "foo"},
+	}
+	if len(route) != len(want) {
+		t.Fatalf("route = %+v, want %+v", route, want)
+	}
+	for i := range want {
+		if route[i].address != want[i].address || want[i].user != "" && route[i].user != want[i].user {
+			t.Errorf("route[%d] = %s@%s, want %s@%s", i, route[i].user, route[i].address, want[i].user, want[i].address)
+		}
+	}
+
+	_, err = c.route("loop", "foo", []AuthMethod{AuthPassword("pass")})
+	if err == nil {
+		t.Errorf("route did not detect the jump host that jumps through itself")
+	}
+}
+
+func TestConnectHostProxyJump(t *testing.T) {
+	bastion := newTestServer(t)
+	srv := newTestServer(t)
+	var hosts []string
+	for _, s := range []*testServer{bastion, srv} {
+		address := knownhosts.Normalize(net.JoinHostPort(s.host, strconv.Itoa(s.port)))
+		hosts = append(hosts, knownhosts.Line([]string{address}, s.key.PublicKey()))
+	}
+	config := writeFile(t, "config", []byte(fmt.Sprintf(`Host files
+  HostName %s
+  Port %d
+  User foo
+  ProxyJump jump
+
+Host jump
+  HostName %s
+  Port %d
+  User foo
+`, srv.host, srv.port, bastion.host, bastion.port)))
+
+	s, err := ConnectHost("files", LocalToRemote, &ExtraConfig{
+		SSHConfigFile:   config,
+		KnownHostsFiles: []string{writeKnownHosts(t, hosts...)},
+		Auth:            []AuthMethod{AuthPassword("pass")},
+	})
+	if err != nil {
+		t.Fatalf("ConnectHost returned an error: %v", err)
+	}
+	defer func() {
+		_ = s.Close()
+	}()
+	if n := bastion.forwards(); n != 1 {
+		t.Errorf("the jump host forwarded %d connections, want 1", n)
+	}
+	if s.config.Username != "foo" {
+		t.Errorf("the user of the config file was not used: %q", s.config.Username)
+	}
+	_, err = s.Stat(t.TempDir())
+	if err != nil {
+		t.Errorf("Stat failed through the jump host: %v", err)
+	}
+}
+
+func TestConnectHostTimeout(t *testing.T) {
+	// A server that never sends its SSH banner.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer func(conn net.Conn) {
+				_ = conn.Close()
+			}(conn)
+		}
+	}()
+	silent := listener.Addr().(*net.TCPAddr)
+	bastion := newTestServer(t)
+	config := writeFile(t, "config", []byte(fmt.Sprintf(`Host direct
+  HostName %s
+  Port %d
+
+Host jumped
+  HostName %s
+  Port %d
+  ProxyJump foo@%s:%d
+`, silent.IP, silent.Port, silent.IP, silent.Port, bastion.host, bastion.port)))
+
+	for _, host := range []string{"direct", "jumped"} {
+		start := time.Now()
+		s, err := ConnectHost(host, LocalToRemote, &ExtraConfig{
+			SSHConfigFile:         config,
+			Username:              "foo",
+			Auth:                  []AuthMethod{AuthPassword("pass")},
+			InsecureIgnoreHostKey: true,
+			DialTimeout:           200 * time.Millisecond,
+		})
+		if err == nil {
+			_ = s.Close()
+			t.Fatalf("ConnectHost(%q) succeeded without a greeting", host)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("ConnectHost(%q) returned after %s, want about 200ms", host, elapsed)
+		}
+	}
+	if n := bastion.forwards(); n != 1 {
+		t.Errorf("the jump host forwarded %d connections, want 1", n)
+	}
+}
@@ -0,0 +1,218 @@
+// Package state implements the on-disk store that records the last synced state of every file of a sync pair.
+//
+// The engine compares the files it finds at startup against this state to tell a new file apart from a file that
+// was deleted while the process was down, and starts watching the remote directory from the saved snapshot.
+//
+// The store is a single JSON file holding the records of any number of sync pairs. It is written to a temporary
+// file first and renamed over the previous version, so a crash never leaves a truncated store behind.
+//
+// Example usage:
+//
+//	store, err := state.Open("/var/lib/myapp/sync-state.json")
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+//	pair := store.Pair("sftp://foo@example.com:22/home/foo/upload")
+//	pair.Set("docs/report.txt", state.Entry{Local: local, Remote: remote})
+//	err = store.Save()
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// version is the version of the file format written by Save.
+const version = 1
+
+// FileState is the part of the file information used to tell whether a file changed.
+type FileState struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+}
+
+// StateOf returns the state of the file described by info.
+func StateOf(info os.FileInfo) FileState {
+	return FileState{Size: info.Size(), ModTime: info.ModTime()}
+}
+
+// Matches reports whether info describes the same file state. Modification times are compared with a one second
+// precision, which is the best most servers offer.
+func (s FileState) Matches(info os.FileInfo) bool {
+	return s.MatchesWithin(info, time.Second)
+}
+
+// MatchesWithin reports whether info describes the same file state, comparing modification times with the given
+// precision, such as time.Minute for an FTP server that only gives the times of its files to the minute.
+func (s FileState) MatchesWithin(info os.FileInfo, precision time.Duration) bool {
+	return s.Size == info.Size() && s.ModTime.Truncate(precision).Equal(info.ModTime().Truncate(precision))
+}
+
+// Entry is the state of both copies of a path right after they were last synced.
+type Entry struct {
+	//Dir reports whether the path is a directory
+	Dir bool `json:"dir,omitempty"`
+	//Local is the state of the local copy
+	Local FileState `json:"local"`
+	//Remote is the state of the remote copy
+	Remote FileState `json:"remote"`
+	//Hash is the hash of the content of the file prefixed with the name of its algorithm, for example
+	//"sha256:9f86d0...", if it is known
+	Hash string `json:"hash,omitempty"`
+}
+
+// file is the layout of the store on disk.
+type file struct {
+	Version int                         `json:"version"`
+	Pairs   map[string]map[string]Entry `json:"pairs"`
+}
+
+// Store holds the records of all sync pairs and persists them to a file.
+type Store struct {
+	//path is the file the store is saved to. An empty path keeps the store in memory only.
+	path string
+	//mu guards pairs and dirty
+	mu sync.Mutex
+	//pairs maps the name of a sync pair to the entries of its paths
+	pairs map[string]map[string]Entry
+	//dirty reports whether the store changed since it was last saved
+	dirty bool
+}
+
+// Open loads the store saved at path. A missing file yields an empty store, and an empty path yields a store
+// that is kept in memory only.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, pairs: make(map[string]map[string]Entry)}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return s, nil
+		}
+		return nil, err
+	}
+
+	var f file
+	err = json.Unmarshal(data, &f)
+	if err != nil {
+		return nil, err
+	}
+	if f.Version != version {
+		return nil, errors.New("state: unsupported version of " + path)
+	}
+	for name, entries := range f.Pairs {
+		s.pairs[name] = entries
+	}
+	return s, nil
+}
+
+// Path returns the file the store is saved to.
+func (s *Store) Path() string {
+	return s.path
+}
+
+// Save writes the store to its file if it changed since it was last saved.
+func (s *Store) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.path == "" || !s.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(file{Version: version, Pairs: s.pairs})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), "."+filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func(name string) {
+		_ = os.Remove(name)
+	}(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), s.path)
+	if err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// Pair returns the records of the sync pair called name.
+func (s *Store) Pair(name string) *Pair {
+	return &Pair{store: s, name: name}
+}
+
+// Pair is the view of a Store restricted to a single sync pair. Paths are the slash separated paths relative to
+// the synced directories.
+type Pair struct {
+	store *Store
+	name  string
+}
+
+// Get returns the entry of rel, if any.
+func (p *Pair) Get(rel string) (Entry, bool) {
+	p.store.mu.Lock()
+	defer p.store.mu.Unlock()
+	entry, ok := p.store.pairs[p.name][rel]
+	return entry, ok
+}
+
+// Set records the entry of rel.
+func (p *Pair) Set(rel string, entry Entry) {
+	p.store.mu.Lock()
+	defer p.store.mu.Unlock()
+	entries := p.store.pairs[p.name]
+	if entries == nil {
+		entries = make(map[string]Entry)
+		p.store.pairs[p.name] = entries
+	}
+	if old, ok := entries[rel]; ok && old == entry {
+		return
+	}
+	entries[rel] = entry
+	p.store.dirty = true
+}
+
+// Delete forgets rel and every path below it.
+func (p *Pair) Delete(rel string) {
+	p.store.mu.Lock()
+	defer p.store.mu.Unlock()
+	for path := range p.store.pairs[p.name] {
+		if path == rel || strings.HasPrefix(path, rel+"/") {
+			delete(p.store.pairs[p.name], path)
+			p.store.dirty = true
+		}
+	}
+}
+
+// Entries returns a copy of all the entries of the pair.
+func (p *Pair) Entries() map[string]Entry {
+	p.store.mu.Lock()
+	defer p.store.mu.Unlock()
+	entries := make(map[string]Entry, len(p.store.pairs[p.name]))
+	for rel, entry := range p.store.pairs[p.name] {
+		entries[rel] = entry
+	}
+	return entries
+}
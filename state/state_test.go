@@ -0,0 +1,64 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStoreSaveAndOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open returned an error: %v", err)
+	}
+
+	mtime := time.Unix(1690000000, 0).UTC()
+	entry := Entry{Local: FileState{Size: 4, ModTime: mtime}, Remote: FileState{Size: 4, ModTime: mtime}, Hash: "abcd"}
+	store.Pair("a").Set("dir/file.txt", entry)
+	store.Pair("a").Set("dir", Entry{Dir: true})
+	store.Pair("b").Set("other.txt", entry)
+	err = store.Save()
+	if err != nil {
+		t.Fatalf("Save returned an error: %v", err)
+	}
+
+	store, err = Open(path)
+	if err != nil {
+		t.Fatalf("Open returned an error: %v", err)
+	}
+	got, ok := store.Pair("a").Get("dir/file.txt")
+	if !ok || got.Hash != entry.Hash || !got.Local.ModTime.Equal(mtime) || got.Remote.Size != 4 {
+		t.Fatalf("Get returned %+v, %v; want %+v", got, ok, entry)
+	}
+	if _, ok := store.Pair("a").Get("other.txt"); ok {
+		t.Fatalf("pairs are not kept apart")
+	}
+
+	store.Pair("a").Delete("dir")
+	if n := len(store.Pair("a").Entries()); n != 0 {
+		t.Fatalf("Delete left %d entries behind", n)
+	}
+	if n := len(store.Pair("b").Entries()); n != 1 {
+		t.Fatalf("Delete removed entries of another pair")
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(filepath.Dir(path), ".state.json.*"))
+	if len(matches) != 0 {
+		t.Fatalf("Save left temporary files behind: %v", matches)
+	}
+}
+
+func TestOpenMissingFile(t *testing.T) {
+	store, err := Open(filepath.Join(t.TempDir(), "missing.json"))
+	if err != nil {
+		t.Fatalf("Open returned an error: %v", err)
+	}
+	if n := len(store.Pair("a").Entries()); n != 0 {
+		t.Fatalf("new store has %d entries", n)
+	}
+	if _, err := os.Stat(store.Path()); !os.IsNotExist(err) {
+		t.Fatalf("Open created the file: %v", err)
+	}
+}
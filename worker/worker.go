@@ -1,55 +1,384 @@
 // Package worker implements a worker pool to process tasks concurrently using goroutines.
 //
-// The worker pool consists of a set of worker goroutines that can process tasks concurrently.
-// Tasks are represented by the Task struct, which includes an EventType indicating the type of event
-// (e.g., creation, write, removal) and the Name of the file associated with the event.
+// A Pool runs a fixed number of worker goroutines that call a Handler for every task submitted with Submit.
+// The number of workers is configured separately from the capacity of the queue the tasks wait in. A panic
+// in the Handler is recovered and reported as a *PanicError, and the outcome of every task can be read from
+// the channel returned by Results.
 //
-// To use the worker pool, create a new Pool using NewWorkerPool, specifying the capacity of the pool,
-// i.e., the maximum number of concurrent workers. Then, tasks can be submitted to the worker pool
-// through the Tasks channel. Each worker goroutine in the pool will process tasks as they arrive.
-// The worker pool ensures that tasks are processed in a concurrent and synchronized manner,
-// allowing for efficient processing of multiple tasks simultaneously.
+// Tasks on related keys run one at a time and in the order they were submitted, where two keys are related
+// if they are the same path or one is a directory containing the other. A Write followed by a Remove of the
+// same file therefore never runs out of order, and the creation of a directory finishes before the uploads
+// into it start. Tasks on unrelated keys run in parallel.
+//
+// Shutdown stops accepting tasks, waits until the queued ones are processed and stops the workers.
 //
 // Example usage:
 //
-//	// Create a worker pool with a capacity of 10 workers
-//	pool := NewWorkerPool(10)
+//	// Create a worker pool of 4 workers whose queue holds 100 tasks
+//	pool := worker.New(worker.Config[worker.Task]{Workers: 4, Capacity: 100, Key: worker.TaskKey})
 //
 //	// Start the worker goroutines to process tasks
-//	for i := 0; i < cap(pool.Tasks); i++ {
-//	  go pool.Worker()
+//	err := pool.Start(ctx, func(ctx context.Context, task worker.Task) error {
+//	    return process(task)
+//	})
+//	if err != nil {
+//	    return err
 //	}
 //
 //	// Submit tasks to the worker pool
-//	pool.Tasks <- Task{EventType: fsnotify.Create, Name: "file1.txt"}
-//	pool.Tasks <- Task{EventType: fsnotify.Write, Name: "file2.txt"}
-//	pool.Tasks <- Task{EventType: fsnotify.Remove, Name: "file3.txt"}
+//	err = pool.Submit(ctx, worker.Task{EventType: fsnotify.Create, Name: "dir"})
+//	err = pool.Submit(ctx, worker.Task{EventType: fsnotify.Create, Name: "dir/file1.txt"})
+//
+//	// Wait until the tasks are processed and stop the workers
+//	err = pool.Shutdown(ctx)
 package worker
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strings"
 	"sync"
 
 	"github.com/fsnotify/fsnotify"
 )
 
+// ErrClosed is returned by Submit and Start once Shutdown was called.
+var ErrClosed = errors.New("worker pool is shut down")
+
+// ErrStarted is returned by Start when the pool was already started.
+var ErrStarted = errors.New("worker pool already started")
+
 // Task represents a task that the WorkerPool operates on.
 // It includes the EventType, indicating the type of file event (e.g., create, write, remove),
-// and the Name, which is the file name associated with the event.
+// the Name, which is the file name associated with the event, Remote, which reports whether
+// the event was seen on the remote side of the sync rather than the local one, and Path, the
+// path of the file relative to the synced directories, which is the same on both sides and is
+// "." for the synced directories themselves.
 type Task struct {
 	EventType fsnotify.Op
 	Name      string
+	Remote    bool
+	Path      string
+}
+
+// TaskKey returns the key that orders the tasks on related paths: the Path of task, so that the tasks on the
+// local and the remote copy of a file are ordered with each other, or its Name if Path is empty.
+func TaskKey(task Task) string {
+	if task.Path != "" {
+		return task.Path
+	}
+	return task.Name
+}
+
+// Handler processes a single task. ctx is done once the pool is shut down without waiting for the tasks.
+type Handler[T any] func(ctx context.Context, task T) error
+
+// Result is the outcome of a task.
+type Result[T any] struct {
+	Task T     // Task is the processed task.
+	Err  error // Err is the error returned by the Handler, or a *PanicError if it panicked.
+}
+
+// PanicError is the error of a task whose Handler panicked.
+type PanicError struct {
+	Value interface{} // Value is the value the Handler panicked with.
+	Stack []byte      // Stack is the stack trace of the panic.
+}
+
+// Error returns the panic value and the stack trace.
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("task panicked: %v\n%s", e.Value, e.Stack)
+}
+
+// Config is the configuration of a Pool.
+type Config[T any] struct {
+	Workers  int                 // Workers is the number of worker goroutines. It defaults to 1.
+	Capacity int                 // Capacity is the number of tasks that can wait to start. It defaults to Workers.
+	Key      func(task T) string // Key returns the path that orders a task. Tasks are not ordered if it is nil.
+	Results  bool                // Results enables the channel returned by Results, which must then be read.
 }
 
 // Pool is a pool of worker goroutines that can process tasks concurrently.
-type Pool struct {
-	Tasks chan Task      // Tasks is the channel through which tasks are submitted to the worker pool.
-	WG    sync.WaitGroup // WG is used to wait for all worker goroutines to finish their tasks.
+type Pool[T any] struct {
+	config Config[T]
+
+	mu      sync.Mutex     // mu guards the fields below.
+	queue   []entry[T]     // queue holds the submitted tasks that did not start yet, in submission order.
+	running map[string]int // running counts the tasks in progress by key.
+	wake    chan struct{}  // wake is closed and replaced when the queue or the running tasks changed.
+	started bool           // started reports whether Start was called.
+	closed  bool           // closed reports whether Shutdown was called.
+
+	cancel  context.CancelFunc // cancel cancels the context of the handlers.
+	workers sync.WaitGroup     // workers tracks the worker goroutines.
+	results chan Result[T]     // results delivers the results if Config.Results is set.
+	stop    sync.Once          // stop closes stopped once.
+	stopped chan struct{}      // stopped is closed once the workers returned.
+}
+
+// entry is a queued task and its key.
+type entry[T any] struct {
+	task T
+	key  string
+}
+
+// New returns a pool configured by config. It does not process tasks until Start is called.
+func New[T any](config Config[T]) *Pool[T] {
+	if config.Workers < 1 {
+		config.Workers = 1
+	}
+	if config.Capacity < 1 {
+		config.Capacity = config.Workers
+	}
+	p := &Pool[T]{
+		config:  config,
+		running: make(map[string]int),
+		wake:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if config.Results {
+		p.results = make(chan Result[T], config.Capacity)
+	}
+	return p
 }
 
-// NewWorkerPool constructs a new WorkerPool with the given capacity.
-// The capacity specifies the maximum number of concurrent workers in the pool.
-func NewWorkerPool(capacity int) *Pool {
-	return &Pool{
-		Tasks: make(chan Task, capacity),
+// NewWorkerPool constructs a new pool of tasks with the given capacity, which is both the number of workers
+// and the number of tasks that can wait to start. Tasks are ordered by their Name.
+func NewWorkerPool(capacity int) *Pool[Task] {
+	return New(Config[Task]{Workers: capacity, Capacity: capacity, Key: TaskKey})
+}
+
+// Start starts the workers, which call handler for every submitted task until the pool is shut down. The
+// handlers are called with a context derived from ctx.
+//
+// - Returns ErrStarted if the pool was already started and ErrClosed if it was shut down.
+func (p *Pool[T]) Start(ctx context.Context, handler Handler[T]) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrClosed
+	}
+	if p.started {
+		return ErrStarted
+	}
+	p.started = true
+	ctx, p.cancel = context.WithCancel(ctx)
+	for i := 0; i < p.config.Workers; i++ {
+		p.workers.Add(1)
+		go p.work(ctx, handler)
+	}
+	go func() {
+		p.workers.Wait()
+		p.cancel()
+		p.shutDown()
+	}()
+	return nil
+}
+
+// Submit queues task, waiting for room in the queue until ctx is done.
+//
+// - Returns ErrClosed if the pool was shut down, or the error of ctx.
+func (p *Pool[T]) Submit(ctx context.Context, task T) error {
+	var key string
+	if p.config.Key != nil {
+		key = p.config.Key(task)
+	}
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return ErrClosed
+		}
+		if len(p.queue) < p.config.Capacity {
+			p.queue = append(p.queue, entry[T]{task: task, key: key})
+			p.broadcast()
+			p.mu.Unlock()
+			return nil
+		}
+		wake := p.wake
+		p.mu.Unlock()
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Shutdown stops accepting tasks and waits until the queued ones are processed and the workers returned. If ctx
+// is done first, the context of the handlers is canceled, the tasks that did not start are dropped and the error
+// of ctx is returned.
+func (p *Pool[T]) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		p.broadcast()
+	}
+	started := p.started
+	p.mu.Unlock()
+	if !started {
+		p.shutDown()
+		return nil
+	}
+	select {
+	case <-p.stopped:
+		return nil
+	case <-ctx.Done():
+		p.cancel()
+		return ctx.Err()
+	}
+}
+
+// Results returns the channel the result of every task is delivered on, which is closed once the pool is shut
+// down. It is nil unless Config.Results is set, in which case the workers wait for it to be read.
+func (p *Pool[T]) Results() <-chan Result[T] {
+	return p.results
+}
+
+// Len returns the number of tasks waiting to start.
+func (p *Pool[T]) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.queue)
+}
+
+// shutDown closes the results channel and stopped.
+func (p *Pool[T]) shutDown() {
+	p.stop.Do(func() {
+		if p.results != nil {
+			close(p.results)
+		}
+		close(p.stopped)
+	})
+}
+
+// work processes tasks until the pool is shut down and its queue is empty, or ctx is done.
+func (p *Pool[T]) work(ctx context.Context, handler Handler[T]) {
+	defer p.workers.Done()
+	for {
+		e, ok := p.next(ctx)
+		if !ok {
+			return
+		}
+		err := run(ctx, handler, e.task)
+		if p.results != nil {
+			select {
+			case p.results <- Result[T]{Task: e.task, Err: err}:
+			case <-ctx.Done():
+			}
+		}
+		p.done(e)
+	}
+}
+
+// run calls handler and turns a panic into a *PanicError.
+func run[T any](ctx context.Context, handler Handler[T], task T) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return handler(ctx, task)
+}
+
+// next blocks until a task can start and returns it. It returns false once the pool is shut down and its queue is
+// empty, or ctx is done.
+func (p *Pool[T]) next(ctx context.Context) (entry[T], bool) {
+	for {
+		p.mu.Lock()
+		e, ok := p.take()
+		done := p.closed && len(p.queue) == 0
+		wake := p.wake
+		p.mu.Unlock()
+		if ok {
+			return e, true
+		}
+		if done {
+			return entry[T]{}, false
+		}
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return entry[T]{}, false
+		}
+	}
+}
+
+// done reports that the task of e is processed, which lets the tasks waiting for it start.
+func (p *Pool[T]) done(e entry[T]) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e.key != "" {
+		p.running[e.key]--
+		if p.running[e.key] == 0 {
+			delete(p.running, e.key)
+		}
+	}
+	p.broadcast()
+}
+
+// take removes the first queued task that can start from the queue and marks it as running. p.mu must be held.
+func (p *Pool[T]) take() (entry[T], bool) {
+	for i, e := range p.queue {
+		if p.blocked(e.key, p.queue[:i]) {
+			continue
+		}
+		p.queue = append(p.queue[:i], p.queue[i+1:]...)
+		if e.key != "" {
+			p.running[e.key]++
+		}
+		// Wake up the submitters waiting for room and the workers that may take the next task.
+		p.broadcast()
+		return e, true
+	}
+	return entry[T]{}, false
+}
+
+// blocked reports whether a task on key must wait for a running task or one of the earlier queued tasks. p.mu
+// must be held.
+func (p *Pool[T]) blocked(key string, earlier []entry[T]) bool {
+	if key == "" {
+		return false
+	}
+	for running := range p.running {
+		if related(running, key) {
+			return true
+		}
+	}
+	for _, e := range earlier {
+		if e.key != "" && related(e.key, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// broadcast wakes up the goroutines waiting in Submit and next. p.mu must be held.
+func (p *Pool[T]) broadcast() {
+	close(p.wake)
+	p.wake = make(chan struct{})
+}
+
+// related reports whether the paths a and b are the same or one of them contains the other. The relative path "."
+// contains every path.
+func related(a, b string) bool {
+	if a == "." || b == "." {
+		return true
+	}
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	if !strings.HasPrefix(b, a) {
+		return false
+	}
+	if len(a) == len(b) {
+		return true
+	}
+	if strings.HasSuffix(a, "/") || strings.HasSuffix(a, string(os.PathSeparator)) {
+		return true
 	}
+	return b[len(a)] == '/' || b[len(a)] == os.PathSeparator
 }
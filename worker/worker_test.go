@@ -0,0 +1,209 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestPoolOrdersRelatedPaths(t *testing.T) {
+	pool := New(Config[Task]{Workers: 4, Capacity: 10, Key: TaskKey})
+	var mu sync.Mutex
+	var order []string
+	err := pool.Start(context.Background(), func(ctx context.Context, task Task) error {
+		if task.Name == "dir" {
+			// Give the tasks inside of the directory a chance to overtake it.
+			time.Sleep(20 * time.Millisecond)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		order = append(order, task.Name+" "+task.EventType.String())
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Start returned an error: %v", err)
+	}
+
+	tasks := []Task{
+		{EventType: fsnotify.Create, Name: "dir"},
+		{EventType: fsnotify.Create, Name: "dir/file.txt"},
+		{EventType: fsnotify.Write, Name: "dir/file.txt"},
+		{EventType: fsnotify.Remove, Name: "dir/file.txt"},
+		{EventType: fsnotify.Create, Name: "other.txt"},
+	}
+	for _, task := range tasks {
+		err = pool.Submit(context.Background(), task)
+		if err != nil {
+			t.Fatalf("Submit returned an error: %v", err)
+		}
+	}
+	err = pool.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("Shutdown returned an error: %v", err)
+	}
+
+	want := []string{"dir CREATE", "dir/file.txt CREATE", "dir/file.txt WRITE", "dir/file.txt REMOVE"}
+	var got []string
+	for _, name := range order {
+		if name != "other.txt CREATE" {
+			got = append(got, name)
+		}
+	}
+	if len(got) != len(want) {
+		t.Fatalf("processed %v, want %v", order, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("processed %v, want %v", got, want)
+		}
+	}
+	if order[0] != "other.txt CREATE" {
+		t.Errorf("the unrelated task did not run in parallel with the directory: %v", order)
+	}
+	if n := pool.Len(); n != 0 {
+		t.Errorf("Len() = %d after every task is done", n)
+	}
+	if err = pool.Submit(context.Background(), Task{Name: "late"}); !errors.Is(err, ErrClosed) {
+		t.Errorf("Submit after Shutdown returned %v, want ErrClosed", err)
+	}
+}
+
+func TestPoolOrdersLocalAndRemoteTasks(t *testing.T) {
+	pool := New(Config[Task]{Workers: 2, Capacity: 10, Key: TaskKey})
+	var mu sync.Mutex
+	var order []string
+	running := 0
+	overlapped := false
+	err := pool.Start(context.Background(), func(ctx context.Context, task Task) error {
+		mu.Lock()
+		running++
+		overlapped = overlapped || running > 1
+		mu.Unlock()
+		if !task.Remote {
+			// Give the remote task a chance to run at the same time.
+			time.Sleep(20 * time.Millisecond)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		running--
+		order = append(order, task.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Start returned an error: %v", err)
+	}
+
+	// The local and the remote copy of the same file have different names but the same relative path.
+	tasks := []Task{
+		{EventType: fsnotify.Write, Name: "/home/user/sync/dir/file.txt", Path: "dir/file.txt"},
+		{EventType: fsnotify.Remove, Name: "/srv/files/dir/file.txt", Remote: true, Path: "dir/file.txt"},
+	}
+	for _, task := range tasks {
+		err = pool.Submit(context.Background(), task)
+		if err != nil {
+			t.Fatalf("Submit returned an error: %v", err)
+		}
+	}
+	err = pool.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("Shutdown returned an error: %v", err)
+	}
+
+	if overlapped {
+		t.Errorf("the local and the remote task on the same path ran at the same time")
+	}
+	if len(order) != 2 || order[0] != tasks[0].Name || order[1] != tasks[1].Name {
+		t.Errorf("processed %v, want the local task before the remote one", order)
+	}
+	if key := TaskKey(Task{Name: "dir/file.txt"}); key != "dir/file.txt" {
+		t.Errorf("TaskKey of a task without a Path = %q, want its Name", key)
+	}
+}
+
+func TestPoolResults(t *testing.T) {
+	pool := New(Config[int]{Workers: 2, Capacity: 1, Results: true})
+	failure := errors.New("failure")
+	err := pool.Start(context.Background(), func(ctx context.Context, task int) error {
+		switch task {
+		case 1:
+			return failure
+		case 2:
+			panic("boom")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Start returned an error: %v", err)
+	}
+	if err = pool.Start(context.Background(), nil); !errors.Is(err, ErrStarted) {
+		t.Errorf("second Start returned %v, want ErrStarted", err)
+	}
+
+	go func() {
+		for task := 0; task < 3; task++ {
+			_ = pool.Submit(context.Background(), task)
+		}
+		_ = pool.Shutdown(context.Background())
+	}()
+	results := make(map[int]error)
+	for result := range pool.Results() {
+		results[result.Task] = result.Err
+	}
+	if len(results) != 3 {
+		t.Fatalf("got %d results, want 3", len(results))
+	}
+	if results[0] != nil || !errors.Is(results[1], failure) {
+		t.Errorf("results = %v, want no error for 0 and %v for 1", results, failure)
+	}
+	var panicErr *PanicError
+	if !errors.As(results[2], &panicErr) || panicErr.Value != "boom" {
+		t.Errorf("result of the panicking task = %v, want a *PanicError", results[2])
+	}
+}
+
+func TestPoolShutdownTimeout(t *testing.T) {
+	pool := New(Config[int]{Workers: 1, Capacity: 2})
+	started := make(chan struct{})
+	err := pool.Start(context.Background(), func(ctx context.Context, task int) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err != nil {
+		t.Fatalf("Start returned an error: %v", err)
+	}
+	_ = pool.Submit(context.Background(), 1)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = pool.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown returned %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestRelated(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"dir", "dir", true},
+		{"dir", "dir/file", true},
+		{"dir/file", "dir", true},
+		{"dir", "dir2/file", false},
+		{"/", "/file", true},
+		{"dir/a", "dir/b", false},
+		{".", "dir/file", true},
+		{"dir", ".", true},
+	}
+	for _, tt := range tests {
+		if got := related(tt.a, tt.b); got != tt.want {
+			t.Errorf("related(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}